@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
-	"io/ioutil"
 	"net/http"
 
 	log "github.com/sirupsen/logrus"
@@ -27,6 +26,7 @@ func main() {
 	if err := util.Init("car-service", *notrace); err != nil {
 		panic(err)
 	}
+	defer util.Close()
 
 	carService, err := service.NewCarRentalService()
 	if err != nil {
@@ -35,10 +35,20 @@ func main() {
 
 	s := &server{service: carService}
 	http.HandleFunc("/cars/booking", s.bookingHandler)
-	handler := util.NewContextHandler(http.DefaultServeMux)
+	http.HandleFunc("/cars/reservation", s.reservationHandler)
+	http.Handle("/metrics", util.MetricsHandler())
+	util.RegisterHealthEndpoint(http.DefaultServeMux)
+	util.RegisterVersionEndpoint(http.DefaultServeMux)
+	util.RegisterSchemaEndpoint(http.DefaultServeMux, &service.BookCarRentalRequest{})
+	util.RegisterDebugEndpoints(http.DefaultServeMux)
+	handler, err := util.NewHandler(http.DefaultServeMux, util.WithMetricsPaths("/cars/booking", "/cars/reservation"))
+	if err != nil {
+		panic(err)
+	}
 
+	util.FinishStartup()
 	log.Printf("Car rental service listening on %s...", port)
-	if err := http.ListenAndServe(port, handler); err != nil {
+	if err := util.ListenAndServe(port, handler); err != nil {
 		panic(err)
 	}
 }
@@ -50,56 +60,76 @@ func (s *server) bookingHandler(w http.ResponseWriter, r *http.Request) {
 		s.getBooking(ctx, w, r)
 	case "POST":
 		s.bookCarRental(ctx, w, r)
+	case "PUT":
+		s.updateBooking(ctx, w, r)
+	case "DELETE":
+		s.cancelBooking(ctx, w, r)
 	default:
+		err := errors.New("invalid HTTP method")
 		log.WithContext(ctx).WithFields(log.Fields{
-			"error": errors.New("invalid HTTP method"),
+			"error": err,
 		}).Error("Invalid HTTP method for endpoint")
-		http.Error(w, "Invalid HTTP method", http.StatusBadRequest)
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
 	}
 }
 
 func (s *server) getBooking(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	includeCancelled, err := util.BoolQuery(r, "include_cancelled")
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid booking request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
 	ref := r.URL.Query().Get("ref")
 	ctx = util.WithRef(ctx, ref)
-	confirmation, err := s.service.GetBooking(ctx, ref)
+	confirmation, err := s.service.GetBooking(ctx, ref, service.GetOptions{IncludeCancelled: includeCancelled})
 	if err != nil {
 		log.WithContext(ctx).WithFields(log.Fields{
 			"error": err,
 		}).Error("Failed to fetch booking")
 		if err == service.ErrNoSuchBooking {
-			http.Error(w, err.Error(), http.StatusNotFound)
+			util.LegacyError(w, ctx, http.StatusNotFound, err)
 		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			util.WriteError(w, err)
 		}
 		return
 	}
 
-	resp, err := json.Marshal(confirmation)
-	if err != nil {
+	log.WithContext(ctx).Info("Fetched booking")
+	w.Header().Set("ETag", util.VersionETag(confirmation.Version))
+	if err := util.WriteResponse(w, r, confirmation); err != nil {
 		panic(err)
 	}
-
-	log.WithContext(ctx).Info("Fetched booking")
-	w.Write(resp)
 }
 
+// bookCarRental books the request body, or, if the reservation query parameter is
+// set, confirms that reservation instead.
 func (s *server) bookCarRental(ctx context.Context, w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	data, err := ioutil.ReadAll(r.Body)
+	if ref := r.URL.Query().Get("reservation"); ref != "" {
+		s.confirmReservation(ctx, w, ref)
+		return
+	}
+
+	dryRun, err := util.BoolQuery(r, "dry_run")
 	if err != nil {
 		log.WithContext(ctx).WithFields(log.Fields{
 			"error": err,
-		}).Error("Failed to read request body")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		}).Error("Invalid booking request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
 		return
 	}
 
+	defer r.Body.Close()
+
 	var req service.BookCarRentalRequest
-	if err := json.Unmarshal(data, &req); err != nil {
+	if err := util.DecodeJSONBody(r, &req); err != nil {
 		log.WithContext(ctx).WithFields(log.Fields{
 			"error": err,
-		}).Error("Failed to unmarshal request body")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		}).Error("Failed to decode request body")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
 		return
 	}
 
@@ -107,7 +137,13 @@ func (s *server) bookCarRental(ctx context.Context, w http.ResponseWriter, r *ht
 		log.WithContext(ctx).WithFields(log.Fields{
 			"error": err,
 		}).Error("Invalid booking request")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	if dryRun {
+		// Validate only, without creating a booking.
+		s.writeDryRun(ctx, w, &service.CarRentalConfirmation{CarRental: &req, Price: s.service.Quote(&req)})
 		return
 	}
 
@@ -116,7 +152,7 @@ func (s *server) bookCarRental(ctx context.Context, w http.ResponseWriter, r *ht
 		log.WithContext(ctx).WithFields(log.Fields{
 			"error": err,
 		}).Error("Failed to book car")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		util.WriteError(w, err)
 		return
 	}
 	ctx = util.WithRef(ctx, confirmation.Ref)
@@ -129,6 +165,214 @@ func (s *server) bookCarRental(ctx context.Context, w http.ResponseWriter, r *ht
 	}
 
 	log.WithContext(ctx).Info("Booked car")
+	w.Header().Set("ETag", util.VersionETag(confirmation.Version))
 	w.WriteHeader(http.StatusCreated)
 	w.Write(resp)
 }
+
+func (s *server) updateBooking(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get("ref")
+	ctx = util.WithRef(ctx, ref)
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		err := errors.New("missing If-Match header")
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid update request")
+		util.LegacyError(w, ctx, http.StatusPreconditionRequired, err)
+		return
+	}
+	version, err := util.ParseVersionETag(ifMatch)
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid update request")
+		util.LegacyError(w, ctx, http.StatusPreconditionFailed, err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	var req service.BookCarRentalRequest
+	if err := util.DecodeJSONBody(r, &req); err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to decode request body")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := req.Validate(); err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid update request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	confirmation, err := s.service.UpdateBooking(ctx, ref, &req, version)
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to update booking")
+		switch err {
+		case service.ErrNoSuchBooking:
+			util.LegacyError(w, ctx, http.StatusNotFound, err)
+		case service.ErrVersionMismatch:
+			util.LegacyError(w, ctx, http.StatusPreconditionFailed, err)
+		default:
+			util.WriteError(w, err)
+		}
+		return
+	}
+
+	resp, err := json.Marshal(confirmation)
+	if err != nil {
+		panic(err)
+	}
+
+	log.WithContext(ctx).WithFields(log.Fields{
+		"version": confirmation.Version,
+	}).Info("Updated booking")
+	w.Header().Set("ETag", util.VersionETag(confirmation.Version))
+	w.Write(resp)
+}
+
+func (s *server) writeDryRun(ctx context.Context, w http.ResponseWriter, confirmation *service.CarRentalConfirmation) {
+	resp, err := json.Marshal(confirmation)
+	if err != nil {
+		panic(err)
+	}
+
+	log.WithContext(ctx).Info("Validated booking (dry run)")
+	w.Write(resp)
+}
+
+// cancelBooking cancels the booking given by the ref query parameter,
+// responding with a 204. Cancelling an already cancelled booking is also a
+// 204. A missing booking is a 404 unless idempotent=true, in which case it's
+// a 204 as well. The client can't tell a booking deleted by an earlier
+// attempt from one which never existed, so a client retrying a cancel
+// should set it.
+func (s *server) cancelBooking(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get("ref")
+	ctx = util.WithRef(ctx, ref)
+	idempotent, err := util.BoolQuery(r, "idempotent")
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid cancel request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+	err = s.service.CancelBooking(ctx, ref)
+	if err == service.ErrNoSuchBooking && idempotent {
+		log.WithContext(ctx).Info("Booking to cancel already gone")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to cancel booking")
+		if err == service.ErrNoSuchBooking {
+			util.LegacyError(w, ctx, http.StatusNotFound, err)
+		} else {
+			util.WriteError(w, err)
+		}
+		return
+	}
+
+	log.WithContext(ctx).Info("Cancelled booking")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) reservationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "POST" {
+		err := errors.New("invalid HTTP method")
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid HTTP method for endpoint")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+	s.reserveCarRental(ctx, w, r)
+}
+
+// reserveCarRental holds the car in the request body until the hold expires,
+// responding with the reservation. It's booked by posting to the booking
+// endpoint with its ref as the reservation query parameter.
+func (s *server) reserveCarRental(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var req service.BookCarRentalRequest
+	if err := util.DecodeJSONBody(r, &req); err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to decode request body")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := req.Validate(); err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid reservation request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	confirmation, err := s.service.ReserveCarRental(ctx, &req)
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to reserve car")
+		util.WriteError(w, err)
+		return
+	}
+	ctx = util.WithRef(ctx, confirmation.Ref)
+
+	resp, err := json.Marshal(confirmation)
+	if err != nil {
+		panic(err)
+	}
+
+	log.WithContext(ctx).WithFields(log.Fields{
+		"hold_expires": confirmation.HoldExpires,
+	}).Info("Reserved car")
+	w.Header().Set("ETag", util.VersionETag(confirmation.Version))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resp)
+}
+
+// confirmReservation books the reservation with the given ref, responding
+// with the booking. A reservation whose hold expired is gone, so it's a 410.
+func (s *server) confirmReservation(ctx context.Context, w http.ResponseWriter, ref string) {
+	ctx = util.WithRef(ctx, ref)
+	confirmation, err := s.service.ConfirmReservation(ctx, ref)
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to confirm reservation")
+		switch err {
+		case service.ErrNoSuchBooking:
+			util.LegacyError(w, ctx, http.StatusNotFound, err)
+		case service.ErrHoldExpired:
+			util.LegacyError(w, ctx, http.StatusGone, err)
+		default:
+			util.WriteError(w, err)
+		}
+		return
+	}
+
+	resp, err := json.Marshal(confirmation)
+	if err != nil {
+		panic(err)
+	}
+
+	log.WithContext(ctx).Info("Confirmed reservation")
+	w.Header().Set("ETag", util.VersionETag(confirmation.Version))
+	w.Write(resp)
+}
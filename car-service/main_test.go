@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/car-service/service"
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+	"github.com/realkinetic/cloud-native-meetup-2019/util/servicetest"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+// newTestServer returns the car service's handler, storing bookings in the
+// backend and telling the time by the clock. The DynamoDB backend is a
+// stand-in.
+func newTestServer(t *testing.T, backend string, clock util.Clock) http.Handler {
+	if backend == util.StorageDynamoDB {
+		servicetest.NewDynamoDB(t)
+	}
+	t.Setenv("STORAGE_BACKEND", backend)
+	t.Setenv("VALIDATION_MAX_DELAY", "1ms")
+	t.Setenv("HOLD_TTL", "10m")
+	carService, err := service.NewCarRentalService(service.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{service: carService}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cars/booking", s.bookingHandler)
+	mux.HandleFunc("/cars/reservation", s.reservationHandler)
+	return mux
+}
+
+// do serves the request, with the body, if any, encoded as JSON, and returns
+// the response.
+func do(handler http.Handler, method, target string, body interface{}) *httptest.ResponseRecorder {
+	return serve(handler, newRequest(method, target, body))
+}
+
+// newRequest returns a request with the body, if any, encoded as JSON.
+func newRequest(method, target string, body interface{}) *http.Request {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			panic(err)
+		}
+	}
+	r := httptest.NewRequest(method, target, bytes.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// serve serves the request and returns the response.
+func serve(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func testCarRental() *service.BookCarRentalRequest {
+	pickUp := time.Date(2019, 6, 1, 9, 0, 0, 0, time.UTC)
+	return &service.BookCarRentalRequest{
+		Agent:           "Hertz",
+		PickUp:          pickUp,
+		PickUpLocation:  "DEN",
+		DropOff:         pickUp.Add(72 * time.Hour),
+		DropOffLocation: "DEN",
+		Name:            "Ada Lovelace",
+		VehicleClass:    "compact",
+	}
+}
+
+// book books the test car rental and returns the booking.
+func book(t *testing.T, handler http.Handler) *service.CarRentalConfirmation {
+	t.Helper()
+	w := do(handler, "POST", "/cars/booking", testCarRental())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var booking service.CarRentalConfirmation
+	if err := json.Unmarshal(w.Body.Bytes(), &booking); err != nil {
+		t.Fatal(err)
+	}
+	return &booking
+}
+
+// reserve reserves the test car rental and returns the reservation.
+func reserve(t *testing.T, handler http.Handler) *service.CarRentalConfirmation {
+	t.Helper()
+	w := do(handler, "POST", "/cars/reservation", testCarRental())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("reservation status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var reservation service.CarRentalConfirmation
+	if err := json.Unmarshal(w.Body.Bytes(), &reservation); err != nil {
+		t.Fatal(err)
+	}
+	return &reservation
+}
+
+// TestConfirmChangesETag checks confirming a reservation changes its ETag, so
+// a client revalidating the held reservation gets the booking, and can't
+// update it with the held reservation's version.
+func TestConfirmChangesETag(t *testing.T) {
+	for _, backend := range []string{util.StorageMemory, util.StorageDynamoDB} {
+		clock := util.NewFakeClock(time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC))
+		handler := newTestServer(t, backend, clock)
+
+		reservation := reserve(t, handler)
+		target := "/cars/booking?ref=" + reservation.Ref
+		w := do(handler, "GET", target, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: get reservation status = %d, want %d: %s", backend, w.Code, http.StatusOK, w.Body)
+		}
+		held := w.Header().Get("ETag")
+
+		if w := do(handler, "POST", "/cars/booking?reservation="+reservation.Ref, nil); w.Code != http.StatusOK {
+			t.Fatalf("%s: confirmation status = %d, want %d: %s", backend, w.Code, http.StatusOK, w.Body)
+		}
+
+		revalidate := newRequest("GET", target, nil)
+		revalidate.Header.Set("If-None-Match", held)
+		w = serve(handler, revalidate)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: revalidating status = %d, want %d", backend, w.Code, http.StatusOK)
+		}
+		var booking service.CarRentalConfirmation
+		if err := json.Unmarshal(w.Body.Bytes(), &booking); err != nil {
+			t.Fatal(err)
+		}
+		if booking.Held() || booking.Version != reservation.Version+1 {
+			t.Errorf("%s: revalidated booking = %s, want version %d and not held", backend, w.Body, reservation.Version+1)
+		}
+
+		update := newRequest("PUT", target, testCarRental())
+		update.Header.Set("If-Match", held)
+		if w := serve(handler, update); w.Code != http.StatusPreconditionFailed {
+			t.Errorf("%s: update with the held ETag status = %d, want %d", backend, w.Code, http.StatusPreconditionFailed)
+		}
+	}
+}
+
+// TestCancelBooking cancels a booking with and without SOFT_DELETE, against
+// each storage backend. Either way the booking is gone from normal reads and
+// can't be updated, but only a soft deleted one can be read back with
+// include_cancelled=true, with a new version, or cancelled again.
+func TestCancelBooking(t *testing.T) {
+	for _, backend := range []string{util.StorageMemory, util.StorageDynamoDB} {
+		for _, softDelete := range []bool{false, true} {
+			name := fmt.Sprintf("%s, soft delete %v", backend, softDelete)
+			t.Setenv("SOFT_DELETE", strconv.FormatBool(softDelete))
+			now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+			handler := newTestServer(t, backend, util.NewFakeClock(now))
+			booking := book(t, handler)
+			target := "/cars/booking?ref=" + booking.Ref
+
+			if w := do(handler, "DELETE", target, nil); w.Code != http.StatusNoContent {
+				t.Errorf("%s: cancel status = %d, want %d: %s", name, w.Code, http.StatusNoContent, w.Body)
+			}
+			if w := do(handler, "GET", target, nil); w.Code != http.StatusNotFound {
+				t.Errorf("%s: get status = %d, want %d", name, w.Code, http.StatusNotFound)
+			}
+			update := newRequest("PUT", target, testCarRental())
+			update.Header.Set("If-Match", util.VersionETag(booking.Version))
+			if w := serve(handler, update); w.Code != http.StatusNotFound {
+				t.Errorf("%s: update status = %d, want %d", name, w.Code, http.StatusNotFound)
+			}
+
+			// The pre-cancel ETag no longer matches.
+			get := newRequest("GET", target+"&include_cancelled=true", nil)
+			get.Header.Set("If-None-Match", util.VersionETag(booking.Version))
+			w := serve(handler, get)
+			again := do(handler, "DELETE", target, nil)
+			if !softDelete {
+				if w.Code != http.StatusNotFound {
+					t.Errorf("%s: get cancelled status = %d, want %d", name, w.Code, http.StatusNotFound)
+				}
+				if again.Code != http.StatusNotFound {
+					t.Errorf("%s: second cancel status = %d, want %d", name, again.Code, http.StatusNotFound)
+				}
+				continue
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: get cancelled status = %d, want %d: %s", name, w.Code, http.StatusOK, w.Body)
+			}
+			var cancelled service.CarRentalConfirmation
+			if err := json.Unmarshal(w.Body.Bytes(), &cancelled); err != nil {
+				t.Fatal(err)
+			}
+			if !cancelled.Cancelled() || cancelled.CancelledAt == nil || !cancelled.CancelledAt.Equal(now) {
+				t.Errorf("%s: cancelled booking = %s, want status %q and cancelled_at %v", name, w.Body, util.BookingCancelled, now)
+			}
+			if cancelled.Version != booking.Version+1 {
+				t.Errorf("%s: cancelled booking version = %d, want %d", name, cancelled.Version, booking.Version+1)
+			}
+			if again.Code != http.StatusNoContent {
+				t.Errorf("%s: second cancel status = %d, want %d", name, again.Code, http.StatusNoContent)
+			}
+		}
+	}
+}
+
+// TestUpdateBooking checks an update needs the booking's current version in
+// If-Match, and increments it, against each storage backend.
+func TestUpdateBooking(t *testing.T) {
+	for _, backend := range []string{util.StorageMemory, util.StorageDynamoDB} {
+		handler := newTestServer(t, backend, util.SystemClock)
+		booking := book(t, handler)
+		target := "/cars/booking?ref=" + booking.Ref
+		updated := testCarRental()
+		updated.VehicleClass = "suv"
+
+		for _, test := range []struct {
+			name    string
+			ifMatch string
+			want    int
+		}{
+			{"missing If-Match", "", http.StatusPreconditionRequired},
+			{"invalid If-Match", `"latest"`, http.StatusPreconditionFailed},
+			{"future version", util.VersionETag(booking.Version + 1), http.StatusPreconditionFailed},
+			{"current version", util.VersionETag(booking.Version), http.StatusOK},
+			// The update above made the version stale.
+			{"stale version", util.VersionETag(booking.Version), http.StatusPreconditionFailed},
+		} {
+			r := newRequest("PUT", target, updated)
+			if test.ifMatch != "" {
+				r.Header.Set("If-Match", test.ifMatch)
+			}
+			if w := serve(handler, r); w.Code != test.want {
+				t.Errorf("%s: %s: update status = %d, want %d: %s", backend, test.name, w.Code, test.want, w.Body)
+			}
+		}
+
+		w := do(handler, "GET", target, nil)
+		var stored service.CarRentalConfirmation
+		if err := json.Unmarshal(w.Body.Bytes(), &stored); err != nil {
+			t.Fatal(err)
+		}
+		if want := booking.Version + 1; stored.Version != want || stored.CarRental.VehicleClass != "suv" {
+			t.Errorf("%s: stored booking = %s, want an suv at version %d", backend, w.Body, want)
+		}
+		if got, want := w.Header().Get("ETag"), util.VersionETag(booking.Version+1); got != want {
+			t.Errorf("%s: ETag = %s, want %s", backend, got, want)
+		}
+	}
+}
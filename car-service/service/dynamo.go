@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+// dynamoService is a Store backed by DynamoDB.
+type dynamoService struct {
+	db *dynamodb.DynamoDB
+
+	// reader serves Get. It's a read replica if READ_REGION is set, otherwise
+	// it's db.
+	reader *dynamodb.DynamoDB
+}
+
+func newDynamoService() (Store, error) {
+	db := util.NewDynamoDB()
+
+	if err := util.CreateTable(db, rentalsTable); err != nil {
+		return nil, err
+	}
+
+	return &dynamoService{db: db, reader: util.NewReadDynamoDB(db)}, nil
+}
+
+func (d *dynamoService) Put(ctx context.Context, confirmation *CarRentalConfirmation) error {
+	av, err := dynamodbattribute.MarshalMap(confirmation)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(rentalsTable),
+	}
+	return util.TraceDynamoDB(ctx, "PutItem", rentalsTable, func(ctx context.Context) error {
+		_, err := d.db.PutItemWithContext(ctx, input)
+		return err
+	})
+}
+
+func (d *dynamoService) Get(ctx context.Context, ref string) (*CarRentalConfirmation, error) {
+	var result *dynamodb.GetItemOutput
+	err := util.TraceDynamoDB(ctx, "GetItem", rentalsTable, func(ctx context.Context) error {
+		var err error
+		result, err = d.reader.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(rentalsTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				"ref": {
+					S: aws.String(ref),
+				},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Item) == 0 {
+		return nil, ErrNoSuchBooking
+	}
+
+	var confirmation *CarRentalConfirmation
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &confirmation); err != nil {
+		return nil, err
+	}
+
+	return confirmation, nil
+}
+
+func (d *dynamoService) List(ctx context.Context, limit int, cursor string) ([]*CarRentalConfirmation, string, error) {
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(rentalsTable),
+	}
+	items, next, err := util.ScanPage(ctx, d.db, input, limit, cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	confirmations := []*CarRentalConfirmation{}
+	if err := dynamodbattribute.UnmarshalListOfMaps(items, &confirmations); err != nil {
+		return nil, "", err
+	}
+	return confirmations, next, nil
+}
+
+func (d *dynamoService) Delete(ctx context.Context, ref string) error {
+	err := util.TraceDynamoDB(ctx, "DeleteItem", rentalsTable, func(ctx context.Context) error {
+		_, err := d.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(rentalsTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				"ref": {
+					S: aws.String(ref),
+				},
+			},
+			ConditionExpression: aws.String("attribute_exists(#ref)"),
+			ExpressionAttributeNames: map[string]*string{
+				"#ref": aws.String("ref"),
+			},
+		})
+		return err
+	})
+	if awsError, ok := err.(awserr.Error); ok && awsError.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrNoSuchBooking
+	}
+	return err
+}
+
+// Cancel treats bookings stored before versioning as version 0, like Update.
+func (d *dynamoService) Cancel(ctx context.Context, ref string, at time.Time) error {
+	cancelledAt, err := dynamodbattribute.Marshal(at)
+	if err != nil {
+		return err
+	}
+	err = util.TraceDynamoDB(ctx, "UpdateItem", rentalsTable, func(ctx context.Context) error {
+		_, err := d.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(rentalsTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				"ref": {
+					S: aws.String(ref),
+				},
+			},
+			UpdateExpression:    aws.String("SET #status = :status, #cancelled_at = :cancelled_at, #version = if_not_exists(#version, :zero) + :one"),
+			ConditionExpression: aws.String("attribute_exists(#ref) AND attribute_not_exists(#cancelled_at)"),
+			ExpressionAttributeNames: map[string]*string{
+				"#ref":          aws.String("ref"),
+				"#status":       aws.String("status"),
+				"#cancelled_at": aws.String("cancelled_at"),
+				"#version":      aws.String("version"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":status":       {S: aws.String(util.BookingCancelled)},
+				":cancelled_at": cancelledAt,
+				":zero":         {N: aws.String("0")},
+				":one":          {N: aws.String("1")},
+			},
+		})
+		return err
+	})
+	if awsError, ok := err.(awserr.Error); ok && awsError.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		// The condition doesn't say which check failed.
+		if stored, err := d.Get(ctx, ref); err == nil && stored.Cancelled() {
+			return ErrAlreadyCancelled
+		}
+		return ErrNoSuchBooking
+	}
+	return err
+}
+
+// Update treats bookings stored before versioning as version 0.
+func (d *dynamoService) Update(ctx context.Context, ref string, r *BookCarRentalRequest, price util.Money, version int64) (*CarRentalConfirmation, error) {
+	av, err := dynamodbattribute.MarshalMap(r)
+	if err != nil {
+		return nil, err
+	}
+
+	condition := "attribute_exists(#ref) AND attribute_not_exists(#cancelled_at) AND #version = :version"
+	values := map[string]*dynamodb.AttributeValue{
+		":car_rental": {M: av},
+		":price":      {N: aws.String(strconv.FormatInt(int64(price), 10))},
+		":version":    {N: aws.String(strconv.FormatInt(version, 10))},
+		":next":       {N: aws.String(strconv.FormatInt(version+1, 10))},
+	}
+	if version == 0 {
+		condition = "attribute_exists(#ref) AND attribute_not_exists(#cancelled_at) AND attribute_not_exists(#version)"
+		delete(values, ":version")
+	}
+
+	var result *dynamodb.UpdateItemOutput
+	err = util.TraceDynamoDB(ctx, "UpdateItem", rentalsTable, func(ctx context.Context) error {
+		var err error
+		result, err = d.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(rentalsTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				"ref": {
+					S: aws.String(ref),
+				},
+			},
+			UpdateExpression:    aws.String("SET #car_rental = :car_rental, #price = :price, #version = :next"),
+			ConditionExpression: aws.String(condition),
+			ExpressionAttributeNames: map[string]*string{
+				"#cancelled_at": aws.String("cancelled_at"),
+				"#ref":          aws.String("ref"),
+				"#car_rental":   aws.String("car_rental"),
+				"#price":        aws.String("price"),
+				"#version":      aws.String("version"),
+			},
+			ExpressionAttributeValues: values,
+			ReturnValues:              aws.String(dynamodb.ReturnValueAllNew),
+		})
+		return err
+	})
+	if err != nil {
+		if awsError, ok := err.(awserr.Error); ok && awsError.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil, d.updateConflict(ctx, ref)
+		}
+		return nil, err
+	}
+
+	var confirmation *CarRentalConfirmation
+	if err := dynamodbattribute.UnmarshalMap(result.Attributes, &confirmation); err != nil {
+		return nil, err
+	}
+	return confirmation, nil
+}
+
+// updateConflict determines why a conditional update failed, distinguishing a
+// missing or cancelled booking from a stale version.
+func (d *dynamoService) updateConflict(ctx context.Context, ref string) error {
+	var result *dynamodb.GetItemOutput
+	err := util.TraceDynamoDB(ctx, "GetItem", rentalsTable, func(ctx context.Context) error {
+		var err error
+		result, err = d.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(rentalsTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				"ref": {
+					S: aws.String(ref),
+				},
+			},
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(result.Item) == 0 || result.Item["cancelled_at"] != nil {
+		return ErrNoSuchBooking
+	}
+	return ErrVersionMismatch
+}
+
+// Confirm compares the hold's expiry in Unix seconds, as it's stored.
+func (d *dynamoService) Confirm(ctx context.Context, ref string, now time.Time) (*CarRentalConfirmation, error) {
+	var result *dynamodb.UpdateItemOutput
+	err := util.TraceDynamoDB(ctx, "UpdateItem", rentalsTable, func(ctx context.Context) error {
+		var err error
+		result, err = d.db.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName: aws.String(rentalsTable),
+			Key: map[string]*dynamodb.AttributeValue{
+				"ref": {
+					S: aws.String(ref),
+				},
+			},
+			UpdateExpression:    aws.String("SET #version = #version + :one REMOVE #status, #hold_expires"),
+			ConditionExpression: aws.String("#status = :held AND #hold_expires > :now"),
+			ExpressionAttributeNames: map[string]*string{
+				"#status":       aws.String("status"),
+				"#hold_expires": aws.String("hold_expires"),
+				"#version":      aws.String("version"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":held": {S: aws.String(util.BookingHeld)},
+				":now":  {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+				":one":  {N: aws.String("1")},
+			},
+			ReturnValues: aws.String(dynamodb.ReturnValueAllNew),
+		})
+		return err
+	})
+	if err != nil {
+		if awsError, ok := err.(awserr.Error); ok && awsError.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil, d.confirmConflict(ctx, ref)
+		}
+		return nil, err
+	}
+
+	var confirmation *CarRentalConfirmation
+	if err := dynamodbattribute.UnmarshalMap(result.Attributes, &confirmation); err != nil {
+		return nil, err
+	}
+	return confirmation, nil
+}
+
+// confirmConflict determines why a conditional confirm failed. A held
+// reservation which failed the condition has expired.
+func (d *dynamoService) confirmConflict(ctx context.Context, ref string) error {
+	stored, err := d.Get(ctx, ref)
+	switch {
+	case err != nil:
+		return err
+	case stored.Cancelled():
+		return ErrNoSuchBooking
+	case !stored.Held():
+		return ErrNotHeld
+	default:
+		return ErrHoldExpired
+	}
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+// defaultDailyRate is the daily rate of vehicle classes without their own.
+const defaultDailyRate util.Money = 5500
+
+// dailyRates are the daily rates of vehicle classes.
+var dailyRates = map[string]util.Money{
+	"economy":  3900,
+	"compact":  4500,
+	"standard": 5500,
+	"suv":      7900,
+	"luxury":   12900,
+}
+
+// Pricing prices a car rental booking.
+type Pricing func(*BookCarRentalRequest) util.Money
+
+// Option configures the car rental service.
+type Option func(*carRentalService)
+
+// WithPricing sets the pricing of car rental bookings, which is a daily rate
+// by vehicle class by default.
+func WithPricing(pricing Pricing) Option {
+	return func(s *carRentalService) {
+		s.pricing = pricing
+	}
+}
+
+// defaultPricing charges the vehicle class's daily rate for each day of the
+// rental, with any part of a day charged as a whole one.
+func defaultPricing(r *BookCarRentalRequest) util.Money {
+	rate, ok := dailyRates[strings.ToLower(r.VehicleClass)]
+	if !ok {
+		rate = defaultDailyRate
+	}
+	rental := r.DropOff.Sub(r.PickUp)
+	days := int64(rental / (24 * time.Hour))
+	if rental%(24*time.Hour) > 0 {
+		days++
+	}
+	if days < 1 {
+		days = 1
+	}
+	return rate * util.Money(days)
+}
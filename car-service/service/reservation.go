@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nats-io/nuid"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+var (
+	// ErrHoldExpired is returned when confirming a reservation whose hold
+	// expired.
+	ErrHoldExpired = errors.New("reservation hold expired")
+	// ErrNotHeld is returned by Store.Confirm for a booking which isn't a
+	// held reservation, e.g. because it was already confirmed.
+	ErrNotHeld = errors.New("booking isn't held")
+)
+
+// Held returns whether the booking is a reservation which hasn't been
+// confirmed. Its hold may have expired; see Expired.
+func (c *CarRentalConfirmation) Held() bool {
+	return c.Status == util.BookingHeld
+}
+
+// Expired returns whether the booking is a reservation whose hold expired
+// before now without it being confirmed. Expired reservations are treated as
+// if they don't exist.
+func (c *CarRentalConfirmation) Expired(now time.Time) bool {
+	return c.Held() && c.HoldExpires != nil && !now.Before(*c.HoldExpires)
+}
+
+// ReserveCarRental holds the car for HOLD_TTL without booking it, and returns
+// the reservation, which ConfirmReservation books. Nothing is published until
+// the reservation is confirmed.
+func (s *carRentalService) ReserveCarRental(ctx context.Context, r *BookCarRentalRequest) (*CarRentalConfirmation, error) {
+	now := s.clock.Now()
+	expires := now.Add(s.holdTTL)
+	confirmation := &CarRentalConfirmation{
+		Ref:         nuid.Next(),
+		CarRental:   r,
+		Created:     now,
+		Version:     1,
+		Price:       s.pricing(r),
+		Status:      util.BookingHeld,
+		HoldExpires: &expires,
+	}
+	if err := s.store.Put(ctx, confirmation); err != nil {
+		return confirmation, err
+	}
+	return confirmation, nil
+}
+
+// ConfirmReservation books the held reservation with the given ref. It
+// returns ErrHoldExpired if the hold expired first, and ErrNoSuchBooking if
+// there is no such reservation or it was cancelled. Confirming a booking
+// again returns it without publishing another event, so a client can safely
+// retry.
+func (s *carRentalService) ConfirmReservation(ctx context.Context, ref string) (*CarRentalConfirmation, error) {
+	now := s.clock.Now()
+	confirmation, err := s.store.Confirm(ctx, ref, now)
+	if err == ErrNotHeld {
+		return s.store.Get(ctx, ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	util.RecordBooking("car-service")
+	publishBookingEvent(ctx, CarRentalBookedSubject, confirmation.bookedEvent(now))
+	return confirmation, nil
+}
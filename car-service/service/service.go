@@ -4,33 +4,51 @@ import (
 	"context"
 	"errors"
 	"math/rand"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/nats-io/nuid"
-	"github.com/opentracing-contrib/go-aws-sdk"
 	"github.com/opentracing/opentracing-go"
 	tracelog "github.com/opentracing/opentracing-go/log"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+const (
+	maxValidationDelayEnv     = "VALIDATION_MAX_DELAY"
+	defaultMaxValidationDelay = time.Second
+)
+
+const (
+	// CarRentalBookedSubject and CarRentalCancelledSubject are the NATS subjects
+	// car rentals are published to, as util.BookingEvents, once booked and
+	// cancelled.
+	CarRentalBookedSubject    = "car.booked"
+	CarRentalCancelledSubject = "car.cancelled"
 )
 
+// publishBookingEvent publishes the service's booking events. It's a variable
+// so tests can observe what's published without a NATS server.
+var publishBookingEvent = util.PublishBookingEvent
+
 var (
-	ErrNoSuchBooking = errors.New("no such booking")
-	rentalsTable     = "rentals"
+	ErrNoSuchBooking   = errors.New("no such booking")
+	ErrVersionMismatch = errors.New("booking version mismatch")
+	// ErrAlreadyCancelled is returned by Store.Cancel for a booking which
+	// was already cancelled.
+	ErrAlreadyCancelled = errors.New("booking already cancelled")
+	rentalsTable        = util.TableName("rentals")
 )
 
 type BookCarRentalRequest struct {
-	Agent           string    `json:"agent"`
-	PickUp          time.Time `json:"pick_up"`
-	PickUpLocation  string    `json:"pick_up_location"`
-	DropOff         time.Time `json:"drop_off"`
-	DropOffLocation string    `json:"drop_off_location"`
-	Name            string    `json:"name"`
-	VehicleClass    string    `json:"vehicle_class"`
+	Agent           string    `json:"agent" xml:"agent" schema:"required"`
+	PickUp          time.Time `json:"pick_up" xml:"pick_up" schema:"required"`
+	PickUpLocation  string    `json:"pick_up_location" xml:"pick_up_location" schema:"required"`
+	DropOff         time.Time `json:"drop_off" xml:"drop_off" schema:"required"`
+	DropOffLocation string    `json:"drop_off_location" xml:"drop_off_location" schema:"required"`
+	Name            string    `json:"name" xml:"name" schema:"required"`
+	VehicleClass    string    `json:"vehicle_class" xml:"vehicle_class" schema:"required"`
 }
 
 func (b *BookCarRentalRequest) Validate() error {
@@ -59,115 +77,269 @@ func (b *BookCarRentalRequest) Validate() error {
 }
 
 type CarRentalConfirmation struct {
-	Ref       string                `json:"ref"`
-	CarRental *BookCarRentalRequest `json:"car_rental"`
+	Ref       string                `json:"ref" xml:"ref"`
+	CarRental *BookCarRentalRequest `json:"car_rental" xml:"car_rental"`
+	// Created is zero for bookings stored before it was recorded.
+	Created time.Time `json:"created" xml:"created"`
+	Version int64     `json:"version" xml:"version"`
+	// Price is the price of the booking when it was made or last updated.
+	Price util.Money `json:"price" xml:"price"`
+	// Status is util.BookingCancelled once the booking is cancelled, if
+	// SOFT_DELETE is set. Otherwise cancelled bookings are deleted.
+	Status      string     `json:"status,omitempty" xml:"status,omitempty"`
+	CancelledAt *time.Time `json:"cancelled_at,omitempty" xml:"cancelled_at,omitempty"`
+	// HoldExpires is when a reservation's hold expires, unless it's
+	// confirmed first. It's only set while Status is util.BookingHeld, and
+	// is stored in Unix seconds so it can be compared in conditions.
+	HoldExpires *time.Time `json:"hold_expires,omitempty" xml:"hold_expires,omitempty" dynamodbav:"hold_expires,unixtime,omitempty"`
+}
+
+// Cancelled returns whether the booking was cancelled and kept.
+func (c *CarRentalConfirmation) Cancelled() bool {
+	return c.Status == util.BookingCancelled
+}
+
+// bookedEvent is the event published when the booking is booked at the given
+// time.
+func (c *CarRentalConfirmation) bookedEvent(at time.Time) *util.BookingEvent {
+	return &util.BookingEvent{Ref: c.Ref, Version: c.Version, Price: c.Price, Timestamp: at}
+}
+
+// GetOptions control how a booking is read.
+type GetOptions struct {
+	// IncludeCancelled returns cancelled bookings, which are only kept if
+	// SOFT_DELETE is set, rather than ErrNoSuchBooking.
+	IncludeCancelled bool
 }
 
 type CarRentalService interface {
 	BookCarRental(context.Context, *BookCarRentalRequest) (*CarRentalConfirmation, error)
-	GetBooking(ctx context.Context, ref string) (*CarRentalConfirmation, error)
-}
-
-type dynamoService struct {
-	db *dynamodb.DynamoDB
-}
-
-func NewCarRentalService() (CarRentalService, error) {
-	rand.Seed(time.Now().Unix())
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-		Config:            aws.Config{Region: aws.String("us-east-1")},
-	}))
-	db := dynamodb.New(sess)
-	otaws.AddOTHandlers(db.Client)
-
-	input := &dynamodb.CreateTableInput{
-		AttributeDefinitions: []*dynamodb.AttributeDefinition{
-			{
-				AttributeName: aws.String("ref"),
-				AttributeType: aws.String("S"),
-			},
-		},
-		KeySchema: []*dynamodb.KeySchemaElement{
-			{
-				AttributeName: aws.String("ref"),
-				KeyType:       aws.String("HASH"),
-			},
-		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(2),
-			WriteCapacityUnits: aws.Int64(2),
-		},
-		TableName: aws.String(rentalsTable),
-	}
-	_, err := db.CreateTable(input)
+	GetBooking(ctx context.Context, ref string, opts GetOptions) (*CarRentalConfirmation, error)
+	CancelBooking(ctx context.Context, ref string) error
+	UpdateBooking(ctx context.Context, ref string, r *BookCarRentalRequest, version int64) (*CarRentalConfirmation, error)
+	Quote(r *BookCarRentalRequest) util.Money
+	ReserveCarRental(context.Context, *BookCarRentalRequest) (*CarRentalConfirmation, error)
+	ConfirmReservation(ctx context.Context, ref string) (*CarRentalConfirmation, error)
+}
+
+// Store persists car rental bookings keyed by ref.
+type Store interface {
+	// Put stores a new booking.
+	Put(ctx context.Context, confirmation *CarRentalConfirmation) error
+
+	// Get returns the booking with the given ref, even if it's cancelled. It
+	// returns ErrNoSuchBooking if there is no such booking.
+	Get(ctx context.Context, ref string) (*CarRentalConfirmation, error)
+
+	// Update replaces the booking details for the given ref if the stored
+	// version matches, and returns the updated booking. It returns
+	// ErrNoSuchBooking or ErrVersionMismatch if the update can't be applied.
+	// Cancelled bookings can't be updated.
+	Update(ctx context.Context, ref string, r *BookCarRentalRequest, price util.Money, version int64) (*CarRentalConfirmation, error)
+
+	// Delete removes the booking with the given ref. It returns
+	// ErrNoSuchBooking if there is no such booking.
+	Delete(ctx context.Context, ref string) error
+
+	// Cancel marks the booking with the given ref as cancelled at the given
+	// time rather than removing it, bumping its version. It returns
+	// ErrNoSuchBooking if there is no such booking and ErrAlreadyCancelled if
+	// it's already cancelled.
+	Cancel(ctx context.Context, ref string, at time.Time) error
+
+	// Confirm books the held reservation with the given ref, if its hold
+	// hasn't expired at the given time, bumping its version, and returns the
+	// booking. It returns ErrNoSuchBooking if there is no such booking or
+	// it's cancelled, ErrNotHeld if it's already booked, and ErrHoldExpired
+	// if the hold expired.
+	Confirm(ctx context.Context, ref string, now time.Time) (*CarRentalConfirmation, error)
+
+	// List returns a page of at most limit bookings, starting from the
+	// cursor returned with the previous page, or the first page if it's
+	// empty, and the cursor of the next page, which is empty on the last
+	// page. Bookings are in no particular order, but every booking is listed
+	// by paging through to the last page. It returns util.ErrInvalidCursor
+	// if the cursor wasn't returned by List.
+	List(ctx context.Context, limit int, cursor string) ([]*CarRentalConfirmation, string, error)
+}
+
+type carRentalService struct {
+	store Store
+
+	// rand drives the simulated validation delay. It isn't safe for
+	// concurrent use, so access is guarded by randMu.
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	// maxValidationDelay caps the simulated validation delay.
+	maxValidationDelay time.Duration
+
+	// pricing prices bookings.
+	pricing Pricing
+
+	// softDelete keeps cancelled bookings, marked as cancelled, for
+	// auditing.
+	softDelete bool
+
+	// holdTTL is how long reservations hold inventory.
+	holdTTL time.Duration
+
+	// clock tells the time bookings are created and cancelled.
+	clock util.Clock
+}
+
+// NewCarRentalService returns a CarRentalService which stores bookings in the
+// backend selected by STORAGE_BACKEND. Possibly orphaned bookings are
+// reported in the background if REAPER_ENABLED is set; see util.StartReaper.
+func NewCarRentalService(opts ...Option) (CarRentalService, error) {
+	store, err := newStore()
 	if err != nil {
-		if awsError, ok := err.(awserr.Error); ok {
-			if awsError.Code() != dynamodb.ErrCodeResourceInUseException {
-				return nil, err
-			}
-		} else {
-			return nil, err
-		}
+		return nil, err
 	}
-
-	return &dynamoService{db: db}, nil
+	if err := util.StartReaper("car-service", reaperCandidates(store), store.Delete); err != nil {
+		return nil, err
+	}
+	return NewCarRentalServiceWithStore(store, opts...)
 }
 
-func (d *dynamoService) BookCarRental(ctx context.Context, r *BookCarRentalRequest) (*CarRentalConfirmation, error) {
-	confirmation := &CarRentalConfirmation{Ref: nuid.Next(), CarRental: r}
-	av, err := dynamodbattribute.MarshalMap(confirmation)
+// NewCarRentalServiceWithStore returns a CarRentalService which stores bookings in
+// the given Store.
+func NewCarRentalServiceWithStore(store Store, opts ...Option) (CarRentalService, error) {
+	maxValidationDelay, err := util.DurationFromEnv(maxValidationDelayEnv, defaultMaxValidationDelay)
+	if err != nil {
+		return nil, err
+	}
+	softDelete, err := util.SoftDeleteFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	holdTTL, err := util.HoldTTLFromEnv()
 	if err != nil {
 		return nil, err
 	}
 
-	input := &dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(rentalsTable),
+	s := &carRentalService{
+		store:              store,
+		rand:               rand.New(rand.NewSource(time.Now().UnixNano())),
+		maxValidationDelay: maxValidationDelay,
+		pricing:            defaultPricing,
+		softDelete:         softDelete,
+		holdTTL:            holdTTL,
+		clock:              util.SystemClock,
 	}
-	_, err = d.db.PutItemWithContext(ctx, input)
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
 
-	return confirmation, err
+// WithClock sets the clock which tells the time bookings are created and
+// cancelled, which is the system clock by default.
+func WithClock(clock util.Clock) Option {
+	return func(s *carRentalService) {
+		s.clock = clock
+	}
 }
 
-func (d *dynamoService) GetBooking(ctx context.Context, ref string) (*CarRentalConfirmation, error) {
-	result, err := d.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(rentalsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ref": {
-				S: aws.String(ref),
-			},
-		},
-	})
+func newStore() (Store, error) {
+	backend, err := util.StorageBackendFromEnv()
 	if err != nil {
 		return nil, err
 	}
+	if backend == util.StorageMemory {
+		return newMemoryStore(), nil
+	}
+	return newDynamoService()
+}
+
+func (s *carRentalService) BookCarRental(ctx context.Context, r *BookCarRentalRequest) (*CarRentalConfirmation, error) {
+	confirmation := &CarRentalConfirmation{
+		Ref:       nuid.Next(),
+		CarRental: r,
+		Created:   s.clock.Now(),
+		Version:   1,
+		Price:     s.pricing(r),
+	}
+	if err := s.store.Put(ctx, confirmation); err != nil {
+		return confirmation, err
+	}
+	util.RecordBooking("car-service")
+	publishBookingEvent(ctx, CarRentalBookedSubject, confirmation.bookedEvent(confirmation.Created))
+	return confirmation, nil
+}
 
-	var confirmation *CarRentalConfirmation
-	if err := dynamodbattribute.UnmarshalMap(result.Item, &confirmation); err != nil {
+func (s *carRentalService) GetBooking(ctx context.Context, ref string, opts GetOptions) (*CarRentalConfirmation, error) {
+	confirmation, err := s.store.Get(ctx, ref)
+	if err != nil {
 		return nil, err
 	}
-	if confirmation.Ref == "" {
+	if confirmation.Expired(s.clock.Now()) {
 		return nil, ErrNoSuchBooking
 	}
+	if confirmation.Cancelled() {
+		if !opts.IncludeCancelled {
+			return nil, ErrNoSuchBooking
+		}
+		// There's nothing to validate for a cancelled booking.
+		return confirmation, nil
+	}
 
 	span, ctx := opentracing.StartSpanFromContext(ctx, "validateCarReservation")
-	span.LogFields(
+	util.LogSpanFields(span,
 		tracelog.String("ref", confirmation.Ref),
 		tracelog.String("agent", confirmation.CarRental.Agent),
 		tracelog.String("name", confirmation.CarRental.Name),
 		tracelog.String("vehicle_class", confirmation.CarRental.VehicleClass),
 	)
-	err = d.validateCarReservation(ctx, confirmation)
+	err = s.validateCarReservation(ctx, confirmation)
 	span.Finish()
 
 	return confirmation, nil
 }
 
-func (d *dynamoService) validateCarReservation(ctx context.Context, confirmation *CarRentalConfirmation) error {
+// CancelBooking cancels the booking with the given ref. It's deleted unless
+// SOFT_DELETE is set, in which case it's kept and marked as cancelled. It
+// returns ErrNoSuchBooking if there is no such booking. The cancellation is
+// published with just the ref, since deleted bookings can't be read back.
+//
+// Cancelling a kept booking again succeeds without publishing another event,
+// so a client can safely retry. A deleted booking can't be told apart from
+// one which never existed, so cancelling it again returns ErrNoSuchBooking;
+// see the idempotent parameter of the cancel endpoint.
+func (s *carRentalService) CancelBooking(ctx context.Context, ref string) error {
+	now := s.clock.Now()
+	var err error
+	if s.softDelete {
+		err = s.store.Cancel(ctx, ref, now)
+	} else {
+		err = s.store.Delete(ctx, ref)
+	}
+	if err == ErrAlreadyCancelled {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	publishBookingEvent(ctx, CarRentalCancelledSubject, &util.BookingEvent{Ref: ref, Timestamp: now})
+	return nil
+}
+
+// Quote returns the price of the car rental without booking it.
+func (s *carRentalService) Quote(r *BookCarRentalRequest) util.Money {
+	return s.pricing(r)
+}
+
+// UpdateBooking replaces the booking details for the given ref if the stored
+// version matches. It returns ErrVersionMismatch if the booking was modified
+// since the caller read it. Bookings stored before versioning are treated as
+// version 0.
+func (s *carRentalService) UpdateBooking(ctx context.Context, ref string, r *BookCarRentalRequest, version int64) (*CarRentalConfirmation, error) {
+	return s.store.Update(ctx, ref, r, s.pricing(r), version)
+}
+
+func (s *carRentalService) validateCarReservation(ctx context.Context, confirmation *CarRentalConfirmation) error {
 	// Do some work.
-	sleep := 500*time.Millisecond + time.Duration(rand.Intn(1))*time.Second
-	time.Sleep(sleep)
+	time.Sleep(s.validationDelay())
 	log.WithContext(ctx).WithFields(log.Fields{
 		"agent":             confirmation.CarRental.Agent,
 		"pick_up":           confirmation.CarRental.PickUp,
@@ -179,3 +351,13 @@ func (d *dynamoService) validateCarReservation(ctx context.Context, confirmation
 	}).Infof("Validated flight reservation")
 	return nil
 }
+
+// validationDelay returns a random delay of at most maxValidationDelay.
+func (s *carRentalService) validationDelay() time.Duration {
+	if s.maxValidationDelay <= 0 {
+		return 0
+	}
+	s.randMu.Lock()
+	defer s.randMu.Unlock()
+	return time.Duration(s.rand.Int63n(int64(s.maxValidationDelay) + 1))
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/flight-service/service"
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+	"github.com/realkinetic/cloud-native-meetup-2019/util/servicetest"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+// newTestServer returns the flight service's handler, storing bookings in
+// the backend and telling the time by the clock. The DynamoDB backend is a
+// stand-in.
+func newTestServer(t *testing.T, backend string, clock util.Clock) http.Handler {
+	if backend == util.StorageDynamoDB {
+		servicetest.NewDynamoDB(t)
+	}
+	t.Setenv("STORAGE_BACKEND", backend)
+	t.Setenv("VALIDATION_MAX_DELAY", "1ms")
+	t.Setenv("HOLD_TTL", "10m")
+	flightService, err := service.NewFlightService(service.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{service: flightService}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/flights/booking", s.bookingHandler)
+	mux.HandleFunc("/flights/reservation", s.reservationHandler)
+	return mux
+}
+
+// do serves the request, with the body, if any, encoded as JSON, and returns
+// the response.
+func do(handler http.Handler, method, target string, body interface{}) *httptest.ResponseRecorder {
+	return serve(handler, newRequest(method, target, body))
+}
+
+// newRequest returns a request with the body, if any, encoded as JSON.
+func newRequest(method, target string, body interface{}) *http.Request {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			panic(err)
+		}
+	}
+	r := httptest.NewRequest(method, target, bytes.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+// serve serves the request and returns the response.
+func serve(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func testFlight() *service.BookFlightRequest {
+	return &service.BookFlightRequest{
+		Airline:      "DL",
+		FlightNumber: "DL123",
+		Time:         time.Date(2019, 6, 1, 9, 0, 0, 0, time.UTC),
+		Passengers:   []service.Passenger{{Name: "Ada Lovelace"}},
+	}
+}
+
+// reserve reserves the test flight and returns the reservation.
+func reserve(t *testing.T, handler http.Handler) *service.FlightConfirmation {
+	t.Helper()
+	w := do(handler, "POST", "/flights/reservation", testFlight())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("reservation status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var reservation service.FlightConfirmation
+	if err := json.Unmarshal(w.Body.Bytes(), &reservation); err != nil {
+		t.Fatal(err)
+	}
+	return &reservation
+}
+
+func TestReserveThenConfirm(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := util.NewFakeClock(now)
+	handler := newTestServer(t, util.StorageMemory, clock)
+
+	reservation := reserve(t, handler)
+	if !reservation.Held() {
+		t.Errorf("reservation status = %q, want %q", reservation.Status, util.BookingHeld)
+	}
+	if want := now.Add(10 * time.Minute); reservation.HoldExpires == nil || !reservation.HoldExpires.Equal(want) {
+		t.Errorf("hold expires %v, want %v", reservation.HoldExpires, want)
+	}
+
+	clock.Advance(5 * time.Minute)
+	for i := 0; i < 2; i++ {
+		// Confirming again returns the booking, so a client can retry.
+		w := do(handler, "POST", "/flights/booking?reservation="+reservation.Ref, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("confirmation %d status = %d, want %d: %s", i+1, w.Code, http.StatusOK, w.Body)
+		}
+		var booking service.FlightConfirmation
+		if err := json.Unmarshal(w.Body.Bytes(), &booking); err != nil {
+			t.Fatal(err)
+		}
+		if booking.Ref != reservation.Ref || booking.Held() || booking.HoldExpires != nil {
+			t.Errorf("confirmation %d = %s, want a booking of %s", i+1, w.Body, reservation.Ref)
+		}
+	}
+
+	// A booking doesn't expire.
+	clock.Advance(time.Hour)
+	if w := do(handler, "GET", "/flights/booking?ref="+reservation.Ref, nil); w.Code != http.StatusOK {
+		t.Errorf("get status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	if w := do(handler, "POST", "/flights/booking?reservation=missing", nil); w.Code != http.StatusNotFound {
+		t.Errorf("confirming a missing reservation: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestConfirmExpiredHold(t *testing.T) {
+	clock := util.NewFakeClock(time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC))
+	handler := newTestServer(t, util.StorageMemory, clock)
+
+	reservation := reserve(t, handler)
+	clock.Advance(10 * time.Minute)
+	if w := do(handler, "POST", "/flights/booking?reservation="+reservation.Ref, nil); w.Code != http.StatusGone {
+		t.Errorf("confirmation status = %d, want %d: %s", w.Code, http.StatusGone, w.Body)
+	}
+	// An expired reservation is treated as if it doesn't exist.
+	if w := do(handler, "GET", "/flights/booking?ref="+reservation.Ref, nil); w.Code != http.StatusNotFound {
+		t.Errorf("get status = %d, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+	}
+}
+
+// TestConfirmChangesETag checks confirming a reservation changes its ETag, so
+// a client revalidating the held reservation gets the booking, and can't
+// update it with the held reservation's version.
+func TestConfirmChangesETag(t *testing.T) {
+	for _, backend := range []string{util.StorageMemory, util.StorageDynamoDB} {
+		clock := util.NewFakeClock(time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC))
+		handler := newTestServer(t, backend, clock)
+
+		reservation := reserve(t, handler)
+		target := "/flights/booking?ref=" + reservation.Ref
+		w := do(handler, "GET", target, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: get reservation status = %d, want %d: %s", backend, w.Code, http.StatusOK, w.Body)
+		}
+		held := w.Header().Get("ETag")
+
+		if w := do(handler, "POST", "/flights/booking?reservation="+reservation.Ref, nil); w.Code != http.StatusOK {
+			t.Fatalf("%s: confirmation status = %d, want %d: %s", backend, w.Code, http.StatusOK, w.Body)
+		}
+
+		revalidate := newRequest("GET", target, nil)
+		revalidate.Header.Set("If-None-Match", held)
+		w = serve(handler, revalidate)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: revalidating status = %d, want %d", backend, w.Code, http.StatusOK)
+		}
+		var booking service.FlightConfirmation
+		if err := json.Unmarshal(w.Body.Bytes(), &booking); err != nil {
+			t.Fatal(err)
+		}
+		if booking.Held() || booking.Version != reservation.Version+1 {
+			t.Errorf("%s: revalidated booking = %s, want version %d and not held", backend, w.Body, reservation.Version+1)
+		}
+
+		update := newRequest("PUT", target, testFlight())
+		update.Header.Set("If-Match", held)
+		if w := serve(handler, update); w.Code != http.StatusPreconditionFailed {
+			t.Errorf("%s: update with the held ETag status = %d, want %d", backend, w.Code, http.StatusPreconditionFailed)
+		}
+	}
+}
+
+// TestCancelBooking cancels a booking with and without SOFT_DELETE, against
+// each storage backend. Either way the booking is gone from normal reads and
+// can't be updated, but only a soft deleted one can be read back with
+// include_cancelled=true, with a new version, or cancelled again.
+func TestCancelBooking(t *testing.T) {
+	for _, backend := range []string{util.StorageMemory, util.StorageDynamoDB} {
+		for _, softDelete := range []bool{false, true} {
+			name := fmt.Sprintf("%s, soft delete %v", backend, softDelete)
+			t.Setenv("SOFT_DELETE", strconv.FormatBool(softDelete))
+			now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+			handler := newTestServer(t, backend, util.NewFakeClock(now))
+
+			w := do(handler, "POST", "/flights/booking", testFlight())
+			if w.Code != http.StatusCreated {
+				t.Fatalf("%s: booking status = %d, want %d: %s", name, w.Code, http.StatusCreated, w.Body)
+			}
+			var booking service.FlightConfirmation
+			if err := json.Unmarshal(w.Body.Bytes(), &booking); err != nil {
+				t.Fatal(err)
+			}
+			target := "/flights/booking?ref=" + booking.Ref
+
+			if w := do(handler, "DELETE", target, nil); w.Code != http.StatusNoContent {
+				t.Errorf("%s: cancel status = %d, want %d: %s", name, w.Code, http.StatusNoContent, w.Body)
+			}
+			if w := do(handler, "GET", target, nil); w.Code != http.StatusNotFound {
+				t.Errorf("%s: get status = %d, want %d", name, w.Code, http.StatusNotFound)
+			}
+			update := newRequest("PUT", target, testFlight())
+			update.Header.Set("If-Match", util.VersionETag(booking.Version))
+			if w := serve(handler, update); w.Code != http.StatusNotFound {
+				t.Errorf("%s: update status = %d, want %d", name, w.Code, http.StatusNotFound)
+			}
+
+			// The pre-cancel ETag no longer matches.
+			get := newRequest("GET", target+"&include_cancelled=true", nil)
+			get.Header.Set("If-None-Match", util.VersionETag(booking.Version))
+			w = serve(handler, get)
+			again := do(handler, "DELETE", target, nil)
+			if !softDelete {
+				if w.Code != http.StatusNotFound {
+					t.Errorf("%s: get cancelled status = %d, want %d", name, w.Code, http.StatusNotFound)
+				}
+				if again.Code != http.StatusNotFound {
+					t.Errorf("%s: second cancel status = %d, want %d", name, again.Code, http.StatusNotFound)
+				}
+				continue
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: get cancelled status = %d, want %d: %s", name, w.Code, http.StatusOK, w.Body)
+			}
+			var cancelled service.FlightConfirmation
+			if err := json.Unmarshal(w.Body.Bytes(), &cancelled); err != nil {
+				t.Fatal(err)
+			}
+			if !cancelled.Cancelled() || cancelled.CancelledAt == nil || !cancelled.CancelledAt.Equal(now) {
+				t.Errorf("%s: cancelled booking = %s, want status %q and cancelled_at %v", name, w.Body, util.BookingCancelled, now)
+			}
+			if cancelled.Version != booking.Version+1 {
+				t.Errorf("%s: cancelled booking version = %d, want %d", name, cancelled.Version, booking.Version+1)
+			}
+			if again.Code != http.StatusNoContent {
+				t.Errorf("%s: second cancel status = %d, want %d", name, again.Code, http.StatusNoContent)
+			}
+		}
+	}
+}
+
+// TestIdempotentCancel checks a cancel with idempotent=true succeeds however
+// many times it's repeated, and even if the booking never existed.
+func TestIdempotentCancel(t *testing.T) {
+	for _, softDelete := range []bool{false, true} {
+		t.Setenv("SOFT_DELETE", strconv.FormatBool(softDelete))
+		handler := newTestServer(t, util.StorageMemory, util.SystemClock)
+		w := do(handler, "POST", "/flights/booking", testFlight())
+		if w.Code != http.StatusCreated {
+			t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+		}
+		var booking service.FlightConfirmation
+		if err := json.Unmarshal(w.Body.Bytes(), &booking); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			if w := do(handler, "DELETE", "/flights/booking?idempotent=true&ref="+booking.Ref, nil); w.Code != http.StatusNoContent {
+				t.Errorf("soft delete %v: cancel %d status = %d, want %d", softDelete, i+1, w.Code, http.StatusNoContent)
+			}
+		}
+		if w := do(handler, "DELETE", "/flights/booking?idempotent=true&ref=missing", nil); w.Code != http.StatusNoContent {
+			t.Errorf("soft delete %v: idempotent cancel of a missing booking status = %d, want %d", softDelete, w.Code, http.StatusNoContent)
+		}
+		if w := do(handler, "DELETE", "/flights/booking?ref=missing", nil); w.Code != http.StatusNotFound {
+			t.Errorf("soft delete %v: cancel of a missing booking status = %d, want %d", softDelete, w.Code, http.StatusNotFound)
+		}
+		if w := do(handler, "DELETE", "/flights/booking?idempotent=maybe&ref="+booking.Ref, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("soft delete %v: invalid idempotent status = %d, want %d", softDelete, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// TestUpdateBooking checks an update needs the booking's current version in
+// If-Match, and increments it, against each storage backend.
+func TestUpdateBooking(t *testing.T) {
+	for _, backend := range []string{util.StorageMemory, util.StorageDynamoDB} {
+		handler := newTestServer(t, backend, util.SystemClock)
+		w := do(handler, "POST", "/flights/booking", testFlight())
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%s: booking status = %d, want %d: %s", backend, w.Code, http.StatusCreated, w.Body)
+		}
+		var booking service.FlightConfirmation
+		if err := json.Unmarshal(w.Body.Bytes(), &booking); err != nil {
+			t.Fatal(err)
+		}
+		target := "/flights/booking?ref=" + booking.Ref
+		updated := testFlight()
+		updated.FlightNumber = "DL456"
+
+		for _, test := range []struct {
+			name    string
+			ifMatch string
+			want    int
+		}{
+			{"missing If-Match", "", http.StatusPreconditionRequired},
+			{"invalid If-Match", `"latest"`, http.StatusPreconditionFailed},
+			{"future version", util.VersionETag(booking.Version + 1), http.StatusPreconditionFailed},
+			{"current version", util.VersionETag(booking.Version), http.StatusOK},
+			// The update above made the version stale.
+			{"stale version", util.VersionETag(booking.Version), http.StatusPreconditionFailed},
+		} {
+			r := newRequest("PUT", target, updated)
+			if test.ifMatch != "" {
+				r.Header.Set("If-Match", test.ifMatch)
+			}
+			if w := serve(handler, r); w.Code != test.want {
+				t.Errorf("%s: %s: update status = %d, want %d: %s", backend, test.name, w.Code, test.want, w.Body)
+			}
+		}
+
+		w = do(handler, "GET", target, nil)
+		var stored service.FlightConfirmation
+		if err := json.Unmarshal(w.Body.Bytes(), &stored); err != nil {
+			t.Fatal(err)
+		}
+		if want := booking.Version + 1; stored.Version != want || stored.Flight.FlightNumber != "DL456" {
+			t.Errorf("%s: stored booking = %s, want flight DL456 at version %d", backend, w.Body, want)
+		}
+		if got, want := w.Header().Get("ETag"), util.VersionETag(booking.Version+1); got != want {
+			t.Errorf("%s: ETag = %s, want %s", backend, got, want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+type Passenger struct {
+	Name           string     `json:"name" xml:"name" schema:"required"`
+	DateOfBirth    *time.Time `json:"date_of_birth,omitempty" xml:"date_of_birth,omitempty"`
+	SeatPreference string     `json:"seat_preference,omitempty" xml:"seat_preference,omitempty"`
+}
+
+// CustomizeSchema allows a bare passenger name as well as a passenger object,
+// as UnmarshalJSON does.
+func (p *Passenger) CustomizeSchema(s *util.Schema) {
+	object := *s
+	*s = util.Schema{OneOf: []*util.Schema{
+		&object,
+		{Type: "string", MinLength: 1},
+	}}
+}
+
+// passenger has the same fields as Passenger but none of its custom decoding.
+type passenger Passenger
+
+// UnmarshalJSON accepts either a passenger object or, for compatibility with
+// older clients, a bare passenger name.
+func (p *Passenger) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*p = Passenger{Name: name}
+		return nil
+	}
+	var decoded passenger
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*p = Passenger(decoded)
+	return nil
+}
+
+// UnmarshalDynamoDBAttributeValue accepts either a passenger map or, for
+// bookings stored before passengers were structured, a bare passenger name.
+func (p *Passenger) UnmarshalDynamoDBAttributeValue(av *dynamodb.AttributeValue) error {
+	if av.S != nil {
+		*p = Passenger{Name: aws.StringValue(av.S)}
+		return nil
+	}
+	var decoded passenger
+	if err := dynamodbattribute.Unmarshal(av, &decoded); err != nil {
+		return err
+	}
+	*p = Passenger(decoded)
+	return nil
+}
+
+// passengerNames returns the distinct names of the passengers, in order. Two
+// passengers can share a name, but a DynamoDB string set can't hold it twice.
+func passengerNames(passengers []Passenger) []string {
+	names := make([]string, 0, len(passengers))
+	seen := make(map[string]bool, len(passengers))
+	for _, p := range passengers {
+		if !seen[p.Name] {
+			seen[p.Name] = true
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+func TestPassengersUnmarshalJSON(t *testing.T) {
+	dob := time.Date(1815, 12, 10, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name string
+		data string
+		want []Passenger
+	}{
+		{"names", `["Ada Lovelace", "Charles Babbage"]`, []Passenger{{Name: "Ada Lovelace"}, {Name: "Charles Babbage"}}},
+		{
+			"objects",
+			`[{"name": "Ada Lovelace", "date_of_birth": "1815-12-10T00:00:00Z", "seat_preference": "window"}, {"name": "Charles Babbage"}]`,
+			[]Passenger{{Name: "Ada Lovelace", DateOfBirth: &dob, SeatPreference: "window"}, {Name: "Charles Babbage"}},
+		},
+		{"mixed", `["Ada Lovelace", {"name": "Charles Babbage"}]`, []Passenger{{Name: "Ada Lovelace"}, {Name: "Charles Babbage"}}},
+	} {
+		var request BookFlightRequest
+		if err := json.Unmarshal([]byte(`{"passengers": `+test.data+`}`), &request); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(request.Passengers, test.want) {
+			t.Errorf("%s: passengers = %+v, want %+v", test.name, request.Passengers, test.want)
+		}
+	}
+
+	for _, data := range []string{`[1]`, `[["Ada Lovelace"]]`, `[{"name": 1}]`} {
+		var request BookFlightRequest
+		if err := json.Unmarshal([]byte(`{"passengers": `+data+`}`), &request); err == nil {
+			t.Errorf("decoded passengers %s, want an error", data)
+		}
+	}
+}
+
+func TestPassengerUnmarshalDynamoDBAttributeValue(t *testing.T) {
+	stored, err := dynamodbattribute.Marshal([]Passenger{{Name: "Ada Lovelace", SeatPreference: "aisle"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name string
+		av   *dynamodb.AttributeValue
+		want []Passenger
+	}{
+		{"structured", stored, []Passenger{{Name: "Ada Lovelace", SeatPreference: "aisle"}}},
+		{"legacy names", &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{{S: aws.String("Ada Lovelace")}}}, []Passenger{{Name: "Ada Lovelace"}}},
+	} {
+		var passengers []Passenger
+		if err := dynamodbattribute.Unmarshal(test.av, &passengers); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(passengers, test.want) {
+			t.Errorf("%s: passengers = %+v, want %+v", test.name, passengers, test.want)
+		}
+	}
+}
+
+func TestValidatePassengerNames(t *testing.T) {
+	valid := func() *BookFlightRequest {
+		return &BookFlightRequest{
+			Airline:      "DL",
+			FlightNumber: "DL123",
+			Time:         time.Date(2019, 6, 1, 9, 0, 0, 0, time.UTC),
+			Passengers:   []Passenger{{Name: "Ada Lovelace"}},
+		}
+	}
+	request := valid()
+	request.Passengers = append(request.Passengers, Passenger{SeatPreference: "window"})
+	if err := request.Validate(); err == nil || err.Error() != "invalid passenger name" {
+		t.Errorf("Validate() = %v, want invalid passenger name", err)
+	}
+	request.Passengers = nil
+	if err := request.Validate(); err == nil || err.Error() != "invalid passengers" {
+		t.Errorf("Validate() without passengers = %v, want invalid passengers", err)
+	}
+	if err := valid().Validate(); err != nil {
+		t.Errorf("Validate() = %v for a valid request", err)
+	}
+}
+
+func TestValidateMaxPassengers(t *testing.T) {
+	request := testFlight()
+	for len(request.Passengers) < defaultMaxPassengers {
+		request.Passengers = append(request.Passengers, Passenger{Name: "Ada Lovelace"})
+	}
+	if err := request.Validate(); err != nil {
+		t.Errorf("Validate() with %d passengers = %v", len(request.Passengers), err)
+	}
+	request.Passengers = append(request.Passengers, Passenger{Name: "Ada Lovelace"})
+	if err := request.Validate(); err == nil || err.Error() != "too many passengers, at most 50 are allowed" {
+		t.Errorf("Validate() with %d passengers = %v, want too many passengers", len(request.Passengers), err)
+	}
+
+	max := maxPassengers
+	maxPassengers = 1
+	t.Cleanup(func() { maxPassengers = max })
+	request.Passengers = request.Passengers[:2]
+	if err := request.Validate(); err == nil || err.Error() != "too many passengers, at most 1 are allowed" {
+		t.Errorf("Validate() with a limit of 1 = %v, want too many passengers", err)
+	}
+}
@@ -0,0 +1,24 @@
+package service
+
+import "github.com/realkinetic/cloud-native-meetup-2019/util"
+
+// farePerPassenger is the flat fare of each passenger on a flight.
+const farePerPassenger util.Money = 18900
+
+// Pricing prices a flight booking.
+type Pricing func(*BookFlightRequest) util.Money
+
+// Option configures the flight service.
+type Option func(*flightService)
+
+// WithPricing sets the pricing of flight bookings, which is a flat fare per
+// passenger by default.
+func WithPricing(pricing Pricing) Option {
+	return func(s *flightService) {
+		s.pricing = pricing
+	}
+}
+
+func defaultPricing(r *BookFlightRequest) util.Money {
+	return farePerPassenger * util.Money(len(r.Passengers))
+}
@@ -3,36 +3,102 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math/rand"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/nats-io/nuid"
-	"github.com/opentracing-contrib/go-aws-sdk"
 	"github.com/opentracing/opentracing-go"
 	tracelog "github.com/opentracing/opentracing-go/log"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+const (
+	maxValidationDelayEnv     = "VALIDATION_MAX_DELAY"
+	defaultMaxValidationDelay = time.Second
+	maxPassengersEnv          = "MAX_PASSENGERS"
+	defaultMaxPassengers      = 50
 )
 
+const (
+	// FlightBookedSubject and FlightCancelledSubject are the NATS subjects
+	// flight bookings are published to, as util.BookingEvents, once booked and
+	// cancelled.
+	FlightBookedSubject    = "flight.booked"
+	FlightCancelledSubject = "flight.cancelled"
+)
+
+// publishBookingEvent publishes the service's booking events. It's a variable
+// so tests can observe what's published without a NATS server.
+var publishBookingEvent = util.PublishBookingEvent
+
 var (
-	ErrNoSuchBooking = errors.New("no such booking")
-	flightsTable     = "flights"
+	ErrNoSuchBooking   = errors.New("no such booking")
+	ErrVersionMismatch = errors.New("booking version mismatch")
+	// ErrAlreadyCancelled is returned by Store.Cancel for a booking which
+	// was already cancelled.
+	ErrAlreadyCancelled = errors.New("booking already cancelled")
+	flightsTable        = util.TableName("flights")
+
+	// maxPassengers bounds the size of a booking so it stays well under
+	// DynamoDB's 400KB item limit.
+	maxPassengers int
 )
 
+func init() {
+	var err error
+	if maxPassengers, err = util.IntFromEnv(maxPassengersEnv, defaultMaxPassengers); err != nil {
+		panic(err)
+	}
+}
+
 type FlightConfirmation struct {
-	Ref    string             `json:"ref"`
-	Flight *BookFlightRequest `json:"flight"`
+	Ref    string             `json:"ref" xml:"ref"`
+	Flight *BookFlightRequest `json:"flight" xml:"flight"`
+	// Created is zero for bookings stored before it was recorded.
+	Created time.Time `json:"created" xml:"created"`
+	Version int64     `json:"version" xml:"version"`
+	// Price is the price of the booking when it was made or last updated.
+	Price util.Money `json:"price" xml:"price"`
+	// Status is util.BookingCancelled once the booking is cancelled, if
+	// SOFT_DELETE is set. Otherwise cancelled bookings are deleted.
+	Status      string     `json:"status,omitempty" xml:"status,omitempty"`
+	CancelledAt *time.Time `json:"cancelled_at,omitempty" xml:"cancelled_at,omitempty"`
+	// HoldExpires is when a reservation's hold expires, unless it's
+	// confirmed first. It's only set while Status is util.BookingHeld, and
+	// is stored in Unix seconds so it can be compared in conditions.
+	HoldExpires *time.Time `json:"hold_expires,omitempty" xml:"hold_expires,omitempty" dynamodbav:"hold_expires,unixtime,omitempty"`
+	// PassengerNames denormalizes the passenger names so bookings can be
+	// filtered by passenger. It's only stored, never returned to clients.
+	PassengerNames []string `json:"-" xml:"-" dynamodbav:"passenger_names,stringset,omitempty"`
+}
+
+// Cancelled returns whether the booking was cancelled and kept.
+func (c *FlightConfirmation) Cancelled() bool {
+	return c.Status == util.BookingCancelled
+}
+
+// bookedEvent is the event published when the booking is booked at the given
+// time.
+func (c *FlightConfirmation) bookedEvent(at time.Time) *util.BookingEvent {
+	return &util.BookingEvent{Ref: c.Ref, Version: c.Version, Price: c.Price, Timestamp: at}
+}
+
+// GetOptions control how a booking is read.
+type GetOptions struct {
+	// IncludeCancelled returns cancelled bookings, which are only kept if
+	// SOFT_DELETE is set, rather than ErrNoSuchBooking.
+	IncludeCancelled bool
 }
 
 type BookFlightRequest struct {
-	Airline      string    `json:"airline"`
-	FlightNumber string    `json:"flight_number"`
-	Time         time.Time `json:"time"`
-	Passengers   []string  `json:"passengers"`
+	Airline      string      `json:"airline" xml:"airline" schema:"required"`
+	FlightNumber string      `json:"flight_number" xml:"flight_number" schema:"required"`
+	Time         time.Time   `json:"time" xml:"time" schema:"required"`
+	Passengers   []Passenger `json:"passengers" xml:"passengers>passenger" schema:"required"`
 }
 
 func (b *BookFlightRequest) Validate() error {
@@ -48,122 +114,288 @@ func (b *BookFlightRequest) Validate() error {
 	if len(b.Passengers) == 0 {
 		return errors.New("invalid passengers")
 	}
+	if len(b.Passengers) > maxPassengers {
+		return fmt.Errorf("too many passengers, at most %d are allowed", maxPassengers)
+	}
 	for _, p := range b.Passengers {
-		if len(p) == 0 {
+		if len(p.Name) == 0 {
 			return errors.New("invalid passenger name")
 		}
 	}
 	return nil
 }
 
+// CustomizeSchema adds the passenger limit, which is configured at startup,
+// to the generated schema.
+func (b *BookFlightRequest) CustomizeSchema(s *util.Schema) {
+	s.Properties["passengers"].MaxItems = maxPassengers
+}
+
 type FlightService interface {
 	BookFlight(context.Context, *BookFlightRequest) (*FlightConfirmation, error)
-	GetBooking(ctx context.Context, ref string) (*FlightConfirmation, error)
-}
-
-type dynamoService struct {
-	db *dynamodb.DynamoDB
-}
-
-func NewFlightService() (FlightService, error) {
-	rand.Seed(time.Now().Unix())
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-		Config:            aws.Config{Region: aws.String("us-east-1")},
-	}))
-	db := dynamodb.New(sess)
-	otaws.AddOTHandlers(db.Client)
-
-	input := &dynamodb.CreateTableInput{
-		AttributeDefinitions: []*dynamodb.AttributeDefinition{
-			{
-				AttributeName: aws.String("ref"),
-				AttributeType: aws.String("S"),
-			},
-		},
-		KeySchema: []*dynamodb.KeySchemaElement{
-			{
-				AttributeName: aws.String("ref"),
-				KeyType:       aws.String("HASH"),
-			},
-		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(2),
-			WriteCapacityUnits: aws.Int64(2),
-		},
-		TableName: aws.String(flightsTable),
-	}
-	_, err := db.CreateTable(input)
+	GetBooking(ctx context.Context, ref string, opts GetOptions) (*FlightConfirmation, error)
+	CancelBooking(ctx context.Context, ref string) error
+	UpdateBooking(ctx context.Context, ref string, r *BookFlightRequest, version int64) (*FlightConfirmation, error)
+	Quote(r *BookFlightRequest) util.Money
+	ReserveFlight(context.Context, *BookFlightRequest) (*FlightConfirmation, error)
+	ConfirmReservation(ctx context.Context, ref string) (*FlightConfirmation, error)
+	FindByPassenger(ctx context.Context, name string) ([]*FlightConfirmation, error)
+}
+
+// Store persists flight bookings keyed by ref.
+type Store interface {
+	// Put stores a new booking.
+	Put(ctx context.Context, confirmation *FlightConfirmation) error
+
+	// Get returns the booking with the given ref, even if it's cancelled. It
+	// returns ErrNoSuchBooking if there is no such booking.
+	Get(ctx context.Context, ref string) (*FlightConfirmation, error)
+
+	// Update replaces the flight details of the booking with the given ref if
+	// the stored version matches, and returns the updated booking. It returns
+	// ErrNoSuchBooking or ErrVersionMismatch if the update can't be applied.
+	// Cancelled bookings can't be updated.
+	Update(ctx context.Context, ref string, r *BookFlightRequest, price util.Money, version int64) (*FlightConfirmation, error)
+
+	// Delete removes the booking with the given ref. It returns
+	// ErrNoSuchBooking if there is no such booking.
+	Delete(ctx context.Context, ref string) error
+
+	// Cancel marks the booking with the given ref as cancelled at the given
+	// time rather than removing it, bumping its version. It returns
+	// ErrNoSuchBooking if there is no such booking and ErrAlreadyCancelled if
+	// it's already cancelled.
+	Cancel(ctx context.Context, ref string, at time.Time) error
+
+	// Confirm books the held reservation with the given ref, if its hold
+	// hasn't expired at the given time, bumping its version, and returns the
+	// booking. It returns ErrNoSuchBooking if there is no such booking or
+	// it's cancelled, ErrNotHeld if it's already booked, and ErrHoldExpired
+	// if the hold expired.
+	Confirm(ctx context.Context, ref string, now time.Time) (*FlightConfirmation, error)
+
+	// List returns a page of at most limit bookings, starting from the
+	// cursor returned with the previous page, or the first page if it's
+	// empty, and the cursor of the next page, which is empty on the last
+	// page. Bookings are in no particular order, but every booking is listed
+	// by paging through to the last page. It returns util.ErrInvalidCursor
+	// if the cursor wasn't returned by List.
+	List(ctx context.Context, limit int, cursor string) ([]*FlightConfirmation, string, error)
+
+	// FindByPassenger returns the bookings which include the given passenger.
+	FindByPassenger(ctx context.Context, name string) ([]*FlightConfirmation, error)
+}
+
+type flightService struct {
+	store Store
+
+	// rand drives the simulated validation delay. It isn't safe for
+	// concurrent use, so access is guarded by randMu.
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	// maxValidationDelay caps the simulated validation delay.
+	maxValidationDelay time.Duration
+
+	// pricing prices bookings.
+	pricing Pricing
+
+	// softDelete keeps cancelled bookings, marked as cancelled, for
+	// auditing.
+	softDelete bool
+
+	// holdTTL is how long reservations hold inventory.
+	holdTTL time.Duration
+
+	// clock tells the time bookings are created and cancelled.
+	clock util.Clock
+}
+
+// NewFlightService returns a FlightService which stores bookings in the
+// backend selected by STORAGE_BACKEND. Possibly orphaned bookings are
+// reported in the background if REAPER_ENABLED is set; see util.StartReaper.
+func NewFlightService(opts ...Option) (FlightService, error) {
+	store, err := newStore()
 	if err != nil {
-		if awsError, ok := err.(awserr.Error); ok {
-			if awsError.Code() != dynamodb.ErrCodeResourceInUseException {
-				return nil, err
-			}
-		} else {
-			return nil, err
-		}
+		return nil, err
 	}
-
-	return &dynamoService{db: db}, nil
+	if err := util.StartReaper("flight-service", reaperCandidates(store), store.Delete); err != nil {
+		return nil, err
+	}
+	return NewFlightServiceWithStore(store, opts...)
 }
 
-func (d *dynamoService) BookFlight(ctx context.Context, r *BookFlightRequest) (*FlightConfirmation, error) {
-	confirmation := &FlightConfirmation{Ref: nuid.Next(), Flight: r}
-	av, err := dynamodbattribute.MarshalMap(confirmation)
+// NewFlightServiceWithStore returns a FlightService which stores bookings in
+// the given Store.
+func NewFlightServiceWithStore(store Store, opts ...Option) (FlightService, error) {
+	maxValidationDelay, err := util.DurationFromEnv(maxValidationDelayEnv, defaultMaxValidationDelay)
+	if err != nil {
+		return nil, err
+	}
+	softDelete, err := util.SoftDeleteFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	holdTTL, err := util.HoldTTLFromEnv()
 	if err != nil {
 		return nil, err
 	}
 
-	input := &dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(flightsTable),
+	s := &flightService{
+		store:              store,
+		rand:               rand.New(rand.NewSource(time.Now().UnixNano())),
+		maxValidationDelay: maxValidationDelay,
+		pricing:            defaultPricing,
+		softDelete:         softDelete,
+		holdTTL:            holdTTL,
+		clock:              util.SystemClock,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
-	_, err = d.db.PutItemWithContext(ctx, input)
+	return s, nil
+}
 
-	return confirmation, err
+// WithClock sets the clock which tells the time bookings are created and
+// cancelled, which is the system clock by default.
+func WithClock(clock util.Clock) Option {
+	return func(s *flightService) {
+		s.clock = clock
+	}
 }
 
-func (d *dynamoService) GetBooking(ctx context.Context, ref string) (*FlightConfirmation, error) {
-	result, err := d.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(flightsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ref": {
-				S: aws.String(ref),
-			},
-		},
-	})
+func newStore() (Store, error) {
+	backend, err := util.StorageBackendFromEnv()
 	if err != nil {
 		return nil, err
 	}
+	if backend == util.StorageMemory {
+		return newMemoryStore(), nil
+	}
+	return newDynamoService()
+}
+
+func (s *flightService) BookFlight(ctx context.Context, r *BookFlightRequest) (*FlightConfirmation, error) {
+	confirmation := &FlightConfirmation{
+		Ref:     nuid.Next(),
+		Flight:  r,
+		Created: s.clock.Now(),
+		Version: 1,
+		Price:   s.pricing(r),
+		// Denormalized for FindByPassenger.
+		PassengerNames: passengerNames(r.Passengers),
+	}
+	if err := s.store.Put(ctx, confirmation); err != nil {
+		return confirmation, err
+	}
+	util.RecordBooking("flight-service")
+	publishBookingEvent(ctx, FlightBookedSubject, confirmation.bookedEvent(confirmation.Created))
+	return confirmation, nil
+}
 
-	var confirmation *FlightConfirmation
-	if err := dynamodbattribute.UnmarshalMap(result.Item, &confirmation); err != nil {
+func (s *flightService) GetBooking(ctx context.Context, ref string, opts GetOptions) (*FlightConfirmation, error) {
+	confirmation, err := s.store.Get(ctx, ref)
+	if err != nil {
 		return nil, err
 	}
-	if confirmation.Ref == "" {
+	if confirmation.Expired(s.clock.Now()) {
 		return nil, ErrNoSuchBooking
 	}
+	if confirmation.Cancelled() {
+		if !opts.IncludeCancelled {
+			return nil, ErrNoSuchBooking
+		}
+		// There's nothing to validate for a cancelled booking.
+		return confirmation, nil
+	}
 
 	span, ctx := opentracing.StartSpanFromContext(ctx, "validateFlightReservation")
-	span.LogFields(
+	util.LogSpanFields(span,
 		tracelog.String("ref", confirmation.Ref),
 		tracelog.String("airline", confirmation.Flight.Airline),
 		tracelog.String("flight", confirmation.Flight.FlightNumber),
 	)
-	err = d.validateFlightReservation(ctx, confirmation)
+	err = s.validateFlightReservation(ctx, confirmation)
 	span.Finish()
 
 	return confirmation, nil
 }
 
-func (d *dynamoService) validateFlightReservation(ctx context.Context, confirmation *FlightConfirmation) error {
+// FindByPassenger returns the bookings which include the given passenger,
+// other than cancelled ones and expired reservations. Depending on the Store,
+// this may not consider every booking.
+func (s *flightService) FindByPassenger(ctx context.Context, name string) ([]*FlightConfirmation, error) {
+	bookings, err := s.store.FindByPassenger(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	now := s.clock.Now()
+	confirmations := make([]*FlightConfirmation, 0, len(bookings))
+	for _, booking := range bookings {
+		if !booking.Cancelled() && !booking.Expired(now) {
+			confirmations = append(confirmations, booking)
+		}
+	}
+	return confirmations, nil
+}
+
+// CancelBooking cancels the booking with the given ref. It's deleted unless
+// SOFT_DELETE is set, in which case it's kept and marked as cancelled. It
+// returns ErrNoSuchBooking if there is no such booking. The cancellation is
+// published with just the ref, since deleted bookings can't be read back.
+//
+// Cancelling a kept booking again succeeds without publishing another event,
+// so a client can safely retry. A deleted booking can't be told apart from
+// one which never existed, so cancelling it again returns ErrNoSuchBooking;
+// see the idempotent parameter of the cancel endpoint.
+func (s *flightService) CancelBooking(ctx context.Context, ref string) error {
+	now := s.clock.Now()
+	var err error
+	if s.softDelete {
+		err = s.store.Cancel(ctx, ref, now)
+	} else {
+		err = s.store.Delete(ctx, ref)
+	}
+	if err == ErrAlreadyCancelled {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	publishBookingEvent(ctx, FlightCancelledSubject, &util.BookingEvent{Ref: ref, Timestamp: now})
+	return nil
+}
+
+// Quote returns the price of the flight without booking it.
+func (s *flightService) Quote(r *BookFlightRequest) util.Money {
+	return s.pricing(r)
+}
+
+// UpdateBooking replaces the booking details for the given ref if the stored
+// version matches. It returns ErrVersionMismatch if the booking was modified
+// since the caller read it. Bookings stored before versioning are treated as
+// version 0.
+func (s *flightService) UpdateBooking(ctx context.Context, ref string, r *BookFlightRequest, version int64) (*FlightConfirmation, error) {
+	return s.store.Update(ctx, ref, r, s.pricing(r), version)
+}
+
+func (s *flightService) validateFlightReservation(ctx context.Context, confirmation *FlightConfirmation) error {
 	// Do some work.
-	sleep := 500*time.Millisecond + time.Duration(rand.Intn(1))*time.Second
-	time.Sleep(sleep)
+	time.Sleep(s.validationDelay())
 	log.WithContext(ctx).WithFields(log.Fields{
 		"airline":    confirmation.Flight.Airline,
 		"flight":     confirmation.Flight.FlightNumber,
-		"passengers": confirmation.Flight.Passengers,
+		"passengers": passengerNames(confirmation.Flight.Passengers),
 	}).Infof("Validated flight reservation")
 	return nil
 }
+
+// validationDelay returns a random delay of at most maxValidationDelay.
+func (s *flightService) validationDelay() time.Duration {
+	if s.maxValidationDelay <= 0 {
+		return 0
+	}
+	s.randMu.Lock()
+	defer s.randMu.Unlock()
+	return time.Duration(s.rand.Int63n(int64(s.maxValidationDelay) + 1))
+}
@@ -0,0 +1,339 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+	"github.com/realkinetic/cloud-native-meetup-2019/util/servicetest"
+)
+
+var errStoreFailed = errors.New("store failed")
+
+// failingStore is a Store whose writes fail.
+type failingStore struct {
+	Store
+}
+
+func (failingStore) Put(context.Context, *FlightConfirmation) error {
+	return errStoreFailed
+}
+
+func (failingStore) Delete(context.Context, string) error {
+	return errStoreFailed
+}
+
+type publishedEvent struct {
+	subject string
+	event   *util.BookingEvent
+}
+
+// recordEvents records the booking events published until the test ends,
+// rather than publishing them.
+func recordEvents(t *testing.T) *[]publishedEvent {
+	var events []publishedEvent
+	publish := publishBookingEvent
+	publishBookingEvent = func(ctx context.Context, subject string, event *util.BookingEvent) {
+		events = append(events, publishedEvent{subject, event})
+	}
+	t.Cleanup(func() { publishBookingEvent = publish })
+	return &events
+}
+
+func newTestService(t *testing.T, store Store, opts ...Option) *flightService {
+	t.Setenv("VALIDATION_MAX_DELAY", "1ms")
+	s, err := NewFlightServiceWithStore(store, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*flightService)
+}
+
+func testFlight() *BookFlightRequest {
+	return &BookFlightRequest{
+		Airline:      "DL",
+		FlightNumber: "DL123",
+		Time:         time.Date(2019, 6, 1, 9, 0, 0, 0, time.UTC),
+		Passengers:   []Passenger{{Name: "Ada Lovelace"}},
+	}
+}
+
+func TestBookFlightPublishesEvent(t *testing.T) {
+	events := recordEvents(t)
+	s := newTestService(t, newMemoryStore())
+	confirmation, err := s.BookFlight(context.Background(), testFlight())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*events) != 1 {
+		t.Fatalf("published %d events, want 1", len(*events))
+	}
+	published := (*events)[0]
+	if published.subject != FlightBookedSubject {
+		t.Errorf("subject = %q, want %q", published.subject, FlightBookedSubject)
+	}
+	want := util.BookingEvent{
+		Ref:       confirmation.Ref,
+		Version:   1,
+		Price:     confirmation.Price,
+		Timestamp: confirmation.Created,
+	}
+	if *published.event != want {
+		t.Errorf("event = %+v, want %+v", *published.event, want)
+	}
+	payload, err := json.Marshal(published.event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(payload), "Ada") {
+		t.Errorf("event %s contains a passenger's name", payload)
+	}
+}
+
+func TestBookFlightFailureSkipsEvent(t *testing.T) {
+	events := recordEvents(t)
+	s := newTestService(t, failingStore{newMemoryStore()})
+	if _, err := s.BookFlight(context.Background(), testFlight()); err != errStoreFailed {
+		t.Fatalf("BookFlight error = %v, want %v", err, errStoreFailed)
+	}
+	if len(*events) != 0 {
+		t.Errorf("published %d events for a failed booking, want 0", len(*events))
+	}
+}
+
+func TestCancelBookingPublishesEvent(t *testing.T) {
+	events := recordEvents(t)
+	s := newTestService(t, newMemoryStore())
+	confirmation, err := s.BookFlight(context.Background(), testFlight())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CancelBooking(context.Background(), confirmation.Ref); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 2 || (*events)[1].subject != FlightCancelledSubject || (*events)[1].event.Ref != confirmation.Ref {
+		t.Fatalf("events = %+v, want a cancellation of %s", *events, confirmation.Ref)
+	}
+
+	if err := s.CancelBooking(context.Background(), "missing"); err != ErrNoSuchBooking {
+		t.Errorf("cancelling a missing booking: error = %v, want %v", err, ErrNoSuchBooking)
+	}
+	s = newTestService(t, failingStore{newMemoryStore()})
+	if err := s.CancelBooking(context.Background(), confirmation.Ref); err != errStoreFailed {
+		t.Errorf("failed cancel: error = %v, want %v", err, errStoreFailed)
+	}
+	if len(*events) != 2 {
+		t.Errorf("published %d events for failed cancellations, want none", len(*events)-2)
+	}
+}
+
+// TestCancelBookingTwice checks cancelling a soft deleted booking again
+// succeeds without publishing another event, while cancelling a hard deleted
+// one can't be told apart from cancelling a booking which never existed.
+func TestCancelBookingTwice(t *testing.T) {
+	for _, softDelete := range []bool{false, true} {
+		events := recordEvents(t)
+		t.Setenv("SOFT_DELETE", strconv.FormatBool(softDelete))
+		s := newTestService(t, newMemoryStore())
+		confirmation, err := s.BookFlight(context.Background(), testFlight())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CancelBooking(context.Background(), confirmation.Ref); err != nil {
+			t.Fatal(err)
+		}
+
+		var want error
+		if !softDelete {
+			want = ErrNoSuchBooking
+		}
+		if err := s.CancelBooking(context.Background(), confirmation.Ref); err != want {
+			t.Errorf("soft delete %v: second cancel error = %v, want %v", softDelete, err, want)
+		}
+		if len(*events) != 2 {
+			t.Errorf("soft delete %v: published %d events, want a booking and one cancellation", softDelete, len(*events))
+		}
+	}
+}
+
+func TestConfirmReservationPublishesEvent(t *testing.T) {
+	events := recordEvents(t)
+	s := newTestService(t, newMemoryStore())
+	reservation, err := s.ReserveFlight(context.Background(), testFlight())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 0 {
+		t.Fatalf("published %d events for a reservation, want 0", len(*events))
+	}
+	if _, err := s.ConfirmReservation(context.Background(), reservation.Ref); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 1 || (*events)[0].subject != FlightBookedSubject || (*events)[0].event.Ref != reservation.Ref {
+		t.Errorf("events = %+v, want a booking of %s", *events, reservation.Ref)
+	}
+
+	// Confirming again doesn't publish another event.
+	if _, err := s.ConfirmReservation(context.Background(), reservation.Ref); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 1 {
+		t.Errorf("published %d events after confirming twice, want 1", len(*events))
+	}
+}
+
+// TestReaperCandidatesPagesThroughStore checks paging through the reaper's
+// candidates lists every booking other than cancelled ones exactly once.
+func TestReaperCandidatesPagesThroughStore(t *testing.T) {
+	recordEvents(t)
+	t.Setenv("SOFT_DELETE", "true")
+	store := newMemoryStore()
+	s := newTestService(t, store)
+	want := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		confirmation, err := s.BookFlight(context.Background(), testFlight())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[confirmation.Ref] = true
+	}
+	reservation, err := s.ReserveFlight(context.Background(), testFlight())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want[reservation.Ref] = true
+	cancelled, err := s.BookFlight(context.Background(), testFlight())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CancelBooking(context.Background(), cancelled.Ref); err != nil {
+		t.Fatal(err)
+	}
+
+	list := reaperCandidates(store)
+	listed := map[string]bool{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("paging didn't reach the last page")
+		}
+		candidates, next, err := list(context.Background(), 2, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, candidate := range candidates {
+			if listed[candidate.Ref] {
+				t.Errorf("%s listed twice", candidate.Ref)
+			}
+			listed[candidate.Ref] = true
+			if held := candidate.HoldExpires != nil; held != (candidate.Ref == reservation.Ref) {
+				t.Errorf("%s: has hold expiry = %v, want %v", candidate.Ref, held, !held)
+			}
+		}
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(listed, want) {
+		t.Errorf("listed %v, want %v", listed, want)
+	}
+}
+
+// TestWithClock checks bookings are timed by the service's clock, so a fake
+// clock pins when they're created and cancelled, and when holds expire.
+func TestWithClock(t *testing.T) {
+	recordEvents(t)
+	t.Setenv("SOFT_DELETE", "true")
+	t.Setenv("HOLD_TTL", "10m")
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := util.NewFakeClock(now)
+	s := newTestService(t, newMemoryStore(), WithClock(clock))
+	ctx := context.Background()
+
+	booked, err := s.BookFlight(ctx, testFlight())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !booked.Created.Equal(now) {
+		t.Errorf("created %v, want %v", booked.Created, now)
+	}
+	reservation, err := s.ReserveFlight(ctx, testFlight())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(10 * time.Minute); reservation.HoldExpires == nil || !reservation.HoldExpires.Equal(want) {
+		t.Errorf("hold expires %v, want %v", reservation.HoldExpires, want)
+	}
+
+	clock.Advance(10*time.Minute - time.Second)
+	if _, err := s.GetBooking(ctx, reservation.Ref, GetOptions{}); err != nil {
+		t.Errorf("getting a reservation before its hold expires: %v", err)
+	}
+	clock.Advance(time.Second)
+	if _, err := s.GetBooking(ctx, reservation.Ref, GetOptions{}); err != ErrNoSuchBooking {
+		t.Errorf("getting a reservation once its hold expires: error = %v, want %v", err, ErrNoSuchBooking)
+	}
+
+	if err := s.CancelBooking(ctx, booked.Ref); err != nil {
+		t.Fatal(err)
+	}
+	cancelled, err := s.GetBooking(ctx, booked.Ref, GetOptions{IncludeCancelled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(10 * time.Minute); cancelled.CancelledAt == nil || !cancelled.CancelledAt.Equal(want) {
+		t.Errorf("cancelled at %v, want %v", cancelled.CancelledAt, want)
+	}
+}
+
+// TestDynamoGetMissing checks getting a booking DynamoDB has no item for
+// reports there's no such booking rather than returning an empty one.
+func TestDynamoGetMissing(t *testing.T) {
+	servicetest.NewDynamoDB(t)
+	store, err := newDynamoService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmation, err := store.Get(context.Background(), "missing"); err != ErrNoSuchBooking {
+		t.Errorf("Get() = %v, %v, want %v", confirmation, err, ErrNoSuchBooking)
+	}
+}
+
+// TestDynamoDuplicatePassengerNames checks a booking can be stored, updated
+// and found when two passengers share a name, which DynamoDB's string set of
+// passenger names can't hold twice.
+func TestDynamoDuplicatePassengerNames(t *testing.T) {
+	servicetest.NewDynamoDB(t)
+	store, err := newDynamoService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService(t, store)
+	ctx := context.Background()
+
+	r := testFlight()
+	r.Passengers = []Passenger{{Name: "John Smith"}, {Name: "John Smith"}}
+	confirmation, err := s.BookFlight(ctx, r)
+	if err != nil {
+		t.Fatalf("BookFlight() error = %v", err)
+	}
+	r.Passengers = append(r.Passengers, Passenger{Name: "Ada Lovelace"}, Passenger{Name: "Ada Lovelace"})
+	if _, err := s.UpdateBooking(ctx, confirmation.Ref, r, confirmation.Version); err != nil {
+		t.Fatalf("UpdateBooking() error = %v", err)
+	}
+
+	found, err := s.FindByPassenger(ctx, "John Smith")
+	if err != nil {
+		t.Fatalf("FindByPassenger() error = %v", err)
+	}
+	if len(found) != 1 || found[0].Ref != confirmation.Ref || len(found[0].Flight.Passengers) != 4 {
+		t.Errorf("FindByPassenger() = %v, want the booking with all 4 passengers", found)
+	}
+}
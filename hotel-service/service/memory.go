@@ -0,0 +1,139 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+// memoryStore is a Store which keeps bookings in memory, for running without
+// AWS. Bookings are lost when the service exits.
+type memoryStore struct {
+	mu       sync.RWMutex
+	bookings map[string]*HotelConfirmation
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{bookings: make(map[string]*HotelConfirmation)}
+}
+
+func (m *memoryStore) Put(ctx context.Context, confirmation *HotelConfirmation) error {
+	stored := *confirmation
+	m.mu.Lock()
+	m.bookings[confirmation.Ref] = &stored
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memoryStore) Get(ctx context.Context, ref string) (*HotelConfirmation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	stored, ok := m.bookings[ref]
+	if !ok {
+		return nil, ErrNoSuchBooking
+	}
+	confirmation := *stored
+	return &confirmation, nil
+}
+
+func (m *memoryStore) Update(ctx context.Context, ref string, r *BookHotelRequest, price util.Money, version int64) (*HotelConfirmation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.bookings[ref]
+	if !ok {
+		return nil, ErrNoSuchBooking
+	}
+	if stored.Cancelled() {
+		return nil, ErrNoSuchBooking
+	}
+	if stored.Version != version {
+		return nil, ErrVersionMismatch
+	}
+	updated := *stored
+	updated.Hotel = r
+	updated.Price = price
+	updated.Version = version + 1
+	m.bookings[ref] = &updated
+
+	confirmation := updated
+	return &confirmation, nil
+}
+
+func (m *memoryStore) Delete(ctx context.Context, ref string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.bookings[ref]; !ok {
+		return ErrNoSuchBooking
+	}
+	delete(m.bookings, ref)
+	return nil
+}
+
+func (m *memoryStore) Cancel(ctx context.Context, ref string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.bookings[ref]
+	if !ok {
+		return ErrNoSuchBooking
+	}
+	if stored.Cancelled() {
+		return ErrAlreadyCancelled
+	}
+	cancelled := *stored
+	cancelled.Status = util.BookingCancelled
+	cancelled.CancelledAt = &at
+	cancelled.Version++
+	m.bookings[ref] = &cancelled
+	return nil
+}
+
+func (m *memoryStore) Confirm(ctx context.Context, ref string, now time.Time) (*HotelConfirmation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.bookings[ref]
+	if !ok || stored.Cancelled() {
+		return nil, ErrNoSuchBooking
+	}
+	if !stored.Held() {
+		return nil, ErrNotHeld
+	}
+	if stored.Expired(now) {
+		return nil, ErrHoldExpired
+	}
+	confirmed := *stored
+	confirmed.Status = ""
+	confirmed.HoldExpires = nil
+	confirmed.Version++
+	m.bookings[ref] = &confirmed
+
+	confirmation := confirmed
+	return &confirmation, nil
+}
+
+// List pages through the bookings in order of ref. The cursor is the ref of
+// the last booking of the previous page.
+func (m *memoryStore) List(ctx context.Context, limit int, cursor string) ([]*HotelConfirmation, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	refs := make([]string, 0, len(m.bookings))
+	for ref := range m.bookings {
+		if ref > cursor {
+			refs = append(refs, ref)
+		}
+	}
+	sort.Strings(refs)
+	next := ""
+	if len(refs) > limit {
+		refs = refs[:limit]
+		next = refs[limit-1]
+	}
+	confirmations := make([]*HotelConfirmation, 0, len(refs))
+	for _, ref := range refs {
+		confirmation := *m.bookings[ref]
+		confirmations = append(confirmations, &confirmation)
+	}
+	return confirmations, next, nil
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"time"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+// nightlyRate is the price of a room for one night.
+const nightlyRate util.Money = 12500
+
+// Pricing prices a hotel booking.
+type Pricing func(*BookHotelRequest) util.Money
+
+// Option configures the hotel service.
+type Option func(*hotelService)
+
+// WithPricing sets the pricing of hotel bookings, which is a nightly rate by
+// default.
+func WithPricing(pricing Pricing) Option {
+	return func(s *hotelService) {
+		s.pricing = pricing
+	}
+}
+
+// defaultPricing charges the nightly rate for each night of the stay, with
+// any part of a night charged as a whole one.
+func defaultPricing(r *BookHotelRequest) util.Money {
+	stay := r.CheckOut.Sub(r.CheckIn)
+	nights := int64(stay / (24 * time.Hour))
+	if stay%(24*time.Hour) > 0 {
+		nights++
+	}
+	if nights < 1 {
+		nights = 1
+	}
+	return nightlyRate * util.Money(nights)
+}
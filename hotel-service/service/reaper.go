@@ -0,0 +1,31 @@
+package service
+
+import (
+	"context"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+// reaperCandidates pages through the bookings in the store, other than
+// cancelled ones, for the orphaned booking reaper.
+func reaperCandidates(store Store) util.ReaperLister {
+	return func(ctx context.Context, limit int, cursor string) ([]util.ReaperCandidate, string, error) {
+		bookings, next, err := store.List(ctx, limit, cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		candidates := make([]util.ReaperCandidate, 0, len(bookings))
+		for _, booking := range bookings {
+			// Cancelled bookings are kept deliberately.
+			if booking.Cancelled() {
+				continue
+			}
+			candidate := util.ReaperCandidate{Ref: booking.Ref, Created: booking.Created}
+			if booking.Held() {
+				candidate.HoldExpires = booking.HoldExpires
+			}
+			candidates = append(candidates, candidate)
+		}
+		return candidates, next, nil
+	}
+}
@@ -4,31 +4,51 @@ import (
 	"context"
 	"errors"
 	"math/rand"
+	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/nats-io/nuid"
-	"github.com/opentracing-contrib/go-aws-sdk"
 	"github.com/opentracing/opentracing-go"
 	tracelog "github.com/opentracing/opentracing-go/log"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+const (
+	maxValidationDelayEnv     = "VALIDATION_MAX_DELAY"
+	defaultMaxValidationDelay = 4 * time.Second
+	validationTimeoutEnv      = "HOTEL_VALIDATION_TIMEOUT"
+	defaultValidationTimeout  = 2 * time.Second
+)
+
+const (
+	// HotelBookedSubject and HotelCancelledSubject are the NATS subjects
+	// hotel bookings are published to, as util.BookingEvents, once booked and
+	// cancelled.
+	HotelBookedSubject    = "hotel.booked"
+	HotelCancelledSubject = "hotel.cancelled"
 )
 
+// publishBookingEvent publishes the service's booking events. It's a variable
+// so tests can observe what's published without a NATS server.
+var publishBookingEvent = util.PublishBookingEvent
+
 var (
-	ErrNoSuchBooking = errors.New("no such booking")
-	hotelsTable      = "hotels"
+	ErrNoSuchBooking   = errors.New("no such booking")
+	ErrVersionMismatch = errors.New("booking version mismatch")
+	// ErrAlreadyCancelled is returned by Store.Cancel for a booking which
+	// was already cancelled.
+	ErrAlreadyCancelled = errors.New("booking already cancelled")
+	hotelsTable         = util.TableName("hotels")
 )
 
 type BookHotelRequest struct {
-	Hotel    string    `json:"hotel"`
-	CheckIn  time.Time `json:"check_in"`
-	CheckOut time.Time `json:"check_out"`
-	Name     string    `json:"name"`
-	Guests   int       `json:"guests"`
+	Hotel    string    `json:"hotel" xml:"hotel" schema:"required"`
+	CheckIn  time.Time `json:"check_in" xml:"check_in" schema:"required"`
+	CheckOut time.Time `json:"check_out" xml:"check_out" schema:"required"`
+	Name     string    `json:"name" xml:"name" schema:"required"`
+	Guests   int       `json:"guests" xml:"guests" schema:"required"`
 }
 
 func (b *BookHotelRequest) Validate() error {
@@ -51,114 +71,305 @@ func (b *BookHotelRequest) Validate() error {
 }
 
 type HotelConfirmation struct {
-	Ref   string            `json:"ref"`
-	Hotel *BookHotelRequest `json:"hotel"`
+	Ref   string            `json:"ref" xml:"ref"`
+	Hotel *BookHotelRequest `json:"hotel" xml:"hotel"`
+	// Created is zero for bookings stored before it was recorded.
+	Created time.Time `json:"created" xml:"created"`
+	Version int64     `json:"version" xml:"version"`
+	// Price is the price of the booking when it was made or last updated.
+	Price util.Money `json:"price" xml:"price"`
+	// Status is util.BookingCancelled once the booking is cancelled, if
+	// SOFT_DELETE is set. Otherwise cancelled bookings are deleted.
+	Status      string     `json:"status,omitempty" xml:"status,omitempty"`
+	CancelledAt *time.Time `json:"cancelled_at,omitempty" xml:"cancelled_at,omitempty"`
+	// HoldExpires is when a reservation's hold expires, unless it's
+	// confirmed first. It's only set while Status is util.BookingHeld, and
+	// is stored in Unix seconds so it can be compared in conditions.
+	HoldExpires *time.Time `json:"hold_expires,omitempty" xml:"hold_expires,omitempty" dynamodbav:"hold_expires,unixtime,omitempty"`
+	// Validated is set when the reservation was validated with the hotel as
+	// it was fetched. It isn't stored.
+	Validated bool `json:"validated,omitempty" xml:"validated,omitempty" dynamodbav:"-"`
+}
+
+// Cancelled returns whether the booking was cancelled and kept.
+func (c *HotelConfirmation) Cancelled() bool {
+	return c.Status == util.BookingCancelled
+}
+
+// bookedEvent is the event published when the booking is booked at the given
+// time.
+func (c *HotelConfirmation) bookedEvent(at time.Time) *util.BookingEvent {
+	return &util.BookingEvent{Ref: c.Ref, Version: c.Version, Price: c.Price, Timestamp: at}
+}
+
+// GetOptions control how a booking is read.
+type GetOptions struct {
+	// IncludeCancelled returns cancelled bookings, which are only kept if
+	// SOFT_DELETE is set, rather than ErrNoSuchBooking.
+	IncludeCancelled bool
 }
 
 type HotelService interface {
 	BookHotel(context.Context, *BookHotelRequest) (*HotelConfirmation, error)
-	GetBooking(ctx context.Context, ref string) (*HotelConfirmation, error)
-}
-
-type dynamoService struct {
-	db *dynamodb.DynamoDB
-}
-
-func NewHotelService() (HotelService, error) {
-	rand.Seed(time.Now().Unix())
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-		Config:            aws.Config{Region: aws.String("us-east-1")},
-	}))
-	db := dynamodb.New(sess)
-	otaws.AddOTHandlers(db.Client)
-
-	input := &dynamodb.CreateTableInput{
-		AttributeDefinitions: []*dynamodb.AttributeDefinition{
-			{
-				AttributeName: aws.String("ref"),
-				AttributeType: aws.String("S"),
-			},
-		},
-		KeySchema: []*dynamodb.KeySchemaElement{
-			{
-				AttributeName: aws.String("ref"),
-				KeyType:       aws.String("HASH"),
-			},
-		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(2),
-			WriteCapacityUnits: aws.Int64(2),
-		},
-		TableName: aws.String(hotelsTable),
-	}
-	_, err := db.CreateTable(input)
+	GetBooking(ctx context.Context, ref string, opts GetOptions) (*HotelConfirmation, error)
+	CancelBooking(ctx context.Context, ref string) error
+	UpdateBooking(ctx context.Context, ref string, r *BookHotelRequest, version int64) (*HotelConfirmation, error)
+	Quote(r *BookHotelRequest) util.Money
+	ReserveHotel(context.Context, *BookHotelRequest) (*HotelConfirmation, error)
+	ConfirmReservation(ctx context.Context, ref string) (*HotelConfirmation, error)
+}
+
+// Store persists hotel bookings keyed by ref.
+type Store interface {
+	// Put stores a new booking.
+	Put(ctx context.Context, confirmation *HotelConfirmation) error
+
+	// Get returns the booking with the given ref, even if it's cancelled. It
+	// returns ErrNoSuchBooking if there is no such booking.
+	Get(ctx context.Context, ref string) (*HotelConfirmation, error)
+
+	// Update replaces the booking details for the given ref if the stored
+	// version matches, and returns the updated booking. It returns
+	// ErrNoSuchBooking or ErrVersionMismatch if the update can't be applied.
+	// Cancelled bookings can't be updated.
+	Update(ctx context.Context, ref string, r *BookHotelRequest, price util.Money, version int64) (*HotelConfirmation, error)
+
+	// Delete removes the booking with the given ref. It returns
+	// ErrNoSuchBooking if there is no such booking.
+	Delete(ctx context.Context, ref string) error
+
+	// Cancel marks the booking with the given ref as cancelled at the given
+	// time rather than removing it, bumping its version. It returns
+	// ErrNoSuchBooking if there is no such booking and ErrAlreadyCancelled if
+	// it's already cancelled.
+	Cancel(ctx context.Context, ref string, at time.Time) error
+
+	// Confirm books the held reservation with the given ref, if its hold
+	// hasn't expired at the given time, bumping its version, and returns the
+	// booking. It returns ErrNoSuchBooking if there is no such booking or
+	// it's cancelled, ErrNotHeld if it's already booked, and ErrHoldExpired
+	// if the hold expired.
+	Confirm(ctx context.Context, ref string, now time.Time) (*HotelConfirmation, error)
+
+	// List returns a page of at most limit bookings, starting from the
+	// cursor returned with the previous page, or the first page if it's
+	// empty, and the cursor of the next page, which is empty on the last
+	// page. Bookings are in no particular order, but every booking is listed
+	// by paging through to the last page. It returns util.ErrInvalidCursor
+	// if the cursor wasn't returned by List.
+	List(ctx context.Context, limit int, cursor string) ([]*HotelConfirmation, string, error)
+}
+
+type hotelService struct {
+	store Store
+
+	// rand drives the simulated validation delay. It isn't safe for
+	// concurrent use, so access is guarded by randMu.
+	randMu sync.Mutex
+	rand   *rand.Rand
+
+	// maxValidationDelay caps the simulated validation delay.
+	maxValidationDelay time.Duration
+
+	// validationTimeout bounds how long GetBooking waits for validation
+	// before returning the booking unvalidated. Zero means no timeout.
+	validationTimeout time.Duration
+
+	// pricing prices bookings.
+	pricing Pricing
+
+	// softDelete keeps cancelled bookings, marked as cancelled, for
+	// auditing.
+	softDelete bool
+
+	// holdTTL is how long reservations hold inventory.
+	holdTTL time.Duration
+
+	// clock tells the time bookings are created and cancelled.
+	clock util.Clock
+}
+
+// NewHotelService returns a HotelService which stores bookings in the
+// backend selected by STORAGE_BACKEND. Possibly orphaned bookings are
+// reported in the background if REAPER_ENABLED is set; see util.StartReaper.
+func NewHotelService(opts ...Option) (HotelService, error) {
+	store, err := newStore()
 	if err != nil {
-		if awsError, ok := err.(awserr.Error); ok {
-			if awsError.Code() != dynamodb.ErrCodeResourceInUseException {
-				return nil, err
-			}
-		} else {
-			return nil, err
-		}
+		return nil, err
 	}
-
-	return &dynamoService{db: db}, nil
+	if err := util.StartReaper("hotel-service", reaperCandidates(store), store.Delete); err != nil {
+		return nil, err
+	}
+	return NewHotelServiceWithStore(store, opts...)
 }
 
-func (d *dynamoService) BookHotel(ctx context.Context, r *BookHotelRequest) (*HotelConfirmation, error) {
-	confirmation := &HotelConfirmation{Ref: nuid.Next(), Hotel: r}
-	av, err := dynamodbattribute.MarshalMap(confirmation)
+// NewHotelServiceWithStore returns a HotelService which stores bookings in
+// the given Store.
+func NewHotelServiceWithStore(store Store, opts ...Option) (HotelService, error) {
+	maxValidationDelay, err := util.DurationFromEnv(maxValidationDelayEnv, defaultMaxValidationDelay)
+	if err != nil {
+		return nil, err
+	}
+	validationTimeout, err := util.DurationFromEnv(validationTimeoutEnv, defaultValidationTimeout)
+	if err != nil {
+		return nil, err
+	}
+	softDelete, err := util.SoftDeleteFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	holdTTL, err := util.HoldTTLFromEnv()
 	if err != nil {
 		return nil, err
 	}
 
-	input := &dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(hotelsTable),
+	s := &hotelService{
+		store:              store,
+		rand:               rand.New(rand.NewSource(time.Now().UnixNano())),
+		maxValidationDelay: maxValidationDelay,
+		validationTimeout:  validationTimeout,
+		pricing:            defaultPricing,
+		softDelete:         softDelete,
+		holdTTL:            holdTTL,
+		clock:              util.SystemClock,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
-	_, err = d.db.PutItemWithContext(ctx, input)
+	return s, nil
+}
 
-	return confirmation, err
+// WithClock sets the clock which tells the time bookings are created and
+// cancelled, which is the system clock by default.
+func WithClock(clock util.Clock) Option {
+	return func(s *hotelService) {
+		s.clock = clock
+	}
 }
 
-func (d *dynamoService) GetBooking(ctx context.Context, ref string) (*HotelConfirmation, error) {
-	result, err := d.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(hotelsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ref": {
-				S: aws.String(ref),
-			},
-		},
-	})
+func newStore() (Store, error) {
+	backend, err := util.StorageBackendFromEnv()
 	if err != nil {
 		return nil, err
 	}
+	if backend == util.StorageMemory {
+		return newMemoryStore(), nil
+	}
+	return newDynamoService()
+}
+
+func (s *hotelService) BookHotel(ctx context.Context, r *BookHotelRequest) (*HotelConfirmation, error) {
+	confirmation := &HotelConfirmation{
+		Ref:     nuid.Next(),
+		Hotel:   r,
+		Created: s.clock.Now(),
+		Version: 1,
+		Price:   s.pricing(r),
+	}
+	if err := s.store.Put(ctx, confirmation); err != nil {
+		return confirmation, err
+	}
+	util.RecordBooking("hotel-service")
+	publishBookingEvent(ctx, HotelBookedSubject, confirmation.bookedEvent(confirmation.Created))
+	return confirmation, nil
+}
 
-	var confirmation *HotelConfirmation
-	if err := dynamodbattribute.UnmarshalMap(result.Item, &confirmation); err != nil {
+// GetBooking returns the booking with the given ref, validating the
+// reservation with the hotel. Validation is bounded by
+// HOTEL_VALIDATION_TIMEOUT; if it times out, the booking is returned without
+// being marked as validated rather than failing the read.
+func (s *hotelService) GetBooking(ctx context.Context, ref string, opts GetOptions) (*HotelConfirmation, error) {
+	confirmation, err := s.store.Get(ctx, ref)
+	if err != nil {
 		return nil, err
 	}
-	if confirmation.Ref == "" {
+	if confirmation.Expired(s.clock.Now()) {
 		return nil, ErrNoSuchBooking
 	}
+	if confirmation.Cancelled() {
+		if !opts.IncludeCancelled {
+			return nil, ErrNoSuchBooking
+		}
+		// There's nothing to validate for a cancelled booking.
+		return confirmation, nil
+	}
+
+	span, validateCtx := opentracing.StartSpanFromContext(ctx, "validateHotelReservation")
+	defer span.Finish()
+	if util.TracingEnabled() {
+		util.LogSpanFields(span,
+			tracelog.String("ref", confirmation.Ref),
+			tracelog.String("hotel", confirmation.Hotel.Hotel),
+			tracelog.String("name", confirmation.Hotel.Name),
+		)
+	}
+	if s.validationTimeout > 0 {
+		var cancel context.CancelFunc
+		validateCtx, cancel = context.WithTimeout(validateCtx, s.validationTimeout)
+		defer cancel()
+	}
+	err = s.validateHotelReservation(validateCtx, confirmation)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		span.SetTag("validation.timeout", true)
+		log.WithContext(ctx).WithFields(log.Fields{
+			"timeout": s.validationTimeout,
+		}).Warn("Hotel reservation validation timed out, returning unvalidated booking")
+		return confirmation, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	confirmation.Validated = true
+	return confirmation, nil
+}
 
-	span, ctx := opentracing.StartSpanFromContext(ctx, "validateHotelReservation")
-	span.LogFields(
-		tracelog.String("ref", confirmation.Ref),
-		tracelog.String("hotel", confirmation.Hotel.Hotel),
-		tracelog.String("name", confirmation.Hotel.Name),
-	)
-	err = d.validateHotelReservation(ctx, confirmation)
-	span.Finish()
+// CancelBooking cancels the booking with the given ref. It's deleted unless
+// SOFT_DELETE is set, in which case it's kept and marked as cancelled. It
+// returns ErrNoSuchBooking if there is no such booking. The cancellation is
+// published with just the ref, since deleted bookings can't be read back.
+//
+// Cancelling a kept booking again succeeds without publishing another event,
+// so a client can safely retry. A deleted booking can't be told apart from
+// one which never existed, so cancelling it again returns ErrNoSuchBooking;
+// see the idempotent parameter of the cancel endpoint.
+func (s *hotelService) CancelBooking(ctx context.Context, ref string) error {
+	now := s.clock.Now()
+	var err error
+	if s.softDelete {
+		err = s.store.Cancel(ctx, ref, now)
+	} else {
+		err = s.store.Delete(ctx, ref)
+	}
+	if err == ErrAlreadyCancelled {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	publishBookingEvent(ctx, HotelCancelledSubject, &util.BookingEvent{Ref: ref, Timestamp: now})
+	return nil
+}
+
+// Quote returns the price of the hotel without booking it.
+func (s *hotelService) Quote(r *BookHotelRequest) util.Money {
+	return s.pricing(r)
+}
 
-	return confirmation, err
+// UpdateBooking replaces the booking details for the given ref if the stored
+// version matches. It returns ErrVersionMismatch if the booking was modified
+// since the caller read it. Bookings stored before versioning are treated as
+// version 0.
+func (s *hotelService) UpdateBooking(ctx context.Context, ref string, r *BookHotelRequest, version int64) (*HotelConfirmation, error) {
+	return s.store.Update(ctx, ref, r, s.pricing(r), version)
 }
 
-func (d *dynamoService) validateHotelReservation(ctx context.Context, confirmation *HotelConfirmation) error {
+func (s *hotelService) validateHotelReservation(ctx context.Context, confirmation *HotelConfirmation) error {
 	// Do some work.
-	n := rand.Intn(4) + 1
-	time.Sleep(time.Duration(n) * time.Second)
+	select {
+	case <-time.After(s.validationDelay()):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	log.WithContext(ctx).WithFields(log.Fields{
 		"hotel":     confirmation.Hotel.Hotel,
 		"check_in":  confirmation.Hotel.CheckIn,
@@ -168,3 +379,13 @@ func (d *dynamoService) validateHotelReservation(ctx context.Context, confirmati
 	}).Infof("Validated hotel reservation")
 	return nil
 }
+
+// validationDelay returns a random delay of at most maxValidationDelay.
+func (s *hotelService) validationDelay() time.Duration {
+	if s.maxValidationDelay <= 0 {
+		return 0
+	}
+	s.randMu.Lock()
+	defer s.randMu.Unlock()
+	return time.Duration(s.rand.Int63n(int64(s.maxValidationDelay) + 1))
+}
@@ -0,0 +1,277 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+	"github.com/realkinetic/cloud-native-meetup-2019/util/servicetest"
+)
+
+var errStoreFailed = errors.New("store failed")
+
+// failingStore is a Store whose writes fail.
+type failingStore struct {
+	Store
+}
+
+func (failingStore) Put(context.Context, *HotelConfirmation) error {
+	return errStoreFailed
+}
+
+func (failingStore) Delete(context.Context, string) error {
+	return errStoreFailed
+}
+
+type publishedEvent struct {
+	subject string
+	event   *util.BookingEvent
+}
+
+// recordEvents records the booking events published until the test ends,
+// rather than publishing them.
+func recordEvents(t *testing.T) *[]publishedEvent {
+	var events []publishedEvent
+	publish := publishBookingEvent
+	publishBookingEvent = func(ctx context.Context, subject string, event *util.BookingEvent) {
+		events = append(events, publishedEvent{subject, event})
+	}
+	t.Cleanup(func() { publishBookingEvent = publish })
+	return &events
+}
+
+func newTestService(t *testing.T, store Store, opts ...Option) *hotelService {
+	t.Setenv("VALIDATION_MAX_DELAY", "1ms")
+	s, err := NewHotelServiceWithStore(store, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.(*hotelService)
+}
+
+func testHotel() *BookHotelRequest {
+	return &BookHotelRequest{
+		Hotel:    "Savoy",
+		CheckIn:  time.Date(2019, 6, 1, 15, 0, 0, 0, time.UTC),
+		CheckOut: time.Date(2019, 6, 3, 11, 0, 0, 0, time.UTC),
+		Name:     "Ada Lovelace",
+		Guests:   1,
+	}
+}
+
+func TestBookHotelPublishesEvent(t *testing.T) {
+	events := recordEvents(t)
+	s := newTestService(t, newMemoryStore())
+	confirmation, err := s.BookHotel(context.Background(), testHotel())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*events) != 1 {
+		t.Fatalf("published %d events, want 1", len(*events))
+	}
+	published := (*events)[0]
+	if published.subject != HotelBookedSubject {
+		t.Errorf("subject = %q, want %q", published.subject, HotelBookedSubject)
+	}
+	want := util.BookingEvent{
+		Ref:       confirmation.Ref,
+		Version:   1,
+		Price:     confirmation.Price,
+		Timestamp: confirmation.Created,
+	}
+	if *published.event != want {
+		t.Errorf("event = %+v, want %+v", *published.event, want)
+	}
+	payload, err := json.Marshal(published.event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(payload), "Ada") {
+		t.Errorf("event %s contains a guest's name", payload)
+	}
+}
+
+func TestBookHotelFailureSkipsEvent(t *testing.T) {
+	events := recordEvents(t)
+	s := newTestService(t, failingStore{newMemoryStore()})
+	if _, err := s.BookHotel(context.Background(), testHotel()); err != errStoreFailed {
+		t.Fatalf("BookHotel error = %v, want %v", err, errStoreFailed)
+	}
+	if len(*events) != 0 {
+		t.Errorf("published %d events for a failed booking, want 0", len(*events))
+	}
+}
+
+func TestCancelBookingPublishesEvent(t *testing.T) {
+	events := recordEvents(t)
+	s := newTestService(t, newMemoryStore())
+	confirmation, err := s.BookHotel(context.Background(), testHotel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CancelBooking(context.Background(), confirmation.Ref); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 2 || (*events)[1].subject != HotelCancelledSubject || (*events)[1].event.Ref != confirmation.Ref {
+		t.Fatalf("events = %+v, want a cancellation of %s", *events, confirmation.Ref)
+	}
+
+	if err := s.CancelBooking(context.Background(), "missing"); err != ErrNoSuchBooking {
+		t.Errorf("cancelling a missing booking: error = %v, want %v", err, ErrNoSuchBooking)
+	}
+	s = newTestService(t, failingStore{newMemoryStore()})
+	if err := s.CancelBooking(context.Background(), confirmation.Ref); err != errStoreFailed {
+		t.Errorf("failed cancel: error = %v, want %v", err, errStoreFailed)
+	}
+	if len(*events) != 2 {
+		t.Errorf("published %d events for failed cancellations, want none", len(*events)-2)
+	}
+}
+
+// TestCancelBookingTwice checks cancelling a soft deleted booking again
+// succeeds without publishing another event, while cancelling a hard deleted
+// one can't be told apart from cancelling a booking which never existed.
+func TestCancelBookingTwice(t *testing.T) {
+	for _, softDelete := range []bool{false, true} {
+		events := recordEvents(t)
+		t.Setenv("SOFT_DELETE", strconv.FormatBool(softDelete))
+		s := newTestService(t, newMemoryStore())
+		confirmation, err := s.BookHotel(context.Background(), testHotel())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CancelBooking(context.Background(), confirmation.Ref); err != nil {
+			t.Fatal(err)
+		}
+
+		var want error
+		if !softDelete {
+			want = ErrNoSuchBooking
+		}
+		if err := s.CancelBooking(context.Background(), confirmation.Ref); err != want {
+			t.Errorf("soft delete %v: second cancel error = %v, want %v", softDelete, err, want)
+		}
+		if len(*events) != 2 {
+			t.Errorf("soft delete %v: published %d events, want a booking and one cancellation", softDelete, len(*events))
+		}
+	}
+}
+
+func TestConfirmReservationPublishesEvent(t *testing.T) {
+	events := recordEvents(t)
+	s := newTestService(t, newMemoryStore())
+	reservation, err := s.ReserveHotel(context.Background(), testHotel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 0 {
+		t.Fatalf("published %d events for a reservation, want 0", len(*events))
+	}
+	if _, err := s.ConfirmReservation(context.Background(), reservation.Ref); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 1 || (*events)[0].subject != HotelBookedSubject || (*events)[0].event.Ref != reservation.Ref {
+		t.Errorf("events = %+v, want a booking of %s", *events, reservation.Ref)
+	}
+
+	// Confirming again doesn't publish another event.
+	if _, err := s.ConfirmReservation(context.Background(), reservation.Ref); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 1 {
+		t.Errorf("published %d events after confirming twice, want 1", len(*events))
+	}
+}
+
+// newTestStore returns a store using the backend. The DynamoDB backend is a
+// stand-in.
+func newTestStore(t *testing.T, backend string) Store {
+	if backend == util.StorageMemory {
+		return newMemoryStore()
+	}
+	servicetest.NewDynamoDB(t)
+	store, err := newDynamoService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// TestReaperCandidatesPagesThroughStore checks each storage backend's List
+// cursor pages through every booking exactly once.
+func TestReaperCandidatesPagesThroughStore(t *testing.T) {
+	for _, backend := range []string{util.StorageMemory, util.StorageDynamoDB} {
+		recordEvents(t)
+		t.Setenv("SOFT_DELETE", "true")
+		store := newTestStore(t, backend)
+		s := newTestService(t, store)
+		want := map[string]bool{}
+		for i := 0; i < 5; i++ {
+			confirmation, err := s.BookHotel(context.Background(), testHotel())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want[confirmation.Ref] = true
+		}
+		reservation, err := s.ReserveHotel(context.Background(), testHotel())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[reservation.Ref] = true
+		cancelled, err := s.BookHotel(context.Background(), testHotel())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CancelBooking(context.Background(), cancelled.Ref); err != nil {
+			t.Fatal(err)
+		}
+
+		list := reaperCandidates(store)
+		listed := map[string]bool{}
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatalf("%s: paging didn't reach the last page", backend)
+			}
+			candidates, next, err := list(context.Background(), 2, cursor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, candidate := range candidates {
+				if listed[candidate.Ref] {
+					t.Errorf("%s: %s listed twice", backend, candidate.Ref)
+				}
+				listed[candidate.Ref] = true
+				if held := candidate.HoldExpires != nil; held != (candidate.Ref == reservation.Ref) {
+					t.Errorf("%s: %s: has hold expiry = %v, want %v", backend, candidate.Ref, held, !held)
+				}
+			}
+			if cursor = next; cursor == "" {
+				break
+			}
+		}
+		if !reflect.DeepEqual(listed, want) {
+			t.Errorf("%s: listed %v, want %v", backend, listed, want)
+		}
+	}
+}
+
+// TestDynamoGetMissing checks getting a booking DynamoDB has no item for
+// reports there's no such booking rather than returning an empty one.
+func TestDynamoGetMissing(t *testing.T) {
+	servicetest.NewDynamoDB(t)
+	store, err := newDynamoService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmation, err := store.Get(context.Background(), "missing"); err != ErrNoSuchBooking {
+		t.Errorf("Get() = %v, %v, want %v", confirmation, err, ErrNoSuchBooking)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/notification-service/service"
+	trips "github.com/realkinetic/cloud-native-meetup-2019/trip-service/service"
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+var notrace = flag.Bool("notrace", false, "disable tracing")
+
+type worker struct {
+	notifier service.Notifier
+}
+
+func main() {
+	flag.Parse()
+	if err := util.Init("notification-service", *notrace); err != nil {
+		panic(err)
+	}
+	defer util.Close()
+
+	w := &worker{notifier: service.NewNotifier()}
+	sub, err := util.SubscribeEvents(trips.TripBookedSubject, w.tripBooked)
+	if err != nil {
+		panic(err)
+	}
+
+	util.FinishStartup()
+	log.Infof("Notification service subscribed to %s...", trips.TripBookedSubject)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	if err := sub.Unsubscribe(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to unsubscribe")
+	}
+}
+
+func (w *worker) tripBooked(ctx context.Context, event *util.Event) {
+	var confirmation trips.TripConfirmation
+	if err := json.Unmarshal(event.Payload, &confirmation); err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to unmarshal booked trip")
+		return
+	}
+	ctx = util.WithRef(ctx, confirmation.Ref)
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, "sendTripConfirmation")
+	defer span.Finish()
+	if err := w.notifier.SendTripConfirmation(ctx, &confirmation); err != nil {
+		ext.Error.Set(span, true)
+		util.LogSpanFields(span, tracelog.Error(err))
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to send trip confirmation")
+		return
+	}
+	util.Logger(ctx).Info("Sent trip confirmation")
+}
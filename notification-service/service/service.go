@@ -0,0 +1,44 @@
+package service
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+
+	trips "github.com/realkinetic/cloud-native-meetup-2019/trip-service/service"
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+// Notifier sends booking confirmations to travelers.
+type Notifier interface {
+	SendTripConfirmation(context.Context, *trips.TripConfirmation) error
+}
+
+// logNotifier is a stub Notifier which logs the confirmation it would send
+// rather than sending it.
+type logNotifier struct{}
+
+func NewNotifier() Notifier {
+	return &logNotifier{}
+}
+
+// SendTripConfirmation logs the refs of the trip's legs and how many
+// travelers it's for, alongside the trip's ref from the context. Names are
+// personal data, so they're never logged.
+func (l *logNotifier) SendTripConfirmation(ctx context.Context, confirmation *trips.TripConfirmation) error {
+	fields := log.Fields{}
+	if trip := confirmation.Trip; trip != nil {
+		fields["members"] = len(trip.Members)
+	}
+	if c := confirmation.FlightConfirmation; c != nil {
+		fields["flight_ref"] = c.Ref
+	}
+	if c := confirmation.HotelConfirmation; c != nil {
+		fields["hotel_ref"] = c.Ref
+	}
+	if c := confirmation.CarRentalConfirmation; c != nil {
+		fields["car_rental_ref"] = c.Ref
+	}
+	util.Logger(ctx).WithFields(fields).Info("Would send confirmation email")
+	return nil
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	cars "github.com/realkinetic/cloud-native-meetup-2019/car-service/service"
+	flights "github.com/realkinetic/cloud-native-meetup-2019/flight-service/service"
+	hotels "github.com/realkinetic/cloud-native-meetup-2019/hotel-service/service"
+	trips "github.com/realkinetic/cloud-native-meetup-2019/trip-service/service"
+)
+
+// TestSendTripConfirmationOmitsNames checks the stub logs the trip's refs and
+// member count, and none of the travelers' names.
+func TestSendTripConfirmationOmitsNames(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	logrus.SetOutput(ioutil.Discard)
+
+	confirmation := &trips.TripConfirmation{
+		Ref: "trip1",
+		Trip: &trips.BookTripRequest{
+			Name:        "Ada Lovelace",
+			TripName:    "Ada's offsite",
+			Destination: "London",
+			Members:     []string{"Ada Lovelace", "Charles Babbage"},
+		},
+		FlightConfirmation:    &flights.FlightConfirmation{Ref: "FL1"},
+		HotelConfirmation:     &hotels.HotelConfirmation{Ref: "HT1"},
+		CarRentalConfirmation: &cars.CarRentalConfirmation{Ref: "CR1"},
+	}
+	if err := NewNotifier().SendTripConfirmation(context.Background(), confirmation); err != nil {
+		t.Fatal(err)
+	}
+
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("nothing was logged")
+	}
+	for field, want := range map[string]interface{}{
+		"members":        2,
+		"flight_ref":     "FL1",
+		"hotel_ref":      "HT1",
+		"car_rental_ref": "CR1",
+	} {
+		if got := entry.Data[field]; got != want {
+			t.Errorf("%s = %v, want %v", field, got, want)
+		}
+	}
+	for field, value := range entry.Data {
+		logged := fmt.Sprint(value)
+		for _, name := range []string{"Ada", "Babbage", "London"} {
+			if strings.Contains(logged, name) {
+				t.Errorf("%s = %q, which contains %q", field, logged, name)
+			}
+		}
+	}
+}
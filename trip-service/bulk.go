@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/trip-service/service"
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+const (
+	// maxBulkSize is the maximum number of trips in a bulk booking request.
+	maxBulkSize = 25
+
+	// bulkConcurrencyEnv sets the maximum number of trips from a bulk
+	// booking request which are booked concurrently, which bounds the load a
+	// bulk booking puts on the sub-services.
+	bulkConcurrencyEnv     = "BULK_CONCURRENCY"
+	defaultBulkConcurrency = 4
+)
+
+// bulkResult is the outcome of booking a single trip from a bulk request.
+// Status is the status booking the trip alone would have responded with.
+// Exactly one of Confirmation and Error is set.
+type bulkResult struct {
+	Index        int                       `json:"index"`
+	Status       int                       `json:"status"`
+	Confirmation *service.TripConfirmation `json:"confirmation,omitempty"`
+	Error        string                    `json:"error,omitempty"`
+}
+
+// bulkBookTrips books each trip in the request body, reporting the outcome of
+// each.
+func (s *server) bulkBookTrips(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	var bookings []*service.BookTripRequest
+	if err := util.DecodeJSONBody(r, &bookings); err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to decode request body")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	if len(bookings) == 0 || len(bookings) > maxBulkSize {
+		err := fmt.Errorf("bulk booking must contain between 1 and %d trips", maxBulkSize)
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+			"count": len(bookings),
+		}).Error("Invalid bulk booking request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	results := s.bookTrips(ctx, bookings)
+
+	finish := util.TraceRegion(ctx, "json.marshal")
+	resp, err := json.Marshal(results)
+	finish()
+	if err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Fatal("Failed to marshal response")
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	util.Logger(ctx).WithFields(log.Fields{
+		"count":  len(results),
+		"failed": failed,
+	}).Info("Booked bulk trips")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// bookTrips books each trip with at most BULK_CONCURRENCY in flight. A failure
+// to book one trip doesn't affect the others. Results are in request order.
+func (s *server) bookTrips(ctx context.Context, bookings []*service.BookTripRequest) []*bulkResult {
+	var (
+		results = make([]*bulkResult, len(bookings))
+		sem     = make(chan struct{}, s.bulkConcurrency)
+		wg      sync.WaitGroup
+	)
+	for i, booking := range bookings {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, booking *service.BookTripRequest) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = s.bookBulkTrip(ctx, i, booking)
+		}(i, booking)
+	}
+	wg.Wait()
+	return results
+}
+
+// bookBulkTrip books a single trip from a bulk request in its own span.
+func (s *server) bookBulkTrip(ctx context.Context, index int, booking *service.BookTripRequest) *bulkResult {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "bookBulkTrip")
+	defer span.Finish()
+	span.SetTag("index", index)
+
+	result := &bulkResult{Index: index, Status: http.StatusBadRequest}
+	if booking == nil {
+		result.Error = "missing trip"
+		return result
+	}
+	if err := booking.ValidateAll(); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	confirmation, err := s.service.BookTrip(ctx, booking, service.BookOptions{})
+	if err != nil {
+		ext.Error.Set(span, true)
+		util.LogSpanFields(span, tracelog.Error(err))
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+			"index": index,
+		}).Error("Failed to book trip")
+		result.Status, result.Error = bulkError(err)
+		return result
+	}
+	span.SetTag("ref", confirmation.Ref)
+	result.Status = http.StatusCreated
+	result.Confirmation = confirmation
+	return result
+}
+
+// bulkError returns the status and error message of a trip which failed to
+// book, as writeServiceError would respond with them. Errors which may
+// contain internal details are replaced by the status text.
+func bulkError(err error) (int, string) {
+	if err == util.ErrMissingTenant || err == util.ErrUnknownTenant {
+		return http.StatusBadRequest, err.Error()
+	}
+	downstreamErr, ok := err.(*service.DownstreamError)
+	if !ok {
+		status := util.StatusFromError(err)
+		return status, http.StatusText(status)
+	}
+	if isClientError(downstreamErr.StatusCode) {
+		return downstreamErr.StatusCode, downstreamErr.Message
+	}
+	return http.StatusBadGateway, fmt.Sprintf("%s request failed", downstreamErr.Service)
+}
@@ -5,8 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
-	"io/ioutil"
+	"fmt"
 	"net/http"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -16,10 +17,25 @@ import (
 
 const port = ":8000"
 
+// includeRequestParam is the query parameter which controls whether trip
+// confirmations echo the trip request. It defaults to true.
+const includeRequestParam = "include_request"
+
+const (
+	// defaultListLimit and maxListLimit bound the size of a page of listed
+	// bookings.
+	defaultListLimit = 25
+	maxListLimit     = 100
+)
+
 var notrace = flag.Bool("notrace", false, "disable tracing")
 
 type server struct {
 	service service.TripService
+
+	// bulkConcurrency is the maximum number of trips from a bulk booking
+	// request which are booked concurrently.
+	bulkConcurrency int
 }
 
 func main() {
@@ -27,22 +43,46 @@ func main() {
 	if err := util.Init("trip-service", *notrace); err != nil {
 		panic(err)
 	}
+	defer util.Close()
 
 	tripService, err := service.NewTripService()
 	if err != nil {
 		panic(err)
 	}
 
-	s := &server{service: tripService}
-	http.HandleFunc("/trips/booking", s.bookingHandler)
-	handler := util.NewContextHandler(http.DefaultServeMux)
+	bulkConcurrency, err := util.IntFromEnv(bulkConcurrencyEnv, defaultBulkConcurrency)
+	if err != nil {
+		panic(err)
+	}
 
+	s := &server{service: tripService, bulkConcurrency: bulkConcurrency}
+	s.registerHandlers(http.DefaultServeMux)
+	http.Handle("/metrics", util.MetricsHandler())
+	util.RegisterHealthEndpoint(http.DefaultServeMux)
+	util.RegisterVersionEndpoint(http.DefaultServeMux)
+	util.RegisterSchemaEndpoint(http.DefaultServeMux, &service.BookTripRequest{})
+	util.RegisterDebugEndpoints(http.DefaultServeMux)
+	handler, err := util.NewHandler(http.DefaultServeMux, util.WithMetricsPaths("/trips/booking", "/trips/booking/summary", "/trips/booking/by-component", "/trips/bookings"))
+	if err != nil {
+		panic(err)
+	}
+
+	util.FinishStartup()
 	log.Infof("Trip service listening on %s...", port)
-	if err := http.ListenAndServe(port, handler); err != nil {
+	if err := util.ListenAndServe(port, handler); err != nil {
 		panic(err)
 	}
 }
 
+// registerHandlers registers the trip service's endpoints on the mux.
+func (s *server) registerHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/trips/booking", s.bookingHandler)
+	mux.HandleFunc("/trips/booking/summary", s.summaryHandler)
+	mux.HandleFunc("/trips/booking/by-component", s.componentHandler)
+	mux.HandleFunc("/trips/bookings", s.bookingsHandler)
+	mux.HandleFunc("/healthz/deep", s.deepHealthHandler)
+}
+
 func (s *server) bookingHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	switch r.Method {
@@ -50,92 +90,486 @@ func (s *server) bookingHandler(w http.ResponseWriter, r *http.Request) {
 		s.getBooking(ctx, w, r)
 	case "POST":
 		s.bookTrip(ctx, w, r)
+	case "PATCH":
+		s.patchTrip(ctx, w, r)
 	default:
-		log.WithContext(ctx).WithFields(log.Fields{
-			"error": errors.New("invalid HTTP method"),
+		err := errors.New("invalid HTTP method")
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
 		}).Error("Invalid HTTP method for endpoint")
-		http.Error(w, "Invalid HTTP method", http.StatusBadRequest)
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
 	}
 }
 
 func (s *server) getBooking(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	includeRequest, err := util.BoolQueryDefault(r, includeRequestParam, true)
+	if err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid booking request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
 	ref := r.URL.Query().Get("ref")
 	ctx = util.WithRef(ctx, ref)
 	confirmation, err := s.service.GetBooking(ctx, ref)
 	if err != nil {
-		log.WithContext(ctx).WithFields(log.Fields{
+		util.Logger(ctx).WithFields(log.Fields{
 			"error": err,
 		}).Error("Failed to fetch booking")
 		if err == service.ErrNoSuchBooking {
-			http.Error(w, err.Error(), http.StatusNotFound)
+			util.LegacyError(w, ctx, http.StatusNotFound, err)
 		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeServiceError(ctx, w, err)
 		}
 		return
 	}
 
-	resp, err := json.Marshal(confirmation)
+	if !includeRequest {
+		confirmation.Trip = nil
+	}
+
+	util.Logger(ctx).Info("Fetched booking")
+	finish := util.TraceRegion(ctx, "json.marshal")
+	err = util.WriteResponse(w, r, confirmation)
+	finish()
 	if err != nil {
 		panic(err)
 	}
+}
 
-	log.WithContext(ctx).Info("Fetched booking")
+func (s *server) summaryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "GET" {
+		err := errors.New("invalid HTTP method")
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid HTTP method for endpoint")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	ref := r.URL.Query().Get("ref")
+	ctx = util.WithRef(ctx, ref)
+	confirmation, err := s.service.GetBooking(ctx, ref)
+	if err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to fetch booking")
+		if err == service.ErrNoSuchBooking {
+			util.LegacyError(w, ctx, http.StatusNotFound, err)
+		} else {
+			writeServiceError(ctx, w, err)
+		}
+		return
+	}
+
+	finish := util.TraceRegion(ctx, "json.marshal")
+	resp, err := json.Marshal(service.NewItinerary(confirmation))
+	finish()
+	if err != nil {
+		panic(err)
+	}
+
+	util.Logger(ctx).Info("Fetched itinerary")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// bookingsHandler lists an organization's trips or books trips in bulk.
+func (s *server) bookingsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	switch r.Method {
+	case "GET":
+		s.listBookings(ctx, w, r)
+	case "POST":
+		s.bulkBookTrips(ctx, w, r)
+	default:
+		err := errors.New("invalid HTTP method")
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid HTTP method for endpoint")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+	}
+}
+
+// listBookings lists the trips of the organization given by the org query
+// parameter, a page at a time. Pass the cursor of the previous page to fetch
+// the next. Without an org, the trips starting between the from and to query
+// parameters are listed instead; see listBookingsByDate.
+func (s *server) listBookings(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	org := r.URL.Query().Get("org")
+	if org == "" && (r.URL.Query().Get("from") != "" || r.URL.Query().Get("to") != "") {
+		s.listBookingsByDate(ctx, w, r)
+		return
+	}
+	if org == "" {
+		err := errors.New("missing org, or from and to")
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid booking list request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := util.IntQueryDefault(r, "limit", defaultListLimit)
+	if err == nil && limit > maxListLimit {
+		err = fmt.Errorf("limit must be at most %d", maxListLimit)
+	}
+	if err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid booking list request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	list, err := s.service.ListByOrganization(ctx, org, limit, r.URL.Query().Get("cursor"))
+	if err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error":        err,
+			"organization": org,
+		}).Error("Failed to list bookings")
+		if err == service.ErrInvalidCursor {
+			util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		} else {
+			writeServiceError(ctx, w, err)
+		}
+		return
+	}
+
+	util.Logger(ctx).WithFields(log.Fields{
+		"organization": org,
+		"count":        len(list.Trips),
+	}).Info("Listed bookings")
+	if err := util.WriteResponse(w, r, list); err != nil {
+		panic(err)
+	}
+}
+
+// listBookingsByDate lists the trips starting between the from and to query
+// parameters, inclusive, in order of their start. Each is an RFC 3339 time or
+// a date, which is midnight UTC. Like an organization's trips, they're listed a page
+// at a time; see listBookings.
+func (s *server) listBookingsByDate(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	from, err := util.TimeQuery(r, "from")
+	var to time.Time
+	if err == nil {
+		to, err = util.TimeQuery(r, "to")
+	}
+	if err == nil && (from.IsZero() || to.IsZero()) {
+		err = errors.New("from and to must both be set")
+	}
+	var limit int
+	if err == nil {
+		limit, err = util.IntQueryDefault(r, "limit", defaultListLimit)
+	}
+	if err == nil && limit > maxListLimit {
+		err = fmt.Errorf("limit must be at most %d", maxListLimit)
+	}
+	if err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid booking list request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	list, err := s.service.ListByDateRange(ctx, from, to, limit, r.URL.Query().Get("cursor"))
+	if err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+			"from":  from,
+			"to":    to,
+		}).Error("Failed to list bookings")
+		if err == service.ErrInvalidDateRange || err == service.ErrInvalidCursor {
+			util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		} else {
+			writeServiceError(ctx, w, err)
+		}
+		return
+	}
+
+	util.Logger(ctx).WithFields(log.Fields{
+		"from":  from,
+		"to":    to,
+		"count": len(list.Trips),
+	}).Info("Listed bookings")
+	if err := util.WriteResponse(w, r, list); err != nil {
+		panic(err)
+	}
+}
+
+// deepHealthHandler reports the health of the trip service's dependencies.
+// It responds with a 503 unless they're all healthy.
+func (s *server) deepHealthHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "GET" {
+		util.LegacyError(w, ctx, http.StatusBadRequest, errors.New("invalid HTTP method"))
+		return
+	}
+
+	report := s.service.CheckHealth(ctx)
+	resp, err := json.Marshal(report)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != service.HealthOK {
+		util.Logger(ctx).WithFields(log.Fields{
+			"components": report.Components,
+		}).Warn("Dependencies are unhealthy")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(resp)
+}
+
+// componentHandler looks up the trip which owns a sub-booking, given its type
+// and ref, for support staff who only have the sub-booking's ref.
+func (s *server) componentHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != "GET" {
+		err := errors.New("invalid HTTP method")
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid HTTP method for endpoint")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	component := r.URL.Query().Get("type")
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		err := errors.New("missing ref")
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid component lookup")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+	confirmation, err := s.service.FindByComponent(ctx, component, ref)
+	if err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error":         err,
+			"component":     component,
+			"component_ref": ref,
+		}).Error("Failed to find booking by component")
+		switch err {
+		case service.ErrUnknownComponent:
+			util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		case service.ErrNoSuchBooking:
+			util.LegacyError(w, ctx, http.StatusNotFound, err)
+		default:
+			writeServiceError(ctx, w, err)
+		}
+		return
+	}
+
+	ctx = util.WithRef(ctx, confirmation.Ref)
+	util.Logger(ctx).WithFields(log.Fields{
+		"component":     component,
+		"component_ref": ref,
+	}).Info("Found booking by component")
+	finish := util.TraceRegion(ctx, "json.marshal")
+	resp, err := json.Marshal(confirmation)
+	finish()
+	if err != nil {
+		panic(err)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(resp)
 }
 
 func (s *server) bookTrip(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	dryRun, err := util.BoolQuery(r, "dry_run")
+	if err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid booking request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	includeRequest, err := util.BoolQueryDefault(r, includeRequestParam, true)
+	if err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid booking request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	timings, err := util.BoolQuery(r, "timings")
+	if err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid booking request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
 	booking, err := s.deserializeBookingRequest(r)
 	if err != nil {
-		log.WithContext(ctx).WithFields(log.Fields{
+		util.Logger(ctx).WithFields(log.Fields{
 			"error": err,
 		}).Error("Failed to deserialize request")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
 		return
 	}
 
-	if err := booking.Validate(); err != nil {
-		log.WithContext(ctx).WithFields(log.Fields{
+	if err := booking.ValidateAll(); err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
 			"error": err,
 		}).Error("Invalid booking request")
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		util.WriteJSONError(w, http.StatusBadRequest, "invalid booking request", err)
 		return
 	}
 
-	confirmation, err := s.service.BookTrip(ctx, booking)
+	confirmation, err := s.service.BookTrip(ctx, booking, service.BookOptions{
+		DryRun:         dryRun,
+		IdempotencyKey: r.Header.Get("Idempotency-Key"),
+		Timings:        timings,
+	})
 	if err != nil {
-		log.WithContext(ctx).WithFields(log.Fields{
+		util.Logger(ctx).WithFields(log.Fields{
 			"error": err,
 		}).Error("Failed to book trip")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServiceError(ctx, w, err)
 		return
 	}
 	ctx = util.WithRef(ctx, confirmation.Ref)
+	if !includeRequest {
+		confirmation.Trip = nil
+	}
 
+	finish := util.TraceRegion(ctx, "json.marshal")
 	resp, err := json.Marshal(confirmation)
+	finish()
 	if err != nil {
-		log.WithContext(ctx).WithFields(log.Fields{
+		util.Logger(ctx).WithFields(log.Fields{
 			"error": err,
 		}).Fatal("Failed to marshal response")
 	}
 
-	log.WithContext(ctx).Info("Booked trip")
 	w.Header().Set("Content-Type", "application/json")
+	if dryRun {
+		util.Logger(ctx).Info("Validated trip (dry run)")
+		w.Write(resp)
+		return
+	}
+
+	util.Logger(ctx).Info("Booked trip")
 	w.WriteHeader(http.StatusCreated)
 	w.Write(resp)
 }
 
-func (s *server) deserializeBookingRequest(r *http.Request) (*service.BookTripRequest, error) {
+func (s *server) patchTrip(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ref := r.URL.Query().Get("ref")
+	if ref == "" {
+		err := errors.New("missing ref")
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid patch request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+	ctx = util.WithRef(ctx, ref)
+
 	defer r.Body.Close()
-	data, err := ioutil.ReadAll(r.Body)
+
+	var patch service.TripPatch
+	if err := util.DecodeJSONBody(r, &patch); err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to deserialize request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := patch.Validate(); err != nil {
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid patch request")
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+
+	confirmation, err := s.service.PatchTrip(ctx, ref, &patch)
 	if err != nil {
-		return nil, err
+		util.Logger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to patch trip")
+		switch err {
+		case service.ErrNoSuchBooking:
+			util.LegacyError(w, ctx, http.StatusNotFound, err)
+		case service.ErrTripModified:
+			util.LegacyError(w, ctx, http.StatusConflict, err)
+		default:
+			writeServiceError(ctx, w, err)
+		}
+		return
 	}
 
+	finish := util.TraceRegion(ctx, "json.marshal")
+	resp, err := json.Marshal(confirmation)
+	finish()
+	if err != nil {
+		panic(err)
+	}
+
+	util.Logger(ctx).Info("Patched trip")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+func (s *server) deserializeBookingRequest(r *http.Request) (*service.BookTripRequest, error) {
+	defer r.Body.Close()
+
 	var req service.BookTripRequest
-	if err := json.Unmarshal(data, &req); err != nil {
+	if err := util.DecodeJSONBody(r, &req); err != nil {
 		return nil, err
 	}
 
 	return &req, nil
 }
+
+// writeServiceError responds with the status for an error from the trip
+// service. A missing or unknown tenant ID is the client's fault. So is a
+// sub-service rejecting the request, so its status and error are passed on,
+// including its Retry-After if it's throttling. The exception is a rejection
+// of the trip service's own credentials, which the client can't fix. Any
+// other sub-service failure is a bad gateway, and its error isn't exposed
+// since it may contain internal details.
+func writeServiceError(ctx context.Context, w http.ResponseWriter, err error) {
+	if err == util.ErrMissingTenant || err == util.ErrUnknownTenant {
+		util.LegacyError(w, ctx, http.StatusBadRequest, err)
+		return
+	}
+	downstreamErr, ok := err.(*service.DownstreamError)
+	if !ok {
+		util.WriteError(w, err)
+		return
+	}
+	if isClientError(downstreamErr.StatusCode) {
+		var details interface{}
+		if len(downstreamErr.Details) > 0 {
+			details = downstreamErr.Details
+		}
+		if downstreamErr.RetryAfter != "" {
+			w.Header().Set("Retry-After", downstreamErr.RetryAfter)
+		}
+		util.WriteJSONError(w, downstreamErr.StatusCode, downstreamErr.Message, details)
+		return
+	}
+	util.LegacyError(w, ctx, http.StatusBadGateway, fmt.Errorf("%s request failed", downstreamErr.Service))
+}
+
+// isClientError indicates if a sub-service's response status blames the
+// client's request, rather than the trip service's credentials.
+func isClientError(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusProxyAuthRequired:
+		return false
+	}
+	return status >= 400 && status < 500
+}
@@ -0,0 +1,1084 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/trip-service/service"
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+	"github.com/realkinetic/cloud-native-meetup-2019/util/servicetest"
+)
+
+// testRequestID is the request ID sent with test requests, which must be
+// propagated to the sub-services.
+const testRequestID = "tripservicetest0000001"
+
+func TestMain(m *testing.M) {
+	if err := util.Init("trip-service", false); err != nil {
+		panic(err)
+	}
+	log.SetOutput(ioutil.Discard)
+	code := m.Run()
+	util.Close()
+	os.Exit(code)
+}
+
+// testServer is the trip service's handler, backed by stand-ins for DynamoDB
+// and the sub-services.
+type testServer struct {
+	handler http.Handler
+	db      *servicetest.DynamoDB
+	flights *servicetest.SubService
+	hotels  *servicetest.SubService
+	cars    *servicetest.SubService
+}
+
+func newTestServer(t *testing.T, opts ...service.Option) *testServer {
+	t.Helper()
+	ts := &testServer{
+		db:      servicetest.NewDynamoDB(t),
+		flights: servicetest.NewFlightService(t),
+		hotels:  servicetest.NewHotelService(t),
+		cars:    servicetest.NewCarService(t),
+	}
+	t.Setenv("FLIGHT_SERVICE_URL", ts.flights.URL)
+	t.Setenv("HOTEL_SERVICE_URL", ts.hotels.URL)
+	t.Setenv("CAR_SERVICE_URL", ts.cars.URL)
+
+	tripService, err := service.NewTripService(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{service: tripService, bulkConcurrency: defaultBulkConcurrency}
+	mux := http.NewServeMux()
+	s.registerHandlers(mux)
+	if ts.handler, err = util.NewHandler(mux); err != nil {
+		t.Fatal(err)
+	}
+	return ts
+}
+
+// newRequest returns a request with the body, if any, encoded as JSON.
+func newRequest(method, target string, body interface{}) *http.Request {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			panic(err)
+		}
+	}
+	r := httptest.NewRequest(method, target, bytes.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Ctx-RequestID", testRequestID)
+	return r
+}
+
+// serve serves the request and returns the response.
+func (ts *testServer) serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	ts.handler.ServeHTTP(w, r)
+	return w
+}
+
+// do serves a request like newRequest's and returns the response.
+func (ts *testServer) do(method, target string, body interface{}) *httptest.ResponseRecorder {
+	return ts.serve(newRequest(method, target, body))
+}
+
+// testTrip returns a valid trip with every component.
+func testTrip() map[string]interface{} {
+	start := time.Date(2019, 6, 1, 9, 0, 0, 0, time.UTC)
+	end := start.Add(72 * time.Hour)
+	return map[string]interface{}{
+		"name":        "Offsite",
+		"destination": "Denver",
+		"start":       start,
+		"end":         end,
+		"members":     []string{"Ada", "Grace"},
+		"flight": map[string]interface{}{
+			"airline":       "UA",
+			"flight_number": "UA100",
+			"time":          start,
+			"passengers":    []map[string]string{{"name": "Ada"}, {"name": "Grace"}},
+		},
+		"hotel": map[string]interface{}{
+			"hotel":     "Brown Palace",
+			"check_in":  start,
+			"check_out": end,
+			"name":      "Ada",
+			"guests":    2,
+		},
+		"car": map[string]interface{}{
+			"agent":             "Hertz",
+			"pick_up":           start,
+			"pick_up_location":  "DEN",
+			"drop_off":          end,
+			"drop_off_location": "DEN",
+			"name":              "Ada",
+			"vehicle_class":     "compact",
+		},
+	}
+}
+
+func decodeConfirmation(t *testing.T, w *httptest.ResponseRecorder) *service.TripConfirmation {
+	t.Helper()
+	var confirmation service.TripConfirmation
+	if err := json.Unmarshal(w.Body.Bytes(), &confirmation); err != nil {
+		t.Fatalf("invalid confirmation %q: %v", w.Body.String(), err)
+	}
+	return &confirmation
+}
+
+// bookingRequests returns the requests the sub-service received at its
+// booking endpoints, ignoring version checks.
+func bookingRequests(s *servicetest.SubService) []*servicetest.Request {
+	var requests []*servicetest.Request
+	for _, r := range s.Requests() {
+		if strings.HasSuffix(r.Path, "/booking") || strings.HasSuffix(r.Path, "/reservation") {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+func TestBookTrip(t *testing.T) {
+	ts := newTestServer(t)
+
+	w := ts.do("POST", "/trips/booking", testTrip())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	booked := decodeConfirmation(t, w)
+	if booked.Ref == "" {
+		t.Fatal("booked trip has no ref")
+	}
+	if booked.FlightConfirmation == nil || booked.HotelConfirmation == nil || booked.CarRentalConfirmation == nil {
+		t.Fatalf("booked trip is missing components: %s", w.Body)
+	}
+	if want, _ := util.ParseMoney("300.00"); booked.TotalPrice != want {
+		t.Errorf("total price = %v, want %v", booked.TotalPrice, want)
+	}
+	for _, s := range []*servicetest.SubService{ts.flights, ts.hotels, ts.cars} {
+		if s.Bookings() != 1 {
+			t.Errorf("%s has %d bookings, want 1", s.URL, s.Bookings())
+		}
+	}
+
+	w = ts.do("GET", "/trips/booking?ref="+booked.Ref, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	fetched := decodeConfirmation(t, w)
+	if fetched.Ref != booked.Ref ||
+		fetched.FlightConfirmation.Ref != booked.FlightConfirmation.Ref ||
+		fetched.HotelConfirmation.Ref != booked.HotelConfirmation.Ref ||
+		fetched.CarRentalConfirmation.Ref != booked.CarRentalConfirmation.Ref {
+		t.Errorf("fetched trip %s doesn't match booked trip", w.Body)
+	}
+}
+
+// TestBookTripPropagatesContext checks every sub-service call carries the
+// request's ID, once, and joins its trace.
+func TestBookTripPropagatesContext(t *testing.T) {
+	ts := newTestServer(t)
+
+	if w := ts.do("POST", "/trips/booking", testTrip()); w.Code != http.StatusCreated {
+		t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+
+	var traceID string
+	for _, s := range []*servicetest.SubService{ts.flights, ts.hotels, ts.cars} {
+		requests := bookingRequests(s)
+		if len(requests) != 1 {
+			t.Fatalf("%s got %d booking requests, want 1", s.URL, len(requests))
+		}
+		header := requests[0].Header
+		if got := header["X-Ctx-Requestid"]; len(got) != 1 || got[0] != testRequestID {
+			t.Errorf("%s got request IDs %q, want [%q]", s.URL, got, testRequestID)
+		}
+		if got := header.Get("X-Ctx-Origin-Service"); got != "trip-service" {
+			t.Errorf("%s got origin %q, want trip-service", s.URL, got)
+		}
+		// The header is trace:span:parent:flags. Every leg is a child of
+		// the same trace.
+		context := strings.Split(header.Get("Uber-Trace-Id"), ":")
+		if len(context) != 4 {
+			t.Fatalf("%s got trace context %q", s.URL, header.Get("Uber-Trace-Id"))
+		}
+		if traceID == "" {
+			traceID = context[0]
+		} else if context[0] != traceID {
+			t.Errorf("%s got trace ID %s, want %s", s.URL, context[0], traceID)
+		}
+	}
+}
+
+// TestBookTripPartialFailure checks the legs booked before one fails are
+// compensated, and the failure is reported as a bad gateway.
+func TestBookTripPartialFailure(t *testing.T) {
+	ts := newTestServer(t)
+	ts.hotels.Fail(servicetest.Fault{Method: "POST", Status: http.StatusInternalServerError})
+
+	w := ts.do("POST", "/trips/booking", testTrip())
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusBadGateway, w.Body)
+	}
+	if ts.flights.Bookings() != 0 {
+		t.Errorf("flight wasn't compensated, %d bookings remain", ts.flights.Bookings())
+	}
+	requests := bookingRequests(ts.flights)
+	if len(requests) != 2 || requests[1].Method != "DELETE" {
+		t.Errorf("flight service got %d booking requests, want a booking and its cancellation", len(requests))
+	}
+	if len(bookingRequests(ts.cars)) != 0 {
+		t.Error("car was booked after the hotel failed")
+	}
+	if ts.db.Calls("PutItem") != 0 {
+		t.Error("failed trip was stored")
+	}
+}
+
+// TestBookTripTimeout checks a sub-service which doesn't respond in time
+// fails the booking, and the legs booked before it are compensated after the
+// response.
+func TestBookTripTimeout(t *testing.T) {
+	t.Setenv("HANDLER_TIMEOUT", "200ms")
+	ts := newTestServer(t)
+	ts.hotels.Fail(servicetest.Fault{Method: "POST", Delay: 5 * time.Second})
+
+	start := time.Now()
+	w := ts.do("POST", "/trips/booking", testTrip())
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("booking took %v, want it cut off at the handler timeout", elapsed)
+	}
+
+	// The handler carries on compensating once the response is sent.
+	deadline := time.Now().Add(2 * time.Second)
+	for ts.flights.Bookings() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ts.flights.Bookings() != 0 {
+		t.Error("flight wasn't compensated after the timeout")
+	}
+}
+
+// TestBookTripCancelledMidSequence checks a booking whose context is
+// cancelled once its flight is booked, as happens when the server drains on
+// shutdown, stops and compensates the flight.
+func TestBookTripCancelledMidSequence(t *testing.T) {
+	ts := newTestServer(t)
+	ts.hotels.Fail(servicetest.Fault{Method: "POST", Delay: 5 * time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- ts.serve(newRequest("POST", "/trips/booking", testTrip()).WithContext(ctx))
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for ts.flights.Bookings() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ts.flights.Bookings() == 0 {
+		t.Fatal("flight wasn't booked")
+	}
+
+	start := time.Now()
+	cancel()
+	w := <-done
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("booking took %v to return once cancelled", elapsed)
+	}
+	if w.Code == http.StatusCreated {
+		t.Fatalf("cancelled booking succeeded: %s", w.Body)
+	}
+	if ts.flights.Bookings() != 0 || ts.hotels.Bookings() != 0 || ts.cars.Bookings() != 0 {
+		t.Errorf("bookings left after cancelling: %d flights, %d hotels, %d cars",
+			ts.flights.Bookings(), ts.hotels.Bookings(), ts.cars.Bookings())
+	}
+}
+
+func TestGetBookingSubServiceFailure(t *testing.T) {
+	ts := newTestServer(t)
+	w := ts.do("POST", "/trips/booking", testTrip())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	booked := decodeConfirmation(t, w)
+
+	ts.cars.FailRef(booked.CarRentalConfirmation.Ref, servicetest.Fault{Status: http.StatusInternalServerError})
+	w = ts.do("GET", "/trips/booking?ref="+booked.Ref, nil)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("get status = %d, want %d: %s", w.Code, http.StatusBadGateway, w.Body)
+	}
+}
+
+// TestGetBookingRetriesSubServiceFailure checks a failed read is retried, and
+// that each attempt carries the request's context headers once.
+func TestGetBookingRetriesSubServiceFailure(t *testing.T) {
+	t.Setenv("DOWNSTREAM_RETRY_BASE_DELAY", "1ms")
+	ts := newTestServer(t)
+	w := ts.do("POST", "/trips/booking", testTrip())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	booked := decodeConfirmation(t, w)
+
+	carRef := booked.CarRentalConfirmation.Ref
+	ts.cars.FailRef(carRef, servicetest.Fault{Status: http.StatusServiceUnavailable, Count: 2})
+	w = ts.do("GET", "/trips/booking?ref="+booked.Ref, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	var attempts int
+	for _, r := range ts.cars.Requests() {
+		if r.Method != "GET" || r.Query.Get("ref") != carRef {
+			continue
+		}
+		attempts++
+		if got := r.Header["X-Ctx-Requestid"]; len(got) != 1 || got[0] != testRequestID {
+			t.Errorf("attempt %d X-Ctx-RequestID = %q, want [%q]", attempts, got, testRequestID)
+		}
+	}
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+}
+
+// TestGetBookingRetryBudget checks retries stop once the request's retry
+// budget is spent, and the remaining budget is passed on.
+func TestGetBookingRetryBudget(t *testing.T) {
+	t.Setenv("DOWNSTREAM_RETRY_BASE_DELAY", "1ms")
+	for _, test := range []struct {
+		budget   string
+		attempts int
+		// propagated is the budget sent with the first attempt.
+		propagated string
+	}{
+		{"0", 1, "0"},
+		{"1", 2, "0"},
+		{"5", 3, "4"},
+	} {
+		// Each case has its own server, so earlier failures haven't opened
+		// the car service's breaker.
+		ts := newTestServer(t)
+		w := ts.do("POST", "/trips/booking", testTrip())
+		if w.Code != http.StatusCreated {
+			t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+		}
+		booked := decodeConfirmation(t, w)
+		carRef := booked.CarRentalConfirmation.Ref
+
+		ts.cars.FailRef(carRef, servicetest.Fault{Status: http.StatusServiceUnavailable})
+		r := newRequest("GET", "/trips/booking?ref="+booked.Ref, nil)
+		r.Header.Set("X-Ctx-Retry-Budget", test.budget)
+		if w := ts.serve(r); w.Code != http.StatusBadGateway {
+			t.Errorf("budget %s: get status = %d, want %d", test.budget, w.Code, http.StatusBadGateway)
+		}
+
+		var attempts []*servicetest.Request
+		for _, r := range ts.cars.Requests() {
+			if r.Method == "GET" && r.Query.Get("ref") == carRef {
+				attempts = append(attempts, r)
+			}
+		}
+		if len(attempts) != test.attempts {
+			t.Errorf("budget %s: got %d attempts, want %d", test.budget, len(attempts), test.attempts)
+			continue
+		}
+		if got := attempts[0].Header.Get("X-Ctx-Retry-Budget"); got != test.propagated {
+			t.Errorf("budget %s: propagated budget %q, want %q", test.budget, got, test.propagated)
+		}
+	}
+}
+
+// TestGetBookingReadsFromReplica checks bookings are read from the
+// READ_REGION replica, if it's set, and written to the primary.
+func TestGetBookingReadsFromReplica(t *testing.T) {
+	for _, test := range []struct {
+		readRegion string
+		reads      string
+	}{
+		{"", "us-east-1"},
+		{"us-east-1", "us-east-1"},
+		{"us-west-2", "us-west-2"},
+	} {
+		t.Setenv("READ_REGION", test.readRegion)
+		ts := newTestServer(t)
+		w := ts.do("POST", "/trips/booking", testTrip())
+		if w.Code != http.StatusCreated {
+			t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+		}
+		booked := decodeConfirmation(t, w)
+		if got := ts.db.CallsIn("us-west-2", "PutItem"); got != 0 {
+			t.Errorf("READ_REGION=%q: wrote %d items to the replica", test.readRegion, got)
+		}
+
+		reads := ts.db.CallsIn(test.reads, "GetItem")
+		if w := ts.do("GET", "/trips/booking?ref="+booked.Ref, nil); w.Code != http.StatusOK {
+			t.Fatalf("READ_REGION=%q: get status = %d, want %d: %s", test.readRegion, w.Code, http.StatusOK, w.Body)
+		}
+		if got := ts.db.CallsIn(test.reads, "GetItem"); got != reads+1 {
+			t.Errorf("READ_REGION=%q: read %d times from %s, want 1", test.readRegion, got-reads, test.reads)
+		}
+		if got := ts.db.Calls("GetItem"); got != ts.db.CallsIn(test.reads, "GetItem") {
+			t.Errorf("READ_REGION=%q: read %d times from other regions than %s", test.readRegion, got-ts.db.CallsIn(test.reads, "GetItem"), test.reads)
+		}
+	}
+}
+
+func TestGetBookingNotFound(t *testing.T) {
+	ts := newTestServer(t)
+	w := ts.do("GET", "/trips/booking?ref=missing", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("get status = %d, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+	}
+}
+
+// TestIncludeRequest checks confirmations echo the trip request unless
+// include_request is false.
+func TestIncludeRequest(t *testing.T) {
+	ts := newTestServer(t)
+
+	w := ts.do("POST", "/trips/booking?include_request=false", testTrip())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	booked := decodeConfirmation(t, w)
+	if booked.Trip != nil {
+		t.Errorf("booked trip echoes its request: %s", w.Body)
+	}
+
+	for _, test := range []struct {
+		query string
+		want  bool
+	}{
+		{"", true},
+		{"&include_request=true", true},
+		{"&include_request=false", false},
+	} {
+		w := ts.do("GET", "/trips/booking?ref="+booked.Ref+test.query, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%q: get status = %d, want %d: %s", test.query, w.Code, http.StatusOK, w.Body)
+		}
+		if included := decodeConfirmation(t, w).Trip != nil; included != test.want {
+			t.Errorf("%q: request included = %v, want %v", test.query, included, test.want)
+		}
+	}
+
+	if w := ts.do("GET", "/trips/booking?ref="+booked.Ref+"&include_request=maybe", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid include_request: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestBookTripRequiresJSON(t *testing.T) {
+	ts := newTestServer(t)
+	for _, contentType := range []string{"", "application/x-www-form-urlencoded"} {
+		r := newRequest("POST", "/trips/booking", testTrip())
+		r.Header.Set("Content-Type", contentType)
+		if w := ts.serve(r); w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("Content-Type %q: status = %d, want %d", contentType, w.Code, http.StatusUnsupportedMediaType)
+		}
+	}
+	if len(bookingRequests(ts.flights)) != 0 {
+		t.Error("a trip without a JSON body was booked")
+	}
+}
+
+// TestBookTripValidationErrors checks every problem with a booking request is
+// reported together in the error's details, and nothing is booked.
+func TestBookTripValidationErrors(t *testing.T) {
+	ts := newTestServer(t)
+	trip := testTrip()
+	delete(trip, "destination")
+	trip["members"] = []string{}
+	trip["flight"].(map[string]interface{})["airline"] = ""
+	w := ts.do("POST", "/trips/booking", trip)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+	var body struct {
+		Error   string                `json:"error"`
+		Details []*service.FieldError `json:"details"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	var fields []string
+	for _, detail := range body.Details {
+		fields = append(fields, detail.Field)
+	}
+	if want := []string{"destination", "members", service.ComponentFlight}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("details fields = %v, want %v", fields, want)
+	}
+	if len(bookingRequests(ts.flights)) != 0 || len(bookingRequests(ts.hotels)) != 0 || len(bookingRequests(ts.cars)) != 0 {
+		t.Error("an invalid trip was sent to the sub-services")
+	}
+}
+
+// TestInvalidRequests checks requests the handlers reject are 400s with the
+// error in the body.
+func TestInvalidRequests(t *testing.T) {
+	ts := newTestServer(t)
+	for _, test := range []struct {
+		method, target string
+		want           string
+	}{
+		{"DELETE", "/trips/booking", "invalid HTTP method"},
+		{"POST", "/trips/booking/summary", "invalid HTTP method"},
+		{"PUT", "/trips/bookings", "invalid HTTP method"},
+		{"GET", "/trips/bookings", "missing org, or from and to"},
+		{"POST", "/trips/booking/by-component", "invalid HTTP method"},
+		{"GET", "/trips/booking/by-component?type=flight", "missing ref"},
+		{"PATCH", "/trips/booking", "missing ref"},
+		{"POST", "/healthz/deep", "invalid HTTP method"},
+	} {
+		w := ts.do(test.method, test.target, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: status = %d, want %d", test.method, test.target, w.Code, http.StatusBadRequest)
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != test.want {
+			t.Errorf("%s %s: body = %q, want %q", test.method, test.target, got, test.want)
+		}
+	}
+}
+
+func TestTenants(t *testing.T) {
+	t.Setenv("TENANTS", "acme")
+	ts := newTestServer(t)
+	created := ts.db.Calls("CreateTable")
+
+	r := newRequest("POST", "/trips/booking", testTrip())
+	r.Header.Set("X-Tenant-ID", "acme")
+	w := ts.serve(r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	ref := decodeConfirmation(t, w).Ref
+	if ts.db.Item("trips_acme", ref) == nil {
+		t.Errorf("trip wasn't stored in the tenant's table")
+	}
+
+	r = newRequest("POST", "/trips/booking", testTrip())
+	r.Header.Set("X-Tenant-ID", "initech")
+	if w := ts.serve(r); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown tenant's booking status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if len(bookingRequests(ts.flights)) != 1 {
+		t.Error("unknown tenant's trip was booked")
+	}
+	if got := ts.db.Calls("CreateTable"); got != created {
+		t.Errorf("serving requests created %d tables", got-created)
+	}
+}
+
+// TestBookTripDownstreamErrors checks how a sub-service's error response is
+// passed on to the client.
+func TestBookTripDownstreamErrors(t *testing.T) {
+	for _, test := range []struct {
+		fault      servicetest.Fault
+		status     int
+		retryAfter string
+	}{
+		{servicetest.Fault{Status: http.StatusConflict}, http.StatusConflict, ""},
+		{servicetest.Fault{Status: http.StatusUnprocessableEntity}, http.StatusUnprocessableEntity, ""},
+		{servicetest.Fault{Status: http.StatusTooManyRequests, RetryAfter: "7"}, http.StatusTooManyRequests, "7"},
+		{servicetest.Fault{Status: http.StatusForbidden}, http.StatusBadGateway, ""},
+		{servicetest.Fault{Status: http.StatusServiceUnavailable, RetryAfter: "7"}, http.StatusBadGateway, ""},
+	} {
+		ts := newTestServer(t)
+		test.fault.Method = "POST"
+		ts.hotels.Fail(test.fault)
+
+		w := ts.do("POST", "/trips/booking", testTrip())
+		if w.Code != test.status {
+			t.Errorf("hotel status %d: got %d, want %d: %s", test.fault.Status, w.Code, test.status, w.Body)
+		}
+		if got := w.Header().Get("Retry-After"); got != test.retryAfter {
+			t.Errorf("hotel status %d: got Retry-After %q, want %q", test.fault.Status, got, test.retryAfter)
+		}
+		if w.Code != http.StatusBadGateway && !strings.Contains(w.Body.String(), "injected") {
+			t.Errorf("hotel status %d: error wasn't passed on: %s", test.fault.Status, w.Body)
+		}
+	}
+}
+
+// TestDynamoDBThrottling checks throttled DynamoDB reads are reported as 429s
+// so clients back off.
+func TestDynamoDBThrottling(t *testing.T) {
+	ts := newTestServer(t)
+	ts.db.Fail("GetItem", http.StatusBadRequest, servicetest.ErrCodeThrottled, -1)
+
+	w := ts.do("GET", "/trips/booking?ref=any", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("get status = %d, want %d: %s", w.Code, http.StatusTooManyRequests, w.Body)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("throttled response has no Retry-After")
+	}
+}
+
+// TestListByOrganizationNewestFirst books trips at times whose RFC 3339
+// representations don't sort in time order, because of their zones and
+// fractional seconds, and checks they're listed newest first.
+func TestListByOrganizationNewestFirst(t *testing.T) {
+	base := time.Date(2019, 6, 1, 9, 0, 0, 0, time.UTC)
+	clock := util.NewFakeClock(base)
+	ts := newTestServer(t, service.WithClock(clock))
+
+	times := []time.Time{
+		base.In(time.FixedZone("CEST", 2*60*60)).Add(-time.Hour),
+		base,
+		base.Add(500 * time.Millisecond),
+		base.Add(time.Second).In(time.FixedZone("EDT", -4*60*60)),
+	}
+	var refs []string
+	for _, created := range times {
+		clock.Set(created)
+		trip := testTrip()
+		trip["organization"] = "acme"
+		w := ts.do("POST", "/trips/booking", trip)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+		}
+		refs = append(refs, decodeConfirmation(t, w).Ref)
+	}
+
+	w := ts.do("GET", "/trips/bookings?org=acme", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var list service.TripList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, trip := range list.Trips {
+		got = append(got, trip.Ref)
+	}
+	want := []string{refs[3], refs[2], refs[1], refs[0]}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("listed %q, want newest first %q", got, want)
+	}
+}
+
+// TestListByDateRangePages books trips spanning months, some starting at the
+// same time, and checks paging through them lists each in the range once, in
+// order of their start, including when a page ends with the last trip of a
+// month.
+func TestListByDateRangePages(t *testing.T) {
+	ts := newTestServer(t)
+
+	base := time.Date(2019, 6, 29, 9, 0, 0, 0, time.UTC)
+	starts := []time.Time{
+		base,
+		base.Add(24 * time.Hour),
+		base.Add(2 * 24 * time.Hour),
+		base.Add(2 * 24 * time.Hour),
+		base.Add(4 * 24 * time.Hour),
+		base.Add(40 * 24 * time.Hour),
+	}
+	var want []string
+	for i, start := range append(starts, base.Add(-24*time.Hour)) {
+		trip := testTrip()
+		trip["start"] = start
+		trip["end"] = start.Add(72 * time.Hour)
+		w := ts.do("POST", "/trips/booking", trip)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+		}
+		if i < len(starts) {
+			want = append(want, decodeConfirmation(t, w).Ref)
+		}
+	}
+
+	listed := map[string]time.Time{}
+	var got []string
+	cursor := ""
+	for pages := 1; ; pages++ {
+		if pages > len(starts) {
+			t.Fatal("paging didn't reach the last page")
+		}
+		w := ts.do("GET", "/trips/bookings?from=2019-06-29&to=2019-08-31&limit=2&cursor="+cursor, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("list status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+		var list service.TripList
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Trips) > 2 {
+			t.Errorf("page %d has %d trips, want at most 2", pages, len(list.Trips))
+		}
+		for _, trip := range list.Trips {
+			got = append(got, trip.Ref)
+			listed[trip.Ref] = trip.Request.Start
+		}
+		if cursor = list.Cursor; cursor == "" {
+			break
+		}
+	}
+	if len(got) != len(want) || len(listed) != len(want) {
+		t.Fatalf("listed %q, want each of %q once", got, want)
+	}
+	inRange := map[string]bool{}
+	for _, ref := range want {
+		inRange[ref] = true
+	}
+	for i, ref := range got {
+		if !inRange[ref] {
+			t.Errorf("listed %s, which isn't in the range", ref)
+		}
+		if i > 0 && listed[ref].Before(listed[got[i-1]]) {
+			t.Errorf("listed %q out of start order", got)
+		}
+	}
+
+	for _, cursor := range []string{"junk", "eyJyZWYiOiJ4In0"} {
+		w := ts.do("GET", "/trips/bookings?from=2019-06-29&to=2019-08-31&cursor="+cursor, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("cursor %q: status = %d, want %d", cursor, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// TestDynamoDBFailures injects DynamoDB failures with the failure hook and
+// checks how booking and fetching trips report them. A trip which can't be
+// recorded has its sub-bookings cancelled.
+func TestDynamoDBFailures(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		operation string
+		err       error
+		status    int
+	}{
+		{"booking throttled", "PutItem", awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil), http.StatusTooManyRequests},
+		{"booking conflict", "PutItem", awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "conflict", nil), http.StatusConflict},
+		{"booking failed", "PutItem", errors.New("injected"), http.StatusInternalServerError},
+		{"get throttled", "GetItem", awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "throttled", nil), http.StatusTooManyRequests},
+		{"get failed", "GetItem", awserr.New(dynamodb.ErrCodeInternalServerError, "injected", nil), http.StatusInternalServerError},
+	} {
+		var tables []string
+		ts := newTestServer(t, service.WithFailureHook(func(ctx context.Context, operation, table string) error {
+			if operation != test.operation {
+				return nil
+			}
+			tables = append(tables, table)
+			return test.err
+		}))
+
+		var w *httptest.ResponseRecorder
+		if test.operation == "PutItem" {
+			w = ts.do("POST", "/trips/booking", testTrip())
+		} else {
+			w = ts.do("GET", "/trips/booking?ref=any", nil)
+		}
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d: %s", test.name, w.Code, test.status, w.Body)
+		}
+		if len(tables) == 0 || tables[0] != "trips" {
+			t.Errorf("%s: hook called for tables %q, want trips", test.name, tables)
+		}
+		for _, s := range []*servicetest.SubService{ts.flights, ts.hotels, ts.cars} {
+			if s.Bookings() != 0 {
+				t.Errorf("%s: %s has %d bookings, want 0", test.name, s.URL, s.Bookings())
+			}
+		}
+	}
+}
+
+// TestBookTripTimings checks a booking's confirmation only includes timings
+// when they're requested, and they're never included in reads of the trip,
+// including cached ones.
+func TestBookTripTimings(t *testing.T) {
+	t.Setenv("TRIP_CACHE_SIZE", "10")
+	ts := newTestServer(t)
+	ts.hotels.Fail(servicetest.Fault{Method: "POST", Delay: 20 * time.Millisecond})
+
+	w := ts.do("POST", "/trips/booking?timings=true", testTrip())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var booked struct {
+		Ref     string           `json:"ref"`
+		Timings map[string]int64 `json:"timings"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &booked); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"flight_ms", "hotel_ms", "car_ms", "storage_ms"} {
+		if ms, ok := booked.Timings[field]; !ok || ms < 0 {
+			t.Errorf("timings %v: %s = %d, want it set and non-negative", booked.Timings, field, ms)
+		}
+	}
+	if booked.Timings["hotel_ms"] < 20 {
+		t.Errorf("hotel_ms = %d, want at least the hotel's 20ms delay", booked.Timings["hotel_ms"])
+	}
+
+	for i := 0; i < 2; i++ {
+		// Booking filled the cache, so these are cached reads.
+		w = ts.do("GET", "/trips/booking?ref="+booked.Ref+"&timings=true", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("get status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+		if strings.Contains(w.Body.String(), "timings") {
+			t.Errorf("read %d includes timings: %s", i+1, w.Body)
+		}
+	}
+	if ts.db.Calls("GetItem") != 0 {
+		t.Errorf("trip was read from DynamoDB %d times, want it cached", ts.db.Calls("GetItem"))
+	}
+
+	w = ts.do("POST", "/trips/booking", testTrip())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "timings") {
+		t.Errorf("booking without timings=true includes them: %s", w.Body)
+	}
+}
+
+// concurrencyRecorder is a trip service whose bookings take a while, and
+// which records the most it was booking at once.
+type concurrencyRecorder struct {
+	service.TripService
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (c *concurrencyRecorder) BookTrip(ctx context.Context, r *service.BookTripRequest, opts service.BookOptions) (*service.TripConfirmation, error) {
+	c.mu.Lock()
+	c.inFlight++
+	if c.inFlight > c.max {
+		c.max = c.inFlight
+	}
+	c.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+	return &service.TripConfirmation{Ref: r.Name, Trip: r}, nil
+}
+
+// TestBulkBookingConcurrency checks a bulk booking never has more than
+// BULK_CONCURRENCY trips in flight, and its results are in request order.
+func TestBulkBookingConcurrency(t *testing.T) {
+	recorder := &concurrencyRecorder{}
+	s := &server{service: recorder, bulkConcurrency: 3}
+
+	var bookings []*service.BookTripRequest
+	for i := 0; i < 10; i++ {
+		data, err := json.Marshal(testTrip())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var booking service.BookTripRequest
+		if err := json.Unmarshal(data, &booking); err != nil {
+			t.Fatal(err)
+		}
+		booking.Name = fmt.Sprintf("trip%d", i)
+		bookings = append(bookings, &booking)
+	}
+
+	results := s.bookTrips(context.Background(), bookings)
+	if recorder.max != 3 {
+		t.Errorf("at most %d bookings were in flight, want %d", recorder.max, 3)
+	}
+	for i, result := range results {
+		if result.Index != i || result.Confirmation == nil || result.Confirmation.Ref != bookings[i].Name {
+			t.Errorf("result %d = %+v, want the confirmation of %s", i, result, bookings[i].Name)
+		}
+	}
+}
+
+// erroringTrips is a trip service which fails to book the trips named in
+// errs with their errors, and books any other trip.
+type erroringTrips struct {
+	service.TripService
+	errs map[string]error
+}
+
+func (e *erroringTrips) BookTrip(ctx context.Context, r *service.BookTripRequest, opts service.BookOptions) (*service.TripConfirmation, error) {
+	if err := e.errs[r.Name]; err != nil {
+		return nil, err
+	}
+	return &service.TripConfirmation{Ref: r.Name, Trip: r}, nil
+}
+
+// TestBulkBookingErrors checks each trip of a bulk booking gets the status and
+// error booking it alone would respond with, without exposing the internal
+// details of failures.
+func TestBulkBookingErrors(t *testing.T) {
+	trips := &erroringTrips{errs: map[string]error{
+		"conflict": &service.DownstreamError{Service: "hotel-service", StatusCode: http.StatusConflict, Message: "room unavailable"},
+		"outage":   &service.DownstreamError{Service: "hotel-service", StatusCode: http.StatusServiceUnavailable, Message: "dial tcp 10.0.0.5:8080: connection refused"},
+		"database": awserr.New(dynamodb.ErrCodeInternalServerError, "internal error in table trips", nil),
+	}}
+	handler := http.HandlerFunc((&server{service: trips, bulkConcurrency: 2}).bookingsHandler)
+
+	var bookings []interface{}
+	for _, name := range []string{"booked", "conflict", "outage", "database"} {
+		trip := testTrip()
+		trip["name"] = name
+		bookings = append(bookings, trip)
+	}
+	invalid := testTrip()
+	delete(invalid, "destination")
+	bookings = append(bookings, invalid, nil)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest("POST", "/trips/bookings", bookings))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var results []*bulkResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatalf("invalid results %q: %v", w.Body, err)
+	}
+	for i, want := range []struct {
+		status int
+		err    string
+	}{
+		{http.StatusCreated, ""},
+		{http.StatusConflict, "room unavailable"},
+		{http.StatusBadGateway, "hotel-service request failed"},
+		{http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)},
+		{http.StatusBadRequest, "destination"},
+		{http.StatusBadRequest, "missing trip"},
+	} {
+		if i >= len(results) {
+			t.Fatalf("got %d results, want 6", len(results))
+		}
+		result := results[i]
+		if result.Index != i || result.Status != want.status || !strings.Contains(result.Error, want.err) {
+			t.Errorf("result %d = %+v, want status %d and error %q", i, result, want.status, want.err)
+		}
+		if (result.Confirmation != nil) != (want.err == "") {
+			t.Errorf("result %d confirmation = %v, want one only if booked", i, result.Confirmation)
+		}
+	}
+	for _, internal := range []string{"10.0.0.5", "table trips"} {
+		if strings.Contains(w.Body.String(), internal) {
+			t.Errorf("results expose %q: %s", internal, w.Body)
+		}
+	}
+
+	var tooMany []interface{}
+	for i := 0; i <= maxBulkSize; i++ {
+		tooMany = append(tooMany, testTrip())
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newRequest("POST", "/trips/bookings", tooMany))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("%d trips: status = %d, want %d", len(tooMany), w.Code, http.StatusBadRequest)
+	}
+}
+
+// TestPatchTripInvalidatesCache checks a patched trip isn't read from the
+// cache as it was before the patch, including when the patch is stored but
+// fetching the patched trip's confirmation fails.
+func TestPatchTripInvalidatesCache(t *testing.T) {
+	t.Setenv("TRIP_CACHE_SIZE", "10")
+	t.Setenv("DOWNSTREAM_RETRY_BASE_DELAY", "1ms")
+	ts := newTestServer(t)
+
+	w := ts.do("POST", "/trips/booking", testTrip())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("booking status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	booked := decodeConfirmation(t, w)
+	target := "/trips/booking?ref=" + booked.Ref
+	if w := ts.do("GET", target, nil); w.Code != http.StatusOK {
+		t.Fatalf("get status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	ts.flights.Fail(servicetest.Fault{Method: "GET", Status: http.StatusServiceUnavailable})
+	w = ts.do("PATCH", target, map[string]interface{}{"hotel": testTrip()["hotel"]})
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("patch status = %d, want %d: %s", w.Code, http.StatusBadGateway, w.Body)
+	}
+	ts.flights.Reset()
+
+	w = ts.do("GET", target, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("get status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if got := decodeConfirmation(t, w).HotelConfirmation.Ref; got == booked.HotelConfirmation.Ref {
+		t.Errorf("read replaced hotel booking %s after patching", got)
+	}
+}
+
+// TestDeepHealth checks /healthz/deep reports each dependency's health, checking
+// every trips table and reusing the result until it's stale.
+func TestDeepHealth(t *testing.T) {
+	t.Setenv("TENANTS", "acme")
+	clock := util.NewFakeClock(time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC))
+	ts := newTestServer(t, service.WithClock(clock))
+	ts.hotels.Fail(servicetest.Fault{Status: http.StatusServiceUnavailable})
+	described := ts.db.Calls("DescribeTable")
+
+	w := ts.do("GET", "/healthz/deep", nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	var report service.HealthReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Status != service.HealthUnhealthy {
+		t.Errorf("report status = %q, want %q", report.Status, service.HealthUnhealthy)
+	}
+	for name, want := range map[string]string{
+		"dynamodb":       service.HealthOK,
+		"flight-service": service.HealthOK,
+		"hotel-service":  service.HealthUnhealthy,
+		"car-service":    service.HealthOK,
+	} {
+		if health := report.Components[name]; health == nil || health.Status != want {
+			t.Errorf("%s: health = %+v, want status %q", name, health, want)
+		}
+	}
+
+	if got := ts.db.Calls("DescribeTable"); got != described+2 {
+		t.Errorf("described tables %d times, want 2: the shared table and the tenant's", got-described)
+	}
+
+	ts.hotels.Reset()
+	described = ts.db.Calls("DescribeTable")
+	if w := ts.do("GET", "/healthz/deep", nil); w.Code != http.StatusOK {
+		t.Errorf("healthy status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if got := ts.db.Calls("DescribeTable"); got != described {
+		t.Errorf("described tables %d times within the result's TTL", got-described)
+	}
+
+	clock.Advance(time.Minute)
+	ts.db.Fail("DescribeTable", http.StatusBadRequest, "ResourceNotFoundException", 2)
+	if w := ts.do("GET", "/healthz/deep", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status with a missing table = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if got := ts.db.Calls("DescribeTable"); got != described+1 {
+		t.Errorf("described tables %d times after the result went stale, want 1", got-described)
+	}
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+const (
+	// tripCacheSizeEnv enables caching of trip confirmations, holding at
+	// most that many.
+	tripCacheSizeEnv    = "TRIP_CACHE_SIZE"
+	tripCacheTTLEnv     = "TRIP_CACHE_TTL"
+	defaultTripCacheTTL = 30 * time.Second
+)
+
+// tripCacheRequests counts trip confirmation cache lookups by result.
+var tripCacheRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "trip_cache_requests_total",
+		Help: "Number of trip confirmation cache lookups by result (hit or miss).",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	util.MustRegister(tripCacheRequests)
+}
+
+// confirmationCache is an LRU cache of trip confirmations, so frequently read
+// trips don't need a DynamoDB read and a call to each sub-service every time.
+// Entries expire after the TTL, which bounds how stale a read can be: changes
+// made through trip-service invalidate the entry, but changes made directly
+// against a sub-service don't. A nil cache caches nothing.
+type confirmationCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	clock   util.Clock
+}
+
+type cacheEntry struct {
+	key          string
+	confirmation TripConfirmation
+	expires      time.Time
+}
+
+// newConfirmationCacheFromEnv returns a cache of at most TRIP_CACHE_SIZE
+// confirmations which expire after TRIP_CACHE_TTL (default 30s), or nil if
+// TRIP_CACHE_SIZE isn't set. Expiry is timed by the clock.
+func newConfirmationCacheFromEnv(clock util.Clock) (*confirmationCache, error) {
+	size, err := util.IntFromEnv(tripCacheSizeEnv, 0)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	ttl, err := util.DurationFromEnv(tripCacheTTLEnv, defaultTripCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &confirmationCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		clock:   clock,
+	}, nil
+}
+
+// cacheKey keys a trip by its table as well as its ref, so tenants never see
+// each other's trips.
+func cacheKey(table, ref string) string {
+	return table + "/" + ref
+}
+
+// get returns a copy of the cached confirmation, if there's an unexpired one,
+// and tags the request's span with whether it was a hit.
+func (c *confirmationCache) get(ctx context.Context, key string) (*TripConfirmation, bool) {
+	if c == nil {
+		return nil, false
+	}
+	confirmation, ok := c.lookup(key)
+	result := "miss"
+	if ok {
+		result = "hit"
+	}
+	tripCacheRequests.WithLabelValues(result).Inc()
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span.SetTag("cache", result)
+	}
+	return confirmation, ok
+}
+
+func (c *confirmationCache) lookup(key string) (*TripConfirmation, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if c.clock.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	// Callers may modify the confirmation, e.g. to omit the request, so
+	// they're given a copy.
+	confirmation := entry.confirmation
+	return &confirmation, true
+}
+
+// put caches a copy of the confirmation, evicting the least recently used
+// confirmation if the cache is full.
+func (c *confirmationCache) put(key string, confirmation *TripConfirmation) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &cacheEntry{
+		key:          key,
+		confirmation: *confirmation,
+		expires:      c.clock.Now().Add(c.ttl),
+	}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate removes the confirmation with the given key, if it's cached.
+func (c *confirmationCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
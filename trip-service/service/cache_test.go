@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+func newTestCache(t *testing.T, size int, clock util.Clock) *confirmationCache {
+	t.Setenv(tripCacheSizeEnv, strconv.Itoa(size))
+	t.Setenv(tripCacheTTLEnv, "30s")
+	c, err := newConfirmationCacheFromEnv(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestConfirmationCache checks hits and misses are tagged on the request's
+// span and counted, and entries are invalidated, expire after the TTL, and
+// are evicted least recently used first.
+func TestConfirmationCache(t *testing.T) {
+	clock := util.NewFakeClock(time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC))
+	c := newTestCache(t, 2, clock)
+	tracer := mocktracer.New()
+	hits, misses := testutil.ToFloat64(tripCacheRequests.WithLabelValues("hit")), testutil.ToFloat64(tripCacheRequests.WithLabelValues("miss"))
+
+	// get looks the key up in a request's span, and returns whether it was
+	// a hit and the span's cache tag.
+	get := func(key string) (*TripConfirmation, bool, interface{}) {
+		span := tracer.StartSpan("GetBooking").(*mocktracer.MockSpan)
+		defer span.Finish()
+		confirmation, ok := c.get(opentracing.ContextWithSpan(context.Background(), span), key)
+		return confirmation, ok, span.Tag("cache")
+	}
+
+	if _, ok, tag := get("trips/a"); ok || tag != "miss" {
+		t.Errorf("empty cache: hit %v, tagged %v, want a miss", ok, tag)
+	}
+	c.put("trips/a", &TripConfirmation{Ref: "a"})
+	confirmation, ok, tag := get("trips/a")
+	if !ok || confirmation.Ref != "a" || tag != "hit" {
+		t.Fatalf("cached: got %+v, hit %v, tagged %v, want a hit", confirmation, ok, tag)
+	}
+	// Hits are copies, so callers can't modify the cached confirmation.
+	confirmation.Ref = "modified"
+	if confirmation, _, _ := get("trips/a"); confirmation.Ref != "a" {
+		t.Errorf("modifying a hit changed the cached confirmation to %+v", confirmation)
+	}
+	if got := testutil.ToFloat64(tripCacheRequests.WithLabelValues("hit")) - hits; got != 2 {
+		t.Errorf("counted %v hits, want 2", got)
+	}
+	if got := testutil.ToFloat64(tripCacheRequests.WithLabelValues("miss")) - misses; got != 1 {
+		t.Errorf("counted %v misses, want 1", got)
+	}
+
+	c.invalidate("trips/a")
+	if _, ok, _ := get("trips/a"); ok {
+		t.Error("invalidated confirmation is still cached")
+	}
+
+	c.put("trips/a", &TripConfirmation{Ref: "a"})
+	c.put("trips/b", &TripConfirmation{Ref: "b"})
+	get("trips/a")
+	c.put("trips/c", &TripConfirmation{Ref: "c"})
+	if _, ok, _ := get("trips/b"); ok {
+		t.Error("least recently used confirmation wasn't evicted")
+	}
+	if _, ok, _ := get("trips/a"); !ok {
+		t.Error("recently used confirmation was evicted")
+	}
+
+	clock.Advance(30 * time.Second)
+	if _, ok, _ := get("trips/c"); !ok {
+		t.Error("confirmation expired at the TTL, want it kept until after")
+	}
+	clock.Advance(time.Nanosecond)
+	if _, ok, _ := get("trips/c"); ok {
+		t.Error("confirmation didn't expire after the TTL")
+	}
+}
+
+func TestConfirmationCacheDisabled(t *testing.T) {
+	t.Setenv(tripCacheSizeEnv, "")
+	c, err := newConfirmationCacheFromEnv(util.SystemClock)
+	if err != nil || c != nil {
+		t.Fatalf("got %v, %v, want no cache", c, err)
+	}
+	// A nil cache caches nothing.
+	c.put("trips/a", &TripConfirmation{Ref: "a"})
+	if _, ok := c.get(context.Background(), "trips/a"); ok {
+		t.Error("nil cache returned a hit")
+	}
+	c.invalidate("trips/a")
+}
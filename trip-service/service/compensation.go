@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+// compensationTimeout bounds how long cancelling the sub-bookings of a failed
+// trip may take.
+const compensationTimeout = 10 * time.Second
+
+// compensate cancels the sub-bookings which were made for a trip that failed
+// to book. The legs are cancelled concurrently using a context detached from
+// the request's, which may already be cancelled, and bounded by
+// compensationTimeout so cleanup can't hang.
+func (d *dynamoService) compensate(ctx context.Context, trip *TripBooking) {
+	ctx, cancel := context.WithTimeout(util.Detach(ctx), compensationTimeout)
+	defer cancel()
+
+	legs := []struct {
+		name string
+		svc  *downstream
+		url  string
+		ref  string
+	}{
+		{ComponentFlight, d.flights, d.flights.url + "/flights/booking", trip.FlightRef},
+		{ComponentHotel, d.hotels, d.hotels.url + "/hotels/booking", trip.HotelRef},
+		{ComponentCar, d.cars, d.cars.url + "/cars/booking", trip.CarRef},
+	}
+
+	var g errgroup.Group
+	for _, leg := range legs {
+		if leg.ref == "" {
+			continue
+		}
+		leg := leg
+		g.Go(func() error {
+			err := d.cancel(ctx, leg.svc, fmt.Sprintf("%s?ref=%s", leg.url, leg.ref))
+			// A failed compensation leaves an orphaned booking behind,
+			// so it's logged on the trip's span too.
+			entry := util.LoggerWithSpan(ctx).WithFields(log.Fields{
+				"leg":     leg.name,
+				"leg_ref": leg.ref,
+			})
+			if err != nil {
+				entry.WithFields(log.Fields{
+					"error": err,
+				}).Error("Failed to compensate booking")
+				return err
+			}
+			entry.Info("Compensated booking")
+			return nil
+		})
+	}
+	g.Wait()
+}
+
+// cancel cancels the sub-booking at the given URL. A booking which no longer
+// exists is treated as cancelled.
+func (d *dynamoService) cancel(ctx context.Context, svc *downstream, url string) error {
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := svc.do(req, true)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return svc.newDownstreamError(resp, data)
+	}
+	return nil
+}
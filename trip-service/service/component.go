@@ -0,0 +1,17 @@
+package service
+
+// Component types of a trip. Wherever a trip's components are listed, they're
+// listed in this order: flight, hotel, then car. Sub-bookings may be made or
+// fetched concurrently, so listings mustn't depend on which finished first.
+const (
+	ComponentFlight = "flight"
+	ComponentHotel  = "hotel"
+	ComponentCar    = "car"
+)
+
+// componentRank orders the component types for listings.
+var componentRank = map[string]int{
+	ComponentFlight: 0,
+	ComponentHotel:  1,
+	ComponentCar:    2,
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	flights "github.com/realkinetic/cloud-native-meetup-2019/flight-service/service"
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// TestConfirmationGolden checks the serialized shape of trip confirmations
+// against the golden files in testdata. Run with -update to regenerate them.
+func TestConfirmationGolden(t *testing.T) {
+	created := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	request := testTripRequest()
+	request.Hotel, request.Car = nil, nil
+
+	for _, test := range []struct {
+		name         string
+		confirmation *TripConfirmation
+	}{
+		{"flight_only", &TripConfirmation{
+			Ref:  "TR1",
+			Trip: request,
+			FlightConfirmation: &flights.FlightConfirmation{
+				Ref:     "FL1",
+				Flight:  request.Flight,
+				Created: created,
+				Version: 1,
+				Price:   util.Money(10000),
+			},
+			TotalPrice: util.Money(10000),
+		}},
+		// Without the request echo, or any components, only the ref and
+		// total are left.
+		{"minimal", &TripConfirmation{Ref: "TR2"}},
+	} {
+		got, err := json.MarshalIndent(test.confirmation, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, '\n')
+		path := filepath.Join("testdata", test.name+".golden")
+		if *update {
+			if err := ioutil.WriteFile(path, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+// Trips are indexed by when they start in the start-month-index GSI. The
+// index is partitioned by the UTC month the trip starts in, e.g. "2019-06",
+// and sorted by the start time within the month. A GSI's partition key must
+// be matched exactly, so the month is a bucket coarse enough that a typical
+// range, such as this week's trips, is one or two queries, but fine enough
+// that trips spread across partitions as time passes rather than all landing
+// in one. Every trip starting in the same month does share a partition, so if
+// a single month's bookings outgrow one, the bucket should be sharded, e.g.
+// by appending a suffix derived from the ref, and each shard queried.
+const (
+	startIndex = "start-month-index"
+
+	startMonthFormat = "2006-01"
+	// startAtFormat is fixed width, unlike time.RFC3339Nano, so start times
+	// sort as strings in time order. It's at second precision.
+	startAtFormat = "2006-01-02T15:04:05Z"
+
+	// maxDateRange bounds the range of a date range query, and so the
+	// number of months it queries.
+	maxDateRange = 92 * 24 * time.Hour
+)
+
+// ErrInvalidDateRange is returned when listing trips over a range which ends
+// before it starts or is longer than maxDateRange.
+var ErrInvalidDateRange = fmt.Errorf("date range must end after it starts and span at most %d days",
+	int(maxDateRange/(24*time.Hour)))
+
+// startMonth returns the start-month-index partition of a trip starting at
+// start.
+func startMonth(start time.Time) string {
+	return start.UTC().Format(startMonthFormat)
+}
+
+// startAt returns the start-month-index sort key of a trip starting at start.
+func startAt(start time.Time) string {
+	return start.UTC().Format(startAtFormat)
+}
+
+// ListByDateRange returns at most limit of the trips starting from from up to
+// and including to, in order of their start, starting from the cursor of the
+// previous page, if any. It queries each month the range spans until the page
+// is full. Like ListByOrganization, trips are returned as stored, and the
+// index is eventually consistent.
+func (d *dynamoService) ListByDateRange(ctx context.Context, from, to time.Time, limit int, cursor string) (*TripList, error) {
+	if to.Before(from) || to.Sub(from) > maxDateRange {
+		return nil, ErrInvalidDateRange
+	}
+	table, err := d.tripTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	startKey, err := util.DecodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	from, to = from.UTC(), to.UTC()
+	month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if startKey != nil {
+		// The cursor is the index key of the last trip listed, so the next
+		// page carries on from its month.
+		if month, err = cursorMonth(startKey, from, to); err != nil {
+			return nil, err
+		}
+	}
+
+	list := &TripList{Trips: []*TripBooking{}}
+	for !month.After(to) {
+		input := &dynamodb.QueryInput{
+			TableName:              aws.String(table),
+			IndexName:              aws.String(startIndex),
+			KeyConditionExpression: aws.String("#month = :month AND #start BETWEEN :from AND :to"),
+			ExpressionAttributeNames: map[string]*string{
+				"#month": aws.String("start_month"),
+				"#start": aws.String("start_at"),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":month": {S: aws.String(startMonth(month))},
+				":from":  {S: aws.String(startAt(from))},
+				":to":    {S: aws.String(startAt(to))},
+			},
+			Limit:             aws.Int64(int64(limit - len(list.Trips))),
+			ExclusiveStartKey: startKey,
+		}
+
+		var result *dynamodb.QueryOutput
+		err := d.traceDynamoDB(ctx, "Query", table, func(ctx context.Context) error {
+			var err error
+			result, err = d.reader.QueryWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		var trips []*TripBooking
+		if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &trips); err != nil {
+			return nil, err
+		}
+		list.Trips = append(list.Trips, trips...)
+
+		if startKey = result.LastEvaluatedKey; len(startKey) == 0 {
+			month = month.AddDate(0, 1, 0)
+		}
+		if len(list.Trips) >= limit {
+			if len(startKey) > 0 || !month.After(to) {
+				last := list.Trips[len(list.Trips)-1]
+				if list.Cursor, err = util.EncodeCursor(startIndexKey(last)); err != nil {
+					return nil, err
+				}
+			}
+			break
+		}
+	}
+	return list, nil
+}
+
+// startIndexKey returns the start-month-index key of the trip, which a query
+// of the index can start after.
+func startIndexKey(trip *TripBooking) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"ref":         {S: aws.String(trip.Ref)},
+		"start_month": {S: aws.String(trip.StartMonth)},
+		"start_at":    {S: aws.String(trip.StartAt)},
+	}
+}
+
+// cursorMonth returns the month to carry on listing the range from the
+// start-month-index key decoded from a cursor. It returns ErrInvalidCursor if
+// the key isn't one, or its month isn't in the range.
+func cursorMonth(key map[string]*dynamodb.AttributeValue, from, to time.Time) (time.Time, error) {
+	if len(key) != 3 || key["ref"] == nil || key["start_at"] == nil || key["start_month"] == nil {
+		return time.Time{}, ErrInvalidCursor
+	}
+	month, err := time.Parse(startMonthFormat, aws.StringValue(key["start_month"].S))
+	if err != nil || month.Before(time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)) || month.After(to) {
+		return time.Time{}, ErrInvalidCursor
+	}
+	return month, nil
+}
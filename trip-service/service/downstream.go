@@ -0,0 +1,295 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+const (
+	// breakerThreshold is the number of consecutive failures after which a
+	// downstream's breaker opens.
+	breakerThreshold = 5
+
+	// breakerCooldown is how long a breaker stays open before allowing a
+	// trial request through.
+	breakerCooldown = 30 * time.Second
+)
+
+// ErrBreakerOpen is returned when a request isn't attempted because the
+// downstream's circuit breaker is open.
+var ErrBreakerOpen = errors.New("downstream circuit breaker open")
+
+var (
+	downstreamRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "downstream_retries_total",
+			Help: "Number of retried requests to downstream services.",
+		},
+		[]string{"service"},
+	)
+	downstreamBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "downstream_breaker_state",
+			Help: "Circuit breaker state per downstream service (0 = closed, 1 = half-open, 2 = open).",
+		},
+		[]string{"service"},
+	)
+)
+
+func init() {
+	util.MustRegister(downstreamRetries, downstreamBreakerState)
+}
+
+// downstream is a client for one of the booking sub-services. It retries
+// idempotent requests and stops sending requests for a while once the
+// service is persistently failing.
+type downstream struct {
+	name string
+	// url is the base URL of the service.
+	url     string
+	client  *http.Client
+	breaker *breaker
+	// retry decides which failed idempotent requests are retried.
+	retry util.RetryPolicy
+}
+
+func newDownstream(name, url string, client *http.Client, clock util.Clock, retry util.RetryPolicy) *downstream {
+	return &downstream{
+		name:    name,
+		url:     url,
+		client:  client,
+		breaker: newBreaker(name, clock),
+		retry:   retry,
+	}
+}
+
+// checkLatency flags a sub-service call which started at start and took
+// longer than slowCallThreshold, with a warning and on the request's span, so
+// slow dependencies stand out without reading every trace.
+func (d *dynamoService) checkLatency(ctx context.Context, svc *downstream, operation, ref string, start time.Time) {
+	elapsed := d.clock.Since(start)
+	if elapsed <= d.slowCallThreshold {
+		return
+	}
+	elapsedMillis := int64(elapsed / time.Millisecond)
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span.SetTag("slow_call", true)
+		util.LogSpanFields(span,
+			tracelog.String("event", "slow_call"),
+			tracelog.String("service", svc.name),
+			tracelog.String("operation", operation),
+			tracelog.String("ref", ref),
+			tracelog.Int64("elapsed_ms", elapsedMillis),
+		)
+	}
+	util.Logger(ctx).WithFields(log.Fields{
+		"service":    svc.name,
+		"operation":  operation,
+		"leg_ref":    ref,
+		"elapsed_ms": elapsedMillis,
+	}).Warn("Slow sub-service call")
+}
+
+// serviceURLFromEnv returns the base URL of a sub-service from the given env.
+// If it isn't set, the default is used if SERVICE_DISCOVERY_DEFAULTS is true.
+// Otherwise it's an error, so a missing URL is caught at startup rather than
+// by the first booking.
+func serviceURLFromEnv(env, defaultURL string) (string, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		if useDefaults, _ := strconv.ParseBool(os.Getenv(serviceDiscoveryDefaultsEnv)); useDefaults {
+			return defaultURL, nil
+		}
+		return "", fmt.Errorf("%s must be set", env)
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return "", fmt.Errorf("invalid %s %q", env, value)
+	}
+	return strings.TrimSuffix(value, "/"), nil
+}
+
+// do sends the request. If idempotent is set, failures the retry policy
+// classifies as retryable are retried with its backoff while the request's
+// retry budget lasts. Each attempt sends a copy of the request, so headers
+// added to one aren't sent again by the next. Requests with a body must not
+// be idempotent since the body can only be read once.
+func (d *downstream) do(req *http.Request, idempotent bool) (*http.Response, error) {
+	retries := 0
+	if idempotent {
+		retries = d.retry.MaxRetries
+	}
+	for retry := 0; ; retry++ {
+		if !d.breaker.allow() {
+			return nil, ErrBreakerOpen
+		}
+		resp, err := d.client.Do(util.CloneRequest(req))
+		if req.Context().Err() != nil {
+			// The caller gave up, so there's no point retrying, and the
+			// failure says nothing about the downstream's health.
+			return resp, err
+		}
+		if isDownstreamFailure(resp, err) {
+			d.breaker.failure()
+		} else {
+			d.breaker.success()
+		}
+		statusCode := 0
+		if resp != nil {
+			statusCode = resp.StatusCode
+		}
+		class := d.retry.Classify(statusCode, err)
+		if class == util.NotRetryable || retry >= retries || !util.SpendRetry(req.Context()) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if err := sleep(req.Context(), d.retry.Delay(retry, class)); err != nil {
+			return nil, err
+		}
+		downstreamRetries.WithLabelValues(d.name).Inc()
+	}
+}
+
+// DownstreamError is an error response from one of the booking sub-services.
+type DownstreamError struct {
+	// Service is the name of the sub-service.
+	Service string
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Message is the error from the response body.
+	Message string
+	// Details are any structured details of the error.
+	Details json.RawMessage
+	// RetryAfter is the response's Retry-After header, if any, e.g. when the
+	// sub-service is throttling requests.
+	RetryAfter string
+}
+
+func (e *DownstreamError) Error() string {
+	return fmt.Sprintf("%s returned status code %d (%s)", e.Service, e.StatusCode, e.Message)
+}
+
+// newDownstreamError builds the error for a failed response from the given
+// body. Sub-services respond with either a structured JSON error or a plain
+// text one, which is used as the message as is.
+func (d *downstream) newDownstreamError(resp *http.Response, body []byte) *DownstreamError {
+	err := &DownstreamError{
+		Service:    d.name,
+		StatusCode: resp.StatusCode,
+		RetryAfter: resp.Header.Get("Retry-After"),
+	}
+	var structured struct {
+		Error   string          `json:"error"`
+		Details json.RawMessage `json:"details"`
+	}
+	if json.Unmarshal(body, &structured) == nil && structured.Error != "" {
+		err.Message = structured.Error
+		err.Details = structured.Details
+		return err
+	}
+	err.Message = strings.TrimSpace(string(body))
+	return err
+}
+
+// isDownstreamFailure indicates if the request failed in a way that is the
+// downstream's fault, i.e. a transport error or a 5xx response.
+func isDownstreamFailure(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// sleep waits for the given duration or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+// breaker is a consecutive-failure circuit breaker. It opens after
+// breakerThreshold consecutive failures, then after breakerCooldown lets a
+// single trial request through, closing again if it succeeds.
+type breaker struct {
+	mu       sync.Mutex
+	name     string
+	state    breakerState
+	failures int
+	openedAt time.Time
+	clock    util.Clock
+}
+
+func newBreaker(name string, clock util.Clock) *breaker {
+	b := &breaker{name: name, clock: clock}
+	b.setState(breakerClosed)
+	return b
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.clock.Since(b.openedAt) < breakerCooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		// Only the trial request is let through until it completes.
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.setState(breakerClosed)
+}
+
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= breakerThreshold {
+		b.openedAt = b.clock.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// setState must be called with the lock held.
+func (b *breaker) setState(state breakerState) {
+	b.state = state
+	downstreamBreakerState.WithLabelValues(b.name).Set(float64(state))
+}
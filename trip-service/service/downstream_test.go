@@ -0,0 +1,183 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+	"github.com/realkinetic/cloud-native-meetup-2019/util/servicetest"
+)
+
+// testRetryPolicy retries quickly so tests don't wait on backoff.
+var testRetryPolicy = util.RetryPolicy{
+	MaxRetries:        2,
+	BaseDelay:         time.Millisecond,
+	ThrottleBaseDelay: time.Millisecond,
+	MaxDelay:          time.Millisecond,
+	Classify:          util.ClassifyHTTP,
+}
+
+// newTestDownstream returns a downstream for a server which responds to
+// requests with the handler, and the number of requests it received.
+func newTestDownstream(t *testing.T, handler http.HandlerFunc) (*downstream, *int32) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return newDownstream("test", server.URL, server.Client(), util.SystemClock, testRetryPolicy), &attempts
+}
+
+// statuses responds to the nth request with the nth status, and to any after
+// the last with the last.
+func statuses(codes ...int) http.HandlerFunc {
+	var n int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		i := int(atomic.AddInt32(&n, 1)) - 1
+		if i >= len(codes) {
+			i = len(codes) - 1
+		}
+		w.WriteHeader(codes[i])
+	}
+}
+
+func TestDownstreamDo(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		statuses   []int
+		idempotent bool
+		want       int
+		attempts   int32
+	}{
+		{"success", []int{200}, true, 200, 1},
+		{"retried", []int{503, 500, 200}, true, 200, 3},
+		{"throttled", []int{429, 200}, true, 200, 2},
+		{"retries exhausted", []int{503}, true, 503, 3},
+		{"not retryable", []int{404, 200}, true, 404, 1},
+		{"not idempotent", []int{503, 200}, false, 503, 1},
+	} {
+		d, attempts := newTestDownstream(t, statuses(test.statuses...))
+		req, err := http.NewRequest("GET", d.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := d.do(req, test.idempotent)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.want {
+			t.Errorf("%s: status = %d, want %d", test.name, resp.StatusCode, test.want)
+		}
+		if got := atomic.LoadInt32(attempts); got != test.attempts {
+			t.Errorf("%s: got %d attempts, want %d", test.name, got, test.attempts)
+		}
+	}
+}
+
+// TestDownstreamDoCancelled checks a request whose context ends isn't retried
+// and doesn't count against the downstream's breaker.
+func TestDownstreamDoCancelled(t *testing.T) {
+	d, attempts := newTestDownstream(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest("GET", d.url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.do(req.WithContext(ctx), true); err == nil {
+		t.Fatal("do succeeded after the deadline")
+	}
+	if got := atomic.LoadInt32(attempts); got != 1 {
+		t.Errorf("got %d attempts, want 1", got)
+	}
+	if d.breaker.failures != 0 {
+		t.Errorf("breaker counted %d failures, want 0", d.breaker.failures)
+	}
+}
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	clock := util.NewFakeClock(time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC))
+	b := newBreaker("test", clock)
+	for i := 0; i < breakerThreshold; i++ {
+		if !b.allow() {
+			t.Fatalf("breaker opened after %d failures, want %d", i, breakerThreshold)
+		}
+		b.failure()
+	}
+	if b.allow() {
+		t.Fatal("breaker didn't open")
+	}
+
+	clock.Advance(breakerCooldown)
+	if !b.allow() {
+		t.Fatal("breaker didn't let a trial request through after the cooldown")
+	}
+	if b.allow() {
+		t.Error("breaker let a second request through while half-open")
+	}
+	b.success()
+	if !b.allow() {
+		t.Error("breaker didn't close after the trial request succeeded")
+	}
+}
+
+func TestServiceURLFromEnv(t *testing.T) {
+	const env, defaultURL = "TEST_SERVICE_URL", "http://test-service:8080"
+	for _, test := range []struct {
+		name     string
+		value    string
+		defaults string
+		want     string
+		err      string
+	}{
+		{"set", "http://flights.internal:9000", "", "http://flights.internal:9000", ""},
+		{"trailing slash", "http://flights.internal:9000/", "", "http://flights.internal:9000", ""},
+		{"set overrides defaults", "http://flights.internal:9000", "true", "http://flights.internal:9000", ""},
+		{"missing", "", "", "", "TEST_SERVICE_URL must be set"},
+		{"missing with defaults disabled", "", "false", "", "TEST_SERVICE_URL must be set"},
+		{"missing with defaults", "", "true", defaultURL, ""},
+		{"no scheme", "flights.internal:9000", "", "", `invalid TEST_SERVICE_URL "flights.internal:9000"`},
+		{"path only", "/flights", "", "", `invalid TEST_SERVICE_URL "/flights"`},
+	} {
+		t.Setenv(env, test.value)
+		t.Setenv(serviceDiscoveryDefaultsEnv, test.defaults)
+		got, err := serviceURLFromEnv(env, defaultURL)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: error = %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+// TestNewTripServiceMissingURL checks the service doesn't start without
+// a sub-service's URL, naming the variable which is missing.
+func TestNewTripServiceMissingURL(t *testing.T) {
+	servicetest.NewDynamoDB(t)
+	t.Setenv(flightServiceURLEnv, "http://flight-service:8080")
+	t.Setenv(hotelServiceURLEnv, "")
+	t.Setenv(carServiceURLEnv, "http://car-service:8082")
+	t.Setenv(serviceDiscoveryDefaultsEnv, "")
+	if _, err := NewTripService(); err == nil || !strings.Contains(err.Error(), hotelServiceURLEnv) {
+		t.Errorf("NewTripService() error = %v, want %s missing", err, hotelServiceURLEnv)
+	}
+
+	t.Setenv(serviceDiscoveryDefaultsEnv, "true")
+	if _, err := NewTripService(); err != nil {
+		t.Errorf("NewTripService() with discovery defaults: %v", err)
+	}
+}
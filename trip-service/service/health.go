@@ -0,0 +1,146 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// healthCheckTimeout bounds each dependency's health check, so a hung
+// dependency doesn't hang the health check.
+const healthCheckTimeout = time.Second
+
+// dynamoHealthTTL is how long a DynamoDB health check's result is reused.
+const dynamoHealthTTL = 10 * time.Second
+
+// Health statuses of a HealthReport and its components.
+const (
+	HealthOK        = "ok"
+	HealthUnhealthy = "unhealthy"
+)
+
+// HealthReport is the health of the trip service's dependencies.
+type HealthReport struct {
+	// Status is HealthOK only if every component is.
+	Status     string                      `json:"status"`
+	Components map[string]*ComponentHealth `json:"components"`
+}
+
+// ComponentHealth is the health of one dependency.
+type ComponentHealth struct {
+	Status string `json:"status"`
+	// Error is why the component is unhealthy.
+	Error string `json:"error,omitempty"`
+}
+
+// CheckHealth concurrently checks DynamoDB and each sub-service's /healthz.
+func (d *dynamoService) CheckHealth(ctx context.Context) *HealthReport {
+	checks := map[string]func(context.Context) error{
+		"dynamodb":     d.checkDynamoDB,
+		d.flights.name: d.flights.checkHealth,
+		d.hotels.name:  d.hotels.checkHealth,
+		d.cars.name:    d.cars.checkHealth,
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		report = &HealthReport{
+			Status:     HealthOK,
+			Components: make(map[string]*ComponentHealth, len(checks)),
+		}
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+			health := &ComponentHealth{Status: HealthOK}
+			if err := check(ctx); err != nil {
+				health = &ComponentHealth{Status: HealthUnhealthy, Error: err.Error()}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Components[name] = health
+			if health.Status != HealthOK {
+				report.Status = HealthUnhealthy
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return report
+}
+
+// checkDynamoDB checks every trips table the service serves, i.e. the shared
+// table unless TENANT_STRICT is set and each tenant's, can be described. The
+// result is reused for dynamoHealthTTL, so frequent probes don't each cost a
+// DescribeTable call per table.
+func (d *dynamoService) checkDynamoDB(ctx context.Context) error {
+	if checked, err := d.dynamoHealth.get(d.clock.Now()); checked {
+		return err
+	}
+	var err error
+	for _, table := range d.tenants.Tables(tripsTable) {
+		if _, err = d.db.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(table),
+		}); err != nil {
+			err = fmt.Errorf("describing %s: %v", table, err)
+			break
+		}
+	}
+	d.dynamoHealth.put(err, d.clock.Now())
+	return err
+}
+
+// healthCache holds the latest result of a health check. The zero value is
+// an empty cache.
+type healthCache struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// get returns the cached result, and whether there is one, i.e. the check was
+// made less than dynamoHealthTTL before now.
+func (c *healthCache) get(now time.Time) (checked bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checked.IsZero() || now.Sub(c.checked) >= dynamoHealthTTL {
+		return false, nil
+	}
+	return true, c.err
+}
+
+func (c *healthCache) put(err error, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked, c.err = now, err
+}
+
+// checkHealth checks the sub-service's /healthz. It bypasses the retries and
+// breaker since it reports on the service rather than relying on it.
+func (d *downstream) checkHealth(ctx context.Context) error {
+	req, err := http.NewRequest("GET", d.url+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s /healthz returned %d", d.name, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+var idempotencyTable = util.TableName("trip_idempotency")
+
+// idempotencyRecord maps a client-provided idempotency key to the trip it
+// booked.
+type idempotencyRecord struct {
+	Key     string    `json:"key"`
+	TripRef string    `json:"trip_ref"`
+	Created time.Time `json:"created"`
+}
+
+// idempotencyTable returns the idempotency table for the request's tenant.
+func (d *dynamoService) idempotencyTable(ctx context.Context) (string, error) {
+	return d.tenants.Table(ctx, idempotencyTable)
+}
+
+// lookupIdempotencyKey returns the ref of the trip booked with the given
+// idempotency key, or an empty string if there is none.
+func (d *dynamoService) lookupIdempotencyKey(ctx context.Context, key string) (string, error) {
+	table, err := d.idempotencyTable(ctx)
+	if err != nil {
+		return "", err
+	}
+	var result *dynamodb.GetItemOutput
+	err = d.traceDynamoDB(ctx, "GetItem", table, func(ctx context.Context) error {
+		var err error
+		result, err = d.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(table),
+			Key: map[string]*dynamodb.AttributeValue{
+				"key": {
+					S: aws.String(key),
+				},
+			},
+			ConsistentRead: aws.Bool(true),
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var record idempotencyRecord
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &record); err != nil {
+		return "", err
+	}
+	return record.TripRef, nil
+}
+
+// putTripIdempotently atomically stores the trip along with the record of the
+// idempotency key used to book it, so a crash can't leave one without the
+// other. If the key has already been used, the transaction is cancelled and
+// nothing is written.
+func (d *dynamoService) putTripIdempotently(ctx context.Context, trip *TripBooking, key string) error {
+	tripTable, err := d.tripTable(ctx)
+	if err != nil {
+		return err
+	}
+	recordTable, err := d.idempotencyTable(ctx)
+	if err != nil {
+		return err
+	}
+	tripItem, err := dynamodbattribute.MarshalMap(trip)
+	if err != nil {
+		return err
+	}
+	recordItem, err := dynamodbattribute.MarshalMap(&idempotencyRecord{
+		Key:     key,
+		TripRef: trip.Ref,
+		Created: trip.Created,
+	})
+	if err != nil {
+		return err
+	}
+
+	return d.traceDynamoDB(ctx, "TransactWriteItems", tripTable, func(ctx context.Context) error {
+		_, err := d.db.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{
+					Put: &dynamodb.Put{
+						TableName:           aws.String(tripTable),
+						Item:                tripItem,
+						ConditionExpression: aws.String("attribute_not_exists(#ref)"),
+						ExpressionAttributeNames: map[string]*string{
+							"#ref": aws.String("ref"),
+						},
+					},
+				},
+				{
+					Put: &dynamodb.Put{
+						TableName:           aws.String(recordTable),
+						Item:                recordItem,
+						ConditionExpression: aws.String("attribute_not_exists(#key)"),
+						ExpressionAttributeNames: map[string]*string{
+							"#key": aws.String("key"),
+						},
+					},
+				},
+			},
+		})
+		return err
+	})
+}
+
+func isTransactionCanceled(err error) bool {
+	awsError, ok := err.(awserr.Error)
+	return ok && awsError.Code() == dynamodb.ErrCodeTransactionCanceledException
+}
+
+// storeIdempotentTrip stores a booked trip along with its idempotency key. If
+// a concurrent request with the same key won, the sub-bookings made for this
+// trip are cancelled and the existing trip is returned instead.
+func (d *dynamoService) storeIdempotentTrip(ctx context.Context, trip *TripBooking, confirmation *TripConfirmation, key string) (*TripConfirmation, error) {
+	err := d.putTripIdempotently(ctx, trip, key)
+	if err == nil {
+		d.tripBooked(ctx, confirmation)
+		return confirmation, nil
+	}
+	d.compensate(ctx, trip)
+	if !isTransactionCanceled(err) {
+		return nil, err
+	}
+
+	// The transaction may have been cancelled for reasons other than the key
+	// already existing, so only return the existing trip if there is one.
+	existing, lookupErr := d.lookupIdempotencyKey(ctx, key)
+	if lookupErr != nil || existing == "" {
+		return nil, err
+	}
+	return d.GetBooking(ctx, existing)
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Itinerary event types.
+const (
+	EventFlightDeparture = "flight_departure"
+	EventHotelCheckIn    = "hotel_check_in"
+	EventHotelCheckOut   = "hotel_check_out"
+	EventCarPickUp       = "car_pick_up"
+	EventCarDropOff      = "car_drop_off"
+)
+
+// Itinerary is a chronological summary of a trip.
+type Itinerary struct {
+	Ref         string            `json:"ref"`
+	TripName    string            `json:"trip_name,omitempty"`
+	Destination string            `json:"destination"`
+	Start       time.Time         `json:"start"`
+	End         time.Time         `json:"end"`
+	Events      []*ItineraryEvent `json:"events"`
+}
+
+// ItineraryEvent is a single timed step of a trip, such as a flight departure
+// or hotel check-in, along with the ref of the booking it belongs to.
+type ItineraryEvent struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	Description string    `json:"description"`
+	Ref         string    `json:"ref"`
+	// Component is the type of the booking, e.g. ComponentFlight.
+	Component string `json:"component"`
+}
+
+// NewItinerary builds the itinerary for the given trip from its sub-bookings,
+// with events sorted chronologically. Simultaneous events are listed in
+// component order, and then in the order they happen within a booking, so
+// the itinerary is always listed the same way.
+func NewItinerary(c *TripConfirmation) *Itinerary {
+	itinerary := &Itinerary{Ref: c.Ref, Events: []*ItineraryEvent{}}
+	if c.Trip != nil {
+		itinerary.TripName = c.Trip.TripName
+		itinerary.Destination = c.Trip.Destination
+		itinerary.Start = c.Trip.Start
+		itinerary.End = c.Trip.End
+	}
+
+	if f := c.FlightConfirmation; f != nil && f.Flight != nil {
+		itinerary.Events = append(itinerary.Events, &ItineraryEvent{
+			Time:        f.Flight.Time,
+			Type:        EventFlightDeparture,
+			Description: fmt.Sprintf("%s flight %s departs", f.Flight.Airline, f.Flight.FlightNumber),
+			Ref:         f.Ref,
+			Component:   ComponentFlight,
+		})
+	}
+	if h := c.HotelConfirmation; h != nil && h.Hotel != nil {
+		itinerary.Events = append(itinerary.Events,
+			&ItineraryEvent{
+				Time:        h.Hotel.CheckIn,
+				Type:        EventHotelCheckIn,
+				Description: fmt.Sprintf("Check in to %s", h.Hotel.Hotel),
+				Ref:         h.Ref,
+				Component:   ComponentHotel,
+			},
+			&ItineraryEvent{
+				Time:        h.Hotel.CheckOut,
+				Type:        EventHotelCheckOut,
+				Description: fmt.Sprintf("Check out of %s", h.Hotel.Hotel),
+				Ref:         h.Ref,
+				Component:   ComponentHotel,
+			},
+		)
+	}
+	if r := c.CarRentalConfirmation; r != nil && r.CarRental != nil {
+		itinerary.Events = append(itinerary.Events,
+			&ItineraryEvent{
+				Time:        r.CarRental.PickUp,
+				Type:        EventCarPickUp,
+				Description: fmt.Sprintf("Pick up %s car from %s at %s", r.CarRental.VehicleClass, r.CarRental.Agent, r.CarRental.PickUpLocation),
+				Ref:         r.Ref,
+				Component:   ComponentCar,
+			},
+			&ItineraryEvent{
+				Time:        r.CarRental.DropOff,
+				Type:        EventCarDropOff,
+				Description: fmt.Sprintf("Drop off car with %s at %s", r.CarRental.Agent, r.CarRental.DropOffLocation),
+				Ref:         r.Ref,
+				Component:   ComponentCar,
+			},
+		)
+	}
+
+	// The sort is stable so simultaneous events of one booking, such as a
+	// zero-length stay's check-in and check-out, keep their order.
+	sort.SliceStable(itinerary.Events, func(i, j int) bool {
+		a, b := itinerary.Events[i], itinerary.Events[j]
+		if !a.Time.Equal(b.Time) {
+			return a.Time.Before(b.Time)
+		}
+		return componentRank[a.Component] < componentRank[b.Component]
+	})
+	return itinerary
+}
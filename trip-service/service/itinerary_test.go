@@ -0,0 +1,95 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	cars "github.com/realkinetic/cloud-native-meetup-2019/car-service/service"
+	flights "github.com/realkinetic/cloud-native-meetup-2019/flight-service/service"
+	hotels "github.com/realkinetic/cloud-native-meetup-2019/hotel-service/service"
+)
+
+// itineraryTrip returns a trip whose flight departs at departs, whose hotel
+// stay is from checkIn to checkOut, and whose car is rented from pickUp to
+// dropOff.
+func itineraryTrip(departs, checkIn, checkOut, pickUp, dropOff time.Time) *TripConfirmation {
+	return &TripConfirmation{
+		Ref: "TR1",
+		FlightConfirmation: &flights.FlightConfirmation{
+			Ref:    "FL1",
+			Flight: &flights.BookFlightRequest{Airline: "DL", FlightNumber: "DL123", Time: departs},
+		},
+		HotelConfirmation: &hotels.HotelConfirmation{
+			Ref:   "HT1",
+			Hotel: &hotels.BookHotelRequest{Hotel: "Grand", CheckIn: checkIn, CheckOut: checkOut},
+		},
+		CarRentalConfirmation: &cars.CarRentalConfirmation{
+			Ref:       "CR1",
+			CarRental: &cars.BookCarRentalRequest{Agent: "Hertz", PickUp: pickUp, DropOff: dropOff},
+		},
+	}
+}
+
+func eventTypes(itinerary *Itinerary) []string {
+	var types []string
+	for _, event := range itinerary.Events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestItineraryOrder(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2019, 6, 1, hour, 0, 0, 0, time.UTC)
+	}
+	for _, test := range []struct {
+		name string
+		trip *TripConfirmation
+		want []string
+	}{
+		{
+			"chronological",
+			itineraryTrip(at(9), at(14), at(20), at(12), at(21)),
+			[]string{EventFlightDeparture, EventCarPickUp, EventHotelCheckIn, EventHotelCheckOut, EventCarDropOff},
+		},
+		{
+			// Simultaneous events are listed flight, hotel, then car, and a
+			// booking's own events keep their order.
+			"simultaneous",
+			itineraryTrip(at(9), at(9), at(9), at(9), at(9)),
+			[]string{EventFlightDeparture, EventHotelCheckIn, EventHotelCheckOut, EventCarPickUp, EventCarDropOff},
+		},
+		{
+			"partly simultaneous",
+			itineraryTrip(at(12), at(12), at(20), at(9), at(20)),
+			[]string{EventCarPickUp, EventFlightDeparture, EventHotelCheckIn, EventHotelCheckOut, EventCarDropOff},
+		},
+	} {
+		// The listing mustn't depend on the order sub-bookings are found in,
+		// so build it repeatedly.
+		for i := 0; i < 10; i++ {
+			if got := eventTypes(NewItinerary(test.trip)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: events = %v, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestItineraryEventComponents(t *testing.T) {
+	at := time.Date(2019, 6, 1, 9, 0, 0, 0, time.UTC)
+	itinerary := NewItinerary(itineraryTrip(at, at, at, at, at))
+	want := map[string]string{
+		EventFlightDeparture: ComponentFlight,
+		EventHotelCheckIn:    ComponentHotel,
+		EventHotelCheckOut:   ComponentHotel,
+		EventCarPickUp:       ComponentCar,
+		EventCarDropOff:      ComponentCar,
+	}
+	for _, event := range itinerary.Events {
+		if event.Component != want[event.Type] {
+			t.Errorf("%s: component = %q, want %q", event.Type, event.Component, want[event.Type])
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// componentScanLimit bounds the number of trips a component lookup will
+// evaluate. See FindByComponent.
+const componentScanLimit = 1000
+
+// ErrUnknownComponent is returned when looking up a trip by a component type
+// other than flight, hotel, or car.
+var ErrUnknownComponent = errors.New("unknown component type")
+
+// componentRefAttributes maps component types to the trip attribute which
+// holds their ref.
+var componentRefAttributes = map[string]string{
+	ComponentFlight: "flight_ref",
+	ComponentHotel:  "hotel_ref",
+	ComponentCar:    "car_ref",
+}
+
+// FindByComponent returns the confirmation of the trip which owns the
+// sub-booking of the given type (flight, hotel, or car) and ref.
+//
+// This is a support tool rather than a customer-facing path, so it's a scan
+// rather than a query against a GSI per ref. Indexes would make lookups cheap
+// but add a write to each index for every booking, for a lookup which is
+// rarely made. The scan reads the whole table, so it's bounded by
+// componentScanLimit items evaluated and may miss trips in larger tables. If
+// lookups become frequent, add the GSIs.
+func (d *dynamoService) FindByComponent(ctx context.Context, component, ref string) (*TripConfirmation, error) {
+	attribute, ok := componentRefAttributes[component]
+	if !ok {
+		return nil, ErrUnknownComponent
+	}
+	table, err := d.tripTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(table),
+		FilterExpression: aws.String("#ref = :ref"),
+		ExpressionAttributeNames: map[string]*string{
+			"#ref": aws.String(attribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":ref": {S: aws.String(ref)},
+		},
+		Limit: aws.Int64(componentScanLimit),
+	}
+
+	var (
+		trip         *TripBooking
+		scanned      int64
+		unmarshalErr error
+	)
+	err = d.traceDynamoDB(ctx, "Scan", table, func(ctx context.Context) error {
+		return d.reader.ScanPagesWithContext(ctx, input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			if len(page.Items) > 0 {
+				unmarshalErr = dynamodbattribute.UnmarshalMap(page.Items[0], &trip)
+				return false
+			}
+			scanned += aws.Int64Value(page.ScannedCount)
+			return scanned < componentScanLimit
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	if trip == nil {
+		return nil, ErrNoSuchBooking
+	}
+	return d.tripConfirmation(ctx, trip)
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+const (
+	// requireOrganizationEnv rejects trips which don't name the organization
+	// they're booked for.
+	requireOrganizationEnv = "REQUIRE_ORGANIZATION"
+
+	// maxOrganizationLength bounds organization names, which are index keys.
+	maxOrganizationLength = 128
+
+	// organizationIndex is the trips table's index of trips by organization,
+	// newest first. It sorts on created_at rather than created, which is in
+	// local time with a variable-width fraction, so doesn't sort as a
+	// string. Trips stored before created_at aren't indexed.
+	organizationIndex = "organization-created-at-index"
+
+	// createdAtFormat is fixed width, like startAtFormat, so creation times
+	// sort as strings in time order. It's at nanosecond precision so trips
+	// created in the same second are still ordered.
+	createdAtFormat = "2006-01-02T15:04:05.000000000Z"
+)
+
+// requireOrganization is set from REQUIRE_ORGANIZATION at startup.
+var requireOrganization, _ = strconv.ParseBool(os.Getenv(requireOrganizationEnv))
+
+// ErrInvalidCursor is returned when listing trips from a cursor which wasn't
+// returned by a previous page.
+var ErrInvalidCursor = util.ErrInvalidCursor
+
+// tripTableOptions configure the trips table, including each tenant's.
+var tripTableOptions = []util.TableOption{
+	util.WithGlobalSecondaryIndex(organizationIndex, "organization", "created_at"),
+	util.WithGlobalSecondaryIndex(startIndex, "start_month", "start_at"),
+}
+
+// createdAt returns the organization index sort key of a trip created at
+// created.
+func createdAt(created time.Time) string {
+	return created.UTC().Format(createdAtFormat)
+}
+
+// TripList is a page of trips, such as an organization's.
+type TripList struct {
+	Trips []*TripBooking `json:"trips" xml:"trips>trip"`
+	// Cursor fetches the next page. It's empty on the last page.
+	Cursor string `json:"cursor,omitempty" xml:"cursor,omitempty"`
+}
+
+// ListByOrganization returns at most limit of the organization's trips,
+// newest first, starting from the cursor of the previous page, if any. Trips
+// are returned as stored, without fetching their sub-bookings, so listing
+// doesn't call the sub-services for every trip. The index is eventually
+// consistent, so a trip may not be listed immediately after it's booked.
+func (d *dynamoService) ListByOrganization(ctx context.Context, org string, limit int, cursor string) (*TripList, error) {
+	table, err := d.tripTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	startKey, err := util.DecodeCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(table),
+		IndexName:              aws.String(organizationIndex),
+		KeyConditionExpression: aws.String("#organization = :organization"),
+		ExpressionAttributeNames: map[string]*string{
+			"#organization": aws.String("organization"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":organization": {S: aws.String(org)},
+		},
+		ScanIndexForward:  aws.Bool(false),
+		Limit:             aws.Int64(int64(limit)),
+		ExclusiveStartKey: startKey,
+	}
+
+	var result *dynamodb.QueryOutput
+	err = d.traceDynamoDB(ctx, "Query", table, func(ctx context.Context) error {
+		var err error
+		result, err = d.reader.QueryWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := &TripList{Trips: []*TripBooking{}}
+	if err := dynamodbattribute.UnmarshalListOfMaps(result.Items, &list.Trips); err != nil {
+		return nil, err
+	}
+	if list.Cursor, err = util.EncodeCursor(result.LastEvaluatedKey); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
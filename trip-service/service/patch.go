@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	cars "github.com/realkinetic/cloud-native-meetup-2019/car-service/service"
+	flights "github.com/realkinetic/cloud-native-meetup-2019/flight-service/service"
+	hotels "github.com/realkinetic/cloud-native-meetup-2019/hotel-service/service"
+)
+
+// ErrTripModified is returned when a trip is changed concurrently with a patch.
+var ErrTripModified = errors.New("trip was modified concurrently")
+
+// TripPatch is a partial update of a trip. Each component which is set
+// replaces the trip's existing one, and the rest are left untouched.
+type TripPatch struct {
+	Flight *flights.BookFlightRequest `json:"flight,omitempty"`
+	Hotel  *hotels.BookHotelRequest   `json:"hotel,omitempty"`
+	Car    *cars.BookCarRentalRequest `json:"car,omitempty"`
+}
+
+func (p *TripPatch) Validate() error {
+	if p.Flight == nil && p.Hotel == nil && p.Car == nil {
+		return errors.New("patch must change at least one of flight, hotel, or car")
+	}
+	if p.Flight != nil {
+		if err := p.Flight.Validate(); err != nil {
+			return err
+		}
+	}
+	if p.Hotel != nil {
+		if err := p.Hotel.Validate(); err != nil {
+			return err
+		}
+	}
+	if p.Car != nil {
+		if err := p.Car.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PatchTrip re-books the components of the trip which are set in the patch
+// and then cancels the bookings they replace. If booking a new component or
+// recording it fails, the new bookings are cancelled and the trip is left as
+// it was. It returns ErrTripModified if the trip's components were changed
+// concurrently.
+func (d *dynamoService) PatchTrip(ctx context.Context, ref string, patch *TripPatch) (*TripConfirmation, error) {
+	// Read from the primary since the refs are used as the update condition.
+	trip, err := d.loadTrip(ctx, d.db, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	// booked tracks the new bookings so they can be compensated, and
+	// replaced tracks the old ones to cancel once the trip is updated.
+	booked := &TripBooking{Ref: ref}
+	replaced := &TripBooking{Ref: ref}
+	updated := *trip
+	if patch.Flight != nil {
+		flight, err := d.bookFlight(ctx, patch.Flight, BookOptions{})
+		if err != nil {
+			d.compensate(ctx, booked)
+			return nil, err
+		}
+		booked.FlightRef = flight.Ref
+		replaced.FlightRef = trip.FlightRef
+		updated.FlightRef = flight.Ref
+	}
+	if patch.Hotel != nil {
+		hotel, err := d.bookHotel(ctx, patch.Hotel, BookOptions{})
+		if err != nil {
+			d.compensate(ctx, booked)
+			return nil, err
+		}
+		booked.HotelRef = hotel.Ref
+		replaced.HotelRef = trip.HotelRef
+		updated.HotelRef = hotel.Ref
+	}
+	if patch.Car != nil {
+		car, err := d.bookCar(ctx, patch.Car, BookOptions{})
+		if err != nil {
+			d.compensate(ctx, booked)
+			return nil, err
+		}
+		booked.CarRef = car.Ref
+		replaced.CarRef = trip.CarRef
+		updated.CarRef = car.Ref
+	}
+
+	if err := d.updateTripRefs(ctx, trip, &updated); err != nil {
+		d.compensate(ctx, booked)
+		return nil, err
+	}
+	table, err := d.tripTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := cacheKey(table, ref)
+	d.cache.invalidate(key)
+
+	// Cancel the replaced bookings the same way as compensating a failed
+	// trip. The trip no longer references them, so failures are only logged.
+	d.compensate(ctx, replaced)
+	confirmation, err := d.tripConfirmation(ctx, &updated)
+	if err != nil {
+		return nil, err
+	}
+	d.cache.put(key, confirmation)
+	return confirmation, nil
+}
+
+// updateTripRefs stores the changed sub-booking refs of the updated trip,
+// provided the stored refs are still those of the original. Patches only
+// replace components, so refs are never removed.
+func (d *dynamoService) updateTripRefs(ctx context.Context, original, updated *TripBooking) error {
+	table, err := d.tripTable(ctx)
+	if err != nil {
+		return err
+	}
+	var (
+		sets       []string
+		conditions = []string{"attribute_exists(#ref)"}
+		names      = map[string]*string{"#ref": aws.String("ref")}
+		values     = map[string]*dynamodb.AttributeValue{}
+	)
+	for _, field := range []struct {
+		name     string
+		old, new string
+	}{
+		{"flight_ref", original.FlightRef, updated.FlightRef},
+		{"hotel_ref", original.HotelRef, updated.HotelRef},
+		{"car_ref", original.CarRef, updated.CarRef},
+	} {
+		if field.old == field.new {
+			continue
+		}
+		key := "#" + field.name
+		names[key] = aws.String(field.name)
+		sets = append(sets, key+" = :new_"+field.name)
+		values[":new_"+field.name] = &dynamodb.AttributeValue{S: aws.String(field.new)}
+		if field.old != "" {
+			conditions = append(conditions, key+" = :old_"+field.name)
+			values[":old_"+field.name] = &dynamodb.AttributeValue{S: aws.String(field.old)}
+		} else {
+			conditions = append(conditions, "attribute_not_exists("+key+")")
+		}
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"ref": {
+				S: aws.String(original.Ref),
+			},
+		},
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ")),
+		ConditionExpression:       aws.String(strings.Join(conditions, " AND ")),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+	err = d.traceDynamoDB(ctx, "UpdateItem", table, func(ctx context.Context) error {
+		_, err := d.db.UpdateItemWithContext(ctx, input)
+		return err
+	})
+	if awsError, ok := err.(awserr.Error); ok && awsError.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrTripModified
+	}
+	return err
+}
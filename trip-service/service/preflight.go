@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+const (
+	downstreamMinVersionEnv = "DOWNSTREAM_MIN_VERSION"
+	downstreamMaxVersionEnv = "DOWNSTREAM_MAX_VERSION"
+
+	// preflightTimeout bounds each sub-service's version check.
+	preflightTimeout = 5 * time.Second
+)
+
+// versionRange is the range of sub-service versions the trip service is
+// compatible with. Min is inclusive and max is exclusive. Either may be unset.
+type versionRange struct {
+	min, max       util.SemVer
+	hasMin, hasMax bool
+}
+
+// versionRangeFromEnv returns the supported sub-service versions, at least
+// DOWNSTREAM_MIN_VERSION and below DOWNSTREAM_MAX_VERSION.
+func versionRangeFromEnv() (versionRange, error) {
+	var r versionRange
+	if value := os.Getenv(downstreamMinVersionEnv); value != "" {
+		min, err := util.ParseSemVer(value)
+		if err != nil {
+			return r, fmt.Errorf("invalid %s %q", downstreamMinVersionEnv, value)
+		}
+		r.min, r.hasMin = min, true
+	}
+	if value := os.Getenv(downstreamMaxVersionEnv); value != "" {
+		max, err := util.ParseSemVer(value)
+		if err != nil {
+			return r, fmt.Errorf("invalid %s %q", downstreamMaxVersionEnv, value)
+		}
+		r.max, r.hasMax = max, true
+	}
+	return r, nil
+}
+
+func (r versionRange) contains(v util.SemVer) bool {
+	if r.hasMin && v.Less(r.min) {
+		return false
+	}
+	if r.hasMax && !v.Less(r.max) {
+		return false
+	}
+	return true
+}
+
+// preflight checks the version each sub-service reports at /version and
+// warns about any outside the supported range, so version skew surfaces at
+// startup rather than as unmarshal failures while booking. It only logs, so
+// it doesn't block startup on sub-services which aren't up yet.
+func (d *dynamoService) preflight(supported versionRange) {
+	for _, svc := range []*downstream{d.flights, d.hotels, d.cars} {
+		entry := log.WithFields(log.Fields{
+			"downstream": svc.name,
+		})
+		version, err := svc.version()
+		if err != nil {
+			entry.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Failed to check sub-service version")
+			continue
+		}
+		entry = entry.WithFields(log.Fields{
+			"downstream_version": version,
+		})
+		if version == util.DevVersion {
+			entry.Info("Sub-service is a development build, skipping version check")
+			continue
+		}
+		parsed, err := util.ParseSemVer(version)
+		if err != nil {
+			entry.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Sub-service reported an invalid version")
+			continue
+		}
+		if !supported.contains(parsed) {
+			entry.Warn("Sub-service version is outside the supported range")
+			continue
+		}
+		entry.Info("Sub-service version is supported")
+	}
+}
+
+// version fetches the version the sub-service reports.
+func (d *downstream) version() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", d.url+"/version", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", d.newDownstreamError(resp, data)
+	}
+	var info util.VersionInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return "", err
+	}
+	return info.Version, nil
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	cars "github.com/realkinetic/cloud-native-meetup-2019/car-service/service"
+	flights "github.com/realkinetic/cloud-native-meetup-2019/flight-service/service"
+	hotels "github.com/realkinetic/cloud-native-meetup-2019/hotel-service/service"
+)
+
+// twoPhaseBookingEnv books trips by reserving every leg before confirming
+// any, so a leg which can't be reserved doesn't leave the others booked.
+const twoPhaseBookingEnv = "TWO_PHASE_BOOKING"
+
+// twoPhaseBooking is set from TWO_PHASE_BOOKING at startup.
+var twoPhaseBooking, _ = strconv.ParseBool(os.Getenv(twoPhaseBookingEnv))
+
+// confirmReservations confirms each of the trip's reserved legs, replacing
+// their confirmations with the bookings. It's only called once every leg is
+// held. If a confirmation fails, e.g. because its hold expired while the
+// others were reserved, the caller compensates every leg, whether it was
+// confirmed or is still held. Each confirmation's duration is added to its
+// leg's timing.
+func (d *dynamoService) confirmReservations(ctx context.Context, confirmation *TripConfirmation, timings *BookingTimings) error {
+	if reservation := confirmation.FlightConfirmation; reservation != nil {
+		var flight *flights.FlightConfirmation
+		start := d.clock.Now()
+		err := d.confirm(ctx, d.flights, "/flights", reservation.Ref, &flight)
+		timings.FlightMillis += d.elapsedMillis(start)
+		if err != nil {
+			return err
+		}
+		confirmation.FlightConfirmation = flight
+	}
+	if reservation := confirmation.HotelConfirmation; reservation != nil {
+		var hotel *hotels.HotelConfirmation
+		start := d.clock.Now()
+		err := d.confirm(ctx, d.hotels, "/hotels", reservation.Ref, &hotel)
+		timings.HotelMillis += d.elapsedMillis(start)
+		if err != nil {
+			return err
+		}
+		confirmation.HotelConfirmation = hotel
+	}
+	if reservation := confirmation.CarRentalConfirmation; reservation != nil {
+		var car *cars.CarRentalConfirmation
+		start := d.clock.Now()
+		err := d.confirm(ctx, d.cars, "/cars", reservation.Ref, &car)
+		timings.CarMillis += d.elapsedMillis(start)
+		if err != nil {
+			return err
+		}
+		confirmation.CarRentalConfirmation = car
+	}
+	return nil
+}
+
+// confirm confirms the reservation with the given ref at the sub-service
+// resource with the given prefix, e.g. "/flights".
+func (d *dynamoService) confirm(ctx context.Context, svc *downstream, prefix, ref string, returned interface{}) error {
+	url := fmt.Sprintf("%s%s/booking?reservation=%s", svc.url, prefix, ref)
+	return d.book(ctx, svc, struct{}{}, url, returned)
+}
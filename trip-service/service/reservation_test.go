@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	cars "github.com/realkinetic/cloud-native-meetup-2019/car-service/service"
+	flights "github.com/realkinetic/cloud-native-meetup-2019/flight-service/service"
+	hotels "github.com/realkinetic/cloud-native-meetup-2019/hotel-service/service"
+	"github.com/realkinetic/cloud-native-meetup-2019/util/servicetest"
+)
+
+// newTwoPhaseService returns a trip service which books trips in two phases,
+// backed by stand-ins for DynamoDB and the sub-services.
+func newTwoPhaseService(t *testing.T) (TripService, []*servicetest.SubService) {
+	twoPhase := twoPhaseBooking
+	twoPhaseBooking = true
+	t.Cleanup(func() { twoPhaseBooking = twoPhase })
+
+	servicetest.NewDynamoDB(t)
+	subServices := []*servicetest.SubService{
+		servicetest.NewFlightService(t),
+		servicetest.NewHotelService(t),
+		servicetest.NewCarService(t),
+	}
+	t.Setenv("FLIGHT_SERVICE_URL", subServices[0].URL)
+	t.Setenv("HOTEL_SERVICE_URL", subServices[1].URL)
+	t.Setenv("CAR_SERVICE_URL", subServices[2].URL)
+	s, err := NewTripService()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, subServices
+}
+
+func testTripRequest() *BookTripRequest {
+	start := time.Date(2019, 6, 1, 9, 0, 0, 0, time.UTC)
+	end := start.Add(72 * time.Hour)
+	return &BookTripRequest{
+		Name:        "Offsite",
+		Destination: "Denver",
+		Start:       start,
+		End:         end,
+		Members:     []string{"Ada"},
+		Flight: &flights.BookFlightRequest{
+			Airline:      "UA",
+			FlightNumber: "UA100",
+			Time:         start,
+			Passengers:   []flights.Passenger{{Name: "Ada"}},
+		},
+		Hotel: &hotels.BookHotelRequest{Hotel: "Brown Palace", CheckIn: start, CheckOut: end, Name: "Ada", Guests: 1},
+		Car: &cars.BookCarRentalRequest{
+			Agent:           "Hertz",
+			PickUp:          start,
+			PickUpLocation:  "DEN",
+			DropOff:         end,
+			DropOffLocation: "DEN",
+			Name:            "Ada",
+			VehicleClass:    "compact",
+		},
+	}
+}
+
+// TestTwoPhaseBooking checks every leg is reserved before any is confirmed.
+func TestTwoPhaseBooking(t *testing.T) {
+	s, subServices := newTwoPhaseService(t)
+	confirmation, err := s.BookTrip(context.Background(), testTripRequest(), BookOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if confirmation.FlightConfirmation.Held() || confirmation.HotelConfirmation.Held() || confirmation.CarRentalConfirmation.Held() {
+		t.Errorf("booked trip has held legs: %+v", confirmation)
+	}
+
+	var calls []string
+	for _, sub := range subServices {
+		if sub.Bookings() != 1 {
+			t.Errorf("%s has %d bookings, want 1", sub.URL, sub.Bookings())
+		}
+		for _, r := range sub.Requests() {
+			switch {
+			case strings.HasSuffix(r.Path, "/reservation"):
+				calls = append(calls, "reserve")
+			case r.Query.Get("reservation") != "":
+				calls = append(calls, "confirm")
+			}
+		}
+	}
+	if got := strings.Join(calls, ","); got != "reserve,confirm,reserve,confirm,reserve,confirm" {
+		t.Errorf("sub-service calls = %s, want each leg reserved then confirmed", got)
+	}
+}
+
+// TestTwoPhaseBookingExpiredHold checks a trip whose hotel hold expires
+// before it's confirmed fails, and every leg is cancelled, whether it was
+// confirmed or is still held.
+func TestTwoPhaseBookingExpiredHold(t *testing.T) {
+	s, subServices := newTwoPhaseService(t)
+	subServices[1].FailRef("HT1", servicetest.Fault{Status: http.StatusGone, Method: "POST"})
+
+	_, err := s.BookTrip(context.Background(), testTripRequest(), BookOptions{})
+	if downstreamErr, ok := err.(*DownstreamError); !ok || downstreamErr.StatusCode != http.StatusGone {
+		t.Fatalf("error = %v, want the hotel's %d", err, http.StatusGone)
+	}
+	for _, sub := range subServices {
+		if sub.Bookings() != 0 {
+			t.Errorf("%s has %d bookings, want 0", sub.URL, sub.Bookings())
+		}
+	}
+}
@@ -8,16 +8,15 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/nats-io/nuid"
-	"github.com/opentracing-contrib/go-aws-sdk"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
 
 	cars "github.com/realkinetic/cloud-native-meetup-2019/car-service/service"
 	flights "github.com/realkinetic/cloud-native-meetup-2019/flight-service/service"
@@ -29,211 +28,639 @@ const (
 	flightServiceURLEnv = "FLIGHT_SERVICE_URL"
 	hotelServiceURLEnv  = "HOTEL_SERVICE_URL"
 	carServiceURLEnv    = "CAR_SERVICE_URL"
+
+	// serviceDiscoveryDefaultsEnv enables the default sub-service URLs below
+	// for any of the URL envs which aren't set.
+	serviceDiscoveryDefaultsEnv = "SERVICE_DISCOVERY_DEFAULTS"
+	defaultFlightServiceURL     = "http://flight-service:8080"
+	defaultHotelServiceURL      = "http://hotel-service:8081"
+	defaultCarServiceURL        = "http://car-service:8082"
+
+	maxMembersEnv     = "MAX_MEMBERS"
+	defaultMaxMembers = 50
+
+	slowCallThresholdEnv           = "SLOW_CALL_THRESHOLD_MS"
+	defaultSlowCallThresholdMillis = 1000
+
+	// TripBookedSubject is the NATS subject trips are published to once
+	// booked.
+	TripBookedSubject = "trip.booked"
 )
 
 var (
 	ErrNoSuchBooking = errors.New("no such booking")
-	tripsTable       = "trips"
-	flightServiceURL = os.Getenv(flightServiceURLEnv)
-	hotelServiceURL  = os.Getenv(hotelServiceURLEnv)
-	carServiceURL    = os.Getenv(carServiceURLEnv)
+	tripsTable       = util.TableName("trips")
+
+	// maxMembers bounds the size of a trip so it stays well under DynamoDB's
+	// 400KB item limit.
+	maxMembers int
 )
 
+// tripsBooked counts booked trips by the number of components (flight, hotel,
+// and car) they include.
+var tripsBooked = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "trips_total",
+		Help: "Number of booked trips by number of components.",
+	},
+	[]string{"components"},
+)
+
+func init() {
+	util.MustRegister(tripsBooked)
+
+	var err error
+	if maxMembers, err = util.IntFromEnv(maxMembersEnv, defaultMaxMembers); err != nil {
+		panic(err)
+	}
+}
+
 type TripConfirmation struct {
-	Ref                   string                      `json:"ref"`
-	Trip                  *BookTripRequest            `json:"trip"`
-	FlightConfirmation    *flights.FlightConfirmation `json:"flight_confirmation,omitempty"`
-	HotelConfirmation     *hotels.HotelConfirmation   `json:"hotel_confirmation,omitempty"`
-	CarRentalConfirmation *cars.CarRentalConfirmation `json:"car_rental_confirmation,omitempty"`
+	Ref                   string                      `json:"ref" xml:"ref"`
+	DryRun                bool                        `json:"dry_run,omitempty" xml:"dry_run,omitempty"`
+	Trip                  *BookTripRequest            `json:"trip,omitempty" xml:"trip,omitempty"`
+	FlightConfirmation    *flights.FlightConfirmation `json:"flight_confirmation,omitempty" xml:"flight_confirmation,omitempty"`
+	HotelConfirmation     *hotels.HotelConfirmation   `json:"hotel_confirmation,omitempty" xml:"hotel_confirmation,omitempty"`
+	CarRentalConfirmation *cars.CarRentalConfirmation `json:"car_rental_confirmation,omitempty" xml:"car_rental_confirmation,omitempty"`
+	// TotalPrice is the sum of the prices of the trip's components.
+	TotalPrice util.Money `json:"total_price" xml:"total_price"`
+	// Timings is only set on a newly booked trip, if requested with
+	// BookOptions.Timings.
+	Timings *BookingTimings `json:"timings,omitempty" xml:"timings,omitempty"`
+}
+
+// sumPrices sets the total price of the trip from its components.
+func (c *TripConfirmation) sumPrices() {
+	c.TotalPrice = 0
+	if c.FlightConfirmation != nil {
+		c.TotalPrice += c.FlightConfirmation.Price
+	}
+	if c.HotelConfirmation != nil {
+		c.TotalPrice += c.HotelConfirmation.Price
+	}
+	if c.CarRentalConfirmation != nil {
+		c.TotalPrice += c.CarRentalConfirmation.Price
+	}
 }
 
 type TripBooking struct {
-	Request   *BookTripRequest `json:"request"`
-	Created   time.Time        `json:"created"`
-	Ref       string           `json:"ref"`
-	FlightRef string           `json:"flight_ref"`
-	HotelRef  string           `json:"hotel_ref"`
-	CarRef    string           `json:"car_ref"`
+	Request   *BookTripRequest `json:"request,omitempty" xml:"request,omitempty"`
+	Created   time.Time        `json:"created" xml:"created"`
+	Ref       string           `json:"ref" xml:"ref"`
+	FlightRef string           `json:"flight_ref,omitempty" xml:"flight_ref,omitempty"`
+	HotelRef  string           `json:"hotel_ref,omitempty" xml:"hotel_ref,omitempty"`
+	CarRef    string           `json:"car_ref,omitempty" xml:"car_ref,omitempty"`
+	// Organization duplicates the request's organization at the top level
+	// so trips can be indexed by it. Trips without one aren't indexed.
+	Organization string `json:"organization,omitempty" xml:"organization,omitempty"`
+	// CreatedAt sorts the organization index. See createdAt. It's only
+	// stored, never returned to clients.
+	CreatedAt string `json:"-" xml:"-" dynamodbav:"created_at,omitempty"`
+	// StartMonth and StartAt index the trip by when it starts. See
+	// ListByDateRange. They're only stored, never returned to clients.
+	StartMonth string `json:"-" xml:"-" dynamodbav:"start_month,omitempty"`
+	StartAt    string `json:"-" xml:"-" dynamodbav:"start_at,omitempty"`
 }
 
 type BookTripRequest struct {
-	Name        string                     `json:"name"`
-	TripName    string                     `json:"trip_name"`
-	Destination string                     `json:"destination"`
-	Start       time.Time                  `json:"start"`
-	End         time.Time                  `json:"end"`
-	Members     []string                   `json:"members"`
-	Flight      *flights.BookFlightRequest `json:"flight,omitempty"`
-	Hotel       *hotels.BookHotelRequest   `json:"hotel,omitempty"`
-	Car         *cars.BookCarRentalRequest `json:"car,omitempty"`
+	Name        string    `json:"name" xml:"name" schema:"required"`
+	TripName    string    `json:"trip_name,omitempty" xml:"trip_name,omitempty"`
+	Destination string    `json:"destination" xml:"destination" schema:"required"`
+	Start       time.Time `json:"start" xml:"start" schema:"required"`
+	End         time.Time `json:"end" xml:"end" schema:"required"`
+	Members     []string  `json:"members" xml:"members>member" schema:"required"`
+	// Organization is the organization or cost center the trip is booked
+	// for. It's required if REQUIRE_ORGANIZATION is set.
+	Organization string                     `json:"organization,omitempty" xml:"organization,omitempty"`
+	Flight       *flights.BookFlightRequest `json:"flight,omitempty" xml:"flight,omitempty"`
+	Hotel        *hotels.BookHotelRequest   `json:"hotel,omitempty" xml:"hotel,omitempty"`
+	Car          *cars.BookCarRentalRequest `json:"car,omitempty" xml:"car,omitempty"`
 }
 
+// Validate returns the first problem with the request, if any. Use ValidateAll
+// to report every problem.
 func (b *BookTripRequest) Validate() error {
+	if errs := b.validate(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// ValidateAll returns every problem with the request as ValidationErrors, or
+// nil if it's valid.
+func (b *BookTripRequest) ValidateAll() error {
+	if errs := b.validate(); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (b *BookTripRequest) validate() ValidationErrors {
+	var errs ValidationErrors
 	if b.Name == "" {
-		return errors.New("invalid name")
+		errs = append(errs, &FieldError{Field: "name", Message: "invalid name"})
 	}
 	if b.Destination == "" {
-		return errors.New("invalid destination")
+		errs = append(errs, &FieldError{Field: "destination", Message: "invalid destination"})
 	}
 	if b.Start.IsZero() {
-		return errors.New("invalid start date")
+		errs = append(errs, &FieldError{Field: "start", Message: "invalid start date"})
 	}
 	if b.End.IsZero() {
-		return errors.New("invalid end date")
+		errs = append(errs, &FieldError{Field: "end", Message: "invalid end date"})
 	}
 	if len(b.Members) == 0 {
-		return errors.New("invalid members")
+		errs = append(errs, &FieldError{Field: "members", Message: "invalid members"})
 	}
-	for _, m := range b.Members {
+	if len(b.Members) > maxMembers {
+		errs = append(errs, &FieldError{
+			Field:   "members",
+			Message: fmt.Sprintf("too many members, at most %d are allowed", maxMembers),
+		})
+	}
+	for i, m := range b.Members {
 		if len(m) == 0 {
-			return errors.New("invalid member name")
+			errs = append(errs, &FieldError{
+				Field:   fmt.Sprintf("members[%d]", i),
+				Message: "invalid member name",
+			})
 		}
 	}
+	if b.Organization == "" && requireOrganization {
+		errs = append(errs, &FieldError{Field: "organization", Message: "missing organization"})
+	}
+	if len(b.Organization) > maxOrganizationLength {
+		errs = append(errs, &FieldError{
+			Field:   "organization",
+			Message: fmt.Sprintf("organization too long, at most %d characters are allowed", maxOrganizationLength),
+		})
+	}
+	// The sub-requests only report their first problem.
 	if b.Flight != nil {
 		if err := b.Flight.Validate(); err != nil {
-			return err
+			errs = append(errs, &FieldError{Field: ComponentFlight, Message: err.Error()})
 		}
 	}
 	if b.Hotel != nil {
 		if err := b.Hotel.Validate(); err != nil {
-			return err
+			errs = append(errs, &FieldError{Field: ComponentHotel, Message: err.Error()})
 		}
 	}
 	if b.Car != nil {
 		if err := b.Car.Validate(); err != nil {
-			return err
+			errs = append(errs, &FieldError{Field: ComponentCar, Message: err.Error()})
 		}
 	}
-	return nil
+	return errs
+}
+
+// CustomizeSchema adds the member limit, which is configured at startup, and
+// the requirement that member names aren't empty to the generated schema.
+// The flight, hotel, and car schemas come from their own request types.
+func (b *BookTripRequest) CustomizeSchema(s *util.Schema) {
+	members := s.Properties["members"]
+	members.MaxItems = maxMembers
+	members.Items.MinLength = 1
+	organization := s.Properties["organization"]
+	organization.MaxLength = maxOrganizationLength
+	if requireOrganization {
+		s.Required = append(s.Required, "organization")
+		organization.MinLength = 1
+	}
+}
+
+// BookOptions control how a trip is booked.
+type BookOptions struct {
+	// DryRun validates the trip against the sub-services without booking
+	// or storing anything. The returned confirmation has no refs.
+	DryRun bool
+
+	// IdempotencyKey, if set, ensures the trip is only booked once. Booking
+	// again with the same key returns the existing trip.
+	IdempotencyKey string
+
+	// Timings reports how long each step of booking took in the
+	// confirmation.
+	Timings bool
+
+	// reserve holds each leg, to be confirmed once all of them are held,
+	// rather than booking it outright. It's set if TWO_PHASE_BOOKING is.
+	reserve bool
+}
+
+// query returns the query string to pass the options to the sub-services.
+func (o BookOptions) query() string {
+	if o.DryRun {
+		return "?dry_run=true"
+	}
+	return ""
+}
+
+// endpoint returns the endpoint legs are booked at for the sub-service
+// resource with the given prefix, e.g. "/flights".
+func (o BookOptions) endpoint(prefix string) string {
+	if o.reserve {
+		return prefix + "/reservation"
+	}
+	return prefix + "/booking" + o.query()
 }
 
 type TripService interface {
-	BookTrip(context.Context, *BookTripRequest) (*TripConfirmation, error)
+	BookTrip(context.Context, *BookTripRequest, BookOptions) (*TripConfirmation, error)
 	GetBooking(ctx context.Context, ref string) (*TripConfirmation, error)
+	PatchTrip(ctx context.Context, ref string, patch *TripPatch) (*TripConfirmation, error)
+	FindByComponent(ctx context.Context, component, ref string) (*TripConfirmation, error)
+	ListByOrganization(ctx context.Context, org string, limit int, cursor string) (*TripList, error)
+	ListByDateRange(ctx context.Context, from, to time.Time, limit int, cursor string) (*TripList, error)
+	CheckHealth(ctx context.Context) *HealthReport
 }
 
 type dynamoService struct {
-	db         *dynamodb.DynamoDB
-	httpClient *http.Client
-}
-
-func NewTripService() (TripService, error) {
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-		Config:            aws.Config{Region: aws.String("us-east-1")},
-	}))
-	db := dynamodb.New(sess)
-	otaws.AddOTHandlers(db.Client)
-
-	input := &dynamodb.CreateTableInput{
-		AttributeDefinitions: []*dynamodb.AttributeDefinition{
-			{
-				AttributeName: aws.String("ref"),
-				AttributeType: aws.String("S"),
-			},
-		},
-		KeySchema: []*dynamodb.KeySchemaElement{
-			{
-				AttributeName: aws.String("ref"),
-				KeyType:       aws.String("HASH"),
-			},
-		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(2),
-			WriteCapacityUnits: aws.Int64(2),
-		},
-		TableName: aws.String(tripsTable),
-	}
-	_, err := db.CreateTable(input)
-	if err != nil {
-		if awsError, ok := err.(awserr.Error); ok {
-			if awsError.Code() != dynamodb.ErrCodeResourceInUseException {
-				return nil, err
+	db *dynamodb.DynamoDB
+
+	// reader serves GetBooking. It's a read replica if READ_REGION is set,
+	// otherwise it's db.
+	reader *dynamodb.DynamoDB
+
+	// slowCallThreshold is the latency above which a sub-service call is
+	// flagged as slow.
+	slowCallThreshold time.Duration
+
+	// tenants routes requests to their tenant's tables.
+	tenants *util.TenantTables
+
+	// cache holds recently read or booked trip confirmations. It's nil
+	// unless TRIP_CACHE_SIZE is set.
+	cache *confirmationCache
+
+	// dynamoHealth caches the DynamoDB health check's results.
+	dynamoHealth healthCache
+
+	flights *downstream
+	hotels  *downstream
+	cars    *downstream
+
+	// clock tells the time trips are created, and times sub-service calls,
+	// cache entries, and breaker cooldowns.
+	clock util.Clock
+
+	// failureHook, if set, is called before each DynamoDB operation, and
+	// fails the operation if it returns an error. It's nil in production.
+	failureHook func(ctx context.Context, operation, table string) error
+}
+
+// Option configures the trip service.
+type Option func(*dynamoService)
+
+// WithFailureHook sets a hook which is called before each DynamoDB operation
+// with its name, e.g. "PutItem", and table. If it returns an error, the
+// operation fails with it without being sent, as if DynamoDB had returned it,
+// so tests can exercise the error handling without AWS.
+func WithFailureHook(hook func(ctx context.Context, operation, table string) error) Option {
+	return func(d *dynamoService) {
+		d.failureHook = hook
+	}
+}
+
+// WithClock sets the clock the trip service tells the time by, which is the
+// system clock by default.
+func WithClock(clock util.Clock) Option {
+	return func(d *dynamoService) {
+		d.clock = clock
+	}
+}
+
+// traceDynamoDB calls fn like util.TraceDynamoDB, unless the failure hook
+// fails the operation first. Injected failures are traced like real ones.
+func (d *dynamoService) traceDynamoDB(ctx context.Context, operation, table string, fn func(context.Context) error) error {
+	return util.TraceDynamoDB(ctx, operation, table, func(ctx context.Context) error {
+		if d.failureHook != nil {
+			if err := d.failureHook(ctx, operation, table); err != nil {
+				return err
 			}
-		} else {
-			return nil, err
 		}
+		return fn(ctx)
+	})
+}
+
+// tripTable returns the trips table for the request's tenant.
+func (d *dynamoService) tripTable(ctx context.Context) (string, error) {
+	return d.tenants.Table(ctx, tripsTable)
+}
+
+func NewTripService(opts ...Option) (TripService, error) {
+	d := &dynamoService{clock: util.SystemClock}
+	for _, opt := range opts {
+		opt(d)
 	}
 
-	return &dynamoService{
-		db:         db,
-		httpClient: util.NewInstrumentedHTTPClient(),
-	}, nil
+	db := util.NewDynamoDB()
+
+	if err := util.CreateTable(db, tripsTable, tripTableOptions...); err != nil {
+		return nil, err
+	}
+	if err := util.CreateTable(db, idempotencyTable, util.WithHashKey("key")); err != nil {
+		return nil, err
+	}
+	tenants, err := util.NewTenantTables(db)
+	if err != nil {
+		return nil, err
+	}
+	if err := tenants.Provision(tripsTable, tripTableOptions...); err != nil {
+		return nil, err
+	}
+	if err := tenants.Provision(idempotencyTable, util.WithHashKey("key")); err != nil {
+		return nil, err
+	}
+
+	flightURL, err := serviceURLFromEnv(flightServiceURLEnv, defaultFlightServiceURL)
+	if err != nil {
+		return nil, err
+	}
+	hotelURL, err := serviceURLFromEnv(hotelServiceURLEnv, defaultHotelServiceURL)
+	if err != nil {
+		return nil, err
+	}
+	carURL, err := serviceURLFromEnv(carServiceURLEnv, defaultCarServiceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	slowCallThresholdMillis, err := util.IntFromEnv(slowCallThresholdEnv, defaultSlowCallThresholdMillis)
+	if err != nil {
+		return nil, err
+	}
+
+	supportedVersions, err := versionRangeFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := newConfirmationCacheFromEnv(d.clock)
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := util.NewInstrumentedHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	d.db = db
+	d.reader = util.NewReadDynamoDB(db)
+	d.slowCallThreshold = time.Duration(slowCallThresholdMillis) * time.Millisecond
+	d.tenants = tenants
+	d.cache = cache
+	retryPolicy := util.DownstreamRetryPolicyFromEnv()
+	d.flights = newDownstream("flight-service", flightURL, httpClient, d.clock, retryPolicy)
+	d.hotels = newDownstream("hotel-service", hotelURL, httpClient, d.clock, retryPolicy)
+	d.cars = newDownstream("car-service", carURL, httpClient, d.clock, retryPolicy)
+	go d.preflight(supportedVersions)
+	return d, nil
 }
 
-func (d *dynamoService) BookTrip(ctx context.Context, r *BookTripRequest) (*TripConfirmation, error) {
-	ref := nuid.Next()
-	confirmation := &TripConfirmation{Ref: ref, Trip: r}
+// BookTrip books each component of the trip in turn and records it. If any
+// step fails, including because ctx was cancelled, e.g. when the server is
+// draining, the components already booked are compensated. If
+// TWO_PHASE_BOOKING is set, every component is reserved before any is
+// confirmed; see confirmReservations.
+func (d *dynamoService) BookTrip(ctx context.Context, r *BookTripRequest, opts BookOptions) (*TripConfirmation, error) {
+	opts.reserve = twoPhaseBooking && !opts.DryRun
+
+	// Resolve the table up front so nothing is booked for a request which
+	// can't be stored.
+	table, err := d.tripTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	idempotent := opts.IdempotencyKey != "" && !opts.DryRun
+	if idempotent {
+		existing, err := d.lookupIdempotencyKey(ctx, opts.IdempotencyKey)
+		if err != nil {
+			return nil, err
+		}
+		if existing != "" {
+			return d.GetBooking(ctx, existing)
+		}
+	}
+
+	var ref string
+	if !opts.DryRun {
+		ref = nuid.Next()
+	}
+	confirmation := &TripConfirmation{Ref: ref, DryRun: opts.DryRun, Trip: r}
+	timings := &BookingTimings{}
+	created := d.clock.Now()
 	trip := &TripBooking{
-		Request: r,
-		Ref:     ref,
-		Created: time.Now(),
+		Request:      r,
+		Ref:          ref,
+		Created:      created,
+		CreatedAt:    createdAt(created),
+		Organization: r.Organization,
+		StartMonth:   startMonth(r.Start),
+		StartAt:      startAt(r.Start),
 	}
 	if r.Flight != nil {
-		flightConfirmation, err := d.bookFlight(ctx, r.Flight)
+		start := d.clock.Now()
+		flightConfirmation, err := d.bookFlight(ctx, r.Flight, opts)
+		timings.FlightMillis += d.elapsedMillis(start)
 		if err != nil {
+			d.compensate(ctx, trip)
 			return nil, err
 		}
 		confirmation.FlightConfirmation = flightConfirmation
 		trip.FlightRef = flightConfirmation.Ref
 	}
 	if r.Hotel != nil {
-		hotelConfirmation, err := d.bookHotel(ctx, r.Hotel)
+		start := d.clock.Now()
+		hotelConfirmation, err := d.bookHotel(ctx, r.Hotel, opts)
+		timings.HotelMillis += d.elapsedMillis(start)
 		if err != nil {
+			d.compensate(ctx, trip)
 			return nil, err
 		}
 		confirmation.HotelConfirmation = hotelConfirmation
 		trip.HotelRef = hotelConfirmation.Ref
 	}
 	if r.Car != nil {
-		carConfirmation, err := d.bookCar(ctx, r.Car)
+		start := d.clock.Now()
+		carConfirmation, err := d.bookCar(ctx, r.Car, opts)
+		timings.CarMillis += d.elapsedMillis(start)
 		if err != nil {
+			d.compensate(ctx, trip)
 			return nil, err
 		}
 		confirmation.CarRentalConfirmation = carConfirmation
 		trip.CarRef = carConfirmation.Ref
 	}
+	if opts.reserve {
+		if err := d.confirmReservations(ctx, confirmation, timings); err != nil {
+			d.compensate(ctx, trip)
+			return nil, err
+		}
+	}
+	confirmation.sumPrices()
+	if opts.DryRun {
+		// Nothing was booked, so there is nothing to store.
+		if opts.Timings {
+			confirmation.Timings = timings
+		}
+		return confirmation, nil
+	}
 
 	// Don't store these since it's redundant.
 	r.Flight = nil
 	r.Hotel = nil
 	r.Car = nil
 
+	if idempotent {
+		start := d.clock.Now()
+		confirmation, err := d.storeIdempotentTrip(ctx, trip, confirmation, opts.IdempotencyKey)
+		timings.StorageMillis = d.elapsedMillis(start)
+		if err != nil {
+			return nil, err
+		}
+		d.cache.put(cacheKey(table, confirmation.Ref), confirmation)
+		// The cache holds a copy, so cached reads don't include timings.
+		if opts.Timings {
+			confirmation.Timings = timings
+		}
+		return confirmation, nil
+	}
+
 	av, err := dynamodbattribute.MarshalMap(trip)
 	if err != nil {
+		d.compensate(ctx, trip)
 		return nil, err
 	}
 
 	input := &dynamodb.PutItemInput{
 		Item:      av,
-		TableName: aws.String(tripsTable),
+		TableName: aws.String(table),
+	}
+	start := d.clock.Now()
+	err = d.traceDynamoDB(ctx, "PutItem", table, func(ctx context.Context) error {
+		_, err := d.db.PutItemWithContext(ctx, input)
+		return err
+	})
+	timings.StorageMillis = d.elapsedMillis(start)
+	if err != nil {
+		// Don't leave the sub-bookings of an unrecorded trip behind.
+		d.compensate(ctx, trip)
+		return nil, err
 	}
-	_, err = d.db.PutItemWithContext(ctx, input)
 
-	return confirmation, err
+	d.tripBooked(ctx, confirmation)
+	d.cache.put(cacheKey(table, ref), confirmation)
+	if opts.Timings {
+		confirmation.Timings = timings
+	}
+	return confirmation, nil
+}
+
+// tripBooked records a booked trip in logs and metrics and publishes it for
+// asynchronous consumers. The trip is booked regardless, so publishing
+// failures are only logged.
+func (d *dynamoService) tripBooked(ctx context.Context, confirmation *TripConfirmation) {
+	var (
+		hasFlight  = confirmation.FlightConfirmation != nil
+		hasHotel   = confirmation.HotelConfirmation != nil
+		hasCar     = confirmation.CarRentalConfirmation != nil
+		components = 0
+	)
+	for _, booked := range []bool{hasFlight, hasHotel, hasCar} {
+		if booked {
+			components++
+		}
+	}
+	tripsBooked.WithLabelValues(strconv.Itoa(components)).Inc()
+
+	// Summarize the trip in one entry for log analytics. Member names are
+	// PII, so only their count is logged.
+	fields := log.Fields{
+		"ref":        confirmation.Ref,
+		"has_flight": hasFlight,
+		"has_hotel":  hasHotel,
+		"has_car":    hasCar,
+	}
+	if trip := confirmation.Trip; trip != nil {
+		fields["destination"] = trip.Destination
+		fields["member_count"] = len(trip.Members)
+		fields["start"] = trip.Start
+		fields["end"] = trip.End
+	}
+	util.Logger(ctx).WithFields(fields).Info("Booked trip composition")
+
+	if err := util.PublishEvent(ctx, TripBookedSubject, confirmation); err != nil {
+		util.LoggerWithSpan(ctx).WithFields(log.Fields{
+			"error": err,
+			"ref":   confirmation.Ref,
+		}).Warn("Failed to publish booked trip")
+	}
 }
 
+// GetBooking returns the confirmation of the trip with the given ref, from
+// the cache if it's enabled and holds the trip.
 func (d *dynamoService) GetBooking(ctx context.Context, ref string) (*TripConfirmation, error) {
-	result, err := d.db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(tripsTable),
-		Key: map[string]*dynamodb.AttributeValue{
-			"ref": {
-				S: aws.String(ref),
+	table, err := d.tripTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := cacheKey(table, ref)
+	if confirmation, ok := d.cache.get(ctx, key); ok {
+		return confirmation, nil
+	}
+
+	trip, err := d.loadTrip(ctx, d.reader, ref)
+	if err != nil {
+		return nil, err
+	}
+	confirmation, err := d.tripConfirmation(ctx, trip)
+	if err != nil {
+		return nil, err
+	}
+	d.cache.put(key, confirmation)
+	return confirmation, nil
+}
+
+// loadTrip reads the stored trip with the given ref using the given client.
+func (d *dynamoService) loadTrip(ctx context.Context, db *dynamodb.DynamoDB, ref string) (*TripBooking, error) {
+	table, err := d.tripTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var result *dynamodb.GetItemOutput
+	err = d.traceDynamoDB(ctx, "GetItem", table, func(ctx context.Context) error {
+		var err error
+		result, err = db.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(table),
+			Key: map[string]*dynamodb.AttributeValue{
+				"ref": {
+					S: aws.String(ref),
+				},
 			},
-		},
+		})
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	if len(result.Item) == 0 {
+		return nil, ErrNoSuchBooking
+	}
+
 	var trip *TripBooking
 	if err := dynamodbattribute.UnmarshalMap(result.Item, &trip); err != nil {
 		return nil, err
 	}
-	if trip.Ref == "" {
-		return nil, ErrNoSuchBooking
-	}
-	confirmation := &TripConfirmation{Ref: ref, Trip: trip.Request}
+	return trip, nil
+}
+
+// tripConfirmation fetches the sub-bookings of the trip to build its
+// confirmation.
+func (d *dynamoService) tripConfirmation(ctx context.Context, trip *TripBooking) (*TripConfirmation, error) {
+	confirmation := &TripConfirmation{Ref: trip.Ref, Trip: trip.Request}
 
 	if trip.FlightRef != "" {
 		flight, err := d.getFlight(ctx, trip.FlightRef)
@@ -257,35 +684,42 @@ func (d *dynamoService) GetBooking(ctx context.Context, ref string) (*TripConfir
 		confirmation.CarRentalConfirmation = car
 	}
 
-	return confirmation, err
+	confirmation.sumPrices()
+	return confirmation, nil
 }
 
 func (d *dynamoService) getFlight(ctx context.Context, ref string) (*flights.FlightConfirmation, error) {
 	var confirmation *flights.FlightConfirmation
-	err := d.getBooking(ctx, fmt.Sprintf("%s/flights/booking?ref=%s", flightServiceURL, ref), &confirmation)
+	start := d.clock.Now()
+	err := d.getBooking(ctx, d.flights, fmt.Sprintf("%s/flights/booking?ref=%s", d.flights.url, ref), &confirmation)
+	d.checkLatency(ctx, d.flights, "GetBooking", ref, start)
 	return confirmation, err
 }
 
 func (d *dynamoService) getHotel(ctx context.Context, ref string) (*hotels.HotelConfirmation, error) {
 	var confirmation *hotels.HotelConfirmation
-	err := d.getBooking(ctx, fmt.Sprintf("%s/hotels/booking?ref=%s", hotelServiceURL, ref), &confirmation)
+	start := d.clock.Now()
+	err := d.getBooking(ctx, d.hotels, fmt.Sprintf("%s/hotels/booking?ref=%s", d.hotels.url, ref), &confirmation)
+	d.checkLatency(ctx, d.hotels, "GetBooking", ref, start)
 	return confirmation, err
 }
 
 func (d *dynamoService) getCar(ctx context.Context, ref string) (*cars.CarRentalConfirmation, error) {
 	var confirmation *cars.CarRentalConfirmation
-	err := d.getBooking(ctx, fmt.Sprintf("%s/cars/booking?ref=%s", carServiceURL, ref), &confirmation)
+	start := d.clock.Now()
+	err := d.getBooking(ctx, d.cars, fmt.Sprintf("%s/cars/booking?ref=%s", d.cars.url, ref), &confirmation)
+	d.checkLatency(ctx, d.cars, "GetBooking", ref, start)
 	return confirmation, err
 }
 
-func (d *dynamoService) getBooking(ctx context.Context, url string, returned interface{}) error {
+func (d *dynamoService) getBooking(ctx context.Context, svc *downstream, url string, returned interface{}) error {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
 	req = req.WithContext(ctx)
 
-	resp, err := d.httpClient.Do(req)
+	resp, err := svc.do(req, true)
 	if err != nil {
 		return err
 	}
@@ -296,30 +730,43 @@ func (d *dynamoService) getBooking(ctx context.Context, url string, returned int
 		return err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("GetBooking request returned status code %d (%s)", resp.StatusCode, data)
+		return svc.newDownstreamError(resp, data)
 	}
+	defer util.TraceRegion(ctx, "json.unmarshal")()
 	return json.Unmarshal(data, &returned)
 }
 
-func (d *dynamoService) bookFlight(ctx context.Context, r *flights.BookFlightRequest) (*flights.FlightConfirmation, error) {
+func (d *dynamoService) bookFlight(ctx context.Context, r *flights.BookFlightRequest, opts BookOptions) (*flights.FlightConfirmation, error) {
 	var confirmation *flights.FlightConfirmation
-	err := d.book(ctx, r, flightServiceURL+"/flights/booking", &confirmation)
+	start := d.clock.Now()
+	err := d.book(ctx, d.flights, r, d.flights.url+opts.endpoint("/flights"), &confirmation)
+	if err == nil {
+		d.checkLatency(ctx, d.flights, "Book", confirmation.Ref, start)
+	}
 	return confirmation, err
 }
 
-func (d *dynamoService) bookHotel(ctx context.Context, r *hotels.BookHotelRequest) (*hotels.HotelConfirmation, error) {
+func (d *dynamoService) bookHotel(ctx context.Context, r *hotels.BookHotelRequest, opts BookOptions) (*hotels.HotelConfirmation, error) {
 	var confirmation *hotels.HotelConfirmation
-	err := d.book(ctx, r, hotelServiceURL+"/hotels/booking", &confirmation)
+	start := d.clock.Now()
+	err := d.book(ctx, d.hotels, r, d.hotels.url+opts.endpoint("/hotels"), &confirmation)
+	if err == nil {
+		d.checkLatency(ctx, d.hotels, "Book", confirmation.Ref, start)
+	}
 	return confirmation, err
 }
 
-func (d *dynamoService) bookCar(ctx context.Context, r *cars.BookCarRentalRequest) (*cars.CarRentalConfirmation, error) {
+func (d *dynamoService) bookCar(ctx context.Context, r *cars.BookCarRentalRequest, opts BookOptions) (*cars.CarRentalConfirmation, error) {
 	var confirmation *cars.CarRentalConfirmation
-	err := d.book(ctx, r, carServiceURL+"/cars/booking", &confirmation)
+	start := d.clock.Now()
+	err := d.book(ctx, d.cars, r, d.cars.url+opts.endpoint("/cars"), &confirmation)
+	if err == nil {
+		d.checkLatency(ctx, d.cars, "Book", confirmation.Ref, start)
+	}
 	return confirmation, err
 }
 
-func (d *dynamoService) book(ctx context.Context, payload interface{}, url string, returned interface{}) error {
+func (d *dynamoService) book(ctx context.Context, svc *downstream, payload interface{}, url string, returned interface{}) error {
 	data, err := json.Marshal(payload)
 	if err != nil {
 		panic(err)
@@ -332,7 +779,7 @@ func (d *dynamoService) book(ctx context.Context, payload interface{}, url strin
 	req.Header.Set("Content-Type", "application/json")
 	req = req.WithContext(ctx)
 
-	resp, err := d.httpClient.Do(req)
+	resp, err := svc.do(req, false)
 	if err != nil {
 		return err
 	}
@@ -342,8 +789,10 @@ func (d *dynamoService) book(ctx context.Context, payload interface{}, url strin
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("%s request returned status code %d (%s)", url, resp.StatusCode, data)
+	// Dry runs respond with 200 since nothing is created.
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return svc.newDownstreamError(resp, data)
 	}
+	defer util.TraceRegion(ctx, "json.unmarshal")()
 	return json.Unmarshal(data, &returned)
 }
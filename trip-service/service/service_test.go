@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	cars "github.com/realkinetic/cloud-native-meetup-2019/car-service/service"
+	flights "github.com/realkinetic/cloud-native-meetup-2019/flight-service/service"
+	hotels "github.com/realkinetic/cloud-native-meetup-2019/hotel-service/service"
+	"github.com/realkinetic/cloud-native-meetup-2019/util"
+)
+
+// TestTripBookedLogsComposition checks a booked trip is summarized in one log
+// entry, which counts the members rather than naming them.
+func TestTripBookedLogsComposition(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	log.SetOutput(ioutil.Discard)
+
+	start := time.Date(2019, 6, 1, 9, 0, 0, 0, time.UTC)
+	confirmation := &TripConfirmation{
+		Ref: "trip-ref",
+		Trip: &BookTripRequest{
+			Name:        "Offsite",
+			Destination: "Denver",
+			Start:       start,
+			End:         start.Add(72 * time.Hour),
+			Members:     []string{"Ada Lovelace", "Grace Hopper"},
+		},
+		FlightConfirmation: &flights.FlightConfirmation{Ref: "flight-ref"},
+		HotelConfirmation:  &hotels.HotelConfirmation{Ref: "hotel-ref"},
+	}
+	(&dynamoService{}).tripBooked(context.Background(), confirmation)
+
+	var entries []*log.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Booked trip composition" {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) != 1 {
+		t.Fatalf("logged %d trip compositions, want 1", len(entries))
+	}
+	entry := entries[0]
+	want := log.Fields{
+		"ref":          "trip-ref",
+		"has_flight":   true,
+		"has_hotel":    true,
+		"has_car":      false,
+		"destination":  "Denver",
+		"member_count": 2,
+		"start":        start,
+		"end":          start.Add(72 * time.Hour),
+	}
+	for field, value := range want {
+		if got := entry.Data[field]; !reflect.DeepEqual(got, value) {
+			t.Errorf("logged %s = %v, want %v", field, got, value)
+		}
+	}
+	if line, _ := entry.String(); strings.Contains(line, "Grace") {
+		t.Errorf("trip composition names a member: %s", line)
+	}
+}
+
+// TestSumPrices checks a trip's total is exactly the sum of its components'
+// prices, whichever it has.
+func TestSumPrices(t *testing.T) {
+	confirmation := &TripConfirmation{
+		FlightConfirmation: &flights.FlightConfirmation{Price: util.Money(10)},
+		HotelConfirmation:  &hotels.HotelConfirmation{Price: util.Money(20)},
+		TotalPrice:         util.Money(1),
+	}
+	confirmation.sumPrices()
+	if confirmation.TotalPrice != 30 {
+		t.Errorf("total = %s, want 0.30", confirmation.TotalPrice)
+	}
+
+	confirmation.CarRentalConfirmation = &cars.CarRentalConfirmation{Price: util.Money(19999)}
+	confirmation.sumPrices()
+	if confirmation.TotalPrice != 20029 {
+		t.Errorf("total = %s, want 200.29", confirmation.TotalPrice)
+	}
+
+	confirmation = &TripConfirmation{}
+	confirmation.sumPrices()
+	if confirmation.TotalPrice != 0 {
+		t.Errorf("total without components = %s, want 0.00", confirmation.TotalPrice)
+	}
+}
@@ -0,0 +1,22 @@
+package service
+
+import (
+	"time"
+)
+
+// BookingTimings are how long each step of booking a trip took, in
+// milliseconds, for clients without access to its trace. They're measured
+// around the same calls as the trace's spans. Steps which weren't taken are
+// zero.
+type BookingTimings struct {
+	FlightMillis  int64 `json:"flight_ms" xml:"flight_ms"`
+	HotelMillis   int64 `json:"hotel_ms" xml:"hotel_ms"`
+	CarMillis     int64 `json:"car_ms" xml:"car_ms"`
+	StorageMillis int64 `json:"storage_ms" xml:"storage_ms"`
+}
+
+// elapsedMillis returns the milliseconds elapsed since start by the
+// service's clock.
+func (d *dynamoService) elapsedMillis(start time.Time) int64 {
+	return int64(d.clock.Since(start) / time.Millisecond)
+}
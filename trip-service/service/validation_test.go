@@ -0,0 +1,60 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidateAll(t *testing.T) {
+	if err := testTripRequest().ValidateAll(); err != nil {
+		t.Fatalf("ValidateAll() = %v for a valid request", err)
+	}
+
+	request := testTripRequest()
+	request.Name = ""
+	request.Members = []string{"Ada", ""}
+	request.Hotel.Hotel = ""
+	request.Car.Agent = ""
+	err := request.ValidateAll()
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("ValidateAll() = %#v, want ValidationErrors", err)
+	}
+	var fields []string
+	for _, err := range errs {
+		fields = append(fields, err.Field)
+	}
+	if want := []string{"name", "members[1]", ComponentHotel, ComponentCar}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("invalid fields = %v, want %v", fields, want)
+	}
+
+	// Validate fails fast with the first of them.
+	if err := request.Validate(); !reflect.DeepEqual(err, errs[0]) {
+		t.Errorf("Validate() = %v, want %v", err, errs[0])
+	}
+}
+
+func TestValidateMaxMembers(t *testing.T) {
+	request := testTripRequest()
+	request.Members = nil
+	for len(request.Members) < defaultMaxMembers {
+		request.Members = append(request.Members, "Ada")
+	}
+	if err := request.ValidateAll(); err != nil {
+		t.Errorf("ValidateAll() with %d members = %v", len(request.Members), err)
+	}
+	request.Members = append(request.Members, "Ada")
+	want := &FieldError{Field: "members", Message: "too many members, at most 50 are allowed"}
+	if err := request.ValidateAll(); !reflect.DeepEqual(err, ValidationErrors{want}) {
+		t.Errorf("ValidateAll() with %d members = %v, want %v", len(request.Members), err, want)
+	}
+
+	max := maxMembers
+	maxMembers = 1
+	t.Cleanup(func() { maxMembers = max })
+	request.Members = request.Members[:2]
+	want.Message = "too many members, at most 1 are allowed"
+	if err := request.ValidateAll(); !reflect.DeepEqual(err, ValidationErrors{want}) {
+		t.Errorf("ValidateAll() with a limit of 1 = %v, want %v", err, want)
+	}
+}
@@ -0,0 +1,126 @@
+package util
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	apiKeysEnv           = "API_KEYS"
+	downstreamAPIKeyEnv  = "DOWNSTREAM_API_KEY"
+	apiKeyHeader         = "X-API-Key"
+	authorizationHeader  = "Authorization"
+	bearerPrefix         = "Bearer "
+	authenticateHeader   = "WWW-Authenticate"
+	authenticateResponse = `Bearer realm="api"`
+)
+
+// DefaultAuthExemptPaths are the paths which don't require an API key by
+// default.
+var DefaultAuthExemptPaths = []string{"/healthz", "/metrics"}
+
+// APIKeysFromEnv parses the API_KEYS env, a comma-separated list of
+// principal:key pairs, into a map of key to principal. It returns an empty map
+// if API_KEYS isn't set.
+func APIKeysFromEnv() (map[string]string, error) {
+	keys := make(map[string]string)
+	value := os.Getenv(apiKeysEnv)
+	if value == "" {
+		return keys, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid %s entry, expected principal:key", apiKeysEnv)
+		}
+		keys[parts[1]] = parts[0]
+	}
+	return keys, nil
+}
+
+// APIKeyMiddleware returns an http.Handler which requires requests to present
+// one of the given API keys, mapped to the principal they identify, in either
+// an "Authorization: Bearer <key>" or "X-API-Key" header. Requests without a
+// valid key get a 401. Requests to the exempt paths skip the check. The
+// authenticated principal is added to the request context for logging and
+// tagged on the request's span.
+func APIKeyMiddleware(handler http.Handler, keys map[string]string, exempt ...string) http.Handler {
+	exemptPaths := make(map[string]bool, len(exempt))
+	for _, path := range exempt {
+		exemptPaths[path] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exemptPaths[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		key := apiKeyFromRequest(r)
+		if key == "" {
+			log.WithContext(ctx).Warn("Missing API key")
+			w.Header().Set(authenticateHeader, authenticateResponse)
+			http.Error(w, "Missing API key", http.StatusUnauthorized)
+			return
+		}
+		principal, ok := lookupAPIKey(keys, key)
+		if !ok {
+			log.WithContext(ctx).Warn("Invalid API key")
+			w.Header().Set(authenticateHeader, authenticateResponse)
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		ctx = withPrincipal(ctx, principal)
+		if span := opentracing.SpanFromContext(ctx); span != nil {
+			span.SetTag("principal", principal)
+		}
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func apiKeyFromRequest(r *http.Request) string {
+	if auth := r.Header.Get(authorizationHeader); strings.HasPrefix(auth, bearerPrefix) {
+		return strings.TrimSpace(strings.TrimPrefix(auth, bearerPrefix))
+	}
+	return r.Header.Get(apiKeyHeader)
+}
+
+// lookupAPIKey compares the key against every valid key in constant time so
+// the response time doesn't leak how much of a key matched.
+func lookupAPIKey(keys map[string]string, key string) (string, bool) {
+	var (
+		principal string
+		found     bool
+	)
+	for valid, p := range keys {
+		if subtle.ConstantTimeCompare([]byte(valid), []byte(key)) == 1 {
+			principal = p
+			found = true
+		}
+	}
+	return principal, found
+}
+
+func withPrincipal(ctx context.Context, principal string) context.Context {
+	values := ctx.Value(ctxValuesKey)
+	if values == nil {
+		values = &ctxValues{}
+		ctx = context.WithValue(ctx, ctxValuesKey, values)
+	}
+	values.(*ctxValues).Principal = principal
+	return ctx
+}
+
+// addAPIKeyHeader authenticates an outbound request to another service with
+// the key in DOWNSTREAM_API_KEY, if set.
+func addAPIKeyHeader(r *http.Request) {
+	if key := os.Getenv(downstreamAPIKeyEnv); key != "" {
+		r.Header.Set(apiKeyHeader, key)
+	}
+}
@@ -0,0 +1,129 @@
+package util
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	keys := map[string]string{"secret": "ops", "other": "reporting"}
+	var principal string
+	handler := APIKeyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = r.Context().Value(ctxValuesKey).(*ctxValues).Principal
+	}), keys, DefaultAuthExemptPaths...)
+
+	for _, test := range []struct {
+		name      string
+		path      string
+		header    string
+		value     string
+		want      int
+		principal string
+	}{
+		{"bearer", "/trips/booking", authorizationHeader, "Bearer secret", http.StatusOK, "ops"},
+		{"API key header", "/trips/booking", apiKeyHeader, "other", http.StatusOK, "reporting"},
+		{"invalid", "/trips/booking", apiKeyHeader, "guess", http.StatusUnauthorized, ""},
+		{"prefix of a key", "/trips/booking", apiKeyHeader, "sec", http.StatusUnauthorized, ""},
+		{"not bearer", "/trips/booking", authorizationHeader, "Basic c2VjcmV0", http.StatusUnauthorized, ""},
+		{"missing", "/trips/booking", "", "", http.StatusUnauthorized, ""},
+		{"health check", "/healthz", "", "", http.StatusOK, ""},
+		{"metrics", "/metrics", "", "", http.StatusOK, ""},
+	} {
+		principal = ""
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		ctx, cancel := contextWithRequest(r)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+		cancel()
+
+		if w.Code != test.want {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.want)
+		}
+		if test.want == http.StatusUnauthorized && w.Header().Get(authenticateHeader) == "" {
+			t.Errorf("%s: 401 without a %s header", test.name, authenticateHeader)
+		}
+		if principal != test.principal {
+			t.Errorf("%s: principal = %q, want %q", test.name, principal, test.principal)
+		}
+	}
+}
+
+func TestAPIKeysFromEnv(t *testing.T) {
+	t.Setenv(apiKeysEnv, "")
+	if keys, err := APIKeysFromEnv(); err != nil || len(keys) != 0 {
+		t.Errorf("unset: keys = %v, %v, want none", keys, err)
+	}
+
+	t.Setenv(apiKeysEnv, "ops:secret, reporting:other:key")
+	keys, err := APIKeysFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys["secret"] != "ops" || keys["other:key"] != "reporting" {
+		t.Errorf("keys = %v, want secret for ops and other:key for reporting", keys)
+	}
+
+	for _, value := range []string{"secret", "ops:", ":secret", "ops:secret,"} {
+		t.Setenv(apiKeysEnv, value)
+		if _, err := APIKeysFromEnv(); err == nil {
+			t.Errorf("%s=%q: no error", apiKeysEnv, value)
+		}
+	}
+}
+
+// TestPrincipalLoggedAndTagged checks an authenticated request's logs and
+// span carry its principal, while an unauthenticated request's don't.
+func TestPrincipalLoggedAndTagged(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	log.SetOutput(ioutil.Discard)
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	handler := NewContextHandler(APIKeyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Logger(r.Context()).Info("Handled request")
+	}), map[string]string{"secret": "ops"}, "/public"))
+
+	for _, test := range []struct {
+		name, path, key string
+		want            interface{}
+	}{
+		{"with key", "/trips/booking", "secret", "ops"},
+		{"without key", "/public", "", nil},
+	} {
+		hook.Reset()
+		tracer.Reset()
+		r := httptest.NewRequest("GET", test.path, nil)
+		if test.key != "" {
+			r.Header.Set(apiKeyHeader, test.key)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		entry := hook.LastEntry()
+		if entry == nil || entry.Message != "Handled request" {
+			t.Fatalf("%s: request wasn't handled", test.name)
+		}
+		if got := entry.Data["principal"]; got != test.want {
+			t.Errorf("%s: logged principal %v, want %v", test.name, got, test.want)
+		}
+		spans := tracer.FinishedSpans()
+		if len(spans) != 1 {
+			t.Fatalf("%s: got %d spans, want 1", test.name, len(spans))
+		}
+		if got := spans[0].Tag("principal"); got != test.want {
+			t.Errorf("%s: span tagged with principal %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const redactFieldsEnv = "LOG_REDACT_FIELDS"
+
+// maxLoggedBodySize is the most of a request or response body that's logged.
+const maxLoggedBodySize = 64 * 1024
+
+// defaultRedactFields are the JSON fields scrubbed from logged bodies since
+// they hold traveller PII.
+var defaultRedactFields = []string{"name", "date_of_birth", "email", "phone"}
+
+const redacted = "[REDACTED]"
+
+// bodyLogMiddleware returns an http.Handler which, when the log level is
+// trace, logs request and response bodies with the given JSON fields
+// scrubbed. The request body is restored before the handler reads it. Bodies
+// larger than MAX_REQUEST_BODY_BYTES are rejected rather than buffered.
+func bodyLogMiddleware(handler http.Handler, redactFields []string) http.Handler {
+	redact := make(map[string]bool, len(redactFields))
+	for _, field := range redactFields {
+		redact[field] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !log.IsLevelEnabled(log.TraceLevel) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		var reqBody []byte
+		if r.Body != nil {
+			// Bound the buffered body like DecodeJSONBody does, so a huge
+			// request can't exhaust memory just because tracing is on.
+			body := &limitedBody{r: r.Body, remaining: maxRequestBodyBytes}
+			var err error
+			reqBody, err = ioutil.ReadAll(body)
+			r.Body.Close()
+			if body.exceeded {
+				err = fmt.Errorf("request body exceeds %d bytes", maxRequestBodyBytes)
+				Logger(r.Context()).WithFields(log.Fields{
+					"error": err,
+				}).Error("Request body too large")
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				Logger(r.Context()).WithFields(log.Fields{
+					"error": err,
+				}).Error("Failed to read request body")
+				http.Error(w, "Failed to read request", http.StatusBadRequest)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(reqBody))
+		}
+
+		bw := &bodyWriter{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(bw, r)
+
+		Logger(r.Context()).WithFields(log.Fields{
+			"status":        bw.status,
+			"request_body":  scrubBody(reqBody, redact),
+			"response_body": scrubBody(bw.body.Bytes(), redact),
+		}).Trace("HTTP request and response bodies")
+	})
+}
+
+// redactFieldsFromEnv returns the comma-separated JSON fields in
+// LOG_REDACT_FIELDS, or defaultRedactFields if it isn't set.
+func redactFieldsFromEnv() []string {
+	value := os.Getenv(redactFieldsEnv)
+	if value == "" {
+		return defaultRedactFields
+	}
+	var fields []string
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// scrubBody returns the body with the values of the redacted fields replaced,
+// at any depth. Bodies which aren't JSON aren't logged since they can't be
+// scrubbed.
+func scrubBody(body []byte, redact map[string]bool) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if len(body) > maxLoggedBodySize {
+		return fmt.Sprintf("<%d byte body omitted>", len(body))
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Sprintf("<%d byte non-JSON body omitted>", len(body))
+	}
+	scrubbed, err := json.Marshal(scrubValue(v, redact))
+	if err != nil {
+		return fmt.Sprintf("<%d byte body omitted>", len(body))
+	}
+	return string(scrubbed)
+}
+
+func scrubValue(v interface{}, redact map[string]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if redact[key] {
+				v[key] = redacted
+			} else {
+				v[key] = scrubValue(value, redact)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = scrubValue(value, redact)
+		}
+	}
+	return v
+}
+
+// bodyWriter captures the status and the start of the response body.
+type bodyWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (b *bodyWriter) WriteHeader(status int) {
+	if !b.wroteHeader {
+		b.status = status
+		b.wroteHeader = true
+	}
+	b.ResponseWriter.WriteHeader(status)
+}
+
+func (b *bodyWriter) Write(p []byte) (int, error) {
+	b.wroteHeader = true
+	if remaining := maxLoggedBodySize + 1 - b.body.Len(); remaining > 0 {
+		if len(p) < remaining {
+			remaining = len(p)
+		}
+		b.body.Write(p[:remaining])
+	}
+	return b.ResponseWriter.Write(p)
+}
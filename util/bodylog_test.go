@@ -0,0 +1,103 @@
+package util
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// traceLevel sets the log level to trace until the test ends.
+func traceLevel(t *testing.T) {
+	level := log.GetLevel()
+	log.SetLevel(log.TraceLevel)
+	t.Cleanup(func() { log.SetLevel(level) })
+}
+
+// TestBodyLogMiddleware checks the handler can still read the request body
+// once it's been logged, and the logged bodies are scrubbed.
+func TestBodyLogMiddleware(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	log.SetOutput(ioutil.Discard)
+	const body = `{"destination":"Denver","members":[{"name":"Ada"}]}`
+	var read string
+	handler := bodyLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		read = string(data)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"ref":"TR1","email":"ada@example.com"}`))
+	}), defaultRedactFields)
+
+	for _, trace := range []bool{false, true} {
+		hook.Reset()
+		if trace {
+			traceLevel(t)
+		}
+		read = ""
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/trips/booking", strings.NewReader(body)))
+		if read != body {
+			t.Errorf("trace %v: handler read %q, want %q", trace, read, body)
+		}
+		if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), "ada@example.com") {
+			t.Errorf("trace %v: response %d %q, want the handler's", trace, w.Code, w.Body)
+		}
+
+		entry := hook.LastEntry()
+		if !trace {
+			if entry != nil {
+				t.Errorf("logged %q below trace level", entry.Message)
+			}
+			continue
+		}
+		if entry == nil {
+			t.Fatal("bodies weren't logged")
+		}
+		if got, want := entry.Data["request_body"], `{"destination":"Denver","members":[{"name":"[REDACTED]"}]}`; got != want {
+			t.Errorf("logged request body %v, want %v", got, want)
+		}
+		if got, want := entry.Data["response_body"], `{"email":"[REDACTED]","ref":"TR1"}`; got != want {
+			t.Errorf("logged response body %v, want %v", got, want)
+		}
+		if entry.Data["status"] != http.StatusCreated {
+			t.Errorf("logged status %v, want %d", entry.Data["status"], http.StatusCreated)
+		}
+	}
+}
+
+// TestBodyLogMiddlewareLimit checks a body larger than the request limit is
+// rejected rather than buffered for logging.
+func TestBodyLogMiddlewareLimit(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	traceLevel(t)
+	max := maxRequestBodyBytes
+	maxRequestBodyBytes = 16
+	t.Cleanup(func() { maxRequestBodyBytes = max })
+
+	var called bool
+	handler := bodyLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}), defaultRedactFields)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/trips/booking", strings.NewReader(strings.Repeat("a", 17))))
+	if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != "request body exceeds 16 bytes" {
+		t.Errorf("response %d %q, want %d request body exceeds 16 bytes", w.Code, w.Body, http.StatusBadRequest)
+	}
+	if called {
+		t.Error("handler was called with an oversized body")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/trips/booking", strings.NewReader(strings.Repeat("a", 16))))
+	if !called {
+		t.Errorf("handler wasn't called with a body at the limit: %d %q", w.Code, w.Body)
+	}
+}
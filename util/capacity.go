@@ -0,0 +1,99 @@
+package util
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var dynamoDBConsumedCapacity = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "dynamodb_consumed_capacity_units_total",
+		Help: "Capacity units consumed by DynamoDB operations.",
+	},
+	[]string{"operation", "table"},
+)
+
+func init() {
+	MustRegister(dynamoDBConsumedCapacity)
+}
+
+// requestConsumedCapacity is a request handler which asks DynamoDB to report
+// the total capacity consumed by operations which support it.
+func requestConsumedCapacity(r *request.Request) {
+	field := consumedCapacityField(r.Params, "ReturnConsumedCapacity")
+	if !field.IsValid() || !field.IsNil() {
+		return
+	}
+	field.Set(reflect.ValueOf(aws.String(dynamodb.ReturnConsumedCapacityTotal)))
+}
+
+// recordConsumedCapacity is a request handler which tags the span in the
+// request's context with the capacity units the operation consumed, as
+// dynamodb.read_capacity_units or dynamodb.write_capacity_units, and counts
+// them in dynamodb_consumed_capacity_units_total, so traces show what each
+// request costs.
+func recordConsumedCapacity(r *request.Request) {
+	if r.Error != nil {
+		return
+	}
+	field := consumedCapacityField(r.Data, "ConsumedCapacity")
+	if !field.IsValid() {
+		return
+	}
+	// Single-table operations report one ConsumedCapacity, and batches and
+	// transactions one per table.
+	var consumed []*dynamodb.ConsumedCapacity
+	switch capacity := field.Interface().(type) {
+	case *dynamodb.ConsumedCapacity:
+		consumed = []*dynamodb.ConsumedCapacity{capacity}
+	case []*dynamodb.ConsumedCapacity:
+		consumed = capacity
+	}
+
+	var total float64
+	for _, capacity := range consumed {
+		if capacity == nil || capacity.CapacityUnits == nil {
+			continue
+		}
+		units := aws.Float64Value(capacity.CapacityUnits)
+		total += units
+		dynamoDBConsumedCapacity.WithLabelValues(r.Operation.Name, aws.StringValue(capacity.TableName)).Add(units)
+	}
+	if len(consumed) == 0 {
+		return
+	}
+	tag := "dynamodb.write_capacity_units"
+	if isReadOperation(r.Operation.Name) {
+		tag = "dynamodb.read_capacity_units"
+	}
+	if span := opentracing.SpanFromContext(r.Context()); span != nil {
+		span.SetTag(tag, total)
+	}
+}
+
+// consumedCapacityField returns the named field of the operation's input or
+// output struct, or the zero Value if it doesn't have one.
+func consumedCapacityField(v interface{}, name string) reflect.Value {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Ptr || value.IsNil() || value.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	return value.Elem().FieldByName(name)
+}
+
+// isReadOperation indicates if the DynamoDB operation only reads, so it
+// consumes read rather than write capacity.
+func isReadOperation(operation string) bool {
+	for _, prefix := range []string{"Get", "BatchGet", "TransactGet", "Query", "Scan"} {
+		if strings.HasPrefix(operation, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package util
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	chaosLatencyEnv   = "CHAOS_LATENCY_MS"
+	chaosErrorRateEnv = "CHAOS_ERROR_RATE"
+)
+
+// ChaosMiddleware returns an http.Handler which injects latency and failures
+// for exercising callers' timeouts and retries. Every request is delayed by
+// CHAOS_LATENCY_MS and then fails with a 503 with probability
+// CHAOS_ERROR_RATE, between 0 and 1. Requests to the exempt paths are left
+// alone. If neither env is set, the handler is returned unchanged.
+func ChaosMiddleware(handler http.Handler, exempt ...string) (http.Handler, error) {
+	latency, errorRate, err := chaosFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if latency == 0 && errorRate == 0 {
+		return handler, nil
+	}
+
+	log.WithFields(log.Fields{
+		"latency":    latency,
+		"error_rate": errorRate,
+	}).Warn("Chaos injection enabled")
+
+	exemptPaths := make(map[string]bool, len(exempt))
+	for _, path := range exempt {
+		exemptPaths[path] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exemptPaths[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		span := opentracing.SpanFromContext(ctx)
+		if latency > 0 {
+			if span != nil {
+				span.SetTag("chaos.latency_ms", int64(latency/time.Millisecond))
+			}
+			select {
+			case <-time.After(latency):
+			case <-ctx.Done():
+				// The caller gave up, so there's no one to respond to.
+				return
+			}
+		}
+		if errorRate > 0 && rand.Float64() < errorRate {
+			if span != nil {
+				span.SetTag("chaos.error", true)
+			}
+			log.WithContext(ctx).Warn("Injected chaos failure")
+			http.Error(w, "Injected failure", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}), nil
+}
+
+func chaosFromEnv() (time.Duration, float64, error) {
+	var (
+		latency   time.Duration
+		errorRate float64
+	)
+	if value := os.Getenv(chaosLatencyEnv); value != "" {
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ms < 0 {
+			return 0, 0, fmt.Errorf("invalid %s %q", chaosLatencyEnv, value)
+		}
+		latency = time.Duration(ms) * time.Millisecond
+	}
+	if value := os.Getenv(chaosErrorRateEnv); value != "" {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return 0, 0, fmt.Errorf("invalid %s %q", chaosErrorRateEnv, value)
+		}
+		errorRate = rate
+	}
+	return latency, errorRate, nil
+}
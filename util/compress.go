@@ -0,0 +1,123 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// minCompressSize is the smallest response body which is compressed. Below
+// this, the gzip overhead outweighs the savings.
+const minCompressSize = 1024
+
+// CompressMiddleware returns an http.Handler which gzips response bodies for
+// clients that send Accept-Encoding: gzip. Responses smaller than
+// minCompressSize are sent uncompressed.
+func CompressMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsGzip(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		cw := &compressWriter{ResponseWriter: w}
+		defer cw.close()
+		handler.ServeHTTP(cw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	if r.Method == "HEAD" {
+		return false
+	}
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		encoding = strings.TrimSpace(strings.SplitN(encoding, ";", 2)[0])
+		if encoding == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter buffers the start of the response until it knows whether
+// the body is large enough to compress.
+type compressWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buf         bytes.Buffer
+	gz          *gzip.Writer
+	passthrough bool
+}
+
+func (c *compressWriter) WriteHeader(status int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+	c.status = status
+	// Don't compress bodyless or already encoded responses.
+	if status == http.StatusNoContent || status == http.StatusNotModified ||
+		c.Header().Get("Content-Encoding") != "" {
+		c.passthrough = true
+		c.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.passthrough {
+		return c.ResponseWriter.Write(p)
+	}
+	if c.gz != nil {
+		return c.gz.Write(p)
+	}
+	c.buf.Write(p)
+	if c.buf.Len() < minCompressSize {
+		return len(p), nil
+	}
+	if err := c.startGzip(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// startGzip writes the response header with gzip encoding and compresses the
+// buffered body.
+func (c *compressWriter) startGzip() error {
+	header := c.Header()
+	// Preserve the handler's Content-Type, or sniff it from the uncompressed
+	// body as net/http otherwise would.
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", http.DetectContentType(c.buf.Bytes()))
+	}
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	c.ResponseWriter.WriteHeader(c.status)
+
+	c.gz = gzip.NewWriter(c.ResponseWriter)
+	_, err := c.gz.Write(c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+// close flushes the response. Bodies which never reached minCompressSize are
+// written uncompressed.
+func (c *compressWriter) close() {
+	if c.gz != nil {
+		c.gz.Close()
+		return
+	}
+	if c.passthrough {
+		return
+	}
+	if !c.wroteHeader {
+		// The handler wrote nothing, so let net/http send its default.
+		return
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	c.ResponseWriter.Write(c.buf.Bytes())
+}
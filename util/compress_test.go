@@ -0,0 +1,86 @@
+package util
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// writeBody returns a handler which responds with the status and the body,
+// written in two halves so it can cross the compression threshold partway.
+func writeBody(status int, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body[:len(body)/2]))
+		w.Write([]byte(body[len(body)/2:]))
+	})
+}
+
+func TestCompressMiddleware(t *testing.T) {
+	large := `{"ref":"` + strings.Repeat("a", 2*minCompressSize) + `"}`
+	small := `{"ref":"TR1"}`
+	for _, test := range []struct {
+		name           string
+		acceptEncoding string
+		status         int
+		body           string
+		compressed     bool
+	}{
+		{"large", "gzip", http.StatusCreated, large, true},
+		{"weighted", "deflate, gzip;q=0.8", http.StatusOK, large, true},
+		{"small", "gzip", http.StatusOK, small, false},
+		{"not accepted", "", http.StatusOK, large, false},
+		{"other encoding", "br", http.StatusOK, large, false},
+	} {
+		r := httptest.NewRequest("GET", "/trips/booking", nil)
+		if test.acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		CompressMiddleware(writeBody(test.status, test.body)).ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s: Content-Type = %q, want the handler's", test.name, got)
+		}
+		body := w.Body.String()
+		if test.compressed {
+			if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+				t.Errorf("%s: Content-Encoding = %q, want gzip", test.name, got)
+				continue
+			}
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			data, err := ioutil.ReadAll(gz)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			body = string(data)
+		} else if got := w.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: Content-Encoding = %q, want none", test.name, got)
+		}
+		if body != test.body {
+			t.Errorf("%s: body = %.40q..., want %.40q...", test.name, body, test.body)
+		}
+	}
+}
+
+func TestCompressMiddlewareNoContent(t *testing.T) {
+	r := httptest.NewRequest("DELETE", "/trips/booking", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	CompressMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})).ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("got %d with %d bytes encoded %q, want an empty 204", w.Code, w.Body.Len(), w.Header().Get("Content-Encoding"))
+	}
+}
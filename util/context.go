@@ -0,0 +1,35 @@
+package util
+
+import (
+	"context"
+	"time"
+)
+
+// detachedContext carries the values of its parent, such as the request
+// context and active span, but none of its deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+// Detach returns a context with the values of ctx which is never cancelled.
+// Use it for work which must finish even if the request that started it has
+// been cancelled, such as cleanup, bounded by its own timeout.
+func Detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+func (d detachedContext) Value(key interface{}) interface{} {
+	return d.parent.Value(key)
+}
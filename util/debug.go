@@ -0,0 +1,35 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const debugEndpointsEnv = "DEBUG_ENDPOINTS"
+
+// RegisterDebugEndpoints registers the debugging endpoints on the mux if
+// DEBUG_ENDPOINTS is true. They expose internals, so they're off by default.
+func RegisterDebugEndpoints(mux *http.ServeMux) {
+	enabled, _ := strconv.ParseBool(os.Getenv(debugEndpointsEnv))
+	if !enabled {
+		return
+	}
+	mux.HandleFunc("/debug/tracing", tracingHandler)
+}
+
+// tracingHandler reports the tracing configuration set up by Init.
+func tracingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		LegacyError(w, r.Context(), http.StatusBadRequest, errInvalidMethod)
+		return
+	}
+	resp, err := json.Marshal(tracingConfig)
+	if err != nil {
+		LegacyError(w, r.Context(), http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -0,0 +1,225 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	strictJSONEnv          = "STRICT_JSON"
+	maxRequestBodyBytesEnv = "MAX_REQUEST_BODY_BYTES"
+
+	// defaultMaxRequestBodyBytes leaves room for a full bulk booking.
+	defaultMaxRequestBodyBytes = 10 << 20
+)
+
+// strictJSON is set from STRICT_JSON at startup.
+var strictJSON, _ = strconv.ParseBool(os.Getenv(strictJSONEnv))
+
+// maxRequestBodyBytes is set from MAX_REQUEST_BODY_BYTES at startup.
+var maxRequestBodyBytes = func() int64 {
+	n, err := IntFromEnv(maxRequestBodyBytesEnv, defaultMaxRequestBodyBytes)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Ignoring request body limit")
+		return defaultMaxRequestBodyBytes
+	}
+	return int64(n)
+}()
+
+// DecodeJSONBody decodes the JSON request body into v as it's read, rather
+// than buffering the whole body first, so large requests such as bulk
+// bookings don't need twice their size in memory. Bodies larger than
+// MAX_REQUEST_BODY_BYTES (default 10MB) are rejected. If STRICT_JSON is true,
+// fields which don't exist in v are rejected with an error naming the field,
+// so a client's typo isn't silently dropped, though the body is then buffered
+// to check it. Types with custom unmarshaling decode their own fields as they
+// see fit.
+//
+// The returned errors describe what's wrong with the body, for responding
+// with a 400.
+func DecodeJSONBody(r *http.Request, v interface{}) error {
+	body := &limitedBody{r: r.Body, remaining: maxRequestBodyBytes}
+	decoder := json.NewDecoder(body)
+	var err error
+	if strictJSON {
+		err = decodeStrict(decoder, v)
+	} else {
+		err = decoder.Decode(v)
+	}
+	if err == nil {
+		// Like json.Unmarshal, reject anything but whitespace after the
+		// value.
+		var extra json.RawMessage
+		if err = decoder.Decode(&extra); err == io.EOF && !body.exceeded {
+			return nil
+		}
+		err = fmt.Errorf("unexpected data after the JSON value")
+	}
+	switch {
+	case body.exceeded:
+		return fmt.Errorf("request body exceeds %d bytes", maxRequestBodyBytes)
+	case err == io.EOF:
+		return fmt.Errorf("request body is empty")
+	case err == io.ErrUnexpectedEOF:
+		return fmt.Errorf("request body is truncated JSON")
+	}
+	if syntaxErr, ok := err.(*json.SyntaxError); ok {
+		return fmt.Errorf("invalid JSON at offset %d: %v", syntaxErr.Offset, syntaxErr)
+	}
+	return err
+}
+
+// decodeStrict decodes the decoder's next JSON value into v, rejecting fields
+// which don't exist in v, like json.Decoder.DisallowUnknownFields, which needs
+// Go 1.10. Unlike it, the value is buffered to be checked before it's decoded.
+func decodeStrict(decoder *json.Decoder, v interface{}) error {
+	var raw json.RawMessage
+	if err := decoder.Decode(&raw); err != nil {
+		return err
+	}
+	if err := checkFields(raw, reflect.TypeOf(v)); err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// checkFields returns an error naming the first field of the JSON objects in
+// data, in order of name, which doesn't exist in the struct t decodes them
+// into, at any depth. Values of types with custom unmarshaling aren't
+// checked, nor is data which doesn't fit t, which json.Unmarshal reports.
+func checkFields(data []byte, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		if t.Implements(unmarshalerType) {
+			return nil
+		}
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(data, &object) != nil {
+			return nil
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fields := jsonFields(t)
+		for _, name := range names {
+			field, ok := fields[name]
+			if !ok {
+				// Like json.Unmarshal, fall back to a case-insensitive match.
+				for fieldName, f := range fields {
+					if strings.EqualFold(fieldName, name) {
+						field, ok = f, true
+						break
+					}
+				}
+			}
+			if !ok {
+				return fmt.Errorf("json: unknown field %q", name)
+			}
+			if err := checkFields(object[name], field.Type); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		var elements []json.RawMessage
+		if json.Unmarshal(data, &elements) != nil {
+			return nil
+		}
+		for _, element := range elements {
+			if err := checkFields(element, t.Elem()); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		var values map[string]json.RawMessage
+		if json.Unmarshal(data, &values) != nil {
+			return nil
+		}
+		for _, value := range values {
+			if err := checkFields(value, t.Elem()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jsonFields returns the fields of the struct type by their JSON names,
+// including those of embedded structs, as json.Unmarshal sets them.
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			for embeddedName, embedded := range jsonFields(fieldType) {
+				if _, ok := fields[embeddedName]; !ok {
+					fields[embeddedName] = embedded
+				}
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			// Unexported.
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+// limitedBody reads at most remaining bytes from r, recording whether the
+// body was larger.
+type limitedBody struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Check whether there's more before calling it too large.
+		var probe [1]byte
+		if n, _ := l.r.Read(probe[:]); n > 0 {
+			l.exceeded = true
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
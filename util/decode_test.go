@@ -0,0 +1,100 @@
+package util
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type decodeRecord struct {
+	Destination string `json:"destination"`
+}
+
+func TestDecodeJSONBody(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		body   string
+		strict bool
+		err    string
+	}{
+		{"valid", `{"destination":"Denver"}`, false, ""},
+		{"valid strict", `{"destination":"Denver"}`, true, ""},
+		{"trailing whitespace", "{\"destination\":\"Denver\"}\n", true, ""},
+		{"unknown field", `{"destination":"Denver","destenation":"Boulder"}`, false, ""},
+		{"unknown field strict", `{"destination":"Denver","destenation":"Boulder"}`, true, `json: unknown field "destenation"`},
+		{"trailing data", `{"destination":"Denver"}{"destination":"Boulder"}`, false, "unexpected data after the JSON value"},
+		{"trailing data strict", `{"destination":"Denver"} garbage`, true, "unexpected data after the JSON value"},
+		{"empty", ``, false, "request body is empty"},
+		{"truncated", `{"destination":`, false, "request body is truncated JSON"},
+		{"syntax error", `{"destination" "Denver"}`, false, "invalid JSON at offset 16"},
+	} {
+		strict := strictJSON
+		strictJSON = test.strict
+		var record decodeRecord
+		err := DecodeJSONBody(httptest.NewRequest("POST", "/", strings.NewReader(test.body)), &record)
+		strictJSON = strict
+
+		if test.err == "" {
+			if err != nil || record.Destination != "Denver" {
+				t.Errorf("%s: decoded %+v, %v, want Denver", test.name, record, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, want %s", test.name, err, test.err)
+		}
+	}
+}
+
+func TestDecodeJSONBodyLimit(t *testing.T) {
+	max := maxRequestBodyBytes
+	maxRequestBodyBytes = int64(len(`{"destination":"Denver"}`))
+	t.Cleanup(func() { maxRequestBodyBytes = max })
+
+	var record decodeRecord
+	if err := DecodeJSONBody(httptest.NewRequest("POST", "/", strings.NewReader(`{"destination":"Denver"}`)), &record); err != nil {
+		t.Errorf("body at the limit: %v", err)
+	}
+	for _, body := range []string{`{"destination":"Denver, Colorado"}`, `{"destination":"Denver"} `} {
+		err := DecodeJSONBody(httptest.NewRequest("POST", "/", strings.NewReader(body)), &record)
+		if want := "request body exceeds 24 bytes"; err == nil || err.Error() != want {
+			t.Errorf("body %q over the limit: error = %v, want %s", body, err, want)
+		}
+	}
+}
+
+type strictLeg struct {
+	From string    `json:"from"`
+	At   time.Time `json:"at"`
+}
+
+type strictTrip struct {
+	decodeRecord
+	Legs    []*strictLeg          `json:"legs"`
+	Tags    map[string]*strictLeg `json:"tags,omitempty"`
+	Ignored string                `json:"-"`
+}
+
+func TestCheckFields(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		body string
+		err  string
+	}{
+		{"known", `{"destination":"Denver","legs":[{"from":"DEN","at":"2019-06-01T09:00:00Z"}]}`, ""},
+		{"case insensitive", `{"Destination":"Denver","LEGS":[{"From":"DEN"}]}`, ""},
+		{"unknown nested in a list", `{"destination":"Denver","legs":[{"from":"DEN","to":"SFO"}]}`, `json: unknown field "to"`},
+		{"unknown nested in a map", `{"tags":{"home":{"form":"DEN"}}}`, `json: unknown field "form"`},
+		{"ignored field", `{"Ignored":"x"}`, `json: unknown field "Ignored"`},
+		{"first by name", `{"zebra":1,"apple":2}`, `json: unknown field "apple"`},
+		// Mismatched types are left for json.Unmarshal to report.
+		{"mismatched type", `{"legs":{"from":"DEN"}}`, ""},
+	} {
+		err := checkFields([]byte(test.body), reflect.TypeOf(&strictTrip{}))
+		if test.err == "" && err != nil || test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+		}
+	}
+}
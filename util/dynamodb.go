@@ -0,0 +1,392 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/opentracing-contrib/go-aws-sdk"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	accessKeyIDEnv     = "AWS_ACCESS_KEY_ID"
+	secretAccessKeyEnv = "AWS_SECRET_ACCESS_KEY"
+	sessionTokenEnv    = "AWS_SESSION_TOKEN"
+
+	billingModeEnv    = "DYNAMODB_BILLING_MODE"
+	readCapacityEnv   = "DYNAMODB_READ_CAPACITY"
+	writeCapacityEnv  = "DYNAMODB_WRITE_CAPACITY"
+	startupTimeoutEnv = "DYNAMODB_STARTUP_TIMEOUT"
+	readRegionEnv     = "READ_REGION"
+	endpointEnv       = "DYNAMODB_ENDPOINT"
+	tablePrefixEnv    = "TABLE_PREFIX"
+
+	defaultRegion = "us-east-1"
+
+	defaultReadCapacity   = 2
+	defaultWriteCapacity  = 2
+	defaultStartupTimeout = time.Minute
+	initialSetupBackoff   = 500 * time.Millisecond
+	maxSetupBackoff       = 8 * time.Second
+)
+
+var errTableNotActive = errors.New("table not active")
+
+// addOTHandlers instruments a client for tracing. Tests replace it to observe
+// the spans.
+var addOTHandlers = func(c *client.Client) {
+	otaws.AddOTHandlers(c)
+}
+
+// NewDynamoDB returns a DynamoDB client instrumented for tracing. If
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are set, they're used as static
+// credentials, e.g. dummy credentials for dynamodb-local. Otherwise the
+// default credential chain, including the shared config in ~/.aws, is used.
+// If DYNAMODB_ENDPOINT is set, requests are sent there instead of to AWS.
+// Retries follow DynamoDBRetryPolicyFromEnv. Operations
+// report the capacity they consume; see recordConsumedCapacity.
+func NewDynamoDB() *dynamodb.DynamoDB {
+	return newDynamoDB(defaultRegion)
+}
+
+// NewReadDynamoDB returns the client to read from. If READ_REGION is set, it's
+// a client for the global table replica in that region. Otherwise it's the
+// given primary client. Replicas are eventually consistent, so reads which
+// must observe the latest write should use the primary.
+func NewReadDynamoDB(primary *dynamodb.DynamoDB) *dynamodb.DynamoDB {
+	region := os.Getenv(readRegionEnv)
+	if region == "" || region == aws.StringValue(primary.Config.Region) {
+		return primary
+	}
+	return newDynamoDB(region)
+}
+
+func newDynamoDB(region string) *dynamodb.DynamoDB {
+	retryer := newPolicyRetryer(DynamoDBRetryPolicyFromEnv())
+	config := aws.Config{
+		Region:     aws.String(region),
+		MaxRetries: aws.Int(retryer.MaxRetries()),
+	}
+	request.WithRetryer(&config, retryer)
+	if endpoint := os.Getenv(endpointEnv); endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+	accessKeyID := os.Getenv(accessKeyIDEnv)
+	secretAccessKey := os.Getenv(secretAccessKeyEnv)
+	if accessKeyID != "" && secretAccessKey != "" {
+		config.Credentials = credentials.NewStaticCredentials(
+			accessKeyID, secretAccessKey, os.Getenv(sessionTokenEnv))
+	}
+
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+		Config:            config,
+	}))
+	db := dynamodb.New(sess)
+	addOTHandlers(db.Client)
+	db.Handlers.Build.PushFront(requestConsumedCapacity)
+	// otaws finishes the operation's span in its Complete handler, so the
+	// span must be tagged before it.
+	db.Handlers.Complete.PushFront(tagRetries)
+	db.Handlers.Complete.PushFront(recordConsumedCapacity)
+	return db
+}
+
+// TraceDynamoDB calls fn within a child span for the given DynamoDB operation
+// on table. If fn fails, the span is marked as errored and the AWS error code
+// is logged to it so the failure is visible in the trace. Throttled
+// operations are also counted in dynamodb_throttled_total.
+func TraceDynamoDB(ctx context.Context, operation, table string, fn func(context.Context) error) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "dynamodb."+operation)
+	defer span.Finish()
+	span.SetTag("table", table)
+
+	start := time.Now()
+	err := fn(ctx)
+	dynamoDBDuration.WithLabelValues(operation, table).Observe(time.Since(start).Seconds())
+	if err != nil {
+		code := "Unknown"
+		if awsError, ok := err.(awserr.Error); ok {
+			code = awsError.Code()
+		}
+		if IsThrottle(err) {
+			dynamoDBThrottled.WithLabelValues(operation, table).Inc()
+		}
+		ext.Error.Set(span, true)
+		LogSpanFields(span,
+			tracelog.String("event", "error"),
+			tracelog.String("error.kind", code),
+			tracelog.String("message", err.Error()),
+		)
+	}
+	return err
+}
+
+// TableName returns the name of the given table prefixed by the TABLE_PREFIX
+// env, e.g. "workshop42_trips" for a prefix of "workshop42_", so several
+// deployments can share an account. Without a prefix, the name is unchanged.
+func TableName(name string) string {
+	return os.Getenv(tablePrefixEnv) + name
+}
+
+// TableOption configures a table created by CreateTable.
+type TableOption func(*dynamodb.CreateTableInput)
+
+// WithHashKey sets the name of the table's string hash key, which defaults to
+// "ref".
+func WithHashKey(name string) TableOption {
+	return func(input *dynamodb.CreateTableInput) {
+		input.AttributeDefinitions[0].AttributeName = aws.String(name)
+		input.KeySchema[0].AttributeName = aws.String(name)
+	}
+}
+
+// WithGlobalSecondaryIndex adds a global secondary index with the given name,
+// keyed by the string hashKey attribute and, unless it's empty, the string
+// rangeKey attribute, projecting every attribute. Indexes are only created
+// along with the table, so a warning is logged if an existing table lacks
+// one; add it with UpdateTable.
+func WithGlobalSecondaryIndex(name, hashKey, rangeKey string) TableOption {
+	return func(input *dynamodb.CreateTableInput) {
+		keys := []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String(hashKey),
+				KeyType:       aws.String("HASH"),
+			},
+		}
+		defineStringAttribute(input, hashKey)
+		if rangeKey != "" {
+			keys = append(keys, &dynamodb.KeySchemaElement{
+				AttributeName: aws.String(rangeKey),
+				KeyType:       aws.String("RANGE"),
+			})
+			defineStringAttribute(input, rangeKey)
+		}
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndex{
+			IndexName: aws.String(name),
+			KeySchema: keys,
+			Projection: &dynamodb.Projection{
+				ProjectionType: aws.String(dynamodb.ProjectionTypeAll),
+			},
+		})
+	}
+}
+
+// defineStringAttribute defines the key attribute as a string, unless it's
+// already defined.
+func defineStringAttribute(input *dynamodb.CreateTableInput, name string) {
+	for _, definition := range input.AttributeDefinitions {
+		if aws.StringValue(definition.AttributeName) == name {
+			return
+		}
+	}
+	input.AttributeDefinitions = append(input.AttributeDefinitions, &dynamodb.AttributeDefinition{
+		AttributeName: aws.String(name),
+		AttributeType: aws.String("S"),
+	})
+}
+
+// CreateTable creates the DynamoDB table with the given name, keyed by a
+// string "ref" attribute unless configured otherwise, if it doesn't already
+// exist, and waits for it to become active. Billing is configured from the
+// DYNAMODB_BILLING_MODE env (PROVISIONED or PAY_PER_REQUEST). For provisioned
+// tables, capacity is read from DYNAMODB_READ_CAPACITY and
+// DYNAMODB_WRITE_CAPACITY, defaulting to 2/2.
+//
+// If DynamoDB isn't reachable yet, e.g. because it's still starting alongside
+// the service, setup is retried with exponential backoff until
+// DYNAMODB_STARTUP_TIMEOUT (default 1m) elapses.
+//
+// Setup is traced as a step of startup and its duration is recorded in
+// startup_duration_seconds.
+func CreateTable(db *dynamodb.DynamoDB, table string, opts ...TableOption) error {
+	span, finish := startStartupStep("dynamodb.CreateTable", "create_table:"+table)
+	defer finish()
+	span.SetTag("table", table)
+
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{
+				AttributeName: aws.String("ref"),
+				AttributeType: aws.String("S"),
+			},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{
+				AttributeName: aws.String("ref"),
+				KeyType:       aws.String("HASH"),
+			},
+		},
+		TableName: aws.String(table),
+	}
+	for _, opt := range opts {
+		opt(input)
+	}
+	if err := setBilling(input); err != nil {
+		return err
+	}
+
+	timeout, err := DurationFromEnv(startupTimeoutEnv, defaultStartupTimeout)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	backoff := initialSetupBackoff
+	for attempt := 1; ; attempt++ {
+		created, err := createTable(db, input)
+		if err == nil {
+			span.SetTag("created", created)
+			log.WithFields(log.Fields{
+				"table":    table,
+				"created":  created,
+				"attempts": attempt,
+			}).Info("DynamoDB table ready")
+			return nil
+		}
+		if !isRetryableSetupError(err) || time.Now().Add(backoff).After(deadline) {
+			ext.Error.Set(span, true)
+			return err
+		}
+		log.WithFields(log.Fields{
+			"error":   err,
+			"table":   table,
+			"attempt": attempt,
+			"backoff": backoff.String(),
+		}).Warn("DynamoDB table not ready, retrying")
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxSetupBackoff {
+			backoff = maxSetupBackoff
+		}
+	}
+}
+
+// createTable makes a single attempt to create the table and confirm that it
+// is active. It indicates whether the table was created, rather than already
+// existing.
+func createTable(db *dynamodb.DynamoDB, input *dynamodb.CreateTableInput) (bool, error) {
+	created := true
+	_, err := db.CreateTable(input)
+	if err != nil {
+		if awsError, ok := err.(awserr.Error); ok {
+			if awsError.Code() != dynamodb.ErrCodeResourceInUseException {
+				return false, err
+			}
+			created = false
+		} else {
+			return false, err
+		}
+	}
+
+	resp, err := db.DescribeTable(&dynamodb.DescribeTableInput{TableName: input.TableName})
+	if err != nil {
+		return false, err
+	}
+	if aws.StringValue(resp.Table.TableStatus) != dynamodb.TableStatusActive {
+		return false, errTableNotActive
+	}
+	if !created {
+		warnMissingIndexes(input, resp.Table)
+	}
+	return created, nil
+}
+
+// warnMissingIndexes warns about indexes the existing table was expected to
+// have, since CreateTable doesn't add them to existing tables.
+func warnMissingIndexes(input *dynamodb.CreateTableInput, table *dynamodb.TableDescription) {
+	existing := make(map[string]bool, len(table.GlobalSecondaryIndexes))
+	for _, index := range table.GlobalSecondaryIndexes {
+		existing[aws.StringValue(index.IndexName)] = true
+	}
+	for _, index := range input.GlobalSecondaryIndexes {
+		if !existing[aws.StringValue(index.IndexName)] {
+			log.WithFields(log.Fields{
+				"table": aws.StringValue(input.TableName),
+				"index": aws.StringValue(index.IndexName),
+			}).Warn("DynamoDB table is missing an index, queries using it will fail")
+		}
+	}
+}
+
+// isRetryableSetupError indicates if the error is likely transient, i.e.
+// DynamoDB is unreachable, unavailable, or the table is still being created.
+func isRetryableSetupError(err error) bool {
+	if err == errTableNotActive {
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= http.StatusInternalServerError {
+		return true
+	}
+	if awsError, ok := err.(awserr.Error); ok && awsError.Code() == dynamodb.ErrCodeResourceNotFoundException {
+		return true
+	}
+	return request.IsErrorRetryable(err) || request.IsErrorThrottle(err)
+}
+
+func setBilling(input *dynamodb.CreateTableInput) error {
+	mode := os.Getenv(billingModeEnv)
+	switch mode {
+	case "", dynamodb.BillingModeProvisioned:
+		read, err := capacityFromEnv(readCapacityEnv, defaultReadCapacity)
+		if err != nil {
+			return err
+		}
+		write, err := capacityFromEnv(writeCapacityEnv, defaultWriteCapacity)
+		if err != nil {
+			return err
+		}
+		input.ProvisionedThroughput = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(read),
+			WriteCapacityUnits: aws.Int64(write),
+		}
+		// Indexes are provisioned like their table.
+		for _, index := range input.GlobalSecondaryIndexes {
+			index.ProvisionedThroughput = input.ProvisionedThroughput
+		}
+	case dynamodb.BillingModePayPerRequest:
+		input.BillingMode = aws.String(dynamodb.BillingModePayPerRequest)
+	default:
+		return fmt.Errorf("invalid %s %q", billingModeEnv, mode)
+	}
+	return nil
+}
+
+func capacityFromEnv(env string, defaultCapacity int64) (int64, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return defaultCapacity, nil
+	}
+	capacity, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || capacity <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", env, value)
+	}
+	return capacity, nil
+}
+
+// DurationFromEnv parses the duration in the given env var, returning the
+// default if it isn't set.
+func DurationFromEnv(env string, defaultDuration time.Duration) (time.Duration, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return defaultDuration, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid %s %q", env, value)
+	}
+	return duration, nil
+}
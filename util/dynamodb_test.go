@@ -0,0 +1,138 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util/servicetest"
+)
+
+// fakeOTHandlers instruments clients like otaws: each operation gets a span,
+// which is finished by a Complete handler. The span's tags are captured when
+// it's finished, since tags set afterwards are lost.
+type fakeOTHandlers struct {
+	tracer *mocktracer.MockTracer
+	tags   []map[string]interface{}
+}
+
+func (f *fakeOTHandlers) add(c *client.Client) {
+	c.Handlers.Build.PushFront(func(r *request.Request) {
+		_, ctx := opentracing.StartSpanFromContextWithTracer(r.Context(), f.tracer, r.Operation.Name)
+		r.SetContext(ctx)
+	})
+	c.Handlers.Complete.PushBack(func(r *request.Request) {
+		span := opentracing.SpanFromContext(r.Context()).(*mocktracer.MockSpan)
+		f.tags = append(f.tags, span.Tags())
+		span.Finish()
+	})
+}
+
+// fakeOTClients makes NewDynamoDB add fake otaws handlers to its clients
+// until the test ends.
+func fakeOTClients(t *testing.T) *fakeOTHandlers {
+	ot := &fakeOTHandlers{tracer: mocktracer.New()}
+	add := addOTHandlers
+	addOTHandlers = ot.add
+	t.Cleanup(func() { addOTHandlers = add })
+	return ot
+}
+
+func TestConsumedCapacityTaggedBeforeSpanFinishes(t *testing.T) {
+	servicetest.NewDynamoDB(t)
+	ot := fakeOTClients(t)
+	db := NewDynamoDB()
+	if err := CreateTable(db, "bookings"); err != nil {
+		t.Fatal(err)
+	}
+	ot.tags = nil
+
+	_, err := db.PutItemWithContext(context.Background(), &dynamodb.PutItemInput{
+		TableName: aws.String("bookings"),
+		Item:      map[string]*dynamodb.AttributeValue{"ref": {S: aws.String("abc")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ot.tags) != 1 {
+		t.Fatalf("got %d finished spans, want 1", len(ot.tags))
+	}
+	if got := ot.tags[0]["dynamodb.write_capacity_units"]; got != float64(1) {
+		t.Errorf("span finished with dynamodb.write_capacity_units = %v, want 1", got)
+	}
+}
+
+func TestRetriesTaggedBeforeSpanFinishes(t *testing.T) {
+	fake := servicetest.NewDynamoDB(t)
+	t.Setenv("DYNAMODB_MAX_RETRIES", "2")
+	t.Setenv("DYNAMODB_RETRY_BASE_DELAY", "1ms")
+	ot := fakeOTClients(t)
+	db := NewDynamoDB()
+	if err := CreateTable(db, "bookings"); err != nil {
+		t.Fatal(err)
+	}
+	ot.tags = nil
+
+	fake.Fail("GetItem", http.StatusInternalServerError, servicetest.ErrCodeInternal, 1)
+	_, err := db.GetItemWithContext(context.Background(), &dynamodb.GetItemInput{
+		TableName: aws.String("bookings"),
+		Key:       map[string]*dynamodb.AttributeValue{"ref": {S: aws.String("abc")}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.Calls("GetItem"); got != 2 {
+		t.Fatalf("GetItem was called %d times, want 2", got)
+	}
+	if len(ot.tags) != 1 {
+		t.Fatalf("got %d finished spans, want 1", len(ot.tags))
+	}
+	if got := ot.tags[0]["aws.retries"]; got != 1 {
+		t.Errorf("span finished with aws.retries = %v, want 1", got)
+	}
+}
+
+// TestTablePrefix checks TABLE_PREFIX is applied to the names of the tables
+// created and the items written to them, and that no prefix leaves them
+// unchanged.
+func TestTablePrefix(t *testing.T) {
+	for _, test := range []struct {
+		prefix string
+		want   string
+	}{
+		{"", "trips"},
+		{"workshop42_", "workshop42_trips"},
+	} {
+		fake := servicetest.NewDynamoDB(t)
+		t.Setenv(tablePrefixEnv, test.prefix)
+		table := TableName("trips")
+		if table != test.want {
+			t.Errorf("prefix %q: table name = %q, want %q", test.prefix, table, test.want)
+		}
+
+		db := NewDynamoDB()
+		if err := CreateTable(db, table); err != nil {
+			t.Fatal(err)
+		}
+		if tables := fake.Tables(); len(tables) != 1 || tables[0] != test.want {
+			t.Errorf("prefix %q: created tables %v, want %s", test.prefix, tables, test.want)
+		}
+		_, err := db.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(table),
+			Item:      map[string]*dynamodb.AttributeValue{"ref": {S: aws.String("TR1")}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fake.Item(test.want, "TR1") == nil {
+			t.Errorf("prefix %q: item wasn't written to %s", test.prefix, test.want)
+		}
+	}
+}
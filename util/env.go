@@ -0,0 +1,35 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// IntFromEnv parses the positive integer in the given env var, returning the
+// default if it isn't set.
+func IntFromEnv(env string, defaultValue int) (int, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", env, value)
+	}
+	return n, nil
+}
+
+// boolFromEnv parses the boolean in the given env var, which is false if it
+// isn't set.
+func boolFromEnv(env string) (bool, error) {
+	value := os.Getenv(env)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", env, value)
+	}
+	return b, nil
+}
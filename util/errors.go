@@ -0,0 +1,140 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	log "github.com/sirupsen/logrus"
+)
+
+// throttledRetryAfter is the Retry-After, in seconds, sent when DynamoDB
+// throttles a request.
+const throttledRetryAfter = "1"
+
+// errInvalidMethod is the error for a request whose method the endpoint
+// doesn't handle.
+var errInvalidMethod = errors.New("invalid HTTP method")
+
+// Cancellation reasons of a DynamoDB transaction which mean it was throttled
+// or conflicted with another write.
+var (
+	throttledCancellationReasons = map[string]bool{
+		"ProvisionedThroughputExceeded": true,
+		"ThrottlingError":               true,
+	}
+	conflictCancellationReasons = map[string]bool{
+		"ConditionalCheckFailed": true,
+		"TransactionConflict":    true,
+	}
+)
+
+// StatusFromError returns the HTTP status for an unexpected error from
+// serving a request. DynamoDB throttling, which persists after the SDK's
+// retries, is a 429 so clients back off. A failed condition or a conflicting
+// transaction is a 409, since the request raced another write. Anything else
+// is a 500.
+func StatusFromError(err error) int {
+	switch {
+	case IsThrottle(err):
+		return http.StatusTooManyRequests
+	case IsConflict(err):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// IsThrottle indicates if the error is DynamoDB throttling, including a
+// transaction cancelled because one of its items was throttled.
+func IsThrottle(err error) bool {
+	if request.IsErrorThrottle(err) {
+		return true
+	}
+	for _, reason := range cancellationReasons(err) {
+		if throttledCancellationReasons[reason] {
+			return true
+		}
+	}
+	return false
+}
+
+// IsConflict indicates if the error is a DynamoDB write which failed its
+// condition or conflicted with a concurrent transaction, including a
+// transaction cancelled for either reason. A transaction which was also
+// throttled is a throttle rather than a conflict, since retrying it later may
+// succeed.
+func IsConflict(err error) bool {
+	awsError, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch awsError.Code() {
+	case dynamodb.ErrCodeConditionalCheckFailedException, dynamodb.ErrCodeTransactionConflictException:
+		return true
+	}
+	if IsThrottle(err) {
+		return false
+	}
+	for _, reason := range cancellationReasons(err) {
+		if conflictCancellationReasons[reason] {
+			return true
+		}
+	}
+	return false
+}
+
+// cancellationReasons returns the reason code for each item of a cancelled
+// DynamoDB transaction, e.g. ["None", "ConditionalCheckFailed"], or nil if
+// the error isn't a cancelled transaction. The SDK doesn't expose the
+// reasons, so they're parsed from the message, which lists them in brackets.
+func cancellationReasons(err error) []string {
+	awsError, ok := err.(awserr.Error)
+	if !ok || awsError.Code() != dynamodb.ErrCodeTransactionCanceledException {
+		return nil
+	}
+	message := awsError.Message()
+	start := strings.LastIndex(message, "[")
+	end := strings.LastIndex(message, "]")
+	if start < 0 || end < start {
+		return nil
+	}
+	reasons := strings.Split(message[start+1:end], ",")
+	for i, reason := range reasons {
+		reasons[i] = strings.TrimSpace(reason)
+	}
+	return reasons
+}
+
+// WriteError responds with the status for the error given by StatusFromError.
+// Throttled clients are told when to retry.
+func WriteError(w http.ResponseWriter, err error) {
+	status := StatusFromError(err)
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", throttledRetryAfter)
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// LegacyError responds with the error as plain text, like http.Error, and
+// logs a deprecation warning naming the caller so the remaining plain-text
+// error responses can be found and converted to WriteJSONError. It's a
+// migration aid and will be removed once every handler is converted.
+func LegacyError(w http.ResponseWriter, ctx context.Context, code int, err error) {
+	caller := "unknown"
+	if _, file, line, ok := runtime.Caller(1); ok {
+		// Include the package directory since every service has a main.go.
+		caller = fmt.Sprintf("%s/%s:%d", filepath.Base(filepath.Dir(file)), filepath.Base(file), line)
+	}
+	Logger(ctx).WithFields(log.Fields{
+		"caller": caller,
+		"status": code,
+	}).Warn("Deprecated plain-text error response")
+	http.Error(w, err.Error(), code)
+}
@@ -0,0 +1,102 @@
+package util
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// cancelled returns the error DynamoDB returns for a transaction cancelled
+// for the given reasons.
+func cancelled(reasons string) error {
+	return awserr.New(dynamodb.ErrCodeTransactionCanceledException,
+		"Transaction cancelled, please refer cancellation reasons for specific reasons ["+reasons+"]", nil)
+}
+
+func TestStatusFromError(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		err      error
+		throttle bool
+		conflict bool
+		status   int
+	}{
+		{"throughput exceeded", awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "", nil), true, false, http.StatusTooManyRequests},
+		{"throttling", awserr.New("ThrottlingException", "", nil), true, false, http.StatusTooManyRequests},
+		{"throttled transaction", cancelled("None, ThrottlingError"), true, false, http.StatusTooManyRequests},
+		{"transaction exceeded throughput", cancelled("ProvisionedThroughputExceeded, None"), true, false, http.StatusTooManyRequests},
+		{"throttled and conflicting transaction", cancelled("ConditionalCheckFailed, ThrottlingError"), true, false, http.StatusTooManyRequests},
+		{"condition failed", awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "", nil), false, true, http.StatusConflict},
+		{"transaction conflict", awserr.New(dynamodb.ErrCodeTransactionConflictException, "", nil), false, true, http.StatusConflict},
+		{"transaction condition failed", cancelled("None, ConditionalCheckFailed"), false, true, http.StatusConflict},
+		{"conflicting transaction", cancelled("TransactionConflict, None"), false, true, http.StatusConflict},
+		{"invalid transaction", cancelled("None, ValidationError"), false, false, http.StatusInternalServerError},
+		{"transaction without reasons", awserr.New(dynamodb.ErrCodeTransactionCanceledException, "cancelled", nil), false, false, http.StatusInternalServerError},
+		{"validation", awserr.New("ValidationException", "", nil), false, false, http.StatusInternalServerError},
+		{"other", errors.New("boom"), false, false, http.StatusInternalServerError},
+	} {
+		if got := IsThrottle(test.err); got != test.throttle {
+			t.Errorf("%s: IsThrottle = %v, want %v", test.name, got, test.throttle)
+		}
+		if got := IsConflict(test.err); got != test.conflict {
+			t.Errorf("%s: IsConflict = %v, want %v", test.name, got, test.conflict)
+		}
+		if got := StatusFromError(test.err); got != test.status {
+			t.Errorf("%s: StatusFromError = %d, want %d", test.name, got, test.status)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteError(w, cancelled("None, ThrottlingError"))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != throttledRetryAfter {
+		t.Errorf("throttled: got %d with Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	w = httptest.NewRecorder()
+	WriteError(w, cancelled("ConditionalCheckFailed"))
+	if w.Code != http.StatusConflict || w.Header().Get("Retry-After") != "" {
+		t.Errorf("conflict: got %d with Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestClassifyDynamoDBThrottledTransaction(t *testing.T) {
+	if got := ClassifyDynamoDB(http.StatusBadRequest, cancelled("None, ThrottlingError")); got != Throttled {
+		t.Errorf("throttled transaction classified as %v, want Throttled", got)
+	}
+	if got := ClassifyDynamoDB(http.StatusBadRequest, cancelled("ConditionalCheckFailed")); got != NotRetryable {
+		t.Errorf("conflicting transaction classified as %v, want NotRetryable", got)
+	}
+}
+
+func TestLegacyError(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	log.SetOutput(ioutil.Discard)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/version", nil)
+	versionHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if got := strings.TrimSpace(w.Body.String()); got != errInvalidMethod.Error() {
+		t.Errorf("body = %q, want %q", got, errInvalidMethod)
+	}
+	entry := hook.LastEntry()
+	if entry == nil || entry.Level != log.WarnLevel {
+		t.Fatalf("logged %v, want a deprecation warning", entry)
+	}
+	if caller, _ := entry.Data["caller"].(string); !strings.HasPrefix(caller, "util/version.go:") {
+		t.Errorf("caller = %q, want the handler's location in util/version.go", caller)
+	}
+}
@@ -0,0 +1,90 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidETag is returned when an ETag can't be parsed as a version.
+var ErrInvalidETag = errors.New("invalid ETag")
+
+// xmlETagSuffix distinguishes the ETag of a record's XML representation from
+// its JSON one. See writeWithETag.
+const xmlETagSuffix = "-xml"
+
+// VersionETag returns the strong ETag for the given record version.
+func VersionETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// ParseVersionETag parses an ETag produced by VersionETag, as sent back by
+// clients in an If-Match header. The ETag of the record's XML representation
+// gives the same version.
+func ParseVersionETag(etag string) (int64, error) {
+	etag = strings.TrimSpace(etag)
+	if strings.HasPrefix(etag, "W/") {
+		// Weak ETags can't be used for conditional updates.
+		return 0, ErrInvalidETag
+	}
+	unquoted, err := strconv.Unquote(etag)
+	if err != nil {
+		return 0, ErrInvalidETag
+	}
+	version, err := strconv.ParseInt(strings.TrimSuffix(unquoted, xmlETagSuffix), 10, 64)
+	if err != nil || version < 0 {
+		return 0, ErrInvalidETag
+	}
+	return version, nil
+}
+
+// writeWithETag writes the body along with an ETag. If the response already
+// has an ETag set, such as a record version, it's used for JSON, and suffixed
+// with xmlETagSuffix for XML. Otherwise the ETag is a hash of the content type
+// and body, so it's stable for as long as the body is unchanged. Either way,
+// the JSON and XML representations of a record get different ETags, as strong
+// ETags must, so a cache can't serve one for the other. If the request's
+// If-None-Match header matches the ETag, a 304 Not Modified is written
+// without a body.
+func writeWithETag(w http.ResponseWriter, r *http.Request, body []byte, contentType string) error {
+	etag := w.Header().Get("ETag")
+	switch {
+	case etag == "":
+		hash := sha256.New()
+		hash.Write([]byte(contentType))
+		hash.Write([]byte{0})
+		hash.Write(body)
+		etag = strconv.Quote(hex.EncodeToString(hash.Sum(nil)[:16]))
+	case contentType == xmlContentType:
+		etag = strings.TrimSuffix(etag, `"`) + xmlETagSuffix + `"`
+	}
+	w.Header().Set("ETag", etag)
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	_, err := w.Write(body)
+	return err
+}
+
+// etagMatches indicates if the If-None-Match header value matches the ETag
+// using weak comparison, as specified for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
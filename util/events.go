@@ -0,0 +1,191 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	log "github.com/sirupsen/logrus"
+)
+
+const natsURLEnv = "NATS_URL"
+
+// Event is the envelope events are published in. NATS messages don't have
+// headers, so the headers carrying the trace and request context are sent
+// alongside the payload.
+type Event struct {
+	Headers map[string]string `json:"headers"`
+	Payload json.RawMessage   `json:"payload"`
+}
+
+// SpanContext extracts the context of the span which published the event, so
+// consumers can continue the trace.
+func (e *Event) SpanContext() (opentracing.SpanContext, error) {
+	return opentracing.GlobalTracer().Extract(
+		opentracing.TextMap, opentracing.TextMapCarrier(e.Headers))
+}
+
+// BookingEvent is the payload of the booking services' lifecycle events. It
+// identifies the booking by ref rather than carrying its details, which hold
+// travelers' personal data; consumers which need them read the booking.
+type BookingEvent struct {
+	Ref string `json:"ref"`
+	// Version and Price are the booked booking's, and are unset for a
+	// cancellation.
+	Version int64 `json:"version,omitempty"`
+	Price   Money `json:"price,omitempty"`
+	// Timestamp is when the booking was made or cancelled.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+var (
+	natsMu   sync.Mutex
+	natsConn *nats.Conn
+)
+
+// eventConn returns the connection to the NATS server in NATS_URL, connecting
+// if needed. It returns nil if NATS_URL isn't set.
+func eventConn() (*nats.Conn, error) {
+	url := os.Getenv(natsURLEnv)
+	if url == "" {
+		return nil, nil
+	}
+
+	natsMu.Lock()
+	defer natsMu.Unlock()
+	if natsConn != nil {
+		return natsConn, nil
+	}
+	// Once connected, the client reconnects by itself. If the initial
+	// connection fails, it's retried on the next publish.
+	conn, err := nats.Connect(url, nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	natsConn = conn
+	return natsConn, nil
+}
+
+// PublishEvent publishes the payload as JSON to the NATS subject, wrapped in an
+// Event with the trace context and request context values injected into its
+// headers. Publishing is a no-op if NATS_URL isn't set.
+func PublishEvent(ctx context.Context, subject string, payload interface{}) error {
+	conn, err := eventConn()
+	if err != nil {
+		return err
+	}
+	if conn == nil {
+		return nil
+	}
+
+	span, _ := opentracing.StartSpanFromContext(ctx, "nats.publish")
+	defer span.Finish()
+	ext.SpanKindProducer.Set(span)
+	ext.Component.Set(span, "nats")
+	ext.MessageBusDestination.Set(span, subject)
+
+	err = publishEvent(ctx, span, conn, subject, payload)
+	if err != nil {
+		ext.Error.Set(span, true)
+		LogSpanFields(span, tracelog.Error(err))
+	}
+	return err
+}
+
+// PublishBookingEvent publishes the event to the NATS subject, e.g.
+// "flight.booked". The booking has already been made or cancelled by then, so
+// a failure to publish is logged rather than returned.
+func PublishBookingEvent(ctx context.Context, subject string, event *BookingEvent) {
+	if err := PublishEvent(ctx, subject, event); err != nil {
+		Logger(ctx).WithFields(log.Fields{
+			"error":   err,
+			"subject": subject,
+		}).Warn("Failed to publish booking event")
+	}
+}
+
+func publishEvent(ctx context.Context, span opentracing.Span, conn *nats.Conn, subject string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	event := &Event{Headers: make(map[string]string), Payload: data}
+	if values, ok := ctx.Value(ctxValuesKey).(*ctxValues); ok {
+		header := http.Header{}
+		values.addHeaders(header)
+		for name := range header {
+			event.Headers[name] = header.Get(name)
+		}
+	}
+	err = span.Tracer().Inject(span.Context(), opentracing.TextMap,
+		opentracing.TextMapCarrier(event.Headers))
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return conn.Publish(subject, data)
+}
+
+// SubscribeEvents calls the handler with each event published to the NATS
+// subject. The handler's context carries the publisher's request context
+// values and a span continuing the publisher's trace. Events are handled one
+// at a time. It returns an error if NATS_URL isn't set.
+func SubscribeEvents(subject string, handler func(context.Context, *Event)) (*nats.Subscription, error) {
+	conn, err := eventConn()
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		return nil, fmt.Errorf("%s isn't set", natsURLEnv)
+	}
+	return conn.Subscribe(subject, func(msg *nats.Msg) {
+		var event Event
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			log.WithFields(log.Fields{
+				"error":   err,
+				"subject": msg.Subject,
+			}).Error("Failed to unmarshal event")
+			return
+		}
+		ctx, span := contextWithEvent(msg.Subject, &event)
+		defer span.Finish()
+		handler(ctx, &event)
+	})
+}
+
+// contextWithEvent returns a context populated with the event's propagated
+// context values along with a consumer span. The span follows from the
+// publisher's span rather than being its child since the publisher doesn't
+// wait on it.
+func contextWithEvent(subject string, event *Event) (context.Context, opentracing.Span) {
+	header := http.Header{}
+	for name, value := range event.Headers {
+		header.Set(name, value)
+	}
+	values := &ctxValues{RequestID: nuid.Next()}
+	// Events are only published by our services, so they're trusted.
+	values.fromHeaders(header, true)
+	ctx := context.WithValue(context.Background(), ctxValuesKey, values)
+
+	var opts []opentracing.StartSpanOption
+	if spanContext, err := event.SpanContext(); err == nil {
+		opts = append(opts, opentracing.FollowsFrom(spanContext))
+	}
+	span := opentracing.StartSpan("nats.consume", opts...)
+	ext.SpanKindConsumer.Set(span)
+	ext.Component.Set(span, "nats")
+	ext.MessageBusDestination.Set(span, subject)
+	return opentracing.ContextWithSpan(ctx, span), span
+}
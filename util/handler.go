@@ -0,0 +1,43 @@
+package util
+
+import (
+	"net/http"
+)
+
+// NewHandler wraps a service's handler, usually its mux, in the full
+// middleware stack, so every service orders it the same way. From the
+// outermost in:
+//
+//  1. NewContextHandler, configured by opts: tracing, request context
+//     values, metrics, panic recovery, and the handler timeout. It's
+//     outermost so everything below is traced and logged with the request's
+//     context, and a panic anywhere below is recovered and recorded.
+//  2. The concurrency limit, if MAX_CONCURRENT_REQUESTS is set, so an
+//     overloaded service sheds requests before doing any work for them.
+//  3. Chaos injection, if CHAOS_LATENCY_MS or CHAOS_ERROR_RATE is set, so
+//     injected failures look like the service's own.
+//  4. API key authentication, if API_KEYS is set, so unauthenticated
+//     requests never reach the handler.
+//  5. The JSON Content-Type check, innermost since it's part of validating
+//     the request.
+//
+// Health checks and metrics are exempt from the limit, chaos, and
+// authentication.
+func NewHandler(handler http.Handler, opts ...ContextHandlerOption) (http.Handler, error) {
+	handler = RequireJSON(handler)
+
+	keys, err := APIKeysFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) > 0 {
+		handler = APIKeyMiddleware(handler, keys, DefaultAuthExemptPaths...)
+	}
+	if handler, err = ChaosMiddleware(handler, DefaultAuthExemptPaths...); err != nil {
+		return nil, err
+	}
+	if handler, err = ConcurrencyLimitFromEnv(handler, DefaultAuthExemptPaths...); err != nil {
+		return nil, err
+	}
+	return NewContextHandler(handler, opts...), nil
+}
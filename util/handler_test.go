@@ -0,0 +1,94 @@
+package util
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// TestNewHandlerRecoversWithContext checks a panic is recovered by the
+// outermost layer and still logged with the context the inner layers added,
+// such as the authenticated principal.
+func TestNewHandlerRecoversWithContext(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	log.SetOutput(ioutil.Discard)
+	t.Setenv(apiKeysEnv, "ops:secret")
+	const requestID = "handlertest00000000001"
+	handler, err := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("booking exploded")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/trips/booking", strings.NewReader("{}"))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(apiKeyHeader, "secret")
+	r.Header.Set(requestIDHeader, requestID)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	var entry *log.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Message == "Recovered from panic" {
+			entry = e
+		}
+	}
+	if entry == nil {
+		t.Fatal("the panic wasn't logged")
+	}
+	if entry.Data["request_id"] != requestID || entry.Data["principal"] != "ops" {
+		t.Errorf("panic logged with request_id %v and principal %v, want %s and ops", entry.Data["request_id"], entry.Data["principal"], requestID)
+	}
+}
+
+// TestNewHandlerAuthenticatesFirst checks requests are authenticated before
+// they're validated or handled, and health checks are exempt.
+func TestNewHandlerAuthenticatesFirst(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	t.Setenv(apiKeysEnv, "ops:secret")
+	var handled int
+	handler, err := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled++
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		method, target, contentType, key string
+		want                             int
+		handled                          bool
+	}{
+		{"POST", "/trips/booking", "text/plain", "", http.StatusUnauthorized, false},
+		{"POST", "/trips/booking", "text/plain", "secret", http.StatusUnsupportedMediaType, false},
+		{"POST", "/trips/booking", "application/json", "secret", http.StatusOK, true},
+		{"GET", "/healthz", "", "", http.StatusOK, true},
+	} {
+		before := handled
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader("{}"))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		if test.key != "" {
+			r.Header.Set(apiKeyHeader, test.key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s %s (%s, key %q): status = %d, want %d", test.method, test.target, test.contentType, test.key, w.Code, test.want)
+		}
+		if got := handled > before; got != test.handled {
+			t.Errorf("%s %s (%s, key %q): handled = %v, want %v", test.method, test.target, test.contentType, test.key, got, test.handled)
+		}
+	}
+}
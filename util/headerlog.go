@@ -0,0 +1,52 @@
+package util
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	log "github.com/sirupsen/logrus"
+)
+
+// contextHeaders are the headers which propagate the request's context to
+// the services it calls.
+var contextHeaders = []string{
+	requestIDHeader,
+	deadlineHeader,
+	languageHeader,
+	currencyHeader,
+	forceTraceHeader,
+	debugHeader,
+	tenantHeader,
+	originHeader,
+	retryBudgetHeader,
+}
+
+// logContextHeaders logs a "context_headers" event to the client span of an
+// outbound request, listing which context headers were attached to it and
+// which weren't, so a header lost in propagation can be traced to the hop
+// which dropped it. It's noisy, so it's only logged for requests marked for
+// debugging with X-Debug: 1, or at the debug log level. It's a
+// nethttp.ClientSpanObserver, so it's called once the client span starts.
+func logContextHeaders(span opentracing.Span, r *http.Request) {
+	values, _ := r.Context().Value(ctxValuesKey).(*ctxValues)
+	if (values == nil || !values.Debug) && !log.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+
+	var attached, missing []string
+	for _, header := range contextHeaders {
+		if r.Header.Get(header) != "" {
+			attached = append(attached, header)
+		} else {
+			missing = append(missing, header)
+		}
+	}
+	LogSpanFields(span,
+		tracelog.String("event", "context_headers"),
+		tracelog.String("host", r.URL.Host),
+		tracelog.String("attached", strings.Join(attached, ",")),
+		tracelog.String("missing", strings.Join(missing, ",")),
+	)
+}
@@ -0,0 +1,84 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	log "github.com/sirupsen/logrus"
+)
+
+// TestLogContextHeaders calls a downstream with the instrumented client and
+// checks the context headers attached to the request are logged on its
+// client span, not the caller's, and only when the request is debugged.
+func TestLogContextHeaders(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	level := log.GetLevel()
+	log.SetLevel(log.InfoLevel)
+	t.Cleanup(func() {
+		opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+		log.SetLevel(level)
+	})
+
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer downstream.Close()
+	client, err := NewInstrumentedHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, debug := range []bool{true, false} {
+		tracer.Reset()
+		caller := tracer.StartSpan("caller")
+		ctx := opentracing.ContextWithSpan(context.Background(), caller)
+		ctx = context.WithValue(ctx, ctxValuesKey, &ctxValues{RequestID: "abc123", Debug: debug})
+		req, err := http.NewRequest("GET", downstream.URL+"/downstream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		caller.Finish()
+
+		var events []map[string]string
+		for _, span := range tracer.FinishedSpans() {
+			for _, record := range span.Logs() {
+				fields := map[string]string{}
+				for _, field := range record.Fields {
+					fields[field.Key] = field.ValueString
+				}
+				if fields["event"] != "context_headers" {
+					continue
+				}
+				if span.OperationName != "HTTP GET" {
+					t.Errorf("debug %v: context headers logged on span %q, want the client span", debug, span.OperationName)
+				}
+				events = append(events, fields)
+			}
+		}
+		if !debug {
+			if len(events) != 0 {
+				t.Errorf("context headers logged without debugging: %v", events)
+			}
+			continue
+		}
+		if len(events) != 1 {
+			t.Fatalf("got %d context_headers events, want 1", len(events))
+		}
+		attached := strings.Split(events[0]["attached"], ",")
+		if len(attached) == 0 || attached[0] != requestIDHeader {
+			t.Errorf("attached = %q, want %s first", events[0]["attached"], requestIDHeader)
+		}
+		if !strings.Contains(events[0]["missing"], languageHeader) {
+			t.Errorf("missing = %q, want it to include %s", events[0]["missing"], languageHeader)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package util
+
+import (
+	"net/http"
+)
+
+// RegisterHealthEndpoint registers /healthz on the mux, which reports the
+// service is up. It doesn't check dependencies, so a dependency outage doesn't
+// get the service restarted.
+func RegisterHealthEndpoint(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			LegacyError(w, r.Context(), http.StatusBadRequest, errInvalidMethod)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"ok"}`))
+	})
+}
@@ -1,35 +1,193 @@
 package util
 
 import (
+	"encoding/json"
+	"fmt"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/opentracing-contrib/go-stdlib/nethttp"
 	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	log "github.com/sirupsen/logrus"
 )
 
+// DefaultSkipPaths are the path prefixes NewContextHandler passes straight
+// through by default, since they're hit frequently by probes and scrapers.
+var DefaultSkipPaths = []string{"/healthz", "/readyz", "/metrics"}
+
+// ContextHandlerOption configures NewContextHandler.
+type ContextHandlerOption func(*contextMiddleware)
+
+// WithSkipPaths replaces the path prefixes which skip the middleware
+// entirely, with no span or context values, which are DefaultSkipPaths by
+// default.
+func WithSkipPaths(prefixes ...string) ContextHandlerOption {
+	return func(c *contextMiddleware) {
+		c.skipPaths = prefixes
+	}
+}
+
+// WithMetricsPaths sets the paths which are reported as the path label of
+// request metrics. Any other path is reported as "other", so requests for
+// arbitrary paths can't explode the metrics' cardinality. Services should pass
+// the routes they register.
+func WithMetricsPaths(paths ...string) ContextHandlerOption {
+	return func(c *contextMiddleware) {
+		c.metricsPaths = make(map[string]bool, len(paths))
+		for _, path := range paths {
+			c.metricsPaths[path] = true
+		}
+	}
+}
+
+// WithOperationNameFunc sets the func which names the span of each request.
+// By default, spans are named by the request's method and path, so services
+// with variable paths should normalize them, e.g. by route.
+func WithOperationNameFunc(fn func(*http.Request) string) ContextHandlerOption {
+	return func(c *contextMiddleware) {
+		c.operationName = fn
+	}
+}
+
+// defaultOperationName names a request's span by its method and path.
+func defaultOperationName(r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+// otherMetricsLabel is the path label of requests for unknown paths, and the
+// method label of requests with nonstandard methods.
+const otherMetricsLabel = "other"
+
+// metricsMethods are the methods which are reported as the method label of
+// request metrics. Since clients can send any method, others are reported as
+// "other".
+var metricsMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// metricsMethod returns the method label to use for a request with the given
+// method.
+func metricsMethod(method string) string {
+	if metricsMethods[method] {
+		return method
+	}
+	return otherMetricsLabel
+}
+
 type contextMiddleware struct {
-	handler http.Handler
+	handler       http.Handler
+	next          http.Handler
+	skipPaths     []string
+	metricsPaths  map[string]bool
+	operationName func(*http.Request) string
 }
 
-// NewContextHandler returns an http.Handler which implements tracing and
-// context middleware.
-func NewContextHandler(handler http.Handler) http.Handler {
+// metricsPath returns the path label to use for a request for the given path.
+func (c *contextMiddleware) metricsPath(path string) string {
+	if c.metricsPaths[path] {
+		return path
+	}
+	return otherMetricsLabel
+}
+
+// NewContextHandler returns an http.Handler which implements tracing,
+// context, and response compression middleware. Requests slower than
+// SLOW_REQUEST_MS are logged at warn, requests still being handled after
+// HANDLER_TIMEOUT get a 503, and panics are recovered and recorded on the
+// request's span.
+func NewContextHandler(handler http.Handler, opts ...ContextHandlerOption) http.Handler {
+	c := &contextMiddleware{
+		next:          handler,
+		skipPaths:     DefaultSkipPaths,
+		operationName: defaultOperationName,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	handler = bodyLogMiddleware(handler, redactFieldsFromEnv())
+	handler = CompressMiddleware(handler)
+	handler = forceTraceMiddleware(handler)
+	handler = slowRequestMiddleware(handler, slowRequestThresholdFromEnv())
+	handler = recoverMiddleware(handler)
+	handler = handlerTimeoutMiddleware(handler, handlerTimeoutFromEnv())
+
 	// Add tracing middleware.
-	handler = nethttp.Middleware(
+	c.handler = nethttp.Middleware(
 		opentracing.GlobalTracer(),
 		handler,
-		nethttp.OperationNameFunc(func(r *http.Request) string {
-			return r.Method + " " + r.URL.Path
-		}),
+		nethttp.OperationNameFunc(c.operationName),
 	)
-	return &contextMiddleware{handler}
+	return c
 }
 
 func (c *contextMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, prefix := range c.skipPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			c.next.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	checkTracePropagation(r)
+
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	defer func() {
+		observeHTTPRequest(metricsMethod(r.Method), c.metricsPath(r.URL.Path), sw.status, start)
+	}()
+
 	// Inject context with request data.
-	ctx := contextWithRequest(r)
+	ctx, cancel := contextWithRequest(r)
+	defer cancel()
 	r = r.WithContext(ctx)
-	c.handler.ServeHTTP(w, r)
+	c.handler.ServeHTTP(sw, r)
+}
+
+// statusWriter records the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+// forceTraceMiddleware returns an http.Handler which forces the request's span
+// to be sampled if a trusted caller sent X-Force-Trace: 1, or any caller sent
+// an x_force_trace=1 cookie. It must run inside the tracing middleware so the
+// span exists.
+func forceTraceMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if values, ok := ctx.Value(ctxValuesKey).(*ctxValues); ok && values.ForceTrace {
+			if span := opentracing.SpanFromContext(ctx); span != nil {
+				ext.SamplingPriority.Set(span, 1)
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
 }
 
 type instrumentedRoundTripper struct {
@@ -37,19 +195,140 @@ type instrumentedRoundTripper struct {
 }
 
 func (i *instrumentedRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	// A RoundTripper mustn't modify the caller's request, which may be sent
+	// again, e.g. when it's retried.
+	r = CloneRequest(r)
 	addContextHeaders(r)
+	addRetryBudgetHeader(r)
+	addAPIKeyHeader(r)
+	if !TracingEnabled() {
+		return i.tr.RoundTrip(r)
+	}
 	r, tracer := nethttp.TraceRequest(
 		opentracing.GlobalTracer(),
 		r,
 		nethttp.OperationName(r.Method+" "+r.URL.Path),
+		nethttp.ClientSpanObserver(logContextHeaders),
 	)
 	defer tracer.Finish()
 	return i.tr.RoundTrip(r)
 }
 
+// CloneRequest returns a copy of the request with its own headers, which can
+// be modified without affecting the original, like http.Request.Clone, which
+// needs Go 1.13. The copy shares the original's body.
+func CloneRequest(r *http.Request) *http.Request {
+	clone := r.WithContext(r.Context())
+	clone.Header = make(http.Header, len(r.Header))
+	for name, values := range r.Header {
+		clone.Header[name] = append([]string(nil), values...)
+	}
+	return clone
+}
+
 // NewInstrumentedHTTPClient returns an http.Client that is instrumented for
-// tracing and will propagate context values as request headers.
-func NewInstrumentedHTTPClient() *http.Client {
+// tracing and will propagate context values as request headers. If
+// DOWNSTREAM_CA_BUNDLE or a client certificate is configured, it's used for
+// TLS.
+func NewInstrumentedHTTPClient() (*http.Client, error) {
 	transport := &nethttp.Transport{}
-	return &http.Client{Transport: &instrumentedRoundTripper{transport}}
+	config, err := downstreamTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		transport.RoundTripper = newTransport(config)
+	}
+	return &http.Client{Transport: &instrumentedRoundTripper{transport}}, nil
+}
+
+// RequireJSON returns an http.Handler which rejects POST, PUT, and PATCH
+// requests whose Content-Type isn't application/json with a 415.
+func RequireJSON(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST", "PUT", "PATCH":
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				log.WithContext(r.Context()).WithFields(log.Fields{
+					"content_type": r.Header.Get("Content-Type"),
+				}).Warn("Unsupported content type")
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// BoolQuery parses the named boolean query parameter, returning false if it
+// isn't set.
+func BoolQuery(r *http.Request, name string) (bool, error) {
+	return BoolQueryDefault(r, name, false)
+}
+
+// BoolQueryDefault parses the named boolean query parameter, returning the
+// default if it isn't set.
+func BoolQueryDefault(r *http.Request, name string, defaultValue bool) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return b, nil
+}
+
+// IntQueryDefault parses the named positive integer query parameter,
+// returning the default if it isn't set.
+func IntQueryDefault(r *http.Request, name string, defaultValue int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+// TimeQuery parses the named time query parameter, which is either an RFC 3339
+// time or a date, e.g. "2019-06-01", which is midnight UTC. It returns the
+// zero time if it isn't set.
+func TimeQuery(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return t, nil
+}
+
+// ErrorResponse is the body of a JSON error response.
+type ErrorResponse struct {
+	Error   string      `json:"error"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// WriteJSONError writes an error response with a JSON body, for errors which
+// carry details a plain text body can't.
+func WriteJSONError(w http.ResponseWriter, status int, message string, details interface{}) {
+	body, err := json.Marshal(&ErrorResponse{Error: message, Details: details})
+	if err != nil {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
 }
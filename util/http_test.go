@@ -0,0 +1,213 @@
+package util
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestRequireJSON(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	handler := RequireJSON(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, test := range []struct {
+		method      string
+		contentType string
+		want        int
+	}{
+		{"POST", "application/json", http.StatusOK},
+		{"POST", "application/json; charset=utf-8", http.StatusOK},
+		{"PUT", "Application/JSON", http.StatusOK},
+		{"POST", "", http.StatusUnsupportedMediaType},
+		{"POST", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"PATCH", "text/plain", http.StatusUnsupportedMediaType},
+		{"PUT", "application/json-patch+json", http.StatusUnsupportedMediaType},
+		// Requests without a body aren't checked.
+		{"GET", "", http.StatusOK},
+		{"DELETE", "text/plain", http.StatusOK},
+	} {
+		r := httptest.NewRequest(test.method, "/trips/booking", strings.NewReader("{}"))
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s with Content-Type %q: status = %d, want %d", test.method, test.contentType, w.Code, test.want)
+		}
+	}
+}
+
+// TestContextHandlerSkipPaths checks requests for skipped paths reach the
+// handler with no span or context values, while other requests get both.
+func TestContextHandlerSkipPaths(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	for _, test := range []struct {
+		name    string
+		opts    []ContextHandlerOption
+		path    string
+		skipped bool
+	}{
+		{"health check", nil, "/healthz", true},
+		{"deep health check", nil, "/healthz/deep", true},
+		{"readiness check", nil, "/readyz", true},
+		{"metrics", nil, "/metrics", true},
+		{"booking", nil, "/trips/booking", false},
+		{"configured", []ContextHandlerOption{WithSkipPaths("/status")}, "/status", true},
+		{"configured replaces defaults", []ContextHandlerOption{WithSkipPaths("/status")}, "/healthz", false},
+	} {
+		tracer.Reset()
+		var span opentracing.Span
+		var values interface{}
+		handler := NewContextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			span = opentracing.SpanFromContext(r.Context())
+			values = r.Context().Value(ctxValuesKey)
+		}), test.opts...)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+
+		wantSpans := 1
+		if test.skipped {
+			wantSpans = 0
+		}
+		if got := len(tracer.FinishedSpans()); got != wantSpans {
+			t.Errorf("%s: got %d spans, want %d", test.name, got, wantSpans)
+		}
+		if skipped := span == nil && values == nil; skipped != test.skipped {
+			t.Errorf("%s: handler got span %v and context values %v, want skipped = %v", test.name, span, values, test.skipped)
+		}
+	}
+}
+
+// TestForceTraceCookie checks an x_force_trace=1 cookie alone forces the span
+// of a request from an untrusted caller, such as a browser, to be sampled.
+// The request continues an unsampled trace, and mocktracer records the
+// sampling priority as whether the span is sampled.
+func TestForceTraceCookie(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	handler := NewContextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, test := range []struct {
+		name    string
+		cookie  string
+		sampled bool
+	}{
+		{"cookie", "1", true},
+		{"invalid cookie", "yes", false},
+		{"no cookie", "", false},
+	} {
+		tracer.Reset()
+		r := httptest.NewRequest("GET", "/trips/booking", nil)
+		r.Header.Set("mockpfx-ids-traceid", "1")
+		r.Header.Set("mockpfx-ids-spanid", "1")
+		r.Header.Set("mockpfx-ids-sampled", "false")
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: forceTraceCookie, Value: test.cookie})
+		}
+		if trustedCaller(r) {
+			t.Fatalf("caller %s is trusted", r.RemoteAddr)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		spans := tracer.FinishedSpans()
+		if len(spans) != 1 {
+			t.Fatalf("%s: got %d spans, want 1", test.name, len(spans))
+		}
+		if sampled := spans[0].SpanContext.Sampled; sampled != test.sampled {
+			t.Errorf("%s: span sampled = %v, want %v", test.name, sampled, test.sampled)
+		}
+	}
+}
+
+// TestRequestMetricsLabels checks requests for unknown paths, or with
+// nonstandard methods, are bucketed into "other" so they can't explode the
+// cardinality of the request metrics.
+func TestRequestMetricsLabels(t *testing.T) {
+	handler := NewContextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}), WithMetricsPaths("/trips/booking"))
+	for _, r := range []struct{ method, path string }{
+		{"GET", "/trips/booking"},
+		{"GET", "/trips/booking/TR12345"},
+		{"BREW", "/trips/booking"},
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(r.method, r.path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := w.Body.String()
+	for _, series := range []string{
+		`http_request_duration_seconds_count{code="418",method="GET",path="/trips/booking"} 1`,
+		`http_request_duration_seconds_count{code="418",method="GET",path="other"} 1`,
+		`http_request_duration_seconds_count{code="418",method="other",path="/trips/booking"} 1`,
+	} {
+		if !strings.Contains(metrics, series) {
+			t.Errorf("metrics don't include %s", series)
+		}
+	}
+	for _, label := range []string{"TR12345", "BREW"} {
+		if strings.Contains(metrics, label) {
+			t.Errorf("metrics include the label %s", label)
+		}
+	}
+}
+
+func TestWithOperationNameFunc(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	route := func(r *http.Request) string {
+		if strings.HasPrefix(r.URL.Path, "/trips/") {
+			return r.Method + " /trips/{ref}"
+		}
+		return defaultOperationName(r)
+	}
+	for _, test := range []struct {
+		name string
+		opts []ContextHandlerOption
+		path string
+		want string
+	}{
+		{"default", nil, "/trips/TR12345", "GET /trips/TR12345"},
+		{"custom", []ContextHandlerOption{WithOperationNameFunc(route)}, "/trips/TR12345", "GET /trips/{ref}"},
+		{"custom fallback", []ContextHandlerOption{WithOperationNameFunc(route)}, "/version", "GET /version"},
+	} {
+		tracer.Reset()
+		handler := NewContextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), test.opts...)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+		spans := tracer.FinishedSpans()
+		if len(spans) != 1 || spans[0].OperationName != test.want {
+			t.Errorf("%s: spans %v, want one named %q", test.name, spans, test.want)
+		}
+	}
+}
+
+// TestCloneRequest checks headers set on a cloned request, or appended to
+// one of its header's values, aren't added to the original.
+func TestCloneRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/trips/booking?ref=abc", nil)
+	r.Header.Set("Accept", "application/json")
+	clone := CloneRequest(r)
+	clone.Header.Set(requestIDHeader, "id")
+	clone.Header["Accept"] = append(clone.Header["Accept"][:1], "application/xml")
+
+	if clone.URL.String() != r.URL.String() || clone.Context() != r.Context() {
+		t.Errorf("clone is for %s with context %v, want %s with %v", clone.URL, clone.Context(), r.URL, r.Context())
+	}
+	if len(r.Header) != 1 || len(r.Header["Accept"]) != 1 {
+		t.Errorf("original headers = %v, want only Accept: application/json", r.Header)
+	}
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxConcurrentRequestsEnv = "MAX_CONCURRENT_REQUESTS"
+	concurrencyWaitEnv       = "CONCURRENCY_LIMIT_WAIT"
+
+	defaultConcurrencyWait = 100 * time.Millisecond
+
+	// overloadedRetryAfter is the Retry-After, in seconds, sent with 503s
+	// from the concurrency limit.
+	overloadedRetryAfter = "1"
+)
+
+// ConcurrencyLimitFromEnv limits handler to MAX_CONCURRENT_REQUESTS in-flight
+// requests, waiting up to CONCURRENCY_LIMIT_WAIT (default 100ms) for a slot,
+// as described by ConcurrencyLimitMiddleware. If MAX_CONCURRENT_REQUESTS isn't
+// set, the handler is returned unchanged.
+func ConcurrencyLimitFromEnv(handler http.Handler, exempt ...string) (http.Handler, error) {
+	max, err := IntFromEnv(maxConcurrentRequestsEnv, 0)
+	if err != nil {
+		return nil, err
+	}
+	if max == 0 {
+		return handler, nil
+	}
+	wait, err := DurationFromEnv(concurrencyWaitEnv, defaultConcurrencyWait)
+	if err != nil {
+		return nil, err
+	}
+	return ConcurrencyLimitMiddleware(handler, max, wait, exempt...), nil
+}
+
+// ConcurrencyLimitMiddleware returns an http.Handler which serves at most max
+// requests at once. A request which arrives when the limit is reached waits up
+// to wait for a slot, and otherwise gets a 503 with a Retry-After. Requests to
+// the exempt paths, such as health checks, aren't limited.
+func ConcurrencyLimitMiddleware(handler http.Handler, max int, wait time.Duration, exempt ...string) http.Handler {
+	exemptPaths := make(map[string]bool, len(exempt))
+	for _, path := range exempt {
+		exemptPaths[path] = true
+	}
+	slots := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exemptPaths[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		select {
+		case slots <- struct{}{}:
+		default:
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				// The caller gave up, so there's no one to respond to.
+				return
+			case <-timer.C:
+				if span := opentracing.SpanFromContext(ctx); span != nil {
+					span.SetTag("overloaded", true)
+				}
+				log.WithContext(ctx).WithFields(log.Fields{
+					"max_concurrent_requests": max,
+				}).Warn("Too many concurrent requests")
+				w.Header().Set("Retry-After", overloadedRetryAfter)
+				http.Error(w, "Too many concurrent requests", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		defer func() { <-slots }()
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TestConcurrencyLimitMiddleware drives the requests in flight past the
+// limit, and checks the extra requests wait briefly for a slot and are then
+// shed, unless they're exempt or their caller gives up.
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	const max = 2
+	started, release := make(chan struct{}), make(chan struct{})
+	var served int32
+	handler := ConcurrencyLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+	}), max, 50*time.Millisecond, "/healthz")
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	done := make(chan struct{})
+	for i := 0; i < max; i++ {
+		go func() {
+			serve(httptest.NewRequest("GET", "/slow", nil))
+			done <- struct{}{}
+		}()
+		<-started
+	}
+
+	start := time.Now()
+	w := serve(httptest.NewRequest("GET", "/fast", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != overloadedRetryAfter {
+		t.Errorf("over the limit: status = %d, Retry-After = %q, want %d, %s", w.Code, w.Header().Get("Retry-After"), http.StatusServiceUnavailable, overloadedRetryAfter)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("over the limit: shed after %v, want a wait of 50ms first", elapsed)
+	}
+	if w := serve(httptest.NewRequest("GET", "/healthz", nil)); w.Code != http.StatusOK {
+		t.Errorf("exempt path: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	before := atomic.LoadInt32(&served)
+	serve(httptest.NewRequest("GET", "/fast", nil).WithContext(ctx))
+	if atomic.LoadInt32(&served) != before {
+		t.Error("cancelled request was served while waiting for a slot")
+	}
+
+	// A slot freed while a request waits lets it through.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release <- struct{}{}
+	}()
+	if w := serve(httptest.NewRequest("GET", "/fast", nil)); w.Code != http.StatusOK {
+		t.Errorf("slot freed while waiting: status = %d, want %d", w.Code, http.StatusOK)
+	}
+	close(release)
+	for i := 0; i < max; i++ {
+		<-done
+	}
+}
@@ -2,9 +2,12 @@ package util
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"os"
 	"reflect"
+	"strconv"
+	"time"
 
 	"github.com/nats-io/nuid"
 	"github.com/opentracing/opentracing-go"
@@ -13,10 +16,42 @@ import (
 
 type ctxKey int
 
-const ctxValuesKey ctxKey = iota
+const (
+	ctxValuesKey ctxKey = iota
+	// mirrorToSpanKey marks contexts whose warnings and errors are also
+	// logged on their span. See LoggerWithSpan.
+	mirrorToSpanKey
+	// retryBudgetKey holds the request's remaining retry budget. See
+	// SpendRetry.
+	retryBudgetKey
+)
+
+const (
+	requestIDHeader  = "X-Ctx-RequestID"
+	deadlineHeader   = "X-Ctx-Deadline"
+	languageHeader   = "Accept-Language"
+	currencyHeader   = "X-Currency"
+	forceTraceHeader = "X-Force-Trace"
+	originHeader     = "X-Ctx-Origin-Service"
+	debugHeader      = "X-Debug"
+	tenantHeader     = "X-Tenant-ID"
+
+	// forceTraceCookie forces tracing like X-Force-Trace, for browsers
+	// which can't set headers on navigation requests. Browsers are never
+	// trusted callers, so it's honored from anyone.
+	forceTraceCookie = "x_force_trace"
+)
+
+const logLevelEnv = "LOG_LEVEL"
 
 const (
-	requestIDHeader = "X-Ctx-RequestID"
+	// DefaultLanguage is the language used when the client doesn't send an
+	// Accept-Language header.
+	DefaultLanguage = "en-US"
+
+	// DefaultCurrency is the currency used when the client doesn't send an
+	// X-Currency header.
+	DefaultCurrency = "USD"
 )
 
 type ctxValues struct {
@@ -26,38 +61,219 @@ type ctxValues struct {
 	Method    string
 	IP        string
 	Ref       string
+	Language  string
+	Currency  string
+	Principal string
+	// ForceTrace requests that the trace be sampled regardless of the
+	// sampler's decision.
+	ForceTrace bool
+	// OriginService is the service which made the request, if it was
+	// another of our services.
+	OriginService string
+	// Debug marks the request for debugging. It forces tracing and enables
+	// debug logs for the request, regardless of the log level.
+	Debug bool
+	// TenantID is the tenant the request is made on behalf of, if any.
+	TenantID string
 }
 
-func (c *ctxValues) addHeaders(r *http.Request) {
+// localService is the name of this service, set by Init. It's sent to other
+// services as the origin of our requests.
+var localService string
+
+// debugLogger is the logger used for requests marked for debugging when the
+// log level would drop debug logs. It shares the standard logger's output,
+// formatter, and hooks. It's set by Init.
+var debugLogger *log.Logger
+
+func (c *ctxValues) addHeaders(h http.Header) {
 	// Propagate request id.
 	if c.RequestID != "" {
-		r.Header.Add(requestIDHeader, c.RequestID)
+		h.Set(requestIDHeader, c.RequestID)
+	}
+	// Propagate locale preferences.
+	if c.Language != "" {
+		h.Set(languageHeader, c.Language)
+	}
+	if c.Currency != "" {
+		h.Set(currencyHeader, c.Currency)
+	}
+	// Propagate forced tracing so downstream spans are kept too.
+	if c.ForceTrace {
+		h.Set(forceTraceHeader, "1")
+	}
+	if c.Debug {
+		h.Set(debugHeader, "1")
+	}
+	if c.TenantID != "" {
+		h.Set(tenantHeader, c.TenantID)
+	}
+	// Identify ourselves so the call chain can be stitched together from
+	// logs alone.
+	if localService != "" {
+		h.Set(originHeader, localService)
 	}
 }
 
-func (c *ctxValues) fromRequest(r *http.Request) {
-	id := r.Header.Get(requestIDHeader)
-	if id != "" {
+// fromHeaders sets the values propagated in the headers. Requests for
+// debugging or forced tracing are only honored if trusted is set, i.e. they
+// came from one of our services.
+func (c *ctxValues) fromHeaders(h http.Header, trusted bool) {
+	id := h.Get(requestIDHeader)
+	if validRequestID(id) {
 		c.RequestID = id
+	} else if id != "" {
+		// Don't log the ID itself since it's untrusted.
+		log.WithFields(log.Fields{
+			"length": len(id),
+		}).Warn("Ignoring invalid propagated request ID")
+	}
+	c.Language = h.Get(languageHeader)
+	c.Currency = h.Get(currencyHeader)
+	if trusted {
+		c.Debug = h.Get(debugHeader) == "1"
+		c.ForceTrace = c.Debug || h.Get(forceTraceHeader) == "1"
+	}
+	if origin := h.Get(originHeader); validServiceName(origin) {
+		c.OriginService = origin
+	}
+	if tenant := h.Get(tenantHeader); validTenantID(tenant) {
+		c.TenantID = tenant
+	} else if tenant != "" {
+		log.WithFields(log.Fields{
+			"length": len(tenant),
+		}).Warn("Ignoring invalid tenant ID")
+	}
+}
+
+// forceTraceCookieSet indicates if the request has an x_force_trace cookie of
+// "1". Any other value is ignored with a warning, without logging the
+// untrusted value itself.
+func forceTraceCookieSet(r *http.Request) bool {
+	cookie, err := r.Cookie(forceTraceCookie)
+	if err != nil {
+		return false
+	}
+	if cookie.Value != "1" {
+		log.WithFields(log.Fields{
+			"length": len(cookie.Value),
+		}).Warn("Ignoring invalid force trace cookie")
+		return false
+	}
+	return true
+}
+
+// requestIDLength is the length of a nuid, which request IDs are.
+const requestIDLength = 22
+
+// validRequestID indicates if the propagated request ID looks like one we
+// generated, so a client can't inject arbitrary text into our logs.
+func validRequestID(id string) bool {
+	if len(id) != requestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// maxServiceNameLength bounds the propagated origin service name.
+const maxServiceNameLength = 64
+
+// validServiceName indicates if the propagated origin service looks like one
+// of our service names, so a client can't inject arbitrary text into our logs.
+func validServiceName(name string) bool {
+	if name == "" || len(name) > maxServiceNameLength {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Locale is the client's language and currency preference.
+type Locale struct {
+	Language string
+	Currency string
+}
+
+// LocaleFromContext returns the locale preferences sent by the client,
+// falling back to DefaultLanguage and DefaultCurrency when they weren't
+// provided.
+func LocaleFromContext(ctx context.Context) Locale {
+	locale := Locale{Language: DefaultLanguage, Currency: DefaultCurrency}
+	values, ok := ctx.Value(ctxValuesKey).(*ctxValues)
+	if !ok {
+		return locale
+	}
+	if values.Language != "" {
+		locale.Language = values.Language
 	}
+	if values.Currency != "" {
+		locale.Currency = values.Currency
+	}
+	return locale
 }
 
 // Init initializes logging and tracing for the given service. Call this before
-// using logging or tracing. The notrace flag will disable tracing.
+// using logging or tracing. The log level is read from LOG_LEVEL, defaulting to
+// info. The notrace flag will disable tracing. If the tracer can't be
+// initialized, a warning is logged and tracing is disabled.
 func Init(serviceName string, notrace bool) error {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetOutput(os.Stdout)
-	log.SetLevel(log.InfoLevel)
+	level := log.InfoLevel
+	if value := os.Getenv(logLevelEnv); value != "" {
+		var err error
+		if level, err = log.ParseLevel(value); err != nil {
+			return fmt.Errorf("invalid %s %q", logLevelEnv, value)
+		}
+	}
+	log.SetLevel(level)
+	if level < log.DebugLevel {
+		debugLogger = &log.Logger{
+			Out:       os.Stdout,
+			Formatter: &log.JSONFormatter{},
+			Hooks:     log.StandardLogger().Hooks,
+			Level:     log.DebugLevel,
+			ExitFunc:  os.Exit,
+		}
+	}
 	hook, err := newContextHook(serviceName)
 	if err != nil {
 		return err
 	}
 	log.AddHook(hook)
+	log.AddHook(spanHook{})
+	localService = serviceName
+	if retryBudget, err = IntFromEnv(retryBudgetEnv, defaultRetryBudget); err != nil {
+		return err
+	}
 
+	tracingConfig = TracingConfig{Service: serviceName}
 	if !notrace {
-		tracer := initTracer(serviceName, log.StandardLogger())
+		tracer, config, err := tracerFactory(serviceName, log.StandardLogger())
+		if err != nil {
+			// Run without tracing rather than with a broken tracer.
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Failed to initialize tracer, falling back to noop tracer")
+			tracer = opentracing.NoopTracer{}
+			tracingConfig.Error = err.Error()
+		} else {
+			tracingConfig = config
+		}
 		opentracing.InitGlobalTracer(tracer)
 	}
+	beginStartup()
 	return nil
 }
 
@@ -84,6 +300,7 @@ func (c *ctxHook) Levels() []log.Level {
 		log.ErrorLevel,
 		log.WarnLevel,
 		log.InfoLevel,
+		log.DebugLevel,
 		log.TraceLevel,
 	}
 }
@@ -113,6 +330,44 @@ func (c *ctxHook) Fire(e *log.Entry) error {
 	return nil
 }
 
+// Logger returns a log entry bound to the given context. The request ID, ref,
+// origin service, authenticated principal, and tenant, when present, are also
+// attached as top-level fields for quick filtering.
+//
+// If the request was marked for debugging with X-Debug: 1 by a trusted caller
+// (see TRUSTED_NETWORKS), the entry logs at debug level even if the service's
+// level is higher. The override is carried by the request's context values,
+// so it applies only to that request, and to the downstream requests and
+// events it propagates to, and ends with it; there's no global state to
+// reset.
+func Logger(ctx context.Context) *log.Entry {
+	entry := log.WithContext(ctx)
+	values, ok := ctx.Value(ctxValuesKey).(*ctxValues)
+	if !ok {
+		return entry
+	}
+	if values.Debug && debugLogger != nil {
+		entry = log.NewEntry(debugLogger).WithContext(ctx)
+	}
+	fields := log.Fields{}
+	if values.RequestID != "" {
+		fields["request_id"] = values.RequestID
+	}
+	if values.Ref != "" {
+		fields["ref"] = values.Ref
+	}
+	if values.OriginService != "" {
+		fields["origin_service"] = values.OriginService
+	}
+	if values.Principal != "" {
+		fields["principal"] = values.Principal
+	}
+	if values.TenantID != "" {
+		fields["tenant_id"] = values.TenantID
+	}
+	return entry.WithFields(fields)
+}
+
 func WithRef(ctx context.Context, ref string) context.Context {
 	values := ctx.Value(ctxValuesKey)
 	if values == nil {
@@ -123,7 +378,10 @@ func WithRef(ctx context.Context, ref string) context.Context {
 	return ctx
 }
 
-func contextWithRequest(r *http.Request) context.Context {
+// contextWithRequest returns a context populated with request data. If the
+// caller propagated a deadline, it is applied to the returned context. The
+// returned CancelFunc must be called once the request is done.
+func contextWithRequest(r *http.Request) (context.Context, context.CancelFunc) {
 	values := &ctxValues{
 		RequestID: nuid.Next(),
 		Path:      r.URL.Path,
@@ -132,15 +390,58 @@ func contextWithRequest(r *http.Request) context.Context {
 		IP:        r.RemoteAddr,
 	}
 	// Ensure we use propagated context headers.
-	values.fromRequest(r)
-	return context.WithValue(r.Context(), ctxValuesKey, values)
+	trusted := trustedCaller(r)
+	values.fromHeaders(r.Header, trusted)
+	if !trusted && debugRequested(r) {
+		log.WithFields(log.Fields{
+			"ip": r.RemoteAddr,
+		}).Warn("Ignoring debug or force trace request from untrusted caller")
+	}
+	// Forcing a trace only keeps the request's spans, so unlike debugging
+	// it's safe to allow from browsers.
+	if !values.ForceTrace {
+		values.ForceTrace = forceTraceCookieSet(r)
+	}
+	ctx := context.WithValue(r.Context(), ctxValuesKey, values)
+	ctx = withRetryBudget(ctx, r)
+
+	// Honor the caller's remaining deadline so we don't do work it has
+	// already abandoned.
+	if remaining, ok := deadlineFromRequest(r); ok {
+		return context.WithTimeout(ctx, remaining)
+	}
+	return context.WithCancel(ctx)
 }
 
 func addContextHeaders(r *http.Request) {
 	ctx := r.Context()
+	// Propagate the remaining deadline as a duration rather than an absolute
+	// time to avoid depending on synchronized clocks.
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining < 0 {
+			remaining = 0
+		}
+		r.Header.Set(deadlineHeader, strconv.FormatInt(int64(remaining/time.Millisecond), 10))
+	}
+
 	values := ctx.Value(ctxValuesKey)
 	if values == nil {
 		return
 	}
-	values.(*ctxValues).addHeaders(r)
+	values.(*ctxValues).addHeaders(r.Header)
+}
+
+// deadlineFromRequest returns the remaining time budget propagated by the
+// caller, if any.
+func deadlineFromRequest(r *http.Request) (time.Duration, bool) {
+	header := r.Header.Get(deadlineHeader)
+	if header == "" {
+		return 0, false
+	}
+	ms, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || ms < 0 {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
 }
@@ -0,0 +1,287 @@
+package util
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestAddContextHeadersDeadline(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	addContextHeaders(r)
+	if got := r.Header.Get(deadlineHeader); got != "" {
+		t.Errorf("%s = %q without a deadline", deadlineHeader, got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	r = httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	addContextHeaders(r)
+	ms, err := strconv.ParseInt(r.Header.Get(deadlineHeader), 10, 64)
+	if err != nil || ms <= 1000 || ms > 2000 {
+		t.Errorf("%s = %q, want the remaining 2000ms or just under", deadlineHeader, r.Header.Get(deadlineHeader))
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	r = httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	addContextHeaders(r)
+	if got := r.Header.Get(deadlineHeader); got != "0" {
+		t.Errorf("%s = %q past the deadline, want \"0\"", deadlineHeader, got)
+	}
+}
+
+func TestContextWithRequestDeadline(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"1500", 1500 * time.Millisecond},
+		{"0", 0},
+		{"-5", 0},
+		{"soon", 0},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.header != "" {
+			r.Header.Set(deadlineHeader, test.header)
+		}
+		ctx, cancel := contextWithRequest(r)
+		deadline, ok := ctx.Deadline()
+		cancel()
+		switch {
+		case test.header == "0":
+			// A spent budget leaves no time at all.
+			if !ok || deadline.After(time.Now()) {
+				t.Errorf("%s %q: deadline = %v, %v, want one already passed", deadlineHeader, test.header, deadline, ok)
+			}
+		case test.want == 0:
+			if ok {
+				t.Errorf("%s %q: got deadline %v, want none", deadlineHeader, test.header, deadline)
+			}
+		case !ok || time.Until(deadline) > test.want || time.Until(deadline) < test.want-100*time.Millisecond:
+			t.Errorf("%s %q: deadline in %v, want %v", deadlineHeader, test.header, time.Until(deadline), test.want)
+		}
+	}
+}
+
+// TestDeadlineRoundTrip checks a deadline set by the caller is sent with its
+// outbound requests and applied by the downstream's context handler.
+func TestDeadlineRoundTrip(t *testing.T) {
+	var (
+		remaining time.Duration
+		ok        bool
+	)
+	downstream := httptest.NewServer(NewContextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		if deadline, ok = r.Context().Deadline(); ok {
+			remaining = time.Until(deadline)
+		}
+	})))
+	defer downstream.Close()
+
+	client, err := NewInstrumentedHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequest("GET", downstream.URL+"/downstream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if !ok || remaining > 2*time.Second || remaining < time.Second {
+		t.Errorf("downstream deadline in %v, %v, want just under 2s", remaining, ok)
+	}
+}
+
+func TestLocaleFromContext(t *testing.T) {
+	for _, test := range []struct {
+		language, currency string
+		want               Locale
+	}{
+		{"", "", Locale{Language: DefaultLanguage, Currency: DefaultCurrency}},
+		{"fr-FR", "", Locale{Language: "fr-FR", Currency: DefaultCurrency}},
+		{"", "EUR", Locale{Language: DefaultLanguage, Currency: "EUR"}},
+		{"fr-FR", "EUR", Locale{Language: "fr-FR", Currency: "EUR"}},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.language != "" {
+			r.Header.Set(languageHeader, test.language)
+		}
+		if test.currency != "" {
+			r.Header.Set(currencyHeader, test.currency)
+		}
+		ctx, cancel := contextWithRequest(r)
+		if got := LocaleFromContext(ctx); got != test.want {
+			t.Errorf("%s=%q, %s=%q: locale = %+v, want %+v", languageHeader, test.language, currencyHeader, test.currency, got, test.want)
+		}
+		cancel()
+	}
+
+	want := Locale{Language: DefaultLanguage, Currency: DefaultCurrency}
+	if got := LocaleFromContext(context.Background()); got != want {
+		t.Errorf("locale without context values = %+v, want %+v", got, want)
+	}
+}
+
+// TestLocalePropagation checks the client's locale preferences are sent with
+// outbound requests and logged, and no defaults are sent when it had none.
+func TestLocalePropagation(t *testing.T) {
+	in := httptest.NewRequest("GET", "/", nil)
+	in.Header.Set(languageHeader, "fr-FR")
+	in.Header.Set(currencyHeader, "EUR")
+	ctx, cancel := contextWithRequest(in)
+	defer cancel()
+	out := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	addContextHeaders(out)
+	if got := out.Header.Get(languageHeader); got != "fr-FR" {
+		t.Errorf("propagated %s = %q, want %q", languageHeader, got, "fr-FR")
+	}
+	if got := out.Header.Get(currencyHeader); got != "EUR" {
+		t.Errorf("propagated %s = %q, want %q", currencyHeader, got, "EUR")
+	}
+
+	entry := log.WithContext(ctx)
+	if err := (&ctxHook{}).Fire(entry); err != nil {
+		t.Fatal(err)
+	}
+	logged, _ := entry.Data["context"].(map[string]interface{})
+	if logged["Language"] != "fr-FR" || logged["Currency"] != "EUR" {
+		t.Errorf("logged context %v, want the language and currency", logged)
+	}
+
+	ctx, cancel = contextWithRequest(httptest.NewRequest("GET", "/", nil))
+	defer cancel()
+	out = httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	addContextHeaders(out)
+	for _, header := range []string{languageHeader, currencyHeader} {
+		if got := out.Header.Get(header); got != "" {
+			t.Errorf("propagated %s = %q without a preference", header, got)
+		}
+	}
+}
+
+// TestPropagatedRequestID checks a well-formed propagated request ID is kept,
+// and a malformed one is replaced by a fresh ID with a warning which doesn't
+// log it.
+func TestPropagatedRequestID(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	log.SetOutput(ioutil.Discard)
+	const valid = "tripservicetest0000001"
+	for _, id := range []string{
+		valid,
+		strings.Repeat("a", 10000),
+		"tripservicetest000000\n",
+		"tripservicetest\n{\"level\":\"error\"}",
+		"tripservicetest-000001",
+		"",
+	} {
+		hook.Reset()
+		r := httptest.NewRequest("GET", "/", nil)
+		if id != "" {
+			r.Header.Set(requestIDHeader, id)
+		}
+		ctx, cancel := contextWithRequest(r)
+		got := ctx.Value(ctxValuesKey).(*ctxValues).RequestID
+		cancel()
+
+		if id == valid {
+			if got != valid {
+				t.Errorf("request ID = %q, want the propagated %q", got, valid)
+			}
+			continue
+		}
+		if got == id || !validRequestID(got) {
+			t.Errorf("propagated %.30q: request ID = %q, want a fresh one", id, got)
+		}
+		warned := hook.LastEntry() != nil && hook.LastEntry().Level == log.WarnLevel
+		if warned != (id != "") {
+			t.Errorf("propagated %.30q: warned = %v, want %v", id, warned, id != "")
+		}
+		for _, entry := range hook.AllEntries() {
+			if line, _ := entry.String(); id != "" && strings.Contains(line, id) {
+				t.Errorf("propagated %.30q: logged the untrusted ID", id)
+			}
+		}
+	}
+}
+
+// TestOriginServiceRoundTrip checks a service's outbound requests name it as
+// their origin, and the downstream logs it, while a malformed origin is
+// dropped.
+func TestOriginServiceRoundTrip(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	log.SetOutput(ioutil.Discard)
+	service := localService
+	localService = "trip-service"
+	t.Cleanup(func() { localService = service })
+
+	downstream := httptest.NewServer(NewContextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Logger(r.Context()).Info("Handled request")
+	})))
+	defer downstream.Close()
+	client, err := NewInstrumentedHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The requests are made while handling one, as a service's are.
+	ctx, cancel := contextWithRequest(httptest.NewRequest("GET", "/", nil))
+	defer cancel()
+
+	for _, test := range []struct {
+		name   string
+		client *http.Client
+		origin string
+		want   interface{}
+	}{
+		{"instrumented client", client, "", "trip-service"},
+		{"external client", http.DefaultClient, "", nil},
+		{"malformed origin", http.DefaultClient, "Trip Service {\"level\":\"error\"}", nil},
+		{"oversized origin", http.DefaultClient, strings.Repeat("a", maxServiceNameLength+1), nil},
+	} {
+		hook.Reset()
+		req, err := http.NewRequest("GET", downstream.URL+"/downstream", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.origin != "" {
+			req.Header.Set(originHeader, test.origin)
+		}
+		resp, err := test.client.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		var logged bool
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Handled request" {
+				logged = true
+				if got := entry.Data["origin_service"]; got != test.want {
+					t.Errorf("%s: logged origin service %v, want %v", test.name, got, test.want)
+				}
+			}
+		}
+		if !logged {
+			t.Errorf("%s: downstream didn't log the request", test.name)
+		}
+	}
+}
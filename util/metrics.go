@@ -0,0 +1,144 @@
+package util
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	httpDurationBucketsEnv     = "HTTP_DURATION_BUCKETS"
+	dynamoDBDurationBucketsEnv = "DYNAMODB_DURATION_BUCKETS"
+)
+
+// The default latency buckets extend to 10s since hotel validation alone can
+// take several seconds.
+var (
+	defaultHTTPDurationBuckets     = []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	defaultDynamoDBDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// registry is the shared Prometheus registry served by MetricsHandler.
+var registry = prometheus.NewRegistry()
+
+// bookings counts successful bookings by service. It's defined here rather
+// than in each sub-service since trip-service imports the sub-service
+// packages, which would otherwise register it more than once.
+var bookings = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "bookings_total",
+		Help: "Number of successful bookings.",
+	},
+	[]string{"service"},
+)
+
+var spansDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "trace_spans_dropped_total",
+		Help: "Number of spans dropped because the reporter's buffer was full.",
+	},
+)
+
+var httpDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of HTTP requests served.",
+		Buckets: bucketsFromEnv(httpDurationBucketsEnv, defaultHTTPDurationBuckets),
+	},
+	[]string{"method", "path", "code"},
+)
+
+var dynamoDBThrottled = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "dynamodb_throttled_total",
+		Help: "Number of DynamoDB operations which failed due to throttling.",
+	},
+	[]string{"operation", "table"},
+)
+
+var dynamoDBDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "dynamodb_operation_duration_seconds",
+		Help:    "Latency of DynamoDB operations.",
+		Buckets: bucketsFromEnv(dynamoDBDurationBucketsEnv, defaultDynamoDBDurationBuckets),
+	},
+	[]string{"operation", "table"},
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		bookings,
+		spansDropped,
+		httpDuration,
+		dynamoDBDuration,
+		dynamoDBThrottled,
+	)
+}
+
+// bucketsFromEnv parses the comma-separated histogram bucket boundaries, in
+// seconds, in the given env var. The boundaries are sorted, so they can be
+// given in any order. If the env isn't set or is invalid, the defaults are
+// used.
+func bucketsFromEnv(env string, defaults []float64) []float64 {
+	value := os.Getenv(env)
+	if value == "" {
+		return defaults
+	}
+	parts := strings.Split(value, ",")
+	buckets := make([]float64, 0, len(parts))
+	for _, part := range parts {
+		bucket, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || bucket <= 0 || math.IsInf(bucket, 0) || math.IsNaN(bucket) {
+			log.WithFields(log.Fields{
+				"env":   env,
+				"value": value,
+			}).Warn("Invalid histogram buckets, using defaults")
+			return defaults
+		}
+		buckets = append(buckets, bucket)
+	}
+	sort.Float64s(buckets)
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] == buckets[i-1] {
+			log.WithFields(log.Fields{
+				"env":   env,
+				"value": value,
+			}).Warn("Duplicate histogram buckets, using defaults")
+			return defaults
+		}
+	}
+	return buckets
+}
+
+// observeHTTPRequest records the latency of a request for the given path label
+// which started at start and responded with the given status code.
+func observeHTTPRequest(method, path string, code int, start time.Time) {
+	httpDuration.WithLabelValues(method, path, strconv.Itoa(code)).Observe(time.Since(start).Seconds())
+}
+
+// RecordBooking counts a successful booking by the given service.
+func RecordBooking(service string) {
+	bookings.WithLabelValues(service).Inc()
+}
+
+// MustRegister registers the given collectors with the shared metrics
+// registry. It panics if a collector can't be registered.
+func MustRegister(collectors ...prometheus.Collector) {
+	registry.MustRegister(collectors...)
+}
+
+// MetricsHandler returns an http.Handler which exposes the shared metrics
+// registry in the Prometheus exposition format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
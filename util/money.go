@@ -0,0 +1,85 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in cents. It's serialized as a decimal string such as
+// "123.45" rather than a float, so amounts are never rounded.
+type Money int64
+
+func (m Money) String() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// ParseMoney parses a decimal amount with at most two decimal places, such as
+// "123.45".
+func ParseMoney(s string) (Money, error) {
+	negative := strings.HasPrefix(s, "-")
+	unsigned := strings.TrimPrefix(s, "-")
+	parts := strings.SplitN(unsigned, ".", 2)
+	if parts[0] == "" {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	whole, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || whole < 0 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	var cents int64
+	if len(parts) == 2 {
+		fraction := parts[1]
+		if len(fraction) == 0 || len(fraction) > 2 {
+			return 0, fmt.Errorf("invalid amount %q", s)
+		}
+		if len(fraction) == 1 {
+			fraction += "0"
+		}
+		if cents, err = strconv.ParseInt(fraction, 10, 64); err != nil || cents < 0 {
+			return 0, fmt.Errorf("invalid amount %q", s)
+		}
+	}
+	total := whole*100 + cents
+	if negative {
+		total = -total
+	}
+	return Money(total), nil
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+func (m Money) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalText(text []byte) error {
+	parsed, err := ParseMoney(string(text))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
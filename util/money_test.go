@@ -0,0 +1,98 @@
+package util
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		want Money
+	}{
+		{"0", 0},
+		{"123.45", 12345},
+		{"123.4", 12340},
+		{"123", 12300},
+		{"0.01", 1},
+		{"-0.50", -50},
+		{"-12.05", -1205},
+		{"92233720368547758.07", 9223372036854775807},
+	} {
+		got, err := ParseMoney(test.s)
+		if err != nil || got != test.want {
+			t.Errorf("ParseMoney(%q) = %d, %v, want %d", test.s, got, err, test.want)
+		}
+		if test.s == test.want.String() {
+			continue
+		}
+		if again, err := ParseMoney(test.want.String()); err != nil || again != test.want {
+			t.Errorf("ParseMoney(%q) = %d, %v, want %d", test.want.String(), again, err, test.want)
+		}
+	}
+
+	for _, s := range []string{"", "-", ".50", "1.", "1.234", "1.-5", "1,50", "1e3", "$1.00", "--1"} {
+		if got, err := ParseMoney(s); err == nil {
+			t.Errorf("ParseMoney(%q) = %d, want an error", s, got)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	for _, test := range []struct {
+		m    Money
+		want string
+	}{
+		{0, "0.00"},
+		{1, "0.01"},
+		{10, "0.10"},
+		{12345, "123.45"},
+		{-5, "-0.05"},
+		{-1205, "-12.05"},
+	} {
+		if got := test.m.String(); got != test.want {
+			t.Errorf("Money(%d) = %q, want %q", int64(test.m), got, test.want)
+		}
+	}
+}
+
+// TestMoneySerialization checks amounts survive JSON and XML exactly,
+// including sums which floats can't represent, such as 0.10 + 0.20.
+func TestMoneySerialization(t *testing.T) {
+	type priced struct {
+		Price Money `json:"price" xml:"price"`
+	}
+	sum := Money(10) + Money(20)
+	for _, m := range []Money{sum, 9007199254740993, -1} {
+		data, err := json.Marshal(priced{m})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"price":"` + m.String() + `"}`; string(data) != want {
+			t.Errorf("JSON = %s, want %s", data, want)
+		}
+		var decoded priced
+		if err := json.Unmarshal(data, &decoded); err != nil || decoded.Price != m {
+			t.Errorf("JSON round trip of %s = %s, %v", m, decoded.Price, err)
+		}
+
+		if data, err = xml.Marshal(priced{m}); err != nil {
+			t.Fatal(err)
+		}
+		decoded = priced{}
+		if err := xml.Unmarshal(data, &decoded); err != nil || decoded.Price != m {
+			t.Errorf("XML round trip of %s = %s, %v", m, decoded.Price, err)
+		}
+	}
+	if sum.String() != "0.30" {
+		t.Errorf("0.10 + 0.20 = %s, want 0.30", sum)
+	}
+
+	var decoded priced
+	for _, data := range []string{`{"price":1.5}`, `{"price":"1.505"}`} {
+		if err := json.Unmarshal([]byte(data), &decoded); err == nil {
+			t.Errorf("unmarshaling %s succeeded with %s", data, decoded.Price)
+		}
+	}
+}
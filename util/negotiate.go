@@ -0,0 +1,96 @@
+package util
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	jsonContentType = "application/json"
+	xmlContentType  = "application/xml"
+)
+
+// WriteResponse writes v as the response body, encoded as JSON or XML
+// according to the request's Accept header, along with an ETag as described
+// by writeWithETag. JSON is preferred when the client accepts both or sends
+// no Accept header. If the client accepts neither, a 406 Not Acceptable is
+// written.
+func WriteResponse(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	w.Header().Add("Vary", "Accept")
+	contentType, ok := negotiateContentType(r.Header.Get("Accept"))
+	if !ok {
+		Logger(r.Context()).WithFields(log.Fields{
+			"accept": r.Header.Get("Accept"),
+		}).Warn("Unsupported Accept header")
+		http.Error(w, "Not acceptable, use application/json or application/xml", http.StatusNotAcceptable)
+		return nil
+	}
+
+	var (
+		body []byte
+		err  error
+	)
+	if contentType == xmlContentType {
+		body, err = xml.Marshal(v)
+		if err == nil {
+			body = append([]byte(xml.Header), body...)
+		}
+	} else {
+		body, err = json.Marshal(v)
+	}
+	if err != nil {
+		return err
+	}
+	return writeWithETag(w, r, body, contentType)
+}
+
+// negotiateContentType returns the supported content type the Accept header
+// gives the highest quality, preferring JSON on a tie.
+func negotiateContentType(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return jsonContentType, true
+	}
+	var jsonQ, xmlQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case jsonContentType:
+			jsonQ = maxFloat(jsonQ, q)
+		case xmlContentType, "text/xml":
+			xmlQ = maxFloat(xmlQ, q)
+		case "application/*", "*/*":
+			jsonQ = maxFloat(jsonQ, q)
+			xmlQ = maxFloat(xmlQ, q)
+		}
+	}
+	switch {
+	case jsonQ > 0 && jsonQ >= xmlQ:
+		return jsonContentType, true
+	case xmlQ > 0:
+		return xmlContentType, true
+	default:
+		return "", false
+	}
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,117 @@
+package util
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type negotiateRecord struct {
+	Ref string `json:"ref" xml:"ref"`
+}
+
+func TestWriteResponse(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	for _, test := range []struct {
+		accept      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"", http.StatusOK, jsonContentType, `{"ref":"TR1"}`},
+		{"application/json", http.StatusOK, jsonContentType, `{"ref":"TR1"}`},
+		{"application/xml", http.StatusOK, xmlContentType, `<negotiateRecord><ref>TR1</ref></negotiateRecord>`},
+		{"text/xml", http.StatusOK, xmlContentType, `<ref>TR1</ref>`},
+		{"application/xml, application/json", http.StatusOK, jsonContentType, `{"ref":"TR1"}`},
+		{"application/json;q=0.5, application/xml", http.StatusOK, xmlContentType, `<ref>TR1</ref>`},
+		{"*/*", http.StatusOK, jsonContentType, `{"ref":"TR1"}`},
+		{"text/html", http.StatusNotAcceptable, "", ""},
+		{"application/json;q=0", http.StatusNotAcceptable, "", ""},
+	} {
+		r := httptest.NewRequest("GET", "/trips/booking?ref=TR1", nil)
+		r.Header.Set("Accept", test.accept)
+		w := httptest.NewRecorder()
+		if err := WriteResponse(w, r, &negotiateRecord{Ref: "TR1"}); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != test.status {
+			t.Errorf("Accept %q: status = %d, want %d", test.accept, w.Code, test.status)
+			continue
+		}
+		if w.Header().Get("Vary") != "Accept" {
+			t.Errorf("Accept %q: Vary = %q, want Accept", test.accept, w.Header().Get("Vary"))
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if got := w.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("Accept %q: Content-Type = %q, want %q", test.accept, got, test.contentType)
+		}
+		if !strings.Contains(w.Body.String(), test.body) {
+			t.Errorf("Accept %q: body = %q, want it to contain %q", test.accept, w.Body, test.body)
+		}
+	}
+}
+
+// TestWriteResponseETags checks the JSON and XML representations get
+// different ETags, whether hashed or versioned, so revalidating one doesn't
+// match the other, and a versioned XML ETag still gives the version.
+func TestWriteResponseETags(t *testing.T) {
+	for _, version := range []string{"", VersionETag(3)} {
+		etags := map[string]string{}
+		for _, accept := range []string{jsonContentType, xmlContentType} {
+			r := httptest.NewRequest("GET", "/trips/booking?ref=TR1", nil)
+			r.Header.Set("Accept", accept)
+			w := httptest.NewRecorder()
+			if version != "" {
+				w.Header().Set("ETag", version)
+			}
+			if err := WriteResponse(w, r, &negotiateRecord{Ref: "TR1"}); err != nil {
+				t.Fatal(err)
+			}
+			etags[accept] = w.Header().Get("ETag")
+
+			r.Header.Set("If-None-Match", etags[accept])
+			w = httptest.NewRecorder()
+			if version != "" {
+				w.Header().Set("ETag", version)
+			}
+			if err := WriteResponse(w, r, &negotiateRecord{Ref: "TR1"}); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != http.StatusNotModified {
+				t.Errorf("version %q, %s: revalidating status = %d, want %d", version, accept, w.Code, http.StatusNotModified)
+			}
+		}
+		if etags[jsonContentType] == etags[xmlContentType] {
+			t.Errorf("version %q: JSON and XML share the ETag %s", version, etags[jsonContentType])
+		}
+
+		// Revalidating the XML with the JSON's ETag gets the XML.
+		r := httptest.NewRequest("GET", "/trips/booking?ref=TR1", nil)
+		r.Header.Set("Accept", xmlContentType)
+		r.Header.Set("If-None-Match", etags[jsonContentType])
+		w := httptest.NewRecorder()
+		if version != "" {
+			w.Header().Set("ETag", version)
+		}
+		if err := WriteResponse(w, r, &negotiateRecord{Ref: "TR1"}); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK {
+			t.Errorf("version %q: revalidating the XML with the JSON's ETag: status = %d, want %d", version, w.Code, http.StatusOK)
+		}
+
+		if version != "" {
+			for _, etag := range etags {
+				if got, err := ParseVersionETag(etag); got != 3 || err != nil {
+					t.Errorf("ParseVersionETag(%s) = %d, %v, want 3", etag, got, err)
+				}
+			}
+		}
+	}
+}
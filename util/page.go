@@ -0,0 +1,91 @@
+package util
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// ErrInvalidCursor is returned when a page is requested from a cursor which
+// wasn't returned with a previous page.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ScanPage scans the input's table for at most limit items, starting from the
+// cursor of the previous page, if any. It returns the raw items, for the
+// caller to unmarshal, and the cursor of the next page, which is empty on the
+// last page. A scan with a FilterExpression may take several requests to fill
+// a page, since limit bounds the items each request evaluates.
+func ScanPage(ctx context.Context, db *dynamodb.DynamoDB, input *dynamodb.ScanInput, limit int, cursor string) ([]map[string]*dynamodb.AttributeValue, string, error) {
+	startKey, err := DecodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	items := []map[string]*dynamodb.AttributeValue{}
+	table := aws.StringValue(input.TableName)
+	err = TraceDynamoDB(ctx, "Scan", table, func(ctx context.Context) error {
+		for len(items) < limit {
+			page := *input
+			page.ExclusiveStartKey = startKey
+			page.Limit = aws.Int64(int64(limit - len(items)))
+			result, err := db.ScanWithContext(ctx, &page)
+			if err != nil {
+				return err
+			}
+			items = append(items, result.Items...)
+			startKey = result.LastEvaluatedKey
+			if len(startKey) == 0 {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	next, err := EncodeCursor(startKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return items, next, nil
+}
+
+// EncodeCursor encodes the last evaluated key of a page as an opaque cursor,
+// which is empty if there are no more pages. Every key attribute must be a
+// string.
+func EncodeCursor(key map[string]*dynamodb.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	values := make(map[string]string, len(key))
+	if err := dynamodbattribute.UnmarshalMap(key, &values); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeCursor decodes a cursor from EncodeCursor into the key to start the
+// next page from. It returns ErrInvalidCursor if the cursor is malformed.
+func DecodeCursor(cursor string) (map[string]*dynamodb.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil || len(values) == 0 {
+		return nil, ErrInvalidCursor
+	}
+	return dynamodbattribute.MarshalMap(values)
+}
@@ -0,0 +1,125 @@
+package util
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util/servicetest"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	key := map[string]*dynamodb.AttributeValue{
+		"ref":         {S: aws.String("TR1")},
+		"start_month": {S: aws.String("2019-06")},
+	}
+	cursor, err := EncodeCursor(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, key) {
+		t.Errorf("decoded %v, want %v", decoded, key)
+	}
+
+	if cursor, err := EncodeCursor(nil); cursor != "" || err != nil {
+		t.Errorf("EncodeCursor(nil) = %q, %v, want an empty cursor", cursor, err)
+	}
+	if key, err := DecodeCursor(""); key != nil || err != nil {
+		t.Errorf("DecodeCursor(\"\") = %v, %v, want no key", key, err)
+	}
+}
+
+func TestDecodeInvalidCursor(t *testing.T) {
+	encode := base64.RawURLEncoding.EncodeToString
+	for _, cursor := range []string{
+		"not base64!",
+		encode([]byte("not JSON")),
+		encode([]byte("{}")),
+		encode([]byte(`{"ref":1}`)),
+		encode([]byte(`["TR1"]`)),
+	} {
+		if _, err := DecodeCursor(cursor); err != ErrInvalidCursor {
+			t.Errorf("DecodeCursor(%q) error = %v, want %v", cursor, err, ErrInvalidCursor)
+		}
+	}
+}
+
+// TestScanPage checks paging through a table lists every matching item once,
+// in pages of at most the limit, including when a filter leaves a scan's
+// page short.
+func TestScanPage(t *testing.T) {
+	servicetest.NewDynamoDB(t)
+	db := NewDynamoDB()
+	if err := CreateTable(db, "bookings"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		_, err := db.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String("bookings"),
+			Item: map[string]*dynamodb.AttributeValue{
+				"ref":       {S: aws.String(fmt.Sprintf("BK%d", i))},
+				"cancelled": {BOOL: aws.Bool(i%2 == 1)},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name  string
+		input dynamodb.ScanInput
+		want  int
+	}{
+		{"all", dynamodb.ScanInput{}, 7},
+		{"filtered", dynamodb.ScanInput{
+			FilterExpression:          aws.String("cancelled = :false"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":false": {BOOL: aws.Bool(false)}},
+		}, 4},
+	} {
+		test.input.TableName = aws.String("bookings")
+		listed := map[string]bool{}
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatalf("%s: paging didn't reach the last page", test.name)
+			}
+			items, next, err := ScanPage(context.Background(), db, &test.input, 3, cursor)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if len(items) > 3 {
+				t.Errorf("%s: page has %d items, want at most 3", test.name, len(items))
+			}
+			if next != "" && len(items) != 3 {
+				t.Errorf("%s: page before the last has %d items, want 3", test.name, len(items))
+			}
+			for _, item := range items {
+				ref := aws.StringValue(item["ref"].S)
+				if listed[ref] {
+					t.Errorf("%s: %s listed twice", test.name, ref)
+				}
+				listed[ref] = true
+			}
+			if cursor = next; cursor == "" {
+				break
+			}
+		}
+		if len(listed) != test.want {
+			t.Errorf("%s: listed %d items, want %d", test.name, len(listed), test.want)
+		}
+	}
+
+	if _, _, err := ScanPage(context.Background(), db, &dynamodb.ScanInput{TableName: aws.String("bookings")}, 3, "bogus"); err != ErrInvalidCursor {
+		t.Errorf("scanning from an invalid cursor: error = %v, want %v", err, ErrInvalidCursor)
+	}
+}
@@ -0,0 +1,223 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+	jaeger "github.com/uber/jaeger-client-go"
+	"github.com/uber/jaeger-client-go/zipkin"
+)
+
+// lostTraceWarningInterval is the minimum time between warnings about lost
+// trace headers, so a misconfigured proxy doesn't flood the logs.
+const lostTraceWarningInterval = time.Minute
+
+var lostTraceWarnings = struct {
+	sync.Mutex
+	last       time.Time
+	suppressed int
+}{}
+
+// checkTracePropagation warns if the request came from another of our
+// services, which always propagate a request ID along with the trace, but
+// has no trace context, e.g. because a proxy stripped the tracing headers.
+// Warnings are rate limited to one per lostTraceWarningInterval.
+func checkTracePropagation(r *http.Request) {
+	if !tracingConfig.Enabled || r.Header.Get(requestIDHeader) == "" {
+		return
+	}
+	_, err := opentracing.GlobalTracer().Extract(
+		opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+	if err != opentracing.ErrSpanContextNotFound {
+		return
+	}
+
+	lostTraceWarnings.Lock()
+	now := time.Now()
+	if now.Sub(lostTraceWarnings.last) < lostTraceWarningInterval {
+		lostTraceWarnings.suppressed++
+		lostTraceWarnings.Unlock()
+		return
+	}
+	suppressed := lostTraceWarnings.suppressed
+	lostTraceWarnings.last = now
+	lostTraceWarnings.suppressed = 0
+	lostTraceWarnings.Unlock()
+
+	// Only log the origin if it's one of our service names since it's
+	// untrusted.
+	origin := r.Header.Get(originHeader)
+	if !validServiceName(origin) {
+		origin = ""
+	}
+	log.WithFields(log.Fields{
+		"path":       r.URL.Path,
+		"origin":     origin,
+		"suppressed": suppressed,
+	}).Warn("Request from another service is missing trace headers, the trace is broken")
+}
+
+const propagationFormatEnv = "PROPAGATION_FORMAT"
+
+// Trace context propagation formats for PROPAGATION_FORMAT.
+const (
+	propagationJaeger = "jaeger"
+	propagationB3     = "b3"
+	propagationW3C    = "w3c"
+)
+
+// propagationOptionsFromEnv returns the tracer options which propagate trace
+// context over HTTP in the PROPAGATION_FORMAT format, and the format's name.
+// Jaeger's own headers are used by default. Events are always propagated in
+// Jaeger's format since they only travel between our services.
+func propagationOptionsFromEnv() ([]jaeger.TracerOption, string, error) {
+	format := strings.ToLower(os.Getenv(propagationFormatEnv))
+	switch format {
+	case "", propagationJaeger:
+		return nil, propagationJaeger, nil
+	case propagationB3:
+		propagator := zipkin.NewZipkinB3HTTPHeaderPropagator()
+		return []jaeger.TracerOption{
+			jaeger.TracerOptions.Injector(opentracing.HTTPHeaders, propagator),
+			jaeger.TracerOptions.Extractor(opentracing.HTTPHeaders, propagator),
+		}, format, nil
+	case propagationW3C:
+		propagator := w3cPropagator{}
+		return []jaeger.TracerOption{
+			jaeger.TracerOptions.Injector(opentracing.HTTPHeaders, propagator),
+			jaeger.TracerOptions.Extractor(opentracing.HTTPHeaders, propagator),
+		}, format, nil
+	}
+	return nil, "", fmt.Errorf("invalid %s %q", propagationFormatEnv, os.Getenv(propagationFormatEnv))
+}
+
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+
+	// traceparentVersion is the only version of the traceparent header
+	// which is generated.
+	traceparentVersion = "00"
+
+	// traceStateBaggageKey is the baggage item which carries a caller's
+	// tracestate header through the trace so it's passed on downstream.
+	traceStateBaggageKey = "w3c-tracestate"
+)
+
+// w3cPropagator propagates trace context in the W3C Trace Context traceparent
+// and tracestate headers. Baggage other than the tracestate isn't
+// propagated, since it isn't part of the format.
+type w3cPropagator struct{}
+
+func (w3cPropagator) Inject(sc jaeger.SpanContext, carrier interface{}) error {
+	writer, ok := carrier.(opentracing.TextMapWriter)
+	if !ok {
+		return opentracing.ErrInvalidCarrier
+	}
+	var flags byte
+	if sc.IsSampled() {
+		flags = 1
+	}
+	traceID := sc.TraceID()
+	writer.Set(traceparentHeader, fmt.Sprintf("%s-%016x%016x-%016x-%02x",
+		traceparentVersion, traceID.High, traceID.Low, uint64(sc.SpanID()), flags))
+	sc.ForeachBaggageItem(func(k, v string) bool {
+		if k == traceStateBaggageKey {
+			writer.Set(tracestateHeader, v)
+		}
+		return true
+	})
+	return nil
+}
+
+func (w3cPropagator) Extract(carrier interface{}) (jaeger.SpanContext, error) {
+	reader, ok := carrier.(opentracing.TextMapReader)
+	if !ok {
+		return jaeger.SpanContext{}, opentracing.ErrInvalidCarrier
+	}
+	var traceparent, tracestate string
+	err := reader.ForeachKey(func(k, v string) error {
+		switch strings.ToLower(k) {
+		case traceparentHeader:
+			traceparent = v
+		case tracestateHeader:
+			tracestate = v
+		}
+		return nil
+	})
+	if err != nil {
+		return jaeger.SpanContext{}, err
+	}
+	if traceparent == "" {
+		return jaeger.SpanContext{}, opentracing.ErrSpanContextNotFound
+	}
+
+	traceID, spanID, sampled, err := parseTraceparent(traceparent)
+	if err != nil {
+		return jaeger.SpanContext{}, err
+	}
+	var baggage map[string]string
+	if tracestate != "" {
+		baggage = map[string]string{traceStateBaggageKey: tracestate}
+	}
+	return jaeger.NewSpanContext(traceID, spanID, 0, sampled, baggage), nil
+}
+
+// parseTraceparent parses a traceparent header of the form
+// version-traceid-parentid-flags, where each field is lowercase hex. Headers
+// of future versions may have more fields, which are ignored.
+func parseTraceparent(traceparent string) (jaeger.TraceID, jaeger.SpanID, bool, error) {
+	invalid := opentracing.ErrSpanContextCorrupted
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 ||
+		len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return jaeger.TraceID{}, 0, false, invalid
+	}
+	for _, part := range parts[:4] {
+		if !isLowerHex(part) {
+			return jaeger.TraceID{}, 0, false, invalid
+		}
+	}
+	if parts[0] == "ff" || (parts[0] == traceparentVersion && len(parts) != 4) {
+		return jaeger.TraceID{}, 0, false, invalid
+	}
+	high, err := strconv.ParseUint(parts[1][:16], 16, 64)
+	if err != nil {
+		return jaeger.TraceID{}, 0, false, invalid
+	}
+	low, err := strconv.ParseUint(parts[1][16:], 16, 64)
+	if err != nil {
+		return jaeger.TraceID{}, 0, false, invalid
+	}
+	spanID, err := strconv.ParseUint(parts[2], 16, 64)
+	if err != nil {
+		return jaeger.TraceID{}, 0, false, invalid
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return jaeger.TraceID{}, 0, false, invalid
+	}
+	traceID := jaeger.TraceID{High: high, Low: low}
+	if !traceID.IsValid() || spanID == 0 {
+		return jaeger.TraceID{}, 0, false, invalid
+	}
+	return traceID, jaeger.SpanID(spanID), flags&1 == 1, nil
+}
+
+// isLowerHex indicates if s is made up of lowercase hex digits, which is all
+// the traceparent header allows.
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
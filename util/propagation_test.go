@@ -0,0 +1,225 @@
+package util
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	jaeger "github.com/uber/jaeger-client-go"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	wantTraceID := jaeger.TraceID{High: 0x4bf92f3577b34da6, Low: 0xa3ce929d0e0e4736}
+	wantSpanID := jaeger.SpanID(0x00f067aa0ba902b7)
+	for _, test := range []struct {
+		name        string
+		traceparent string
+		valid       bool
+		sampled     bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"other flags", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03", true, true},
+		{"surrounding space", " 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 ", true, true},
+		{"future version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"uppercase trace ID", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"uppercase span ID", "00-4bf92f3577b34da6a3ce929d0e0e4736-00F067AA0BA902B7-01", false, false},
+		{"uppercase version", "0A-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"non-hex version", "0x-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"signed version", "+0-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"non-hex trace ID", "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01", false, false},
+		{"non-hex flags", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-0z", false, false},
+		{"zero trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"zero span ID", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"short trace ID", "00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"missing flags", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false, false},
+		{"extra field", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"empty", "", false, false},
+	} {
+		traceID, spanID, sampled, err := parseTraceparent(test.traceparent)
+		if !test.valid {
+			if err != opentracing.ErrSpanContextCorrupted {
+				t.Errorf("%s: error = %v, want %v", test.name, err, opentracing.ErrSpanContextCorrupted)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if traceID != wantTraceID || spanID != wantSpanID || sampled != test.sampled {
+			t.Errorf("%s: got %v, %v, sampled %v, want %v, %v, sampled %v",
+				test.name, traceID, spanID, sampled, wantTraceID, wantSpanID, test.sampled)
+		}
+	}
+}
+
+// TestW3CPropagatorRoundTrip checks a span context injected by the W3C
+// propagator is extracted unchanged, keeping the caller's tracestate but no
+// other baggage.
+func TestW3CPropagatorRoundTrip(t *testing.T) {
+	traceID := jaeger.TraceID{High: 0x4bf92f3577b34da6, Low: 0xa3ce929d0e0e4736}
+	for _, sampled := range []bool{true, false} {
+		sc := jaeger.NewSpanContext(traceID, 0xf067aa0ba902b7, 0, sampled, map[string]string{
+			traceStateBaggageKey: "vendor=abc",
+			"user":               "ada",
+		})
+		carrier := opentracing.TextMapCarrier{}
+		if err := (w3cPropagator{}).Inject(sc, carrier); err != nil {
+			t.Fatal(err)
+		}
+		want := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+		if sampled {
+			want = want[:len(want)-1] + "1"
+		}
+		if carrier[traceparentHeader] != want {
+			t.Errorf("traceparent = %q, want %q", carrier[traceparentHeader], want)
+		}
+		if carrier[tracestateHeader] != "vendor=abc" {
+			t.Errorf("tracestate = %q, want %q", carrier[tracestateHeader], "vendor=abc")
+		}
+
+		extracted, err := (w3cPropagator{}).Extract(carrier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if extracted.TraceID() != traceID || extracted.SpanID() != sc.SpanID() || extracted.IsSampled() != sampled {
+			t.Errorf("extracted %v, want %v", extracted, sc)
+		}
+		baggage := map[string]string{}
+		extracted.ForeachBaggageItem(func(k, v string) bool {
+			baggage[k] = v
+			return true
+		})
+		if len(baggage) != 1 || baggage[traceStateBaggageKey] != "vendor=abc" {
+			t.Errorf("extracted baggage %v, want only the tracestate", baggage)
+		}
+	}
+
+	if _, err := (w3cPropagator{}).Extract(opentracing.TextMapCarrier{}); err != opentracing.ErrSpanContextNotFound {
+		t.Errorf("extracting without a traceparent: error = %v, want %v", err, opentracing.ErrSpanContextNotFound)
+	}
+}
+
+// TestPropagationFormats injects a span's context into HTTP headers in each
+// PROPAGATION_FORMAT with a tracer configured for it, and checks the headers
+// are in the format and extract to the same context.
+func TestPropagationFormats(t *testing.T) {
+	for _, test := range []struct {
+		format string
+		header string
+	}{
+		{"", "Uber-Trace-Id"},
+		{"jaeger", "Uber-Trace-Id"},
+		{"b3", "X-B3-Traceid"},
+		{"W3C", "Traceparent"},
+	} {
+		t.Setenv(propagationFormatEnv, test.format)
+		opts, _, err := propagationOptionsFromEnv()
+		if err != nil {
+			t.Fatalf("%q: %v", test.format, err)
+		}
+		tracer, closer := jaeger.NewTracer("test", jaeger.NewConstSampler(true), jaeger.NewNullReporter(), opts...)
+		defer closer.Close()
+
+		span := tracer.StartSpan("test")
+		header := http.Header{}
+		if err := tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header)); err != nil {
+			t.Fatalf("%q: %v", test.format, err)
+		}
+		if header.Get(test.header) == "" {
+			t.Errorf("%q: injected %v, want a %s header", test.format, header, test.header)
+		}
+		extracted, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(header))
+		if err != nil {
+			t.Fatalf("%q: %v", test.format, err)
+		}
+		want := span.Context().(jaeger.SpanContext)
+		got := extracted.(jaeger.SpanContext)
+		if got.TraceID() != want.TraceID() || got.SpanID() != want.SpanID() || got.IsSampled() != want.IsSampled() {
+			t.Errorf("%q: extracted %v, want %v", test.format, got, want)
+		}
+		span.Finish()
+	}
+
+	t.Setenv(propagationFormatEnv, "zipkin")
+	if _, _, err := propagationOptionsFromEnv(); err == nil {
+		t.Error("invalid format accepted")
+	}
+}
+
+// TestCheckTracePropagation simulates requests from another service whose
+// trace headers were stripped on the way, and checks they're warned about at
+// most once per interval.
+func TestCheckTracePropagation(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	log.SetOutput(ioutil.Discard)
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	config := tracingConfig
+	tracingConfig.Enabled = true
+	t.Cleanup(func() { tracingConfig = config })
+	lostTraceWarnings.last = time.Time{}
+
+	request := func(requestID, traced bool) *http.Request {
+		r := httptest.NewRequest("GET", "/flights/booking", nil)
+		if requestID {
+			r.Header.Set(requestIDHeader, "tripservicetest0000001")
+			r.Header.Set(originHeader, "trip-service")
+		}
+		if traced {
+			span := tracer.StartSpan("client")
+			defer span.Finish()
+			tracer.Inject(span.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(r.Header))
+		}
+		return r
+	}
+	warnings := func() []*log.Entry {
+		var entries []*log.Entry
+		for _, entry := range hook.AllEntries() {
+			if entry.Level == log.WarnLevel {
+				entries = append(entries, entry)
+			}
+		}
+		hook.Reset()
+		return entries
+	}
+
+	checkTracePropagation(request(true, true))
+	checkTracePropagation(request(false, false))
+	if got := warnings(); len(got) != 0 {
+		t.Fatalf("warned about %d requests with their trace or from clients, want none", len(got))
+	}
+
+	checkTracePropagation(request(true, false))
+	got := warnings()
+	if len(got) != 1 {
+		t.Fatalf("warned %d times about a stripped request, want once", len(got))
+	}
+	if got[0].Data["origin"] != "trip-service" || got[0].Data["path"] != "/flights/booking" {
+		t.Errorf("warning fields = %v, want the origin and path", got[0].Data)
+	}
+
+	// Further stripped requests are counted but not logged until the
+	// interval passes.
+	checkTracePropagation(request(true, false))
+	checkTracePropagation(request(true, false))
+	if got := warnings(); len(got) != 0 {
+		t.Errorf("warned %d more times within the interval, want none", len(got))
+	}
+	lostTraceWarnings.last = lostTraceWarnings.last.Add(-lostTraceWarningInterval)
+	checkTracePropagation(request(true, false))
+	got = warnings()
+	if len(got) != 1 || got[0].Data["suppressed"] != 2 {
+		t.Errorf("warnings after the interval = %v, want one counting 2 suppressed", got)
+	}
+}
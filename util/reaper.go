@@ -0,0 +1,180 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	reaperEnabledEnv   = "REAPER_ENABLED"
+	reaperIntervalEnv  = "REAPER_INTERVAL"
+	reaperTTLEnv       = "REAPER_TTL"
+	reaperScanLimitEnv = "REAPER_SCAN_LIMIT"
+	reaperDeleteEnv    = "REAPER_DELETE"
+
+	defaultReaperInterval  = time.Hour
+	defaultReaperTTL       = 24 * time.Hour
+	defaultReaperScanLimit = 1000
+)
+
+var reaperCandidates = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "reaper_candidates",
+		Help: "Number of possibly orphaned bookings and expired reservations found by the last reaper scan.",
+	},
+	[]string{"service"},
+)
+
+var reaperDeleted = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "reaper_deleted_total",
+		Help: "Number of expired reservations deleted by the reaper.",
+	},
+	[]string{"service"},
+)
+
+func init() {
+	MustRegister(reaperCandidates, reaperDeleted)
+}
+
+// ReaperCandidate is a booking considered by the reaper.
+type ReaperCandidate struct {
+	Ref     string
+	Created time.Time
+	// HoldExpires is when the hold of a reservation which hasn't been
+	// confirmed expires, and is nil for other bookings.
+	HoldExpires *time.Time
+}
+
+// ReaperLister lists up to limit bookings for the reaper, starting from the
+// cursor returned with the previous page, or the first page if it's empty.
+// It returns the cursor of the next page, which is empty once every booking
+// has been listed.
+type ReaperLister func(ctx context.Context, limit int, cursor string) ([]ReaperCandidate, string, error)
+
+// StartReaper starts a background scan for bookings which may have been
+// orphaned by trips that failed to store, if REAPER_ENABLED is true. Every
+// REAPER_INTERVAL (default 1h), the next page of up to REAPER_SCAN_LIMIT
+// (default 1000) bookings is listed, picking up where the previous scan left
+// off, so every booking is scanned in turn however many there are. Bookings
+// older than REAPER_TTL (default 24h), and reservations whose hold expired,
+// are reported in logs and the reaper_candidates metric.
+//
+// A booking service can't tell whether a trip still references a booking, so
+// old bookings are only ever reported. Reservations whose hold expired can't
+// be confirmed, so nothing references them, and they're deleted, using
+// remove, if REAPER_DELETE is also true.
+func StartReaper(service string, list ReaperLister, remove func(ctx context.Context, ref string) error) error {
+	enabled, err := boolFromEnv(reaperEnabledEnv)
+	if err != nil || !enabled {
+		return err
+	}
+	interval, err := DurationFromEnv(reaperIntervalEnv, defaultReaperInterval)
+	if err != nil {
+		return err
+	}
+	ttl, err := DurationFromEnv(reaperTTLEnv, defaultReaperTTL)
+	if err != nil {
+		return err
+	}
+	limit, err := IntFromEnv(reaperScanLimitEnv, defaultReaperScanLimit)
+	if err != nil {
+		return err
+	}
+	deleteCandidates, err := boolFromEnv(reaperDeleteEnv)
+	if err != nil {
+		return err
+	}
+	if interval == 0 {
+		return nil
+	}
+	if limit <= 0 {
+		return fmt.Errorf("invalid %s %d", reaperScanLimitEnv, limit)
+	}
+
+	log.WithFields(log.Fields{
+		"interval": interval.String(),
+		"ttl":      ttl.String(),
+		"delete":   deleteCandidates,
+	}).Info("Starting orphaned booking reaper")
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		cursor := ""
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			cursor = reap(ctx, SystemClock, service, ttl, limit, cursor, deleteCandidates, list, remove)
+			cancel()
+		}
+	}()
+	return nil
+}
+
+// reap runs a single reaper scan of the page of bookings at the cursor,
+// aging them by the clock, and returns the cursor of the next scan.
+func reap(ctx context.Context, clock Clock, service string, ttl time.Duration, limit int, cursor string, deleteCandidates bool,
+	list ReaperLister, remove func(ctx context.Context, ref string) error) string {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "reaper.scan")
+	defer span.Finish()
+
+	bookings, next, err := list(ctx, limit, cursor)
+	if err == ErrInvalidCursor {
+		// Start over rather than getting stuck.
+		return ""
+	}
+	if err != nil {
+		log.WithContext(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to list bookings for reaper")
+		return cursor
+	}
+
+	now := clock.Now()
+	candidates := 0
+	for _, booking := range bookings {
+		expired := booking.HoldExpires != nil && !now.Before(*booking.HoldExpires)
+		switch {
+		case booking.HoldExpires != nil && !expired:
+			// The reservation is still held, so it may yet be confirmed.
+			continue
+		case expired:
+		case booking.Created.IsZero():
+			// Bookings stored before creation times were recorded can't be
+			// aged.
+			continue
+		case now.Sub(booking.Created) < ttl:
+			continue
+		}
+		candidates++
+		entry := log.WithContext(ctx).WithFields(log.Fields{
+			"ref": booking.Ref,
+		})
+		if !booking.Created.IsZero() {
+			entry = entry.WithField("age", now.Sub(booking.Created).String())
+		}
+		if !expired {
+			entry.Warn("Possible orphaned booking")
+			continue
+		}
+		if !deleteCandidates {
+			entry.Warn("Expired reservation")
+			continue
+		}
+		if err := remove(ctx, booking.Ref); err != nil {
+			entry.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failed to delete expired reservation")
+			continue
+		}
+		reaperDeleted.WithLabelValues(service).Inc()
+		entry.Warn("Deleted expired reservation")
+	}
+	span.SetTag("candidates", candidates)
+	reaperCandidates.WithLabelValues(service).Set(float64(candidates))
+	return next
+}
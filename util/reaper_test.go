@@ -0,0 +1,105 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// pagedLister lists the candidates in pages of the given limit, using the ref
+// of the next page's first candidate as the cursor, and records the cursors
+// it was called with.
+type pagedLister struct {
+	candidates []ReaperCandidate
+	cursors    []string
+	err        error
+}
+
+func (p *pagedLister) list(ctx context.Context, limit int, cursor string) ([]ReaperCandidate, string, error) {
+	p.cursors = append(p.cursors, cursor)
+	if p.err != nil {
+		return nil, "", p.err
+	}
+	start := 0
+	if cursor != "" {
+		for start < len(p.candidates) && p.candidates[start].Ref != cursor {
+			start++
+		}
+		if start == len(p.candidates) {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	end := start + limit
+	if end >= len(p.candidates) {
+		return p.candidates[start:], "", nil
+	}
+	return p.candidates[start:end], p.candidates[end].Ref, nil
+}
+
+func TestReap(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(now)
+	expired := now.Add(-time.Minute)
+	held := now.Add(time.Minute)
+	lister := &pagedLister{candidates: []ReaperCandidate{
+		{Ref: "old", Created: now.Add(-48 * time.Hour)},
+		{Ref: "new", Created: now.Add(-time.Hour)},
+		{Ref: "expired", Created: now.Add(-time.Hour), HoldExpires: &expired},
+		{Ref: "held", Created: now.Add(-48 * time.Hour), HoldExpires: &held},
+		{Ref: "unaged"},
+	}}
+
+	for _, deleteCandidates := range []bool{false, true} {
+		var deleted []string
+		remove := func(ctx context.Context, ref string) error {
+			deleted = append(deleted, ref)
+			return nil
+		}
+		next := reap(context.Background(), clock, "test", 24*time.Hour, 10, "", deleteCandidates, lister.list, remove)
+		if next != "" {
+			t.Errorf("delete=%v: next cursor = %q, want none after the last page", deleteCandidates, next)
+		}
+		// Referenced bookings can't be told apart from orphaned ones, so
+		// only expired reservations are ever deleted.
+		var want []string
+		if deleteCandidates {
+			want = []string{"expired"}
+		}
+		sort.Strings(deleted)
+		if !reflect.DeepEqual(deleted, want) {
+			t.Errorf("delete=%v: deleted %v, want %v", deleteCandidates, deleted, want)
+		}
+	}
+}
+
+func TestReapResumesFromCursor(t *testing.T) {
+	clock := NewFakeClock(time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC))
+	lister := &pagedLister{}
+	for _, ref := range []string{"a", "b", "c", "d", "e"} {
+		lister.candidates = append(lister.candidates, ReaperCandidate{Ref: ref})
+	}
+	remove := func(ctx context.Context, ref string) error { return nil }
+
+	cursor := ""
+	for i := 0; i < 4; i++ {
+		cursor = reap(context.Background(), clock, "test", time.Hour, 2, cursor, false, lister.list, remove)
+	}
+	// The third scan reaches the last page, so the fourth starts over.
+	if want := []string{"", "c", "e", ""}; !reflect.DeepEqual(lister.cursors, want) {
+		t.Errorf("scanned from cursors %q, want %q", lister.cursors, want)
+	}
+
+	// A failed scan is retried from the same cursor, and an invalid cursor
+	// starts over.
+	lister.err = errors.New("scan failed")
+	if next := reap(context.Background(), clock, "test", time.Hour, 2, "c", false, lister.list, remove); next != "c" {
+		t.Errorf("after a failed scan, next cursor = %q, want %q", next, "c")
+	}
+	lister.err = nil
+	if next := reap(context.Background(), clock, "test", time.Hour, 2, "missing", false, lister.list, remove); next != "" {
+		t.Errorf("after an invalid cursor, next cursor = %q, want none", next)
+	}
+}
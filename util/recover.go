@@ -0,0 +1,53 @@
+package util
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	log "github.com/sirupsen/logrus"
+)
+
+// recoverMiddleware returns an http.Handler which recovers from panics in the
+// handler, marking the request's span as errored with the panic value and
+// stack, logging them, and responding with a 500 if nothing was written yet.
+// It must run inside the tracing middleware so the span is still open when
+// the panic is recorded.
+func recoverMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// The handler deliberately aborted the response.
+				panic(recovered)
+			}
+
+			ctx := r.Context()
+			value := fmt.Sprint(recovered)
+			stack := string(debug.Stack())
+			if span := opentracing.SpanFromContext(ctx); span != nil {
+				ext.Error.Set(span, true)
+				LogSpanFields(span,
+					tracelog.String("event", "panic"),
+					tracelog.String("panic", value),
+					tracelog.String("stack", stack),
+				)
+			}
+			Logger(ctx).WithFields(log.Fields{
+				"panic": value,
+				"stack": stack,
+			}).Error("Recovered from panic")
+			if !sw.wroteHeader {
+				http.Error(sw, "Internal server error", http.StatusInternalServerError)
+			}
+		}()
+		handler.ServeHTTP(sw, r)
+	})
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// TestRecoverMarksSpan serves a panicking request through the context
+// handler and checks it gets a 500, its span is marked as errored with the
+// panic logged on it, and the panic is logged.
+func TestRecoverMarksSpan(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	log.SetOutput(ioutil.Discard)
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	handler := NewContextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("booking exploded")
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/trips/booking", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	span := spans[0]
+	if span.Tag("error") != true {
+		t.Errorf("span tags = %v, want error=true", span.Tags())
+	}
+	var logged bool
+	for _, record := range span.Logs() {
+		fields := map[string]string{}
+		for _, field := range record.Fields {
+			fields[field.Key] = field.ValueString
+		}
+		if fields["event"] == "panic" {
+			logged = true
+			if fields["panic"] != "booking exploded" || !strings.Contains(fields["stack"], "recover_test.go") {
+				t.Errorf("span logged panic %q with stack %q, want the panic value and its stack", fields["panic"], fields["stack"])
+			}
+		}
+	}
+	if !logged {
+		t.Errorf("span logs = %v, want a panic event", span.Logs())
+	}
+
+	var entry *log.Entry
+	for _, e := range hook.AllEntries() {
+		if e.Message == "Recovered from panic" {
+			entry = e
+		}
+	}
+	if entry == nil || entry.Level != log.ErrorLevel || entry.Data["panic"] != "booking exploded" {
+		t.Errorf("logged %v, want the panic at error", entry)
+	}
+}
@@ -0,0 +1,249 @@
+package util
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Retry policies are configured by envs with these suffixes, prefixed by
+	// the policy's name, e.g. DYNAMODB_MAX_RETRIES.
+	maxRetriesEnvSuffix        = "_MAX_RETRIES"
+	retryBaseDelayEnvSuffix    = "_RETRY_BASE_DELAY"
+	retryMaxDelayEnvSuffix     = "_RETRY_MAX_DELAY"
+	throttleBaseDelayEnvSuffix = "_THROTTLE_BASE_DELAY"
+
+	dynamoDBRetryPrefix   = "DYNAMODB"
+	downstreamRetryPrefix = "DOWNSTREAM"
+)
+
+// RetryClass is how a failure should be retried.
+type RetryClass int
+
+const (
+	// NotRetryable failures fail immediately, e.g. validation errors.
+	NotRetryable RetryClass = iota
+	// Retryable failures are likely transient, e.g. 5xx responses or
+	// connection errors.
+	Retryable
+	// Throttled failures are retried like Retryable ones but back off
+	// longer, since retrying quickly only adds to the load being shed.
+	Throttled
+)
+
+// RetryClassifier classifies a failed attempt from its response's status
+// code, which is 0 if there was no response, and its error, if any.
+type RetryClassifier func(statusCode int, err error) RetryClass
+
+// ClassifyDynamoDB classifies DynamoDB failures. Throttling, including
+// exceeded provisioned throughput and transactions cancelled by either, is
+// Throttled. Other errors the AWS SDK
+// considers retryable, and 5xx responses other than 501, are Retryable.
+func ClassifyDynamoDB(statusCode int, err error) RetryClass {
+	switch {
+	case err != nil && IsThrottle(err):
+		return Throttled
+	case statusCode >= http.StatusInternalServerError && statusCode != http.StatusNotImplemented:
+		return Retryable
+	case err != nil && request.IsErrorRetryable(err):
+		return Retryable
+	}
+	return NotRetryable
+}
+
+// ClassifyHTTP classifies failed HTTP requests to downstream services. 429
+// responses are Throttled. Transport errors and 5xx responses, such as a 503
+// from a service which is restarting, are Retryable. Requests which failed
+// because their context was cancelled or its deadline passed aren't
+// retryable, since every retry would fail the same way.
+func ClassifyHTTP(statusCode int, err error) RetryClass {
+	switch {
+	case contextEnded(err):
+		return NotRetryable
+	case err != nil:
+		return Retryable
+	case statusCode == http.StatusTooManyRequests:
+		return Throttled
+	case statusCode >= http.StatusInternalServerError:
+		return Retryable
+	}
+	return NotRetryable
+}
+
+// contextEnded indicates if the error is from a context being cancelled or
+// its deadline passing, looking through the *url.Error the http.Client wraps
+// it in, and any other error with an Unwrap method, as errors.Is would if it
+// didn't need Go 1.13.
+func contextEnded(err error) bool {
+	for err != nil {
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return true
+		}
+		switch wrapper := err.(type) {
+		case *url.Error:
+			err = wrapper.Err
+		case interface{ Unwrap() error }:
+			err = wrapper.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// RetryPolicy decides which failures are retried, how many times, and how
+// long to wait before each retry.
+type RetryPolicy struct {
+	// MaxRetries is the number of times a failed operation is retried.
+	MaxRetries int
+	// BaseDelay is the delay ceiling for the first retry of a Retryable
+	// failure. It doubles for each subsequent retry.
+	BaseDelay time.Duration
+	// ThrottleBaseDelay is BaseDelay for Throttled failures.
+	ThrottleBaseDelay time.Duration
+	// MaxDelay caps every delay.
+	MaxDelay time.Duration
+	// Classify classifies failures.
+	Classify RetryClassifier
+}
+
+// DynamoDBRetryPolicyFromEnv returns the policy for DynamoDB requests, which
+// retries throttling with a longer backoff than other failures. It's
+// configured by the DYNAMODB_MAX_RETRIES (default 3),
+// DYNAMODB_RETRY_BASE_DELAY (default 25ms), DYNAMODB_THROTTLE_BASE_DELAY
+// (default 100ms), and DYNAMODB_RETRY_MAX_DELAY (default 1s) envs.
+func DynamoDBRetryPolicyFromEnv() RetryPolicy {
+	return RetryPolicyFromEnv(dynamoDBRetryPrefix, RetryPolicy{
+		MaxRetries:        3,
+		BaseDelay:         25 * time.Millisecond,
+		ThrottleBaseDelay: 100 * time.Millisecond,
+		MaxDelay:          time.Second,
+		Classify:          ClassifyDynamoDB,
+	})
+}
+
+// DownstreamRetryPolicyFromEnv returns the policy for requests to downstream
+// services, which retries 5xx responses quickly. It's configured by the
+// DOWNSTREAM_MAX_RETRIES (default 2), DOWNSTREAM_RETRY_BASE_DELAY (default
+// 100ms), DOWNSTREAM_THROTTLE_BASE_DELAY (default 500ms), and
+// DOWNSTREAM_RETRY_MAX_DELAY (default 2s) envs.
+func DownstreamRetryPolicyFromEnv() RetryPolicy {
+	return RetryPolicyFromEnv(downstreamRetryPrefix, RetryPolicy{
+		MaxRetries:        2,
+		BaseDelay:         100 * time.Millisecond,
+		ThrottleBaseDelay: 500 * time.Millisecond,
+		MaxDelay:          2 * time.Second,
+		Classify:          ClassifyHTTP,
+	})
+}
+
+// RetryPolicyFromEnv returns the defaults overridden by the envs named by the
+// prefix, e.g. DYNAMODB_MAX_RETRIES for a prefix of "DYNAMODB". Invalid
+// settings are logged and replaced by their defaults.
+func RetryPolicyFromEnv(prefix string, defaults RetryPolicy) RetryPolicy {
+	policy := defaults
+	maxRetriesEnv := prefix + maxRetriesEnvSuffix
+	if value := os.Getenv(maxRetriesEnv); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			log.WithFields(log.Fields{
+				"value": value,
+			}).Warn("Invalid " + maxRetriesEnv + ", using default")
+		} else {
+			policy.MaxRetries = n
+		}
+	}
+	policy.BaseDelay = retryDelayFromEnv(prefix+retryBaseDelayEnvSuffix, defaults.BaseDelay)
+	policy.ThrottleBaseDelay = retryDelayFromEnv(prefix+throttleBaseDelayEnvSuffix, defaults.ThrottleBaseDelay)
+	policy.MaxDelay = retryDelayFromEnv(prefix+retryMaxDelayEnvSuffix, defaults.MaxDelay)
+	if policy.MaxDelay < policy.BaseDelay {
+		policy.MaxDelay = policy.BaseDelay
+	}
+	return policy
+}
+
+func retryDelayFromEnv(env string, defaultDelay time.Duration) time.Duration {
+	delay, err := DurationFromEnv(env, defaultDelay)
+	if err != nil || delay == 0 {
+		log.WithFields(log.Fields{
+			"value": os.Getenv(env),
+		}).Warn("Invalid " + env + ", using default")
+		return defaultDelay
+	}
+	return delay
+}
+
+// Delay returns a random delay before the given retry, counting from 0, of a
+// failure of the given class. It's up to the class's base delay times
+// 2^retry, capped at MaxDelay, so retries are spread out with full jitter.
+func (p RetryPolicy) Delay(retry int, class RetryClass) time.Duration {
+	base := p.BaseDelay
+	if class == Throttled {
+		base = p.ThrottleBaseDelay
+	}
+	ceiling := p.MaxDelay
+	if retry < 32 {
+		if d := base << uint(retry); d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// policyRetryer retries DynamoDB requests as the policy decides, so the
+// worst-case latency of a request is bounded by its configuration rather than
+// the SDK's defaults.
+type policyRetryer struct {
+	client.DefaultRetryer
+	policy RetryPolicy
+}
+
+func newPolicyRetryer(policy RetryPolicy) *policyRetryer {
+	return &policyRetryer{
+		DefaultRetryer: client.DefaultRetryer{NumMaxRetries: policy.MaxRetries},
+		policy:         policy,
+	}
+}
+
+// ShouldRetry defers to the request if it says whether it's retryable, and
+// otherwise to the policy.
+func (p *policyRetryer) ShouldRetry(r *request.Request) bool {
+	if r.Retryable != nil {
+		return *r.Retryable
+	}
+	return p.classify(r) != NotRetryable
+}
+
+// RetryRules returns the policy's delay before the request's next retry.
+func (p *policyRetryer) RetryRules(r *request.Request) time.Duration {
+	return p.policy.Delay(r.RetryCount, p.classify(r))
+}
+
+func (p *policyRetryer) classify(r *request.Request) RetryClass {
+	statusCode := 0
+	if r.HTTPResponse != nil {
+		statusCode = r.HTTPResponse.StatusCode
+	}
+	return p.policy.Classify(statusCode, r.Error)
+}
+
+// tagRetries is a request handler which tags the span in the request's
+// context with the number of retries the request needed, if any.
+func tagRetries(r *request.Request) {
+	if r.RetryCount == 0 {
+		return
+	}
+	if span := opentracing.SpanFromContext(r.Context()); span != nil {
+		span.SetTag("aws.retries", r.RetryCount)
+	}
+}
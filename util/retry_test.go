@@ -0,0 +1,133 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// urlError wraps err as the http.Client does.
+func urlError(err error) error {
+	return &url.Error{Op: "Get", URL: "http://downstream/", Err: err}
+}
+
+func TestClassifyHTTP(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		statusCode int
+		err        error
+		want       RetryClass
+	}{
+		{"cancelled", 0, urlError(context.Canceled), NotRetryable},
+		{"deadline exceeded", 0, urlError(context.DeadlineExceeded), NotRetryable},
+		{"wrapped deadline exceeded", 0, fmt.Errorf("booking: %w", urlError(context.DeadlineExceeded)), NotRetryable},
+		{"connection refused", 0, urlError(errors.New("connection refused")), Retryable},
+		{"too many requests", http.StatusTooManyRequests, nil, Throttled},
+		{"internal error", http.StatusInternalServerError, nil, Retryable},
+		{"unavailable", http.StatusServiceUnavailable, nil, Retryable},
+		{"bad request", http.StatusBadRequest, nil, NotRetryable},
+		{"not found", http.StatusNotFound, nil, NotRetryable},
+		{"conflict", http.StatusConflict, nil, NotRetryable},
+	} {
+		if got := ClassifyHTTP(test.statusCode, test.err); got != test.want {
+			t.Errorf("%s: ClassifyHTTP = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestClassifyDynamoDB(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		statusCode int
+		err        error
+		want       RetryClass
+	}{
+		{"throughput exceeded", http.StatusBadRequest, awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "", nil), Throttled},
+		{"throttled transaction", http.StatusBadRequest, cancelled("None, ThrottlingError"), Throttled},
+		{"internal error", http.StatusInternalServerError, awserr.New(dynamodb.ErrCodeInternalServerError, "", nil), Retryable},
+		{"unavailable", http.StatusServiceUnavailable, awserr.New("ServiceUnavailable", "", nil), Retryable},
+		{"not implemented", http.StatusNotImplemented, awserr.New("NotImplemented", "", nil), NotRetryable},
+		{"connection error", 0, awserr.New("RequestError", "send request failed", errors.New("connection reset")), Retryable},
+		{"condition failed", http.StatusBadRequest, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "", nil), NotRetryable},
+		{"validation", http.StatusBadRequest, awserr.New("ValidationException", "", nil), NotRetryable},
+	} {
+		if got := ClassifyDynamoDB(test.statusCode, test.err); got != test.want {
+			t.Errorf("%s: ClassifyDynamoDB = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{
+		BaseDelay:         10 * time.Millisecond,
+		ThrottleBaseDelay: 50 * time.Millisecond,
+		MaxDelay:          200 * time.Millisecond,
+	}
+	for _, test := range []struct {
+		retry   int
+		class   RetryClass
+		ceiling time.Duration
+	}{
+		{0, Retryable, 10 * time.Millisecond},
+		{1, Retryable, 20 * time.Millisecond},
+		{3, Retryable, 80 * time.Millisecond},
+		{5, Retryable, 200 * time.Millisecond},
+		{0, Throttled, 50 * time.Millisecond},
+		{2, Throttled, 200 * time.Millisecond},
+		// Shifts which overflow are capped too.
+		{40, Retryable, 200 * time.Millisecond},
+		{100, Throttled, 200 * time.Millisecond},
+	} {
+		for i := 0; i < 100; i++ {
+			if d := policy.Delay(test.retry, test.class); d < 0 || d > test.ceiling {
+				t.Errorf("Delay(%d, %v) = %v, want within [0, %v]", test.retry, test.class, d, test.ceiling)
+				break
+			}
+		}
+	}
+}
+
+func TestRetryPolicyFromEnv(t *testing.T) {
+	defaults := RetryPolicy{
+		MaxRetries:        2,
+		BaseDelay:         100 * time.Millisecond,
+		ThrottleBaseDelay: 500 * time.Millisecond,
+		MaxDelay:          2 * time.Second,
+		Classify:          ClassifyHTTP,
+	}
+
+	policy := RetryPolicyFromEnv("TEST", defaults)
+	if policy.MaxRetries != 2 || policy.BaseDelay != defaults.BaseDelay ||
+		policy.ThrottleBaseDelay != defaults.ThrottleBaseDelay || policy.MaxDelay != defaults.MaxDelay {
+		t.Errorf("unset: got %+v, want the defaults", policy)
+	}
+
+	t.Setenv("TEST_MAX_RETRIES", "5")
+	t.Setenv("TEST_RETRY_BASE_DELAY", "10ms")
+	t.Setenv("TEST_THROTTLE_BASE_DELAY", "40ms")
+	t.Setenv("TEST_RETRY_MAX_DELAY", "1s")
+	policy = RetryPolicyFromEnv("TEST", defaults)
+	if policy.MaxRetries != 5 || policy.BaseDelay != 10*time.Millisecond ||
+		policy.ThrottleBaseDelay != 40*time.Millisecond || policy.MaxDelay != time.Second {
+		t.Errorf("set: got %+v", policy)
+	}
+
+	t.Setenv("TEST_MAX_RETRIES", "-1")
+	t.Setenv("TEST_RETRY_BASE_DELAY", "0s")
+	t.Setenv("TEST_THROTTLE_BASE_DELAY", "soon")
+	t.Setenv("TEST_RETRY_MAX_DELAY", "50ms")
+	policy = RetryPolicyFromEnv("TEST", defaults)
+	if policy.MaxRetries != 2 || policy.BaseDelay != defaults.BaseDelay || policy.ThrottleBaseDelay != defaults.ThrottleBaseDelay {
+		t.Errorf("invalid: got %+v, want the defaults", policy)
+	}
+	if policy.MaxDelay != defaults.BaseDelay {
+		t.Errorf("max delay below base delay: got %v, want %v", policy.MaxDelay, defaults.BaseDelay)
+	}
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	retryBudgetHeader = "X-Ctx-Retry-Budget"
+	retryBudgetEnv    = "RETRY_BUDGET"
+
+	// defaultRetryBudget is the number of retries a request may make across
+	// the whole call chain when it doesn't carry a budget.
+	defaultRetryBudget = 3
+)
+
+// retryBudget is the budget given to requests which don't carry one, set by
+// Init from RETRY_BUDGET.
+var retryBudget = defaultRetryBudget
+
+// withRetryBudget returns a context carrying the request's retry budget: the
+// caller's propagated budget if there is one, and otherwise the default.
+func withRetryBudget(ctx context.Context, r *http.Request) context.Context {
+	budget := int32(retryBudget)
+	if header := r.Header.Get(retryBudgetHeader); header != "" {
+		if n, err := strconv.ParseInt(header, 10, 32); err == nil && n >= 0 {
+			budget = int32(n)
+		}
+	}
+	return context.WithValue(ctx, retryBudgetKey, &budget)
+}
+
+// SpendRetry takes one retry from the request's retry budget. It returns
+// false if the budget is exhausted, in which case the caller must not retry,
+// so a failure deep in the call chain isn't amplified by every layer above it
+// retrying. Contexts without a budget, such as background jobs', always allow
+// the retry.
+func SpendRetry(ctx context.Context) bool {
+	budget, ok := ctx.Value(retryBudgetKey).(*int32)
+	if !ok {
+		return true
+	}
+	for {
+		remaining := atomic.LoadInt32(budget)
+		if remaining <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(budget, remaining, remaining-1) {
+			return true
+		}
+	}
+}
+
+// addRetryBudgetHeader propagates the remaining retry budget, less one for
+// this hop, so the budget shrinks with the depth of the call chain.
+func addRetryBudgetHeader(r *http.Request) {
+	budget, ok := r.Context().Value(retryBudgetKey).(*int32)
+	if !ok {
+		return
+	}
+	remaining := atomic.LoadInt32(budget) - 1
+	if remaining < 0 {
+		remaining = 0
+	}
+	r.Header.Set(retryBudgetHeader, strconv.FormatInt(int64(remaining), 10))
+}
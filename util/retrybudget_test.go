@@ -0,0 +1,66 @@
+package util
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+// spendAll spends retries from the context's budget until it's exhausted, up
+// to limit, and returns the number spent.
+func spendAll(ctx context.Context, limit int) int {
+	spent := 0
+	for spent < limit && SpendRetry(ctx) {
+		spent++
+	}
+	return spent
+}
+
+func TestSpendRetry(t *testing.T) {
+	for _, test := range []struct {
+		header string
+		want   int
+	}{
+		{"", defaultRetryBudget},
+		{"0", 0},
+		{"2", 2},
+		{"-1", defaultRetryBudget},
+		{"lots", defaultRetryBudget},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if test.header != "" {
+			r.Header.Set(retryBudgetHeader, test.header)
+		}
+		ctx := withRetryBudget(context.Background(), r)
+		if got := spendAll(ctx, 10); got != test.want {
+			t.Errorf("budget %q: spent %d retries, want %d", test.header, got, test.want)
+		}
+	}
+
+	if got := spendAll(context.Background(), 10); got != 10 {
+		t.Errorf("without a budget: spent %d retries, want them all", got)
+	}
+}
+
+// TestAddRetryBudgetHeader checks the budget passed on is what remains, less
+// one for the hop.
+func TestAddRetryBudgetHeader(t *testing.T) {
+	in := httptest.NewRequest("GET", "/", nil)
+	in.Header.Set(retryBudgetHeader, "3")
+	ctx := withRetryBudget(context.Background(), in)
+
+	for _, want := range []string{"2", "1", "0", "0"} {
+		out := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		addRetryBudgetHeader(out)
+		if got := out.Header.Get(retryBudgetHeader); got != want {
+			t.Errorf("propagated budget = %q, want %q", got, want)
+		}
+		SpendRetry(ctx)
+	}
+
+	out := httptest.NewRequest("GET", "/", nil)
+	addRetryBudgetHeader(out)
+	if got := out.Header.Get(retryBudgetHeader); got != "" {
+		t.Errorf("propagated budget %q without one", got)
+	}
+}
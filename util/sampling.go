@@ -0,0 +1,135 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	jaeger "github.com/uber/jaeger-client-go"
+)
+
+const (
+	traceSampleRateEnv           = "TRACE_SAMPLE_RATE"
+	traceOperationSampleRatesEnv = "TRACE_OPERATION_SAMPLE_RATES"
+
+	// samplerTypePerOperation is the sampler type reported by the debug
+	// endpoint when operations are sampled at different rates.
+	samplerTypePerOperation = "per-operation"
+)
+
+// defaultOperationSampleRates keeps every booking when reads are sampled at a
+// lower rate, since bookings are the interesting events.
+const defaultOperationSampleRates = "POST=1"
+
+// newSamplerFromEnv returns the sampler for new traces. By default every
+// trace is sampled. If TRACE_SAMPLE_RATE is set, traces are sampled with that
+// probability unless their operation name, e.g. "GET /trips/booking", starts
+// with a prefix in TRACE_OPERATION_SAMPLE_RATES, a comma-separated list of
+// prefix=rate pairs such as "GET=0.01,POST=1". The longest matching prefix
+// wins. Unless overridden, POST requests are always sampled. It also returns
+// the sampler type and default rate for the debug endpoint.
+func newSamplerFromEnv() (jaeger.Sampler, string, float64, error) {
+	if os.Getenv(traceSampleRateEnv) == "" && os.Getenv(traceOperationSampleRatesEnv) == "" {
+		return jaeger.NewConstSampler(true), jaeger.SamplerTypeConst, 1, nil
+	}
+
+	rate := 1.0
+	if value := os.Getenv(traceSampleRateEnv); value != "" {
+		var err error
+		if rate, err = parseSampleRate(value); err != nil {
+			return nil, "", 0, fmt.Errorf("invalid %s %q", traceSampleRateEnv, value)
+		}
+	}
+	defaultSampler, err := newRateSampler(rate)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	rates := os.Getenv(traceOperationSampleRatesEnv)
+	if rates == "" {
+		rates = defaultOperationSampleRates
+	}
+	var overrides []operationSampleRate
+	for _, pair := range strings.Split(rates, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, "", 0, fmt.Errorf("invalid %s %q", traceOperationSampleRatesEnv, rates)
+		}
+		rate, err := parseSampleRate(parts[1])
+		if err != nil {
+			return nil, "", 0, fmt.Errorf("invalid %s %q", traceOperationSampleRatesEnv, rates)
+		}
+		sampler, err := newRateSampler(rate)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		overrides = append(overrides, operationSampleRate{
+			prefix:  strings.TrimSpace(parts[0]),
+			sampler: sampler,
+		})
+	}
+	sort.SliceStable(overrides, func(i, j int) bool {
+		return len(overrides[i].prefix) > len(overrides[j].prefix)
+	})
+	return &operationSampler{defaultSampler: defaultSampler, overrides: overrides},
+		samplerTypePerOperation, rate, nil
+}
+
+func parseSampleRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("invalid sample rate %q", value)
+	}
+	return rate, nil
+}
+
+// newRateSampler returns a sampler which samples traces with the given
+// probability. Rates of 0 and 1 use const samplers, so they're exact.
+func newRateSampler(rate float64) (jaeger.Sampler, error) {
+	switch rate {
+	case 0:
+		return jaeger.NewConstSampler(false), nil
+	case 1:
+		return jaeger.NewConstSampler(true), nil
+	}
+	return jaeger.NewProbabilisticSampler(rate)
+}
+
+// operationSampler samples traces at a rate chosen by the root span's
+// operation name, which the context middleware sets from the request.
+type operationSampler struct {
+	defaultSampler jaeger.Sampler
+
+	// overrides are ordered longest prefix first.
+	overrides []operationSampleRate
+}
+
+type operationSampleRate struct {
+	prefix  string
+	sampler jaeger.Sampler
+}
+
+func (o *operationSampler) IsSampled(id jaeger.TraceID, operation string) (bool, []jaeger.Tag) {
+	for _, override := range o.overrides {
+		if strings.HasPrefix(operation, override.prefix) {
+			return override.sampler.IsSampled(id, operation)
+		}
+	}
+	return o.defaultSampler.IsSampled(id, operation)
+}
+
+func (o *operationSampler) Close() {
+	o.defaultSampler.Close()
+	for _, override := range o.overrides {
+		override.sampler.Close()
+	}
+}
+
+func (o *operationSampler) Equal(other jaeger.Sampler) bool {
+	return o == other
+}
@@ -0,0 +1,108 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	jaeger "github.com/uber/jaeger-client-go"
+)
+
+func TestNewSamplerFromEnv(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		rate        string
+		rates       string
+		samplerType string
+		sampled     map[string]bool
+	}{
+		{"unset", "", "", jaeger.SamplerTypeConst, map[string]bool{
+			"GET /trips/booking":  true,
+			"POST /trips/booking": true,
+		}},
+		{"bookings always sampled", "0", "", samplerTypePerOperation, map[string]bool{
+			"GET /trips/booking":   false,
+			"POST /trips/booking":  true,
+			"POST /trips/bookings": true,
+		}},
+		{"longest prefix wins", "0", "GET=0,GET /trips/booking=1", samplerTypePerOperation, map[string]bool{
+			"GET /trips/booking":  true,
+			"GET /trips/bookings": true,
+			"GET /healthz":        false,
+			// Overriding the rates replaces the default for bookings.
+			"POST /trips/booking": false,
+		}},
+		{"overrides only", "", "GET=0", samplerTypePerOperation, map[string]bool{
+			"GET /trips/booking": false,
+			"PUT /trips/booking": true,
+		}},
+	} {
+		t.Setenv(traceSampleRateEnv, test.rate)
+		t.Setenv(traceOperationSampleRatesEnv, test.rates)
+		sampler, samplerType, _, err := newSamplerFromEnv()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if samplerType != test.samplerType {
+			t.Errorf("%s: sampler type = %q, want %q", test.name, samplerType, test.samplerType)
+		}
+		for operation, want := range test.sampled {
+			for i := uint64(1); i <= 100; i++ {
+				if sampled, _ := sampler.IsSampled(jaeger.TraceID{Low: i * 0x9e3779b97f4a7c15}, operation); sampled != want {
+					t.Errorf("%s: %q sampled = %v, want %v", test.name, operation, sampled, want)
+					break
+				}
+			}
+		}
+		sampler.Close()
+	}
+
+	for _, test := range []struct{ rate, rates string }{
+		{"2", ""},
+		{"often", ""},
+		{"0.5", "GET"},
+		{"0.5", "=1"},
+		{"0.5", "GET=-1"},
+	} {
+		t.Setenv(traceSampleRateEnv, test.rate)
+		t.Setenv(traceOperationSampleRatesEnv, test.rates)
+		if _, _, _, err := newSamplerFromEnv(); err == nil {
+			t.Errorf("%s=%q, %s=%q: accepted", traceSampleRateEnv, test.rate, traceOperationSampleRatesEnv, test.rates)
+		}
+	}
+}
+
+// TestPostRequestsAlwaysSampled serves requests through the context handler
+// with reads sampled at a rate of zero, and checks only the bookings are
+// traced, using the operation names the middleware gives their spans.
+func TestPostRequestsAlwaysSampled(t *testing.T) {
+	t.Setenv(traceSampleRateEnv, "0")
+	t.Setenv(traceOperationSampleRatesEnv, "")
+	sampler, _, _, err := newSamplerFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter := jaeger.NewInMemoryReporter()
+	tracer, closer := jaeger.NewTracer("test-service", sampler, reporter)
+	defer closer.Close()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	handler := NewContextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 20; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/trips/booking?ref=abc", nil))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/trips/booking", nil))
+	}
+
+	spans := reporter.GetSpans()
+	if len(spans) != 20 {
+		t.Errorf("reported %d spans, want the 20 bookings", len(spans))
+	}
+	for _, span := range spans {
+		if name := span.(*jaeger.Span).OperationName(); name != "POST /trips/booking" {
+			t.Errorf("reported span %q, want only bookings", name)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package util
+
+import (
+	"encoding"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const schemaDraft = "http://json-schema.org/draft-07/schema#"
+
+// Schema is a JSON Schema document, or a subschema of one. Only the keywords
+// the request types need are supported, and zero values are omitted.
+type Schema struct {
+	SchemaURI            string             `json:"$schema,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinLength            int                `json:"minLength,omitempty"`
+	MaxLength            int                `json:"maxLength,omitempty"`
+	Minimum              int                `json:"minimum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             int                `json:"minItems,omitempty"`
+	MaxItems             int                `json:"maxItems,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	Definitions          map[string]*Schema `json:"definitions,omitempty"`
+}
+
+// SchemaCustomizer is implemented by types whose generated schema doesn't
+// capture all of their validation rules, such as limits configured at
+// runtime or custom decoding. CustomizeSchema adjusts the generated schema in
+// place.
+type SchemaCustomizer interface {
+	CustomizeSchema(s *Schema)
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	moneyType         = reflect.TypeOf(Money(0))
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// SchemaFor returns a JSON Schema describing the JSON encoding of v, which
+// must be a struct or a pointer to one. Properties are named by their json
+// tags. Fields tagged `schema:"required"` are required and must be non-empty,
+// matching the Validate methods which reject zero values. Nested structs are
+// referenced from the document's definitions. If STRICT_JSON is set, unknown
+// properties are disallowed, since DecodeJSON rejects them.
+func SchemaFor(v interface{}) *Schema {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	g := &schemaGenerator{definitions: make(map[string]*Schema)}
+	s := g.structSchema(t)
+	customizeSchema(t, s)
+	s.SchemaURI = schemaDraft
+	s.Title = t.Name()
+	if len(g.definitions) > 0 {
+		s.Definitions = g.definitions
+	}
+	return s
+}
+
+// RegisterSchemaEndpoint registers /schema on the mux, serving the JSON
+// Schema of v so clients can check the shape of their requests.
+func RegisterSchemaEndpoint(mux *http.ServeMux, v interface{}) {
+	resp, err := json.Marshal(SchemaFor(v))
+	if err != nil {
+		panic(err)
+	}
+	mux.HandleFunc("/schema", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			LegacyError(w, r.Context(), http.StatusBadRequest, errInvalidMethod)
+			return
+		}
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Write(resp)
+	})
+}
+
+type schemaGenerator struct {
+	definitions map[string]*Schema
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == moneyType:
+		return &Schema{Type: "string", Pattern: `^-?[0-9]+(\.[0-9]{1,2})?$`}
+	case reflect.PtrTo(t).Implements(textMarshalerType):
+		return &Schema{Type: "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.definitions[t.Name()]; !ok {
+			// Reserve the name first in case the type refers to itself.
+			g.definitions[t.Name()] = nil
+			s := g.structSchema(t)
+			customizeSchema(t, s)
+			g.definitions[t.Name()] = s
+		}
+		return &Schema{Ref: "#/definitions/" + t.Name()}
+	}
+	return &Schema{}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	if strictJSON {
+		disallow := false
+		s.AdditionalProperties = &disallow
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		property := g.schema(field.Type)
+		if field.Tag.Get("schema") == "required" {
+			s.Required = append(s.Required, name)
+			requireNonEmpty(property)
+		}
+		s.Properties[name] = property
+	}
+	return s
+}
+
+// customizeSchema lets the struct type t adjust its generated schema s if it
+// implements SchemaCustomizer.
+func customizeSchema(t reflect.Type, s *Schema) {
+	if customizer, ok := reflect.New(t).Interface().(SchemaCustomizer); ok {
+		customizer.CustomizeSchema(s)
+	}
+}
+
+// requireNonEmpty constrains s to exclude the zero value of its type, which
+// the Validate methods treat as missing.
+func requireNonEmpty(s *Schema) {
+	switch s.Type {
+	case "string":
+		if s.Format == "" && s.Pattern == "" {
+			s.MinLength = 1
+		}
+	case "integer":
+		s.Minimum = 1
+	case "array":
+		s.MinItems = 1
+	}
+}
@@ -0,0 +1,119 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	shutdownGracePeriodEnv = "SHUTDOWN_GRACE_PERIOD"
+
+	defaultShutdownGracePeriod = 20 * time.Second
+
+	// drainTimeout bounds how long in-flight requests have to unwind, e.g.
+	// compensate partial bookings, once they've been cancelled.
+	drainTimeout = 15 * time.Second
+)
+
+// ListenAndServe serves handler on addr until the process receives SIGTERM or
+// SIGINT, then shuts down gracefully.
+//
+// On shutdown, the server stops accepting connections and in-flight requests
+// are given SHUTDOWN_GRACE_PERIOD (default 20s) to complete. Requests still
+// running after the grace period have their contexts cancelled, so that
+// multi-step operations abort and clean up after themselves, and are given a
+// further drainTimeout to return before the server exits.
+func ListenAndServe(addr string, handler http.Handler) error {
+	grace, err := DurationFromEnv(shutdownGracePeriodEnv, defaultShutdownGracePeriod)
+	if err != nil {
+		return err
+	}
+
+	d := newDrainHandler(handler)
+	srv := &http.Server{Addr: addr, Handler: d}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sig)
+
+	select {
+	case err := <-errc:
+		return err
+	case s := <-sig:
+		log.WithFields(log.Fields{
+			"signal":       s.String(),
+			"grace_period": grace.String(),
+		}).Info("Shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err == nil {
+		return nil
+	}
+
+	log.Warn("Grace period elapsed, cancelling in-flight requests")
+	d.cancel()
+	if !d.wait(drainTimeout) {
+		log.Error("In-flight requests didn't drain before exiting")
+	}
+	return nil
+}
+
+// drainHandler tracks in-flight requests and derives their contexts from a
+// context which is cancelled when draining.
+type drainHandler struct {
+	handler  http.Handler
+	ctx      context.Context
+	cancel   context.CancelFunc
+	inFlight sync.WaitGroup
+}
+
+func newDrainHandler(handler http.Handler) *drainHandler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &drainHandler{handler: handler, ctx: ctx, cancel: cancel}
+}
+
+func (d *drainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.inFlight.Add(1)
+	defer d.inFlight.Done()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-d.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	d.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// wait waits up to timeout for in-flight requests to return, indicating if
+// they did.
+func (d *drainHandler) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		d.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,36 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestDrainHandler checks draining cancels the contexts of in-flight
+// requests, and waits for them to return.
+func TestDrainHandler(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	d := newDrainHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		// Unwinding, e.g. compensating, takes a while.
+		<-release
+	}))
+	done := make(chan struct{})
+	go func() {
+		d.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/trips/booking", nil))
+		close(done)
+	}()
+	<-started
+
+	d.cancel()
+	if d.wait(20 * time.Millisecond) {
+		t.Fatal("wait returned before the request finished unwinding")
+	}
+	close(release)
+	if !d.wait(time.Second) {
+		t.Fatal("wait timed out after the request returned")
+	}
+	<-done
+}
@@ -0,0 +1,728 @@
+// Package servicetest provides stand-ins for the services' dependencies, so
+// handlers can be tested end to end without AWS or the other services.
+package servicetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Error codes returned by DynamoDB, for Fail.
+const (
+	ErrCodeThrottled  = dynamodb.ErrCodeProvisionedThroughputExceededException
+	ErrCodeInternal   = dynamodb.ErrCodeInternalServerError
+	ErrCodeValidation = "ValidationException"
+)
+
+const targetPrefix = "DynamoDB_20120810."
+
+// DynamoDB is an in-memory stand-in for the DynamoDB API. It supports the
+// operations, and the subset of expressions, the services use: tables with a
+// string hash key and global secondary indexes, item reads and writes with
+// conditions, queries, scans, and transactional writes. Every table is active
+// as soon as it's created.
+type DynamoDB struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	tables   map[string]*table
+	failures map[string]failure
+	calls    map[string]int
+	// regionCalls counts calls by the region they were signed for, then by
+	// operation.
+	regionCalls map[string]map[string]int
+}
+
+type failure struct {
+	status int
+	code   string
+	count  int
+}
+
+type table struct {
+	hashKey string
+	indexes map[string]index
+	items   map[string]item
+}
+
+type index struct {
+	hashKey, rangeKey string
+}
+
+// NewDynamoDB starts a DynamoDB stand-in which is closed when the test ends,
+// and points util.NewDynamoDB at it by setting DYNAMODB_ENDPOINT and dummy
+// credentials. SDK retries are disabled so injected failures surface
+// immediately; set DYNAMODB_MAX_RETRIES after calling it to test them.
+func NewDynamoDB(t testing.TB) *DynamoDB {
+	d := &DynamoDB{
+		tables:      make(map[string]*table),
+		failures:    make(map[string]failure),
+		calls:       make(map[string]int),
+		regionCalls: make(map[string]map[string]int),
+	}
+	d.Server = httptest.NewServer(http.HandlerFunc(d.serveHTTP))
+	t.Cleanup(d.Close)
+	t.Setenv("DYNAMODB_ENDPOINT", d.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	t.Setenv("DYNAMODB_MAX_RETRIES", "0")
+	return d
+}
+
+// Fail makes the next count calls of the operation, e.g. "PutItem", fail with
+// the given status and error code, or every call if count is negative.
+func (d *DynamoDB) Fail(operation string, status int, code string, count int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures[operation] = failure{status: status, code: code, count: count}
+}
+
+// Calls returns the number of times the operation has been called, including
+// failed calls.
+func (d *DynamoDB) Calls(operation string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls[operation]
+}
+
+// CallsIn returns the number of times the operation has been called by
+// clients for the given region, e.g. "us-east-1", including failed calls.
+func (d *DynamoDB) CallsIn(region, operation string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.regionCalls[region][operation]
+}
+
+// Tables returns the names of the tables which have been created, in order.
+func (d *DynamoDB) Tables() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.tables))
+	for name := range d.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Item returns the item in the table with the given hash key, or nil if
+// there isn't one.
+func (d *DynamoDB) Item(tableName, key string) map[string]*dynamodb.AttributeValue {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.tables[tableName]; ok {
+		return t.items[key]
+	}
+	return nil
+}
+
+// PutItem stores the item in the table, which must exist, e.g. to set up an
+// item a test reads.
+func (d *DynamoDB) PutItem(tableName string, it map[string]*dynamodb.AttributeValue) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t := d.tables[tableName]
+	t.items[t.key(it)] = it
+}
+
+// apiError is a DynamoDB error response.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func errorf(code, format string, args ...interface{}) *apiError {
+	return &apiError{status: http.StatusBadRequest, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+func (d *DynamoDB) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), targetPrefix)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	region := signingRegion(r)
+	d.mu.Lock()
+	if d.regionCalls[region] == nil {
+		d.regionCalls[region] = make(map[string]int)
+	}
+	d.regionCalls[region][operation]++
+	out, apiErr := d.call(operation, body)
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if apiErr != nil {
+		w.WriteHeader(apiErr.status)
+		json.NewEncoder(w).Encode(map[string]string{
+			"__type":  "com.amazonaws.dynamodb.v20120810#" + apiErr.code,
+			"message": apiErr.message,
+		})
+		return
+	}
+	resp, err := jsonutil.BuildJSON(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resp)
+}
+
+// signingRegion returns the region the request was signed for, from the
+// credential scope in its Authorization header, e.g.
+// "Credential=test/20190601/us-east-1/dynamodb/aws4_request".
+func signingRegion(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	i := strings.Index(auth, "Credential=")
+	if i < 0 {
+		return ""
+	}
+	scope := strings.SplitN(auth[i+len("Credential="):], ",", 2)[0]
+	if parts := strings.Split(scope, "/"); len(parts) >= 3 {
+		return parts[2]
+	}
+	return ""
+}
+
+// call serves an operation. d.mu must be held.
+func (d *DynamoDB) call(operation string, body []byte) (interface{}, *apiError) {
+	d.calls[operation]++
+	if f, ok := d.failures[operation]; ok && f.count != 0 {
+		if f.count > 0 {
+			f.count--
+			d.failures[operation] = f
+		}
+		return nil, &apiError{status: f.status, code: f.code, message: "injected failure"}
+	}
+
+	var (
+		in  interface{}
+		run func() (interface{}, *apiError)
+	)
+	switch operation {
+	case "CreateTable":
+		input := &dynamodb.CreateTableInput{}
+		in, run = input, func() (interface{}, *apiError) { return d.createTable(input) }
+	case "DescribeTable":
+		input := &dynamodb.DescribeTableInput{}
+		in, run = input, func() (interface{}, *apiError) { return d.describeTable(input) }
+	case "PutItem":
+		input := &dynamodb.PutItemInput{}
+		in, run = input, func() (interface{}, *apiError) { return d.putItem(input) }
+	case "GetItem":
+		input := &dynamodb.GetItemInput{}
+		in, run = input, func() (interface{}, *apiError) { return d.getItem(input) }
+	case "DeleteItem":
+		input := &dynamodb.DeleteItemInput{}
+		in, run = input, func() (interface{}, *apiError) { return d.deleteItem(input) }
+	case "UpdateItem":
+		input := &dynamodb.UpdateItemInput{}
+		in, run = input, func() (interface{}, *apiError) { return d.updateItem(input) }
+	case "Query":
+		input := &dynamodb.QueryInput{}
+		in, run = input, func() (interface{}, *apiError) { return d.query(input) }
+	case "Scan":
+		input := &dynamodb.ScanInput{}
+		in, run = input, func() (interface{}, *apiError) { return d.scan(input) }
+	case "TransactWriteItems":
+		input := &dynamodb.TransactWriteItemsInput{}
+		in, run = input, func() (interface{}, *apiError) { return d.transactWriteItems(input) }
+	default:
+		return nil, errorf("UnknownOperationException", "unsupported operation %q", operation)
+	}
+	if err := jsonutil.UnmarshalJSON(in, strings.NewReader(string(body))); err != nil {
+		return nil, errorf("SerializationException", "%v", err)
+	}
+	return run()
+}
+
+func (d *DynamoDB) table(name *string) (*table, *apiError) {
+	t, ok := d.tables[aws.StringValue(name)]
+	if !ok {
+		return nil, errorf(dynamodb.ErrCodeResourceNotFoundException, "Requested resource not found: Table: %s not found", aws.StringValue(name))
+	}
+	return t, nil
+}
+
+// key returns the item's hash key, which identifies it in the table.
+func (t *table) key(it item) string {
+	if value := it[t.hashKey]; value != nil {
+		return aws.StringValue(value.S)
+	}
+	return ""
+}
+
+func (t *table) keyOf(key map[string]*dynamodb.AttributeValue) (string, *apiError) {
+	value := key[t.hashKey]
+	if value == nil || value.S == nil || len(key) != 1 {
+		return "", errorf(ErrCodeValidation, "The provided key element does not match the schema")
+	}
+	return *value.S, nil
+}
+
+func (d *DynamoDB) createTable(input *dynamodb.CreateTableInput) (interface{}, *apiError) {
+	name := aws.StringValue(input.TableName)
+	if _, ok := d.tables[name]; ok {
+		return nil, errorf(dynamodb.ErrCodeResourceInUseException, "Table already exists: %s", name)
+	}
+	t := &table{indexes: make(map[string]index), items: make(map[string]item)}
+	for _, key := range input.KeySchema {
+		if aws.StringValue(key.KeyType) == dynamodb.KeyTypeHash {
+			t.hashKey = aws.StringValue(key.AttributeName)
+		} else {
+			return nil, errorf(ErrCodeValidation, "range keys aren't supported")
+		}
+	}
+	for _, gsi := range input.GlobalSecondaryIndexes {
+		var i index
+		for _, key := range gsi.KeySchema {
+			if aws.StringValue(key.KeyType) == dynamodb.KeyTypeHash {
+				i.hashKey = aws.StringValue(key.AttributeName)
+			} else {
+				i.rangeKey = aws.StringValue(key.AttributeName)
+			}
+		}
+		t.indexes[aws.StringValue(gsi.IndexName)] = i
+	}
+	d.tables[name] = t
+	return &dynamodb.CreateTableOutput{TableDescription: t.describe(name)}, nil
+}
+
+func (t *table) describe(name string) *dynamodb.TableDescription {
+	description := &dynamodb.TableDescription{
+		TableName:   aws.String(name),
+		TableStatus: aws.String(dynamodb.TableStatusActive),
+		ItemCount:   aws.Int64(int64(len(t.items))),
+	}
+	for indexName := range t.indexes {
+		description.GlobalSecondaryIndexes = append(description.GlobalSecondaryIndexes, &dynamodb.GlobalSecondaryIndexDescription{
+			IndexName:   aws.String(indexName),
+			IndexStatus: aws.String(dynamodb.IndexStatusActive),
+		})
+	}
+	return description
+}
+
+func (d *DynamoDB) describeTable(input *dynamodb.DescribeTableInput) (interface{}, *apiError) {
+	t, err := d.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.DescribeTableOutput{Table: t.describe(aws.StringValue(input.TableName))}, nil
+}
+
+// check evaluates the condition expression, if any, against the item, which
+// is nil if it doesn't exist.
+func check(condition *string, names map[string]*string, values map[string]*dynamodb.AttributeValue, it item) *apiError {
+	if condition == nil {
+		return nil
+	}
+	e, err := newExpression(*condition, names, values)
+	if err != nil {
+		return errorf(ErrCodeValidation, "Invalid ConditionExpression: %v", err)
+	}
+	ok, err := e.evaluate(it)
+	if err != nil {
+		return errorf(ErrCodeValidation, "Invalid ConditionExpression: %v", err)
+	}
+	if !ok {
+		return errorf(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed")
+	}
+	return nil
+}
+
+// validate rejects sets with duplicate members among the attribute values,
+// as DynamoDB does.
+func validate(values map[string]*dynamodb.AttributeValue) *apiError {
+	for _, value := range values {
+		if err := validateValue(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateValue(value *dynamodb.AttributeValue) *apiError {
+	var members []string
+	switch {
+	case value == nil:
+		return nil
+	case value.M != nil:
+		return validate(value.M)
+	case value.L != nil:
+		for _, element := range value.L {
+			if err := validateValue(element); err != nil {
+				return err
+			}
+		}
+		return nil
+	case value.SS != nil:
+		members = aws.StringValueSlice(value.SS)
+	case value.NS != nil:
+		members = aws.StringValueSlice(value.NS)
+	case value.BS != nil:
+		for _, b := range value.BS {
+			members = append(members, string(b))
+		}
+	}
+	seen := make(map[string]bool, len(members))
+	for _, member := range members {
+		if seen[member] {
+			return errorf(ErrCodeValidation, "One or more parameter values were invalid: Input collection %v contains duplicates.", members)
+		}
+		seen[member] = true
+	}
+	return nil
+}
+
+// consumed reports a unit of capacity consumed, if it was requested.
+func consumed(returnConsumed, tableName *string) *dynamodb.ConsumedCapacity {
+	if returnConsumed == nil || *returnConsumed == dynamodb.ReturnConsumedCapacityNone {
+		return nil
+	}
+	return &dynamodb.ConsumedCapacity{TableName: tableName, CapacityUnits: aws.Float64(1)}
+}
+
+func (d *DynamoDB) putItem(input *dynamodb.PutItemInput) (interface{}, *apiError) {
+	t, err := d.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key := t.key(input.Item)
+	if key == "" {
+		return nil, errorf(ErrCodeValidation, "One of the required keys was not given a value")
+	}
+	if err := validate(input.Item); err != nil {
+		return nil, err
+	}
+	old := t.items[key]
+	if err := check(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, old); err != nil {
+		return nil, err
+	}
+	t.items[key] = input.Item
+	out := &dynamodb.PutItemOutput{ConsumedCapacity: consumed(input.ReturnConsumedCapacity, input.TableName)}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld {
+		out.Attributes = old
+	}
+	return out, nil
+}
+
+func (d *DynamoDB) getItem(input *dynamodb.GetItemInput) (interface{}, *apiError) {
+	t, err := d.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.keyOf(input.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.GetItemOutput{
+		Item:             t.items[key],
+		ConsumedCapacity: consumed(input.ReturnConsumedCapacity, input.TableName),
+	}, nil
+}
+
+func (d *DynamoDB) deleteItem(input *dynamodb.DeleteItemInput) (interface{}, *apiError) {
+	t, err := d.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.keyOf(input.Key)
+	if err != nil {
+		return nil, err
+	}
+	old := t.items[key]
+	if err := check(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, old); err != nil {
+		return nil, err
+	}
+	delete(t.items, key)
+	out := &dynamodb.DeleteItemOutput{ConsumedCapacity: consumed(input.ReturnConsumedCapacity, input.TableName)}
+	if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueAllOld {
+		out.Attributes = old
+	}
+	return out, nil
+}
+
+func (d *DynamoDB) updateItem(input *dynamodb.UpdateItemInput) (interface{}, *apiError) {
+	t, err := d.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	key, err := t.keyOf(input.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := validate(input.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+	old := t.items[key]
+	if err := check(input.ConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues, old); err != nil {
+		return nil, err
+	}
+	updated := copyItem(old)
+	if updated == nil {
+		updated = copyItem(input.Key)
+	}
+	if input.UpdateExpression != nil {
+		e, exprErr := newExpression(*input.UpdateExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+		if exprErr == nil {
+			exprErr = e.update(updated)
+		}
+		if exprErr != nil {
+			return nil, errorf(ErrCodeValidation, "Invalid UpdateExpression: %v", exprErr)
+		}
+	}
+	t.items[key] = updated
+	out := &dynamodb.UpdateItemOutput{ConsumedCapacity: consumed(input.ReturnConsumedCapacity, input.TableName)}
+	switch aws.StringValue(input.ReturnValues) {
+	case dynamodb.ReturnValueAllNew:
+		out.Attributes = updated
+	case dynamodb.ReturnValueAllOld:
+		out.Attributes = old
+	}
+	return out, nil
+}
+
+// copyItem copies the item's top-level attributes, which is enough for
+// updates since they replace attributes rather than modifying them in place.
+func copyItem(it item) item {
+	if it == nil {
+		return nil
+	}
+	c := make(item, len(it))
+	for name, value := range it {
+		c[name] = value
+	}
+	return c
+}
+
+// sorted returns the table's items in the order of their hash keys, which
+// scans use so pages are stable.
+func (t *table) sorted() []item {
+	keys := make([]string, 0, len(t.items))
+	for key := range t.items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	items := make([]item, len(keys))
+	for i, key := range keys {
+		items[i] = t.items[key]
+	}
+	return items
+}
+
+// page returns at most limit items after the one with the exclusive start
+// key, if any, and the key to continue from if there are more.
+func (t *table) page(items []item, startKey map[string]*dynamodb.AttributeValue, limit *int64, keyAttributes []string) ([]item, map[string]*dynamodb.AttributeValue) {
+	if len(startKey) > 0 {
+		start := t.key(startKey)
+		for i, it := range items {
+			if t.key(it) == start {
+				items = items[i+1:]
+				break
+			}
+		}
+	}
+	if limit == nil || int64(len(items)) <= *limit {
+		return items, nil
+	}
+	items = items[:*limit]
+	last := items[len(items)-1]
+	lastKey := map[string]*dynamodb.AttributeValue{}
+	for _, name := range keyAttributes {
+		lastKey[name] = last[name]
+	}
+	return items, lastKey
+}
+
+// filter returns the items which match the filter expression, if any.
+func filter(items []item, expression *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) ([]item, *apiError) {
+	if expression == nil {
+		return items, nil
+	}
+	e, err := newExpression(*expression, names, values)
+	if err != nil {
+		return nil, errorf(ErrCodeValidation, "Invalid FilterExpression: %v", err)
+	}
+	var matched []item
+	for _, it := range items {
+		ok, err := e.evaluate(it)
+		if err != nil {
+			return nil, errorf(ErrCodeValidation, "Invalid FilterExpression: %v", err)
+		}
+		if ok {
+			matched = append(matched, it)
+		}
+	}
+	return matched, nil
+}
+
+func toMaps(items []item) []map[string]*dynamodb.AttributeValue {
+	maps := make([]map[string]*dynamodb.AttributeValue, len(items))
+	for i, it := range items {
+		maps[i] = it
+	}
+	return maps
+}
+
+func (d *DynamoDB) scan(input *dynamodb.ScanInput) (interface{}, *apiError) {
+	t, err := d.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	items, lastKey := t.page(t.sorted(), input.ExclusiveStartKey, input.Limit, []string{t.hashKey})
+	scanned := len(items)
+	items, err = filter(items, input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.ScanOutput{
+		Items:            toMaps(items),
+		Count:            aws.Int64(int64(len(items))),
+		ScannedCount:     aws.Int64(int64(scanned)),
+		LastEvaluatedKey: lastKey,
+		ConsumedCapacity: consumed(input.ReturnConsumedCapacity, input.TableName),
+	}, nil
+}
+
+func (d *DynamoDB) query(input *dynamodb.QueryInput) (interface{}, *apiError) {
+	t, err := d.table(input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	i := index{hashKey: t.hashKey}
+	keyAttributes := []string{t.hashKey}
+	if input.IndexName != nil {
+		var ok bool
+		if i, ok = t.indexes[*input.IndexName]; !ok {
+			return nil, errorf(ErrCodeValidation, "The table does not have the specified index: %s", *input.IndexName)
+		}
+		keyAttributes = append(keyAttributes, i.hashKey)
+		if i.rangeKey != "" {
+			keyAttributes = append(keyAttributes, i.rangeKey)
+		}
+	}
+
+	// Items without the index's keys aren't in the index.
+	var items []item
+	for _, it := range t.sorted() {
+		if it[i.hashKey] != nil && (i.rangeKey == "" || it[i.rangeKey] != nil) {
+			items = append(items, it)
+		}
+	}
+	items, err = filter(items, input.KeyConditionExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if i.rangeKey != "" {
+		sort.SliceStable(items, func(a, b int) bool {
+			cmp, _ := compare(items[a][i.rangeKey], items[b][i.rangeKey])
+			return cmp < 0
+		})
+	}
+	if input.ScanIndexForward != nil && !*input.ScanIndexForward {
+		for a, b := 0, len(items)-1; a < b; a, b = a+1, b-1 {
+			items[a], items[b] = items[b], items[a]
+		}
+	}
+
+	items, lastKey := t.page(items, input.ExclusiveStartKey, input.Limit, keyAttributes)
+	scanned := len(items)
+	items, err = filter(items, input.FilterExpression, input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.QueryOutput{
+		Items:            toMaps(items),
+		Count:            aws.Int64(int64(len(items))),
+		ScannedCount:     aws.Int64(int64(scanned)),
+		LastEvaluatedKey: lastKey,
+		ConsumedCapacity: consumed(input.ReturnConsumedCapacity, input.TableName),
+	}, nil
+}
+
+// transactWriteItems checks every item's condition before writing any, and
+// cancels the transaction if one fails, reporting the reasons in the message
+// as DynamoDB does.
+func (d *DynamoDB) transactWriteItems(input *dynamodb.TransactWriteItemsInput) (interface{}, *apiError) {
+	reasons := make([]string, len(input.TransactItems))
+	cancelled := false
+	for i, transactItem := range input.TransactItems {
+		reasons[i] = "None"
+		var err *apiError
+		switch {
+		case transactItem.Put != nil:
+			put := transactItem.Put
+			var t *table
+			if t, err = d.table(put.TableName); err == nil {
+				err = validate(put.Item)
+			}
+			if err == nil {
+				err = check(put.ConditionExpression, put.ExpressionAttributeNames, put.ExpressionAttributeValues, t.items[t.key(put.Item)])
+			}
+		case transactItem.Delete != nil:
+			del := transactItem.Delete
+			var t *table
+			if t, err = d.table(del.TableName); err == nil {
+				var key string
+				if key, err = t.keyOf(del.Key); err == nil {
+					err = check(del.ConditionExpression, del.ExpressionAttributeNames, del.ExpressionAttributeValues, t.items[key])
+				}
+			}
+		case transactItem.ConditionCheck != nil:
+			cc := transactItem.ConditionCheck
+			var t *table
+			if t, err = d.table(cc.TableName); err == nil {
+				var key string
+				if key, err = t.keyOf(cc.Key); err == nil {
+					err = check(cc.ConditionExpression, cc.ExpressionAttributeNames, cc.ExpressionAttributeValues, t.items[key])
+				}
+			}
+		default:
+			err = errorf(ErrCodeValidation, "only Put, Delete and ConditionCheck are supported in transactions")
+		}
+		if err == nil {
+			continue
+		}
+		if err.code != dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil, err
+		}
+		reasons[i] = "ConditionalCheckFailed"
+		cancelled = true
+	}
+	if cancelled {
+		return nil, errorf(dynamodb.ErrCodeTransactionCanceledException,
+			"Transaction cancelled, please refer cancellation reasons for specific reasons [%s]", strings.Join(reasons, ", "))
+	}
+
+	for _, transactItem := range input.TransactItems {
+		switch {
+		case transactItem.Put != nil:
+			t := d.tables[aws.StringValue(transactItem.Put.TableName)]
+			t.items[t.key(transactItem.Put.Item)] = transactItem.Put.Item
+		case transactItem.Delete != nil:
+			t := d.tables[aws.StringValue(transactItem.Delete.TableName)]
+			key, _ := t.keyOf(transactItem.Delete.Key)
+			delete(t.items, key)
+		}
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
@@ -0,0 +1,519 @@
+package servicetest
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// item is a stored DynamoDB item.
+type item map[string]*dynamodb.AttributeValue
+
+// expression evaluates the subset of DynamoDB's condition, filter, key
+// condition and update expressions the services use. Names and values are
+// the request's ExpressionAttributeNames and ExpressionAttributeValues.
+type expression struct {
+	tokens []string
+	pos    int
+	names  map[string]*string
+	values map[string]*dynamodb.AttributeValue
+}
+
+func newExpression(text string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (*expression, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	return &expression{tokens: tokens, names: names, values: values}, nil
+}
+
+// tokenize splits an expression into names, placeholders, numbers,
+// punctuation, comparators and arithmetic operators.
+func tokenize(text string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("(),.[]+-", c):
+			tokens = append(tokens, string(c))
+			i++
+		case strings.ContainsRune("=<>", c):
+			j := i + 1
+			if j < len(text) && strings.ContainsRune("=>", rune(text[j])) {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		case c == '#' || c == ':' || c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			j := i + 1
+			for j < len(text) && (text[j] == '_' || text[j] == '-' || unicode.IsLetter(rune(text[j])) || unicode.IsDigit(rune(text[j]))) {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unsupported character %q in expression %q", c, text)
+		}
+	}
+	return tokens, nil
+}
+
+func (e *expression) peek() string {
+	if e.pos < len(e.tokens) {
+		return e.tokens[e.pos]
+	}
+	return ""
+}
+
+func (e *expression) next() string {
+	token := e.peek()
+	e.pos++
+	return token
+}
+
+func (e *expression) keyword(word string) bool {
+	if strings.EqualFold(e.peek(), word) {
+		e.pos++
+		return true
+	}
+	return false
+}
+
+func (e *expression) expect(token string) error {
+	if got := e.next(); got != token {
+		return fmt.Errorf("expected %q in expression, got %q", token, got)
+	}
+	return nil
+}
+
+func (e *expression) done() error {
+	if e.pos < len(e.tokens) {
+		return fmt.Errorf("unexpected %q in expression", e.peek())
+	}
+	return nil
+}
+
+// evaluate parses and evaluates the whole expression as a condition on item.
+func (e *expression) evaluate(it item) (bool, error) {
+	e.pos = 0
+	ok, err := e.or(it)
+	if err != nil {
+		return false, err
+	}
+	return ok, e.done()
+}
+
+func (e *expression) or(it item) (bool, error) {
+	ok, err := e.and(it)
+	for err == nil && e.keyword("OR") {
+		var right bool
+		right, err = e.and(it)
+		ok = ok || right
+	}
+	return ok, err
+}
+
+func (e *expression) and(it item) (bool, error) {
+	ok, err := e.not(it)
+	for err == nil && e.keyword("AND") {
+		var right bool
+		right, err = e.not(it)
+		ok = ok && right
+	}
+	return ok, err
+}
+
+func (e *expression) not(it item) (bool, error) {
+	if e.keyword("NOT") {
+		ok, err := e.not(it)
+		return !ok, err
+	}
+	return e.primary(it)
+}
+
+func (e *expression) primary(it item) (bool, error) {
+	if e.peek() == "(" {
+		e.next()
+		ok, err := e.or(it)
+		if err != nil {
+			return false, err
+		}
+		return ok, e.expect(")")
+	}
+
+	switch function := strings.ToLower(e.peek()); function {
+	case "attribute_exists", "attribute_not_exists", "contains", "begins_with":
+		e.next()
+		if err := e.expect("("); err != nil {
+			return false, err
+		}
+		value, err := e.operand(it)
+		if err != nil {
+			return false, err
+		}
+		if function == "attribute_exists" || function == "attribute_not_exists" {
+			if err := e.expect(")"); err != nil {
+				return false, err
+			}
+			return (value != nil) == (function == "attribute_exists"), nil
+		}
+		if err := e.expect(","); err != nil {
+			return false, err
+		}
+		arg, err := e.operand(it)
+		if err != nil {
+			return false, err
+		}
+		if err := e.expect(")"); err != nil {
+			return false, err
+		}
+		if value == nil || arg == nil {
+			return false, nil
+		}
+		if function == "begins_with" {
+			return value.S != nil && arg.S != nil && strings.HasPrefix(*value.S, *arg.S), nil
+		}
+		return contains(value, arg), nil
+	}
+
+	left, err := e.operand(it)
+	if err != nil {
+		return false, err
+	}
+	if e.keyword("BETWEEN") {
+		low, err := e.operand(it)
+		if err != nil {
+			return false, err
+		}
+		if !e.keyword("AND") {
+			return false, fmt.Errorf("expected AND in BETWEEN, got %q", e.peek())
+		}
+		high, err := e.operand(it)
+		if err != nil {
+			return false, err
+		}
+		lowCmp, lowOK := compare(left, low)
+		highCmp, highOK := compare(left, high)
+		return lowOK && highOK && lowCmp >= 0 && highCmp <= 0, nil
+	}
+
+	comparator := e.next()
+	right, err := e.operand(it)
+	if err != nil {
+		return false, err
+	}
+	switch comparator {
+	case "=":
+		return equal(left, right), nil
+	case "<>":
+		return !equal(left, right), nil
+	}
+	cmp, ok := compare(left, right)
+	if !ok {
+		return false, nil
+	}
+	switch comparator {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	}
+	return false, fmt.Errorf("unsupported comparator %q", comparator)
+}
+
+// operand returns the value of a placeholder, or of the attribute at a path
+// in the item, which is nil if it doesn't exist.
+func (e *expression) operand(it item) (*dynamodb.AttributeValue, error) {
+	if strings.HasPrefix(e.peek(), ":") {
+		name := e.next()
+		value, ok := e.values[name]
+		if !ok {
+			return nil, fmt.Errorf("undefined expression attribute value %s", name)
+		}
+		return value, nil
+	}
+	path, err := e.path()
+	if err != nil {
+		return nil, err
+	}
+	return resolve(it, path), nil
+}
+
+// pathElement is an attribute name, or a list index if name is empty.
+type pathElement struct {
+	name  string
+	index int
+}
+
+// path parses a document path, e.g. #flight.#passengers[0].
+func (e *expression) path() ([]pathElement, error) {
+	var path []pathElement
+	for {
+		name, err := e.name(e.next())
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, pathElement{name: name})
+		for e.peek() == "[" {
+			e.next()
+			index, err := strconv.Atoi(e.next())
+			if err != nil {
+				return nil, fmt.Errorf("invalid list index in expression: %v", err)
+			}
+			if err := e.expect("]"); err != nil {
+				return nil, err
+			}
+			path = append(path, pathElement{index: index})
+		}
+		if e.peek() != "." {
+			return path, nil
+		}
+		e.next()
+	}
+}
+
+func (e *expression) name(token string) (string, error) {
+	if strings.HasPrefix(token, "#") {
+		name, ok := e.names[token]
+		if !ok {
+			return "", fmt.Errorf("undefined expression attribute name %s", token)
+		}
+		return *name, nil
+	}
+	if token == "" || !(token[0] == '_' || unicode.IsLetter(rune(token[0]))) {
+		return "", fmt.Errorf("expected an attribute name in expression, got %q", token)
+	}
+	return token, nil
+}
+
+func resolve(it item, path []pathElement) *dynamodb.AttributeValue {
+	value := &dynamodb.AttributeValue{M: it}
+	for _, element := range path {
+		switch {
+		case element.name != "" && value.M != nil:
+			value = value.M[element.name]
+		case element.name == "" && element.index < len(value.L):
+			value = value.L[element.index]
+		default:
+			return nil
+		}
+		if value == nil {
+			return nil
+		}
+	}
+	return value
+}
+
+// update applies an update expression of SET and REMOVE clauses to the item.
+// SET assigns values, which may be added or subtracted, and supports
+// if_not_exists but no other functions.
+func (e *expression) update(it item) error {
+	e.pos = 0
+	for e.pos < len(e.tokens) {
+		switch {
+		case e.keyword("SET"):
+			for {
+				path, err := e.path()
+				if err != nil {
+					return err
+				}
+				if err := e.expect("="); err != nil {
+					return err
+				}
+				value, err := e.sum(it)
+				if err != nil {
+					return err
+				}
+				if err := assign(it, path, value); err != nil {
+					return err
+				}
+				if e.peek() != "," {
+					break
+				}
+				e.next()
+			}
+		case e.keyword("REMOVE"):
+			for {
+				path, err := e.path()
+				if err != nil {
+					return err
+				}
+				remove(it, path)
+				if e.peek() != "," {
+					break
+				}
+				e.next()
+			}
+		default:
+			return fmt.Errorf("unsupported update clause %q", e.peek())
+		}
+	}
+	return nil
+}
+
+// sum parses and evaluates the value of a SET action: terms added to or
+// subtracted from each other, which must then be numbers.
+func (e *expression) sum(it item) (*dynamodb.AttributeValue, error) {
+	value, err := e.term(it)
+	for err == nil && (e.peek() == "+" || e.peek() == "-") {
+		operator := e.next()
+		var right *dynamodb.AttributeValue
+		if right, err = e.term(it); err == nil {
+			value, err = arithmetic(value, operator, right)
+		}
+	}
+	return value, err
+}
+
+// term evaluates an operand, or if_not_exists(path, operand), which is the
+// operand only if the attribute at the path doesn't exist.
+func (e *expression) term(it item) (*dynamodb.AttributeValue, error) {
+	if !strings.EqualFold(e.peek(), "if_not_exists") {
+		value, err := e.operand(it)
+		if err == nil && value == nil {
+			err = fmt.Errorf("SET of an attribute which doesn't exist")
+		}
+		return value, err
+	}
+	e.next()
+	if err := e.expect("("); err != nil {
+		return nil, err
+	}
+	path, err := e.path()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.expect(","); err != nil {
+		return nil, err
+	}
+	fallback, err := e.term(it)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.expect(")"); err != nil {
+		return nil, err
+	}
+	if value := resolve(it, path); value != nil {
+		return value, nil
+	}
+	return fallback, nil
+}
+
+func arithmetic(a *dynamodb.AttributeValue, operator string, b *dynamodb.AttributeValue) (*dynamodb.AttributeValue, error) {
+	if a.N == nil || b.N == nil {
+		return nil, fmt.Errorf("an operand of %s isn't a number", operator)
+	}
+	x, okX := new(big.Float).SetString(*a.N)
+	y, okY := new(big.Float).SetString(*b.N)
+	if !okX || !okY {
+		return nil, fmt.Errorf("invalid number in %s", operator)
+	}
+	if operator == "+" {
+		x.Add(x, y)
+	} else {
+		x.Sub(x, y)
+	}
+	n := x.Text('f', -1)
+	return &dynamodb.AttributeValue{N: &n}, nil
+}
+
+func assign(it item, path []pathElement, value *dynamodb.AttributeValue) error {
+	parent := resolve(it, path[:len(path)-1])
+	last := path[len(path)-1]
+	switch {
+	case parent == nil:
+		return fmt.Errorf("SET of a path whose parent doesn't exist")
+	case last.name != "" && parent.M != nil:
+		parent.M[last.name] = value
+	case last.name == "" && last.index < len(parent.L):
+		parent.L[last.index] = value
+	case last.name == "" && last.index == len(parent.L):
+		parent.L = append(parent.L, value)
+	default:
+		return fmt.Errorf("SET of an invalid document path")
+	}
+	return nil
+}
+
+func remove(it item, path []pathElement) {
+	parent := resolve(it, path[:len(path)-1])
+	if parent == nil {
+		return
+	}
+	last := path[len(path)-1]
+	switch {
+	case last.name != "" && parent.M != nil:
+		delete(parent.M, last.name)
+	case last.name == "" && last.index < len(parent.L):
+		parent.L = append(parent.L[:last.index], parent.L[last.index+1:]...)
+	}
+}
+
+func equal(a, b *dynamodb.AttributeValue) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if a.N != nil && b.N != nil {
+		cmp, ok := compare(a, b)
+		return ok && cmp == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compare orders two strings or two numbers. It isn't ok for values of other
+// or differing types, which DynamoDB never considers ordered.
+func compare(a, b *dynamodb.AttributeValue) (int, bool) {
+	switch {
+	case a == nil || b == nil:
+		return 0, false
+	case a.S != nil && b.S != nil:
+		return strings.Compare(*a.S, *b.S), true
+	case a.N != nil && b.N != nil:
+		x, okX := new(big.Float).SetString(*a.N)
+		y, okY := new(big.Float).SetString(*b.N)
+		if !okX || !okY {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	}
+	return 0, false
+}
+
+// contains implements contains(), which matches a substring of a string or a
+// member of a set or list.
+func contains(value, operand *dynamodb.AttributeValue) bool {
+	switch {
+	case value.S != nil:
+		return operand.S != nil && strings.Contains(*value.S, *operand.S)
+	case value.SS != nil:
+		for _, s := range value.SS {
+			if operand.S != nil && *s == *operand.S {
+				return true
+			}
+		}
+	case value.NS != nil:
+		for _, n := range value.NS {
+			if equal(&dynamodb.AttributeValue{N: n}, operand) {
+				return true
+			}
+		}
+	case value.L != nil:
+		for _, element := range value.L {
+			if equal(element, operand) {
+				return true
+			}
+		}
+	}
+	return false
+}
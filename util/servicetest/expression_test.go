@@ -0,0 +1,155 @@
+package servicetest
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestExpressionEvaluate(t *testing.T) {
+	it := item{
+		"ref":     {S: aws.String("abc")},
+		"status":  {S: aws.String("held")},
+		"expires": {N: aws.String("100")},
+		"flight": {M: map[string]*dynamodb.AttributeValue{
+			"passengers": {L: []*dynamodb.AttributeValue{{S: aws.String("Ada")}}},
+		}},
+	}
+	names := map[string]*string{
+		"#ref":        aws.String("ref"),
+		"#status":     aws.String("status"),
+		"#expires":    aws.String("expires"),
+		"#flight":     aws.String("flight"),
+		"#passengers": aws.String("passengers"),
+		"#missing":    aws.String("missing"),
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":held":  {S: aws.String("held")},
+		":now":   {N: aws.String("99.5")},
+		":later": {N: aws.String("200")},
+		":ada":   {S: aws.String("Ada")},
+		":a":     {S: aws.String("a")},
+		":b":     {S: aws.String("b")},
+	}
+	for _, test := range []struct {
+		expression string
+		want       bool
+	}{
+		{"attribute_exists(#ref)", true},
+		{"attribute_not_exists(#ref)", false},
+		{"attribute_not_exists(#missing)", true},
+		{"#status = :held AND #expires > :now", true},
+		{"#status = :held AND #expires > :later", false},
+		{"#status <> :held OR #expires <= :later", true},
+		{"NOT (#status = :held)", false},
+		{"#ref BETWEEN :a AND :b", true},
+		{"contains(#flight.#passengers, :ada)", true},
+		{"contains(#flight.#passengers[0], :b)", false},
+		{"begins_with(#ref, :a)", true},
+		{"#missing = :held", false},
+	} {
+		e, err := newExpression(test.expression, names, values)
+		if err != nil {
+			t.Fatalf("%s: %v", test.expression, err)
+		}
+		got, err := e.evaluate(it)
+		if err != nil {
+			t.Errorf("%s: %v", test.expression, err)
+		} else if got != test.want {
+			t.Errorf("%s = %v, want %v", test.expression, got, test.want)
+		}
+	}
+}
+
+func TestExpressionUpdate(t *testing.T) {
+	it := item{
+		"ref":    {S: aws.String("abc")},
+		"status": {S: aws.String("held")},
+	}
+	e, err := newExpression("SET #price = :price, #version = :version REMOVE #status",
+		map[string]*string{
+			"#price":   aws.String("price"),
+			"#version": aws.String("version"),
+			"#status":  aws.String("status"),
+		},
+		map[string]*dynamodb.AttributeValue{
+			":price":   {S: aws.String("1.00")},
+			":version": {N: aws.String("2")},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.update(it); err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(it["price"].S) != "1.00" || aws.StringValue(it["version"].N) != "2" {
+		t.Errorf("SET didn't assign the values: %v", it)
+	}
+	if _, ok := it["status"]; ok {
+		t.Errorf("REMOVE didn't remove status: %v", it)
+	}
+}
+
+func TestExpressionUpdateArithmetic(t *testing.T) {
+	names := map[string]*string{"#version": aws.String("version")}
+	values := map[string]*dynamodb.AttributeValue{
+		":one":  {N: aws.String("1")},
+		":zero": {N: aws.String("0")},
+	}
+	for _, test := range []struct {
+		expression string
+		version    *dynamodb.AttributeValue
+		want       string
+	}{
+		{"SET #version = #version + :one", &dynamodb.AttributeValue{N: aws.String("2")}, "3"},
+		{"SET #version = #version - :one", &dynamodb.AttributeValue{N: aws.String("2")}, "1"},
+		{"SET #version = if_not_exists(#version, :zero) + :one", &dynamodb.AttributeValue{N: aws.String("2")}, "3"},
+		{"SET #version = if_not_exists(#version, :zero) + :one", nil, "1"},
+	} {
+		it := item{"ref": {S: aws.String("abc")}}
+		if test.version != nil {
+			it["version"] = test.version
+		}
+		e, err := newExpression(test.expression, names, values)
+		if err == nil {
+			err = e.update(it)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.expression, err)
+		} else if got := aws.StringValue(it["version"].N); got != test.want {
+			t.Errorf("%s: version = %s, want %s", test.expression, got, test.want)
+		}
+	}
+
+	for _, expression := range []string{
+		"SET #version = #version + :one",
+		"SET #version = #ref + :one",
+	} {
+		e, err := newExpression(expression, map[string]*string{"#version": aws.String("version"), "#ref": aws.String("ref")}, values)
+		if err == nil {
+			err = e.update(item{"ref": {S: aws.String("abc")}})
+		}
+		if err == nil {
+			t.Errorf("%s: got no error", expression)
+		}
+	}
+}
+
+func TestExpressionInvalid(t *testing.T) {
+	for _, expression := range []string{
+		"#undefined = :held",
+		"#ref = :undefined",
+		"#ref = :held extra",
+		"attribute_exists(#ref",
+	} {
+		e, err := newExpression(expression, map[string]*string{"#ref": aws.String("ref")},
+			map[string]*dynamodb.AttributeValue{":held": {S: aws.String("held")}})
+		if err == nil {
+			_, err = e.evaluate(item{})
+		}
+		if err == nil {
+			t.Errorf("%s: got no error", expression)
+		}
+	}
+}
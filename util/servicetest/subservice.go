@@ -0,0 +1,337 @@
+package servicetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DefaultPrice is the price of every booking a SubService makes.
+const DefaultPrice = "100.00"
+
+// echoedHeaders are the request headers a SubService echoes in its response,
+// so tests can assert what was propagated to it. Headers starting with
+// X-Ctx- are echoed too.
+var echoedHeaders = []string{
+	"Uber-Trace-Id",
+	"Traceparent",
+	"Tracestate",
+	"Accept-Language",
+	"X-Currency",
+	"X-Tenant-ID",
+	"X-Debug",
+	"X-Force-Trace",
+}
+
+// SubService is a stand-in for one of the booking sub-services. It books
+// whatever it's sent, serving canned confirmations, and can be configured to
+// fail or delay requests. See Fail and FailRef.
+type SubService struct {
+	*httptest.Server
+
+	// resource is the path prefix of the service's endpoints, e.g. "flights",
+	// and field the confirmation's field holding the booked request, e.g.
+	// "flight".
+	resource, field string
+
+	mu       sync.Mutex
+	prefix   string
+	next     int
+	bookings map[string]*booking
+	faults   []*fault
+	requests []*Request
+}
+
+type booking struct {
+	request json.RawMessage
+	created time.Time
+	held    bool
+}
+
+// Fault fails or delays the requests it applies to.
+type Fault struct {
+	// Status, if set, is the status of the response, whose body is a JSON
+	// error.
+	Status int
+	// RetryAfter, if set, is sent in the Retry-After header of a failure.
+	RetryAfter string
+	// Delay is how long to wait before responding, unless the request is
+	// cancelled first.
+	Delay time.Duration
+	// Method, if set, limits the fault to requests with that method, e.g.
+	// "POST" to fail bookings.
+	Method string
+	// Count, if set, limits the fault to that many requests, e.g. 1 to fail
+	// a request once and let its retry succeed.
+	Count int
+}
+
+type fault struct {
+	Fault
+	// ref limits the fault to requests for that booking.
+	ref string
+	// applied counts the requests the fault has applied to, and spent is
+	// set once it reaches Count.
+	applied int
+	spent   bool
+}
+
+// Request is a request a SubService received.
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// NewFlightService starts a stand-in flight service which is closed when the
+// test ends.
+func NewFlightService(t testing.TB) *SubService {
+	return newSubService(t, "flights", "flight", "FL")
+}
+
+// NewHotelService starts a stand-in hotel service which is closed when the
+// test ends.
+func NewHotelService(t testing.TB) *SubService {
+	return newSubService(t, "hotels", "hotel", "HT")
+}
+
+// NewCarService starts a stand-in car service which is closed when the test
+// ends.
+func NewCarService(t testing.TB) *SubService {
+	return newSubService(t, "cars", "car_rental", "CR")
+}
+
+func newSubService(t testing.TB, resource, field, prefix string) *SubService {
+	s := &SubService{
+		resource: resource,
+		field:    field,
+		prefix:   prefix,
+		bookings: make(map[string]*booking),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Fail applies the fault to every later request it matches.
+func (s *SubService) Fail(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault{Fault: f})
+}
+
+// FailRef applies the fault to every later request it matches for the
+// booking with the given ref.
+func (s *SubService) FailRef(ref string, f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault{Fault: f, ref: ref})
+}
+
+// Reset clears the faults.
+func (s *SubService) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Requests returns the requests received so far, including failed ones.
+func (s *SubService) Requests() []*Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Request(nil), s.requests...)
+}
+
+// Booked indicates if the booking with the given ref exists, i.e. it was
+// booked and not cancelled.
+func (s *SubService) Booked(ref string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.bookings[ref]
+	return ok
+}
+
+// Bookings returns the number of bookings which exist.
+func (s *SubService) Bookings() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bookings)
+}
+
+func (s *SubService) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	ref := r.URL.Query().Get("ref")
+	if reservation := r.URL.Query().Get("reservation"); reservation != "" {
+		ref = reservation
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, &Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+	var matched []Fault
+	for _, f := range s.faults {
+		if (f.Method != "" && f.Method != r.Method) || (f.ref != "" && f.ref != ref) || f.spent {
+			continue
+		}
+		matched = append(matched, f.Fault)
+		if f.Count > 0 {
+			if f.applied++; f.applied == f.Count {
+				f.spent = true
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, "X-Ctx-") {
+			w.Header()[name] = values
+		}
+	}
+	for _, name := range echoedHeaders {
+		if value := r.Header.Get(name); value != "" {
+			w.Header().Set(name, value)
+		}
+	}
+
+	for _, f := range matched {
+		if f.Delay > 0 {
+			select {
+			case <-time.After(f.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+	for _, f := range matched {
+		if f.Status != 0 {
+			if f.RetryAfter != "" {
+				w.Header().Set("Retry-After", f.RetryAfter)
+			}
+			writeJSONError(w, f.Status, fmt.Sprintf("injected %d", f.Status))
+			return
+		}
+	}
+
+	switch {
+	case r.URL.Path == "/version":
+		writeJSON(w, http.StatusOK, map[string]string{"version": "dev"})
+	case r.URL.Path == "/healthz":
+		w.Write([]byte("ok"))
+	case r.URL.Path == "/"+s.resource+"/reservation" && r.Method == "POST":
+		s.book(w, body, true)
+	case r.URL.Path == "/"+s.resource+"/booking":
+		switch {
+		case r.Method == "POST" && r.URL.Query().Get("reservation") != "":
+			s.confirm(w, ref)
+		case r.Method == "POST":
+			s.book(w, body, false)
+		case r.Method == "GET":
+			s.get(w, ref)
+		case r.Method == "DELETE":
+			s.cancel(w, ref)
+		default:
+			writeJSONError(w, http.StatusBadRequest, "Invalid HTTP method")
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *SubService) book(w http.ResponseWriter, body []byte, held bool) {
+	if !json.Valid(body) {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	s.mu.Lock()
+	s.next++
+	ref := fmt.Sprintf("%s%d", s.prefix, s.next)
+	b := &booking{request: body, created: time.Now().UTC(), held: held}
+	s.bookings[ref] = b
+	confirmation := s.confirmation(ref, b)
+	s.mu.Unlock()
+	writeJSON(w, http.StatusCreated, confirmation)
+}
+
+func (s *SubService) confirm(w http.ResponseWriter, ref string) {
+	s.mu.Lock()
+	b, ok := s.bookings[ref]
+	if ok {
+		b.held = false
+	}
+	var confirmation map[string]interface{}
+	if ok {
+		confirmation = s.confirmation(ref, b)
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no such booking")
+		return
+	}
+	writeJSON(w, http.StatusOK, confirmation)
+}
+
+func (s *SubService) get(w http.ResponseWriter, ref string) {
+	s.mu.Lock()
+	b, ok := s.bookings[ref]
+	var confirmation map[string]interface{}
+	if ok {
+		confirmation = s.confirmation(ref, b)
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no such booking")
+		return
+	}
+	writeJSON(w, http.StatusOK, confirmation)
+}
+
+func (s *SubService) cancel(w http.ResponseWriter, ref string) {
+	s.mu.Lock()
+	_, ok := s.bookings[ref]
+	delete(s.bookings, ref)
+	s.mu.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no such booking")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// confirmation is the canned confirmation of a booking. s.mu must be held.
+func (s *SubService) confirmation(ref string, b *booking) map[string]interface{} {
+	confirmation := map[string]interface{}{
+		"ref":     ref,
+		s.field:   b.request,
+		"created": b.created,
+		"version": 1,
+		"price":   DefaultPrice,
+	}
+	if b.held {
+		confirmation["status"] = "held"
+	}
+	return confirmation
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
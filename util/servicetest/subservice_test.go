@@ -0,0 +1,101 @@
+package servicetest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubServiceBooking(t *testing.T) {
+	s := NewFlightService(t)
+
+	resp, err := http.Post(s.URL+"/flights/booking", "application/json", strings.NewReader(`{"airline":"UA"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var confirmation struct {
+		Ref    string `json:"ref"`
+		Flight struct {
+			Airline string `json:"airline"`
+		} `json:"flight"`
+		Price string `json:"price"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&confirmation)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || confirmation.Ref == "" ||
+		confirmation.Flight.Airline != "UA" || confirmation.Price != DefaultPrice {
+		t.Fatalf("booking got %d %+v", resp.StatusCode, confirmation)
+	}
+
+	req, _ := http.NewRequest("DELETE", s.URL+"/flights/booking?ref="+confirmation.Ref, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || s.Booked(confirmation.Ref) {
+		t.Errorf("cancellation got %d, booked = %v", resp.StatusCode, s.Booked(confirmation.Ref))
+	}
+}
+
+func TestSubServiceEchoesHeaders(t *testing.T) {
+	s := NewHotelService(t)
+	req, _ := http.NewRequest("GET", s.URL+"/hotels/booking?ref=missing", nil)
+	req.Header.Set("Uber-Trace-Id", "1:2:0:1")
+	req.Header.Set("X-Ctx-RequestID", "request")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if got := resp.Header.Get("Uber-Trace-Id"); got != "1:2:0:1" {
+		t.Errorf("echoed trace header = %q", got)
+	}
+	if got := resp.Header.Get("X-Ctx-RequestID"); got != "request" {
+		t.Errorf("echoed request ID = %q", got)
+	}
+	if got := s.Requests(); len(got) != 1 || got[0].Header.Get("X-Ctx-RequestID") != "request" {
+		t.Errorf("recorded requests = %+v", got)
+	}
+}
+
+func TestSubServiceFaults(t *testing.T) {
+	s := NewCarService(t)
+	s.FailRef("bad", Fault{Status: http.StatusTooManyRequests, RetryAfter: "3"})
+	s.FailRef("slow", Fault{Delay: time.Minute})
+
+	resp, err := http.Get(s.URL + "/cars/booking?ref=bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "3" {
+		t.Errorf("failed ref got %d with Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", s.URL+"/cars/booking?ref=slow", nil)
+	if resp, err := http.DefaultClient.Do(req.WithContext(ctx)); err == nil {
+		resp.Body.Close()
+		t.Errorf("delayed ref responded with %d before the timeout", resp.StatusCode)
+	}
+
+	resp, err = http.Get(s.URL + "/cars/booking?ref=other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unaffected ref got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const slowRequestEnv = "SLOW_REQUEST_MS"
+
+// slowRequestThresholdFromEnv returns the SLOW_REQUEST_MS threshold, or zero
+// if it isn't set. An invalid threshold is ignored with a warning rather than
+// failing startup, since it only affects logging.
+func slowRequestThresholdFromEnv() time.Duration {
+	ms, err := IntFromEnv(slowRequestEnv, 0)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Ignoring slow request threshold")
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// slowRequestMiddleware returns an http.Handler which logs a warning for any
+// request taking longer than threshold and tags its span as slow, as a cheap
+// signal of latency SLO violations. It must run inside the tracing middleware
+// so the span exists. A zero threshold disables it.
+func slowRequestMiddleware(handler http.Handler, threshold time.Duration) http.Handler {
+	if threshold <= 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(sw, r)
+		elapsed := time.Since(start)
+		if elapsed <= threshold {
+			return
+		}
+
+		ctx := r.Context()
+		if span := opentracing.SpanFromContext(ctx); span != nil {
+			span.SetTag("slow_request", true)
+		}
+		Logger(ctx).WithFields(log.Fields{
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"status":     sw.status,
+			"elapsed_ms": int64(elapsed / time.Millisecond),
+		}).Warn("Slow request")
+	})
+}
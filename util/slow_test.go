@@ -0,0 +1,86 @@
+package util
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// TestSlowRequestMiddleware serves a request slower than the threshold and
+// one faster, and checks only the slow one is logged and tagged on its span.
+func TestSlowRequestMiddleware(t *testing.T) {
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	log.SetOutput(ioutil.Discard)
+
+	handler := slowRequestMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("slow") == "true" {
+			time.Sleep(30 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}), 10*time.Millisecond)
+
+	tracer := mocktracer.New()
+	for _, slow := range []bool{false, true} {
+		hook.Reset()
+		span := tracer.StartSpan("test").(*mocktracer.MockSpan)
+		ctx := opentracing.ContextWithSpan(context.Background(), span)
+		target := "/trips/booking"
+		if slow {
+			target += "?slow=true"
+		}
+		r := httptest.NewRequest("POST", target, nil).WithContext(ctx)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		if tagged := span.Tag("slow_request") == true; tagged != slow {
+			t.Errorf("slow %v: span tagged slow = %v", slow, tagged)
+		}
+		var warnings []*log.Entry
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Slow request" {
+				warnings = append(warnings, entry)
+			}
+		}
+		if !slow {
+			if len(warnings) != 0 {
+				t.Errorf("fast request logged as slow: %v", warnings[0].Data)
+			}
+			continue
+		}
+		if len(warnings) != 1 {
+			t.Fatalf("logged %d slow request warnings, want 1", len(warnings))
+		}
+		entry := warnings[0]
+		if entry.Level != log.WarnLevel || entry.Data["method"] != "POST" || entry.Data["path"] != "/trips/booking" ||
+			entry.Data["status"] != http.StatusAccepted {
+			t.Errorf("logged %s %v, want a warning with the method, path, and status", entry.Level, entry.Data)
+		}
+		if ms, _ := entry.Data["elapsed_ms"].(int64); ms < 30 {
+			t.Errorf("elapsed_ms = %v, want at least 30", entry.Data["elapsed_ms"])
+		}
+	}
+}
+
+func TestSlowRequestThresholdFromEnv(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"250", 250 * time.Millisecond},
+		{"slow", 0},
+	} {
+		t.Setenv(slowRequestEnv, test.value)
+		if got := slowRequestThresholdFromEnv(); got != test.want {
+			t.Errorf("%s=%q: threshold = %v, want %v", slowRequestEnv, test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package util
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	log "github.com/sirupsen/logrus"
+)
+
+const spanLogFieldsEnv = "SPAN_LOG_FIELDS"
+
+// standardSpanLogFields are the OpenTracing fields which say what a span log
+// is, so they're kept whatever SPAN_LOG_FIELDS allows.
+var standardSpanLogFields = []string{"event", "message", "error", "error.kind"}
+
+// spanLogFields are the fields LogSpanFields keeps, from SPAN_LOG_FIELDS. It's
+// nil, keeping every field, if SPAN_LOG_FIELDS isn't set.
+var spanLogFields = spanLogFieldsFromEnv()
+
+func spanLogFieldsFromEnv() map[string]bool {
+	value := os.Getenv(spanLogFieldsEnv)
+	if value == "" {
+		return nil
+	}
+	allowed := make(map[string]bool)
+	for _, key := range standardSpanLogFields {
+		allowed[key] = true
+	}
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			allowed[key] = true
+		}
+	}
+	return allowed
+}
+
+// LogSpanFields logs the fields on the span, leaving off any which aren't
+// listed in SPAN_LOG_FIELDS, a comma-separated list of field keys, if it's
+// set. The standard event, message, error, and error.kind fields are always
+// kept. Left off fields are still in the service's logs wherever the call
+// site logs them, so operators can trim traces without losing them.
+func LogSpanFields(span opentracing.Span, fields ...tracelog.Field) {
+	if spanLogFields == nil {
+		span.LogFields(fields...)
+		return
+	}
+	kept := make([]tracelog.Field, 0, len(fields))
+	for _, field := range fields {
+		if spanLogFields[field.Key()] {
+			kept = append(kept, field)
+		}
+	}
+	if len(kept) > 0 {
+		span.LogFields(kept...)
+	}
+}
+
+// LoggerWithSpan returns a log entry like Logger, except warnings and errors
+// are also logged on the span in ctx, so they show up in the trace as well as
+// the logs. Info and debug entries are only logged, since they're too
+// frequent to be worth duplicating.
+func LoggerWithSpan(ctx context.Context) *log.Entry {
+	return Logger(context.WithValue(ctx, mirrorToSpanKey, true))
+}
+
+// spanHook logs warnings and errors from LoggerWithSpan entries on the span
+// in the entry's context.
+type spanHook struct{}
+
+func (spanHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel,
+		log.FatalLevel,
+		log.ErrorLevel,
+		log.WarnLevel,
+	}
+}
+
+func (spanHook) Fire(e *log.Entry) error {
+	if e.Context == nil || e.Context.Value(mirrorToSpanKey) != true {
+		return nil
+	}
+	span := opentracing.SpanFromContext(e.Context)
+	if span == nil {
+		return nil
+	}
+
+	keys := make([]string, 0, len(e.Data))
+	for k := range e.Data {
+		// The request's context values are the same for every entry and
+		// would bloat the span, so they're left off.
+		if k != "context" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	fields := []tracelog.Field{
+		tracelog.String("event", e.Level.String()),
+		tracelog.String("message", e.Message),
+	}
+	for _, k := range keys {
+		if err, ok := e.Data[k].(error); ok {
+			fields = append(fields, tracelog.String(k, err.Error()))
+			continue
+		}
+		fields = append(fields, tracelog.Object(k, e.Data[k]))
+	}
+	LogSpanFields(span, fields...)
+	return nil
+}
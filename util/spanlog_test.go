@@ -0,0 +1,104 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	tracelog "github.com/opentracing/opentracing-go/log"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	log "github.com/sirupsen/logrus"
+)
+
+// TestLoggerWithSpan checks warnings and errors logged with LoggerWithSpan are
+// logged on the span too, and other entries aren't.
+func TestLoggerWithSpan(t *testing.T) {
+	logger := log.StandardLogger()
+	hooks, out := logger.ReplaceHooks(log.LevelHooks{}), logger.Out
+	logger.AddHook(spanHook{})
+	logger.SetOutput(ioutil.Discard)
+	t.Cleanup(func() {
+		logger.ReplaceHooks(hooks)
+		logger.SetOutput(out)
+	})
+
+	tracer := mocktracer.New()
+	span := tracer.StartSpan("test")
+	ctx := opentracing.ContextWithSpan(context.Background(), span)
+	LoggerWithSpan(ctx).WithFields(log.Fields{
+		"error": errors.New("connection refused"),
+		"leg":   "hotel",
+	}).Error("Failed to compensate booking")
+	LoggerWithSpan(ctx).Warn("Failed to publish booked trip")
+	LoggerWithSpan(ctx).Info("Booked trip")
+	Logger(ctx).Error("Not mirrored")
+	span.Finish()
+
+	records := span.(*mocktracer.MockSpan).Logs()
+	if len(records) != 2 {
+		t.Fatalf("span got %d logs, want 2: %+v", len(records), records)
+	}
+	want := []map[string]string{
+		{"event": "error", "message": "Failed to compensate booking", "error": "connection refused", "leg": "hotel"},
+		{"event": "warning", "message": "Failed to publish booked trip"},
+	}
+	for i, record := range records {
+		fields := map[string]string{}
+		for _, field := range record.Fields {
+			fields[field.Key] = field.ValueString
+		}
+		for k, v := range want[i] {
+			if fields[k] != v {
+				t.Errorf("log %d: %s = %q, want %q", i, k, fields[k], v)
+			}
+		}
+	}
+}
+
+// TestLogSpanFields checks fields which SPAN_LOG_FIELDS doesn't list are left
+// off span logs, other than the standard ones, and every field is kept when
+// it isn't set.
+func TestLogSpanFields(t *testing.T) {
+	allowed := spanLogFields
+	t.Cleanup(func() { spanLogFields = allowed })
+
+	// logged returns the keys of each record logged on a span.
+	logged := func() [][]string {
+		tracer := mocktracer.New()
+		span := tracer.StartSpan("test")
+		LogSpanFields(span,
+			tracelog.String("event", "validated"),
+			tracelog.String("ref", "HT1"),
+			tracelog.String("name", "Ada Lovelace"),
+		)
+		LogSpanFields(span, tracelog.String("hotel", "Grand"))
+		span.Finish()
+		var records [][]string
+		for _, record := range span.(*mocktracer.MockSpan).Logs() {
+			var keys []string
+			for _, field := range record.Fields {
+				keys = append(keys, field.Key)
+			}
+			records = append(records, keys)
+		}
+		return records
+	}
+
+	for _, test := range []struct {
+		env  string
+		want [][]string
+	}{
+		{"", [][]string{{"event", "ref", "name"}, {"hotel"}}},
+		{"ref", [][]string{{"event", "ref"}}},
+		{" ref , hotel ", [][]string{{"event", "ref"}, {"hotel"}}},
+	} {
+		t.Setenv(spanLogFieldsEnv, test.env)
+		spanLogFields = spanLogFieldsFromEnv()
+		if got := logged(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SPAN_LOG_FIELDS=%q: logged %v, want %v", test.env, got, test.want)
+		}
+	}
+}
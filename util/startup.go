@@ -0,0 +1,67 @@
+package util
+
+import (
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var startupDuration = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "startup_duration_seconds",
+		Help: "Time taken by each step of starting the service, and in total.",
+	},
+	[]string{"step"},
+)
+
+func init() {
+	MustRegister(startupDuration)
+}
+
+var (
+	startupMu    sync.Mutex
+	startupSpan  opentracing.Span
+	startupStart time.Time
+)
+
+// beginStartup starts the root "startup" span which startup steps, such as
+// table creation, are traced under. It's called by Init.
+func beginStartup() {
+	startupMu.Lock()
+	defer startupMu.Unlock()
+	startupStart = time.Now()
+	startupSpan = opentracing.StartSpan("startup")
+}
+
+// startStartupStep starts a span for a step of startup and returns a func
+// which finishes it and records its duration.
+func startStartupStep(operation, step string) (opentracing.Span, func()) {
+	startupMu.Lock()
+	var opts []opentracing.StartSpanOption
+	if startupSpan != nil {
+		opts = append(opts, opentracing.ChildOf(startupSpan.Context()))
+	}
+	startupMu.Unlock()
+
+	start := time.Now()
+	span := opentracing.StartSpan(operation, opts...)
+	return span, func() {
+		span.Finish()
+		startupDuration.WithLabelValues(step).Set(time.Since(start).Seconds())
+	}
+}
+
+// FinishStartup finishes the startup span and records the total startup time.
+// Call it once the service is ready to serve.
+func FinishStartup() {
+	startupMu.Lock()
+	defer startupMu.Unlock()
+	if startupSpan == nil {
+		return
+	}
+	startupSpan.Finish()
+	startupSpan = nil
+	startupDuration.WithLabelValues("total").Set(time.Since(startupStart).Seconds())
+}
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const storageBackendEnv = "STORAGE_BACKEND"
+
+// Storage backends which can be selected with STORAGE_BACKEND.
+const (
+	StorageDynamoDB = "dynamodb"
+	StorageMemory   = "memory"
+)
+
+// StorageBackendFromEnv returns the storage backend named by the
+// STORAGE_BACKEND env, defaulting to DynamoDB if it isn't set.
+func StorageBackendFromEnv() (string, error) {
+	backend := os.Getenv(storageBackendEnv)
+	switch backend {
+	case "":
+		return StorageDynamoDB, nil
+	case StorageDynamoDB, StorageMemory:
+		return backend, nil
+	default:
+		return "", fmt.Errorf("invalid %s %q", storageBackendEnv, backend)
+	}
+}
+
+const softDeleteEnv = "SOFT_DELETE"
+
+// BookingCancelled is the status of a booking which was cancelled but kept
+// for auditing.
+const BookingCancelled = "cancelled"
+
+// SoftDeleteFromEnv returns whether cancelled bookings are kept, marked as
+// cancelled, rather than deleted, as set by the SOFT_DELETE env.
+func SoftDeleteFromEnv() (bool, error) {
+	return boolFromEnv(softDeleteEnv)
+}
+
+const (
+	holdTTLEnv     = "HOLD_TTL"
+	defaultHoldTTL = 10 * time.Minute
+)
+
+// BookingHeld is the status of a reservation: a booking which holds inventory
+// until it's confirmed or its hold expires. Confirmed bookings have no status.
+const BookingHeld = "held"
+
+// HoldTTLFromEnv returns how long a reservation holds inventory before it
+// expires, as set by the HOLD_TTL env, defaulting to 10m.
+func HoldTTLFromEnv() (time.Duration, error) {
+	return DurationFromEnv(holdTTLEnv, defaultHoldTTL)
+}
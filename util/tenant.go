@@ -0,0 +1,139 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	tenantsEnv      = "TENANTS"
+	tenantStrictEnv = "TENANT_STRICT"
+)
+
+// maxTenantIDLength bounds the propagated tenant ID, which becomes part of a
+// table name.
+const maxTenantIDLength = 32
+
+// ErrMissingTenant is returned when a request has no tenant ID and
+// TENANT_STRICT requires one.
+var ErrMissingTenant = errors.New("missing tenant ID")
+
+// ErrUnknownTenant is returned when a request's tenant ID isn't one of the
+// tenants listed in TENANTS.
+var ErrUnknownTenant = errors.New("unknown tenant ID")
+
+// TenantFromContext returns the tenant ID sent with the request in the
+// X-Tenant-ID header, or "" if there isn't one.
+func TenantFromContext(ctx context.Context) string {
+	if values, ok := ctx.Value(ctxValuesKey).(*ctxValues); ok {
+		return values.TenantID
+	}
+	return ""
+}
+
+// validTenantID indicates if the propagated tenant ID is safe to log and use
+// in a table name.
+func validTenantID(id string) bool {
+	if id == "" || len(id) > maxTenantIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// TenantTables routes requests to per-tenant tables. A request with tenant ID
+// "acme" uses "<table>_acme". Only the tenants listed in TENANTS, separated by
+// commas, are served, and their tables are created by Provision at startup,
+// so the tenant ID header, which isn't authenticated, can't create tables or
+// grow the table labels of metrics. Requests for any other tenant are
+// rejected with ErrUnknownTenant. Requests without a tenant ID use the shared
+// table, unless TENANT_STRICT is set, in which case they're rejected with
+// ErrMissingTenant.
+type TenantTables struct {
+	db      *dynamodb.DynamoDB
+	strict  bool
+	tenants []string
+	known   map[string]bool
+}
+
+// NewTenantTables returns the tenant table router configured by TENANTS and
+// TENANT_STRICT.
+func NewTenantTables(db *dynamodb.DynamoDB) (*TenantTables, error) {
+	var strict bool
+	if value := os.Getenv(tenantStrictEnv); value != "" {
+		var err error
+		if strict, err = strconv.ParseBool(value); err != nil {
+			return nil, fmt.Errorf("invalid %s %q", tenantStrictEnv, value)
+		}
+	}
+	t := &TenantTables{db: db, strict: strict, known: make(map[string]bool)}
+	if value := os.Getenv(tenantsEnv); value != "" {
+		for _, tenant := range strings.Split(value, ",") {
+			tenant = strings.TrimSpace(tenant)
+			if !validTenantID(tenant) {
+				return nil, fmt.Errorf("invalid tenant %q in %s", tenant, tenantsEnv)
+			}
+			if !t.known[tenant] {
+				t.tenants = append(t.tenants, tenant)
+				t.known[tenant] = true
+			}
+		}
+	}
+	return t, nil
+}
+
+// Provision creates the given table with the given options for every
+// tenant, unless it already exists. Call it at startup for each table the
+// service passes to Table.
+func (t *TenantTables) Provision(table string, opts ...TableOption) error {
+	for _, tenant := range t.tenants {
+		if err := CreateTable(t.db, tenantTable(table, tenant), opts...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tables returns the names of the given table used by requests: every
+// tenant's, and the shared table unless TENANT_STRICT is set.
+func (t *TenantTables) Tables(table string) []string {
+	var tables []string
+	if !t.strict {
+		tables = append(tables, table)
+	}
+	for _, tenant := range t.tenants {
+		tables = append(tables, tenantTable(table, tenant))
+	}
+	return tables
+}
+
+// Table returns the name of the given table to use for the request's tenant.
+// The table must have been provisioned with Provision.
+func (t *TenantTables) Table(ctx context.Context, table string) (string, error) {
+	tenant := TenantFromContext(ctx)
+	if tenant == "" {
+		if t.strict {
+			return "", ErrMissingTenant
+		}
+		return table, nil
+	}
+	if !t.known[tenant] {
+		return "", ErrUnknownTenant
+	}
+	return tenantTable(table, tenant), nil
+}
+
+func tenantTable(table, tenant string) string {
+	return table + "_" + tenant
+}
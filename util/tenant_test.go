@@ -0,0 +1,67 @@
+package util
+
+import (
+	"context"
+	"testing"
+
+	"github.com/realkinetic/cloud-native-meetup-2019/util/servicetest"
+)
+
+func tenantContext(tenant string) context.Context {
+	return context.WithValue(context.Background(), ctxValuesKey, &ctxValues{TenantID: tenant})
+}
+
+func TestTenantTables(t *testing.T) {
+	db := servicetest.NewDynamoDB(t)
+	t.Setenv(tenantsEnv, "acme, globex")
+	tenants, err := NewTenantTables(NewDynamoDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tenants.Provision("trips"); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.Tables(); len(got) != 2 || got[0] != "trips_acme" || got[1] != "trips_globex" {
+		t.Fatalf("provisioned tables = %q, want trips_acme and trips_globex", got)
+	}
+	created := db.Calls("CreateTable")
+
+	for _, test := range []struct {
+		tenant string
+		want   string
+		err    error
+	}{
+		{"", "trips", nil},
+		{"acme", "trips_acme", nil},
+		{"globex", "trips_globex", nil},
+		{"initech", "", ErrUnknownTenant},
+	} {
+		got, err := tenants.Table(tenantContext(test.tenant), "trips")
+		if got != test.want || err != test.err {
+			t.Errorf("Table for tenant %q = %q, %v, want %q, %v", test.tenant, got, err, test.want, test.err)
+		}
+	}
+	if db.Calls("CreateTable") != created {
+		t.Error("tables were created while routing requests")
+	}
+}
+
+func TestTenantTablesStrict(t *testing.T) {
+	t.Setenv(tenantStrictEnv, "true")
+	tenants, err := NewTenantTables(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tenants.Table(context.Background(), "trips"); err != ErrMissingTenant {
+		t.Errorf("Table without a tenant got %v, want %v", err, ErrMissingTenant)
+	}
+}
+
+func TestTenantTablesInvalidTenants(t *testing.T) {
+	for _, value := range []string{"Acme", "acme,", "acme_corp"} {
+		t.Setenv(tenantsEnv, value)
+		if _, err := NewTenantTables(nil); err == nil {
+			t.Errorf("%s=%q got no error", tenantsEnv, value)
+		}
+	}
+}
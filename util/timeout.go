@@ -0,0 +1,127 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const handlerTimeoutEnv = "HANDLER_TIMEOUT"
+
+// handlerTimeoutFromEnv returns the HANDLER_TIMEOUT, e.g. "5s", or zero if it
+// isn't set. An invalid timeout is ignored with a warning rather than failing
+// startup, like SLOW_REQUEST_MS.
+func handlerTimeoutFromEnv() time.Duration {
+	timeout, err := DurationFromEnv(handlerTimeoutEnv, 0)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Ignoring handler timeout")
+		return 0
+	}
+	return timeout
+}
+
+// handlerTimeoutMiddleware returns an http.Handler which gives the handler at
+// most timeout to respond, regardless of whether the client is still waiting,
+// and responds with a 503 if it doesn't. The handler's context is cancelled at
+// the timeout, so its DynamoDB and downstream calls are abandoned too.
+//
+// The handler runs in its own goroutine and its response is buffered until it
+// returns, so it never writes to the connection after the 503. Panics are
+// re-raised in the serving goroutine, so it must run outside the recover
+// middleware. A zero timeout disables it.
+func handlerTimeoutMiddleware(handler http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{header: make(http.Header), status: http.StatusOK}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+					return
+				}
+				close(done)
+			}()
+			handler.ServeHTTP(tw, r)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			for key, values := range tw.header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(tw.status)
+			w.Write(tw.body.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			if ctx.Err() != context.DeadlineExceeded {
+				// The client went away, so there's no one to respond to.
+				return
+			}
+			if span := opentracing.SpanFromContext(ctx); span != nil {
+				span.SetTag("handler_timeout", true)
+			}
+			Logger(ctx).WithFields(log.Fields{
+				"method":     r.Method,
+				"path":       r.URL.Path,
+				"timeout_ms": int64(timeout / time.Millisecond),
+			}).Warn("Handler timed out")
+			WriteJSONError(w, http.StatusServiceUnavailable, "Request timed out", nil)
+		}
+	})
+}
+
+// timeoutWriter buffers the handler's response until it returns. Once the
+// request has timed out, writes fail with http.ErrHandlerTimeout.
+type timeoutWriter struct {
+	mu          sync.Mutex
+	header      http.Header
+	body        bytes.Buffer
+	status      int
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (t *timeoutWriter) Header() http.Header {
+	return t.header
+}
+
+func (t *timeoutWriter) WriteHeader(status int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timedOut || t.wroteHeader {
+		return
+	}
+	t.status = status
+	t.wroteHeader = true
+}
+
+func (t *timeoutWriter) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	t.wroteHeader = true
+	return t.body.Write(b)
+}
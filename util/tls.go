@@ -0,0 +1,78 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	downstreamCABundleEnv   = "DOWNSTREAM_CA_BUNDLE"
+	downstreamClientCertEnv = "DOWNSTREAM_CLIENT_CERT"
+	downstreamClientKeyEnv  = "DOWNSTREAM_CLIENT_KEY"
+)
+
+// downstreamTLSConfig returns the TLS config for calls to other services. The
+// CA bundle in DOWNSTREAM_CA_BUNDLE is trusted in addition to the system
+// roots, and the certificate and key in DOWNSTREAM_CLIENT_CERT and
+// DOWNSTREAM_CLIENT_KEY are presented for mutual TLS. It returns nil if none
+// of them are set.
+func downstreamTLSConfig() (*tls.Config, error) {
+	caBundle := os.Getenv(downstreamCABundleEnv)
+	clientCert := os.Getenv(downstreamClientCertEnv)
+	clientKey := os.Getenv(downstreamClientKeyEnv)
+	if caBundle == "" && clientCert == "" && clientKey == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if caBundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", downstreamCABundleEnv, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", downstreamCABundleEnv)
+		}
+		config.RootCAs = pool
+	}
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			return nil, errors.New(downstreamClientCertEnv + " and " + downstreamClientKeyEnv + " must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// newTransport returns a transport with the same settings as
+// http.DefaultTransport but using the given TLS config.
+func newTransport(config *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       config,
+	}
+}
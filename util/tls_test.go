@@ -0,0 +1,110 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// writePEM writes the PEM block to a file in the test's temp dir and returns
+// its path.
+func writePEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// getDownstream requests the server's root with a client built by
+// NewInstrumentedHTTPClient.
+func getDownstream(t *testing.T, url string) error {
+	t.Helper()
+	client, err := NewInstrumentedHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestDownstreamTLSConfig(t *testing.T) {
+	if config, err := downstreamTLSConfig(); config != nil || err != nil {
+		t.Errorf("unset: config = %v, %v, want none", config, err)
+	}
+
+	// The server requires a client certificate, and presents its own as
+	// the client's as well, so one self-signed certificate covers both.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	serverCert := server.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(serverCert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caBundle := writePEM(t, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	clientCert := writePEM(t, "client.pem", "CERTIFICATE", serverCert.Certificate[0])
+	clientKey := writePEM(t, "client-key.pem", "PRIVATE KEY", key)
+
+	t.Setenv(downstreamCABundleEnv, caBundle)
+	config, err := downstreamTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.RootCAs == nil || len(config.Certificates) != 0 {
+		t.Errorf("CA bundle only: config has roots %v and %d certificates, want the bundle and none", config.RootCAs, len(config.Certificates))
+	}
+	if err := getDownstream(t, server.URL); err == nil {
+		t.Error("connected without a client certificate")
+	}
+
+	t.Setenv(downstreamClientCertEnv, clientCert)
+	t.Setenv(downstreamClientKeyEnv, clientKey)
+	if err := getDownstream(t, server.URL); err != nil {
+		t.Errorf("mutual TLS: %v", err)
+	}
+
+	t.Setenv(downstreamCABundleEnv, "")
+	if err := getDownstream(t, server.URL); err == nil {
+		t.Error("trusted the server without its CA")
+	}
+}
+
+func TestDownstreamTLSConfigErrors(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name                            string
+		caBundle, clientCert, clientKey string
+	}{
+		{"missing CA bundle", filepath.Join(t.TempDir(), "missing.pem"), "", ""},
+		{"CA bundle without certificates", notPEM, "", ""},
+		{"certificate without key", "", notPEM, ""},
+		{"key without certificate", "", "", notPEM},
+		{"invalid client certificate", "", notPEM, notPEM},
+	} {
+		t.Setenv(downstreamCABundleEnv, test.caBundle)
+		t.Setenv(downstreamClientCertEnv, test.clientCert)
+		t.Setenv(downstreamClientKeyEnv, test.clientKey)
+		if _, err := downstreamTLSConfig(); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+		if _, err := NewInstrumentedHTTPClient(); err == nil {
+			t.Errorf("%s: NewInstrumentedHTTPClient succeeded", test.name)
+		}
+	}
+}
@@ -1,23 +1,135 @@
 package util
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
 
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/sirupsen/logrus"
 	jaeger "github.com/uber/jaeger-client-go"
 	"github.com/uber/jaeger-client-go/thrift"
+	"github.com/uber/jaeger-client-go/thrift-gen/zipkincore"
 )
 
-// initTracer returns an instance of Tracer that samples 100% of traces and
-// logs all spans to stdout.
-func initTracer(service string, l *logrus.Logger) opentracing.Tracer {
-	tracer, _ := jaeger.NewTracer(
+// TracingConfig describes the tracing set up by Init.
+type TracingConfig struct {
+	Enabled    bool    `json:"enabled"`
+	Service    string  `json:"service"`
+	Sampler    string  `json:"sampler,omitempty"`
+	SampleRate float64 `json:"sample_rate"`
+	Reporter   string  `json:"reporter,omitempty"`
+	// Propagation is the format trace context is propagated in over HTTP.
+	Propagation string `json:"propagation,omitempty"`
+	// Error is why the tracer couldn't be initialized, if it failed.
+	Error string `json:"error,omitempty"`
+}
+
+// tracingConfig is set by Init and reported by the debug endpoint.
+var tracingConfig TracingConfig
+
+const (
+	traceBatchSizeEnv     = "TRACE_BATCH_SIZE"
+	traceBatchIntervalEnv = "TRACE_BATCH_INTERVAL"
+	traceBufferSizeEnv    = "TRACE_BUFFER_SIZE"
+
+	defaultTraceBatchInterval = time.Second
+	defaultTraceBufferSize    = 1000
+)
+
+// tracerFactory constructs the tracer installed by Init, and describes it. It's
+// a variable so the fallback path for a failed initialization can be
+// exercised.
+var tracerFactory = initTracer
+
+// tracerCloser flushes and closes the tracer installed by Init. It's called
+// by Close.
+var tracerCloser io.Closer
+
+// Close flushes any spans which haven't been reported yet. Call it before the
+// service exits.
+func Close() error {
+	if tracerCloser == nil {
+		return nil
+	}
+	return tracerCloser.Close()
+}
+
+// TracingEnabled indicates if a tracer is installed. Without one spans are
+// noops, so callers can skip building fields to log on them.
+func TracingEnabled() bool {
+	_, noop := opentracing.GlobalTracer().(opentracing.NoopTracer)
+	return !noop
+}
+
+// initTracer returns an instance of Tracer that samples 100% of traces, or
+// as configured by TRACE_SAMPLE_RATE (see newSamplerFromEnv), and logs all
+// sampled spans to stdout. By default each span is logged as it finishes. If
+// TRACE_BATCH_SIZE is set, spans are instead buffered and logged in batches of
+// up to that many spans, at least every TRACE_BATCH_INTERVAL (default 1s).
+// Trace context is propagated over HTTP in the PROPAGATION_FORMAT format:
+// jaeger (the default), b3, or w3c. The returned config describes the tracer
+// for the debug endpoint.
+func initTracer(service string, l *logrus.Logger) (opentracing.Tracer, TracingConfig, error) {
+	if service == "" {
+		return nil, TracingConfig{}, errors.New("tracer requires a service name")
+	}
+	reporter, reporterType, err := newReporterFromEnv(l)
+	if err != nil {
+		return nil, TracingConfig{}, err
+	}
+	sampler, samplerType, sampleRate, err := newSamplerFromEnv()
+	if err != nil {
+		return nil, TracingConfig{}, err
+	}
+	opts, propagation, err := propagationOptionsFromEnv()
+	if err != nil {
+		return nil, TracingConfig{}, err
+	}
+	tracer, closer := jaeger.NewTracer(
 		service,
-		jaeger.NewConstSampler(true),
-		newLogReporter(l),
+		sampler,
+		reporter,
+		opts...,
 	)
-	return tracer
+	tracerCloser = closer
+	return tracer, TracingConfig{
+		Enabled:     true,
+		Service:     service,
+		Sampler:     samplerType,
+		SampleRate:  sampleRate,
+		Reporter:    reporterType,
+		Propagation: propagation,
+	}, nil
+}
+
+// newReporterFromEnv returns the reporter configured by the envs, and its
+// type, "log" or "batch", as reported by the debug endpoint.
+func newReporterFromEnv(l *logrus.Logger) (jaeger.Reporter, string, error) {
+	if os.Getenv(traceBatchSizeEnv) == "" {
+		return newLogReporter(l), "log", nil
+	}
+	size, err := IntFromEnv(traceBatchSizeEnv, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	interval, err := DurationFromEnv(traceBatchIntervalEnv, defaultTraceBatchInterval)
+	if err != nil {
+		return nil, "", err
+	}
+	if interval == 0 {
+		return nil, "", fmt.Errorf("invalid %s %q", traceBatchIntervalEnv, os.Getenv(traceBatchIntervalEnv))
+	}
+	buffer, err := IntFromEnv(traceBufferSizeEnv, defaultTraceBufferSize)
+	if err != nil {
+		return nil, "", err
+	}
+	return newBatchReporter(l, size, interval, buffer), "batch", nil
 }
 
 type logReporter struct {
@@ -30,22 +142,112 @@ func newLogReporter(log *logrus.Logger) jaeger.Reporter {
 }
 
 func (l *logReporter) Report(span *jaeger.Span) {
-	s := jaeger.BuildZipkinThrift(span)
+	logSpans(l.log, []*zipkincore.Span{jaeger.BuildZipkinThrift(span)})
+}
+
+func (l *logReporter) Close() {}
+
+// logSpans logs the spans as a base64-encoded thrift list.
+func logSpans(l *logrus.Logger, spans []*zipkincore.Span) {
 	t := thrift.NewTMemoryBuffer()
 	p := thrift.NewTBinaryProtocolTransport(t)
-	if err := p.WriteListBegin(thrift.STRUCT, 1); err != nil {
+	if err := p.WriteListBegin(thrift.STRUCT, len(spans)); err != nil {
 		panic(err)
 	}
-	if err := s.Write(p); err != nil {
-		panic(err)
+	for _, s := range spans {
+		if err := s.Write(p); err != nil {
+			panic(err)
+		}
 	}
 	if err := p.WriteListEnd(); err != nil {
 		panic(err)
 	}
 	encoded := base64.StdEncoding.EncodeToString(t.Buffer.Bytes())
-	l.log.WithFields(logrus.Fields{
+	l.WithFields(logrus.Fields{
 		"trace": encoded,
 	}).Info("trace")
 }
 
-func (l *logReporter) Close() {}
+// batchReporter logs spans in batches from a background goroutine, so
+// reporting is off the request path and each log line holds many spans. If
+// the buffer is full, spans are dropped and counted rather than blocking.
+type batchReporter struct {
+	log       *logrus.Logger
+	spans     chan *zipkincore.Span
+	size      int
+	interval  time.Duration
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newBatchReporter(log *logrus.Logger, size int, interval time.Duration, buffer int) *batchReporter {
+	b := &batchReporter{
+		log:      log,
+		spans:    make(chan *zipkincore.Span, buffer),
+		size:     size,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Report converts the span immediately, since the tracer may reuse it once
+// Report returns, and queues it to be logged.
+func (b *batchReporter) Report(span *jaeger.Span) {
+	select {
+	case b.spans <- jaeger.BuildZipkinThrift(span):
+	default:
+		spansDropped.Inc()
+	}
+}
+
+// Close logs the spans which are still buffered.
+func (b *batchReporter) Close() {
+	b.closeOnce.Do(func() {
+		close(b.spans)
+		<-b.done
+	})
+}
+
+func (b *batchReporter) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	batch := make([]*zipkincore.Span, 0, b.size)
+	flush := func() {
+		if len(batch) > 0 {
+			logSpans(b.log, batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case span, ok := <-b.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= b.size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// TraceRegion starts a span for a region of work, such as serialization, as a
+// child of the span in the context and returns a func which finishes it. If
+// there's no span in the context, nothing is traced and the returned func does
+// nothing.
+func TraceRegion(ctx context.Context, name string) func() {
+	parent := opentracing.SpanFromContext(ctx)
+	if parent == nil {
+		return func() {}
+	}
+	span := parent.Tracer().StartSpan(name, opentracing.ChildOf(parent.Context()))
+	return span.Finish
+}
@@ -0,0 +1,316 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opentracing-contrib/go-stdlib/nethttp"
+	"github.com/opentracing/opentracing-go"
+	"github.com/sirupsen/logrus"
+	jaeger "github.com/uber/jaeger-client-go"
+)
+
+// initTestTracing initializes the package for the given service with a Jaeger
+// tracer which keeps finished spans in memory, and returns its reporter.
+func initTestTracing(t *testing.T, service string) *jaeger.InMemoryReporter {
+	t.Helper()
+	reporter := jaeger.NewInMemoryReporter()
+	factory := tracerFactory
+	tracerFactory = func(service string, l *logrus.Logger) (opentracing.Tracer, TracingConfig, error) {
+		tracer, closer := jaeger.NewTracer(service, jaeger.NewConstSampler(true), reporter)
+		tracerCloser = closer
+		return tracer, TracingConfig{Enabled: true, Service: service}, nil
+	}
+	t.Cleanup(func() {
+		tracerFactory = factory
+		Close()
+		opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	})
+	if err := Init(service, false); err != nil {
+		t.Fatal(err)
+	}
+	logrus.SetOutput(ioutil.Discard)
+	return reporter
+}
+
+// TestTracePropagatesAcrossHop sends a request through an edge service which
+// calls a downstream service with the instrumented client, and checks the
+// downstream joins the edge's trace and receives its context headers.
+func TestTracePropagatesAcrossHop(t *testing.T) {
+	reporter := initTestTracing(t, "edge-service")
+
+	var (
+		downstreamHeaders http.Header
+		downstreamTraceID jaeger.TraceID
+	)
+	downstream := httptest.NewServer(NewContextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downstreamHeaders = r.Header
+		if span := opentracing.SpanFromContext(r.Context()); span != nil {
+			downstreamTraceID = span.Context().(jaeger.SpanContext).TraceID()
+		}
+	})))
+	defer downstream.Close()
+
+	client, err := NewInstrumentedHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		edgeRequestID string
+		edgeTraceID   jaeger.TraceID
+	)
+	edge := httptest.NewServer(NewContextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		edgeRequestID = ctx.Value(ctxValuesKey).(*ctxValues).RequestID
+		edgeTraceID = opentracing.SpanFromContext(ctx).Context().(jaeger.SpanContext).TraceID()
+		req, err := http.NewRequest("GET", downstream.URL+"/downstream", nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+	})))
+	defer edge.Close()
+
+	req, err := http.NewRequest("GET", edge.URL+"/edge", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(languageHeader, "fr-FR")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if downstreamHeaders == nil {
+		t.Fatal("downstream wasn't called")
+	}
+	if got := downstreamHeaders.Get(requestIDHeader); got != edgeRequestID {
+		t.Errorf("downstream %s = %q, want %q", requestIDHeader, got, edgeRequestID)
+	}
+	if got := downstreamHeaders[http.CanonicalHeaderKey(requestIDHeader)]; len(got) != 1 {
+		t.Errorf("downstream got %d %s headers, want 1", len(got), requestIDHeader)
+	}
+	if got := downstreamHeaders.Get(originHeader); got != "edge-service" {
+		t.Errorf("downstream %s = %q, want %q", originHeader, got, "edge-service")
+	}
+	if got := downstreamHeaders.Get(languageHeader); got != "fr-FR" {
+		t.Errorf("downstream %s = %q, want %q", languageHeader, got, "fr-FR")
+	}
+	if downstreamHeaders.Get(deadlineHeader) != "" {
+		t.Errorf("downstream got %s without a deadline", deadlineHeader)
+	}
+	if !edgeTraceID.IsValid() || downstreamTraceID != edgeTraceID {
+		t.Errorf("downstream trace ID = %v, want edge's %v", downstreamTraceID, edgeTraceID)
+	}
+
+	// The edge server span, the client span, and the downstream server span
+	// form one trace.
+	spans := reporter.GetSpans()
+	if len(spans) < 3 {
+		t.Fatalf("got %d spans, want at least 3", len(spans))
+	}
+	for _, span := range spans {
+		sc := span.(*jaeger.Span).Context().(jaeger.SpanContext)
+		if sc.TraceID() != edgeTraceID {
+			t.Errorf("span %q has trace ID %v, want %v",
+				span.(*jaeger.Span).OperationName(), sc.TraceID(), edgeTraceID)
+		}
+	}
+}
+
+// TestInstrumentedClientResendsRequest sends one request twice with the
+// instrumented client, as a retry does, and checks each send carries the
+// context headers once without the caller's request being modified.
+func TestInstrumentedClientResendsRequest(t *testing.T) {
+	initTestTracing(t, "edge-service")
+
+	var received []http.Header
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header)
+	}))
+	defer downstream.Close()
+
+	client, err := NewInstrumentedHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	edge := httptest.NewServer(NewContextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequest("GET", downstream.URL+"/downstream", nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req = req.WithContext(r.Context())
+		for i := 0; i < 2; i++ {
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}
+		if len(req.Header) != 0 {
+			t.Errorf("caller's request headers = %v, want none", req.Header)
+		}
+	})))
+	defer edge.Close()
+
+	resp, err := http.Get(edge.URL + "/edge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if len(received) != 2 {
+		t.Fatalf("downstream got %d requests, want 2", len(received))
+	}
+	for i, h := range received {
+		if got := h[http.CanonicalHeaderKey(requestIDHeader)]; len(got) != 1 {
+			t.Errorf("request %d got %d %s headers, want 1", i, len(got), requestIDHeader)
+		}
+		if got := h[http.CanonicalHeaderKey(originHeader)]; len(got) != 1 {
+			t.Errorf("request %d got %d %s headers, want 1", i, len(got), originHeader)
+		}
+	}
+}
+
+// TestDebugTracingReportsReporter checks the debug endpoint reports the
+// reporter the tracer was built with.
+func TestDebugTracingReportsReporter(t *testing.T) {
+	for _, test := range []struct {
+		batchSize string
+		want      string
+	}{
+		{"", "log"},
+		{"10", "batch"},
+	} {
+		t.Setenv(traceBatchSizeEnv, test.batchSize)
+		if err := Init("test-service", false); err != nil {
+			t.Fatal(err)
+		}
+		logrus.SetOutput(ioutil.Discard)
+
+		w := httptest.NewRecorder()
+		tracingHandler(w, httptest.NewRequest("GET", "/debug/tracing", nil))
+		var config TracingConfig
+		if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+			t.Fatal(err)
+		}
+		if config.Reporter != test.want {
+			t.Errorf("%s=%q: reporter = %q, want %q", traceBatchSizeEnv, test.batchSize, config.Reporter, test.want)
+		}
+		Close()
+		opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	}
+}
+
+// TestInitFallsBackToNoopTracer checks a tracer which fails to initialize is
+// replaced by the noop tracer, and the failure is reported by the debug
+// endpoint.
+func TestInitFallsBackToNoopTracer(t *testing.T) {
+	factory := tracerFactory
+	defer func() { tracerFactory = factory }()
+	tracerFactory = func(string, *logrus.Logger) (opentracing.Tracer, TracingConfig, error) {
+		return nil, TracingConfig{}, io.ErrUnexpectedEOF
+	}
+
+	if err := Init("test-service", false); err != nil {
+		t.Fatal(err)
+	}
+	logrus.SetOutput(ioutil.Discard)
+	if TracingEnabled() {
+		t.Error("tracing enabled after the tracer failed to initialize")
+	}
+	want := TracingConfig{Service: "test-service", Error: io.ErrUnexpectedEOF.Error()}
+	if tracingConfig != want {
+		t.Errorf("tracing config = %+v, want %+v", tracingConfig, want)
+	}
+}
+
+// TestInitDescribesTracer checks the debug endpoint reports the tracer Init
+// built, and initializing again doesn't carry over the previous settings.
+func TestInitDescribesTracer(t *testing.T) {
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	t.Setenv(traceSampleRateEnv, "0.25")
+	t.Setenv(propagationFormatEnv, "w3c")
+	if err := Init("test-service", false); err != nil {
+		t.Fatal(err)
+	}
+	logrus.SetOutput(ioutil.Discard)
+	Close()
+	if tracingConfig.Service != "test-service" || !tracingConfig.Enabled || tracingConfig.SampleRate != 0.25 || tracingConfig.Propagation != "w3c" {
+		t.Errorf("tracing config = %+v, want test-service sampling 0.25 with w3c propagation", tracingConfig)
+	}
+
+	t.Setenv(traceSampleRateEnv, "")
+	t.Setenv(propagationFormatEnv, "")
+	if err := Init("other-service", false); err != nil {
+		t.Fatal(err)
+	}
+	logrus.SetOutput(ioutil.Discard)
+	Close()
+	if tracingConfig.Service != "other-service" || tracingConfig.SampleRate != 1 || tracingConfig.Propagation == "w3c" {
+		t.Errorf("reinitialized tracing config = %+v, want other-service's defaults", tracingConfig)
+	}
+}
+
+// roundTripperFunc is a RoundTripper which calls the func.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// BenchmarkRoundTripTracingDisabled compares the instrumented client's round
+// trip with the noop tracer installed against tracing the request with it,
+// as the client did before it checked TracingEnabled.
+func BenchmarkRoundTripTracingDisabled(b *testing.B) {
+	opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+	ok := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+	})
+	transport := &nethttp.Transport{RoundTripper: ok}
+	ctx := context.WithValue(context.Background(), ctxValuesKey, &ctxValues{RequestID: "bench"})
+	req := httptest.NewRequest("GET", "http://downstream/flights/booking", nil).WithContext(ctx)
+
+	b.Run("skipped", func(b *testing.B) {
+		rt := &instrumentedRoundTripper{transport}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := rt.RoundTrip(req); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("traced", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r := req.Clone(req.Context())
+			addContextHeaders(r)
+			addRetryBudgetHeader(r)
+			addAPIKeyHeader(r)
+			r, tracer := nethttp.TraceRequest(
+				opentracing.GlobalTracer(),
+				r,
+				nethttp.OperationName(r.Method+" "+r.URL.Path),
+				nethttp.ClientSpanObserver(logContextHeaders),
+			)
+			if _, err := transport.RoundTrip(r); err != nil {
+				b.Fatal(err)
+			}
+			tracer.Finish()
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const trustedNetworksEnv = "TRUSTED_NETWORKS"
+
+// defaultTrustedNetworks only trusts callers on the same host.
+var defaultTrustedNetworks = []string{"127.0.0.0/8", "::1/128"}
+
+// trustedNetworks are the networks of the callers, usually our other services,
+// which may mark a request for debugging or forced tracing. Those are costly,
+// so requests from anywhere else can't. It's set from TRUSTED_NETWORKS, a
+// comma-separated list of CIDRs, at startup.
+var trustedNetworks = trustedNetworksFromEnv()
+
+// trustedNetworksFromEnv parses TRUSTED_NETWORKS. If it isn't set or is
+// invalid, defaultTrustedNetworks are used.
+func trustedNetworksFromEnv() []*net.IPNet {
+	value := os.Getenv(trustedNetworksEnv)
+	cidrs := defaultTrustedNetworks
+	if value != "" {
+		cidrs = strings.Split(value, ",")
+	}
+	networks, err := parseNetworks(cidrs)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"env":   trustedNetworksEnv,
+			"value": value,
+			"error": err,
+		}).Warn("Invalid trusted networks, using defaults")
+		networks, _ = parseNetworks(defaultTrustedNetworks)
+	}
+	return networks
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// trustedCaller indicates if the request came from one of the trusted
+// networks.
+func trustedCaller(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// debugRequested indicates if the request asks for debugging or forced
+// tracing by header, which only trusted callers may.
+func debugRequested(r *http.Request) bool {
+	return r.Header.Get(debugHeader) != "" || r.Header.Get(forceTraceHeader) != ""
+}
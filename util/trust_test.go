@@ -0,0 +1,86 @@
+package util
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestTrustedNetworksFromEnv(t *testing.T) {
+	networks := trustedNetworks
+	t.Cleanup(func() { trustedNetworks = networks })
+	log.SetOutput(ioutil.Discard)
+
+	for _, test := range []struct {
+		name    string
+		value   string
+		trusted map[string]bool
+	}{
+		{"unset", "", map[string]bool{
+			"127.0.0.1:1234": true,
+			"[::1]:1234":     true,
+			"10.0.0.5:1234":  false,
+			"192.0.2.1:1234": false,
+		}},
+		{"set", "10.0.0.0/8, 192.168.0.0/16", map[string]bool{
+			"10.0.0.5:1234":    true,
+			"192.168.1.1:1234": true,
+			"127.0.0.1:1234":   false,
+			"192.0.2.1:1234":   false,
+		}},
+		{"invalid", "10.0.0.0/8,internal", map[string]bool{
+			"127.0.0.1:1234": true,
+			"10.0.0.5:1234":  false,
+		}},
+	} {
+		t.Setenv(trustedNetworksEnv, test.value)
+		trustedNetworks = trustedNetworksFromEnv()
+		for addr, want := range test.trusted {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = addr
+			if got := trustedCaller(r); got != want {
+				t.Errorf("%s: caller %s trusted = %v, want %v", test.name, addr, got, want)
+			}
+		}
+	}
+}
+
+// TestDebugRequiresTrustedCaller checks only trusted callers can mark a
+// request for debugging or forced tracing by header, while the force trace
+// cookie is honored from any caller.
+func TestDebugRequiresTrustedCaller(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	for _, test := range []struct {
+		name              string
+		header, cookie    string
+		debug, forceTrace bool
+		anyCaller         bool
+	}{
+		{"debug", debugHeader, "", true, true, false},
+		{"force trace", forceTraceHeader, "", false, true, false},
+		{"force trace cookie", "", forceTraceCookie, false, true, true},
+	} {
+		for _, addr := range []string{"127.0.0.1:1234", "192.0.2.1:1234"} {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = addr
+			if test.header != "" {
+				r.Header.Set(test.header, "1")
+			}
+			if test.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: test.cookie, Value: "1"})
+			}
+			ctx, cancel := contextWithRequest(r)
+			values := ctx.Value(ctxValuesKey).(*ctxValues)
+			cancel()
+
+			honored := test.anyCaller || addr == "127.0.0.1:1234"
+			if values.Debug != (test.debug && honored) || values.ForceTrace != (test.forceTrace && honored) {
+				t.Errorf("%s from %s: debug = %v, force trace = %v, want %v, %v",
+					test.name, addr, values.Debug, values.ForceTrace, test.debug && honored, test.forceTrace && honored)
+			}
+		}
+	}
+}
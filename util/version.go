@@ -0,0 +1,84 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Version is the version of the service, set at build time with
+//
+//	-ldflags "-X github.com/realkinetic/cloud-native-meetup-2019/util.Version=1.2.3"
+//
+// Development builds are "dev".
+var Version = "dev"
+
+// DevVersion is the Version of builds which weren't given one.
+const DevVersion = "dev"
+
+// VersionInfo is the response of the /version endpoint.
+type VersionInfo struct {
+	Service string `json:"service"`
+	Version string `json:"version"`
+}
+
+// RegisterVersionEndpoint registers /version on the mux, reporting the
+// service's Version so callers can check compatibility.
+func RegisterVersionEndpoint(mux *http.ServeMux) {
+	mux.HandleFunc("/version", versionHandler)
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		LegacyError(w, r.Context(), http.StatusBadRequest, errInvalidMethod)
+		return
+	}
+	resp, err := json.Marshal(&VersionInfo{Service: localService, Version: Version})
+	if err != nil {
+		LegacyError(w, r.Context(), http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// SemVer is a parsed MAJOR.MINOR.PATCH version. Pre-release and build
+// suffixes are ignored.
+type SemVer [3]int
+
+// ParseSemVer parses a version such as "1.2.3" or "v1.2.3-rc1".
+func ParseSemVer(version string) (SemVer, error) {
+	var v SemVer
+	s := strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != len(v) {
+		return v, fmt.Errorf("invalid version %q", version)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q", version)
+		}
+		v[i] = n
+	}
+	return v, nil
+}
+
+// Less indicates if v is an earlier version than other.
+func (v SemVer) Less(other SemVer) bool {
+	for i := range v {
+		if v[i] != other[i] {
+			return v[i] < other[i]
+		}
+	}
+	return false
+}
+
+func (v SemVer) String() string {
+	return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+}